@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/natesales/cdn-tree/internal/analytics"
+	"github.com/natesales/cdn-tree/internal/control"
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// maxAnalyticsCounts is the largest number of counts a node may report at once
+const maxAnalyticsCounts = 5000
+
+// analyticsReport stores the query counts reported by an edge node
+type analyticsReport struct {
+	Counts []analytics.Count `json:"counts"`
+}
+
+// analyticsQuery stores the parsed time series parameters of an analytics request
+type analyticsQuery struct {
+	Since      int64 // unix seconds
+	Until      int64 // unix seconds
+	Resolution int64 // seconds
+	By         string
+}
+
+// parseAnalyticsQuery parses the since, until, resolution and by query parameters
+func parseAnalyticsQuery(ctx *fiber.Ctx) (analyticsQuery, error) {
+	until := time.Now()
+	if value := ctx.Query("until"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return analyticsQuery{}, errors.New("invalid until, expected RFC 3339 time")
+		}
+		until = parsed
+	}
+	since := until.Add(-24 * time.Hour)
+	if value := ctx.Query("since"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return analyticsQuery{}, errors.New("invalid since, expected RFC 3339 time")
+		}
+		since = parsed
+	}
+
+	resolution, err := time.ParseDuration(ctx.Query("resolution", "5m"))
+	if err != nil || resolution < time.Minute || resolution%time.Minute != 0 {
+		return analyticsQuery{}, errors.New("invalid resolution, expected a whole number of minutes such as 5m or 1h")
+	}
+
+	by := ctx.Query("by")
+	if _, ok := control.AnalyticsGroups[by]; by != "" && !ok {
+		return analyticsQuery{}, errors.New("invalid by, expected type, rcode, node, region or zone")
+	}
+
+	// Align the range to the resolution, so steps line up with the stored buckets
+	query := analyticsQuery{Resolution: int64(resolution / time.Second), By: by}
+	query.Since = since.Unix() - since.Unix()%query.Resolution
+	query.Until = until.Unix()
+	if rest := query.Until % query.Resolution; rest != 0 {
+		query.Until += query.Resolution - rest
+	}
+
+	if query.Until <= query.Since {
+		return analyticsQuery{}, errors.New("since has to be before until")
+	}
+	if (query.Until-query.Since)/query.Resolution > control.MaxAnalyticsPoints {
+		return analyticsQuery{}, errors.New("too many points, increase the resolution or shorten the range")
+	}
+	return query, nil
+}
+
+// sendSeries looks up the query statistics of a zone, or all zones if zone is empty, and sends them as a time series
+func sendSeries(ctx *fiber.Ctx, zone string) error {
+	query, err := parseAnalyticsQuery(ctx)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	stats, err := db.ListQueryStats(database.QueryStatsFilter{Zone: zone, From: query.Since, To: query.Until})
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "retrieved query analytics", map[string]interface{}{
+		"since":      query.Since,
+		"until":      query.Until,
+		"resolution": query.Resolution,
+		"by":         query.By,
+		"series":     control.QuerySeries(stats, query.Since, query.Until, query.Resolution, query.By),
+	})
+}
+
+// handleNodeAnalytics handles a HTTP POST request from an edge node with query counts
+func handleNodeAnalytics(ctx *fiber.Ctx) error {
+	err, node := requireNodeAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, err, nil)
+	}
+
+	report := new(analyticsReport)
+
+	// Parse body into struct
+	if err := ctx.BodyParser(report); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	if len(report.Counts) > maxAnalyticsCounts {
+		return sendResponse(ctx, 400, errors.New("too many counts"), nil)
+	}
+
+	if err := control.ReportQueries(db, node, report.Counts); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "stored query counts", nil)
+}
+
+// handleZoneAnalytics handles a HTTP GET request to retrieve the query time series of a zone
+func handleZoneAnalytics(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	return sendSeries(ctx, zone.Zone)
+}
+
+// handleAnalytics handles a HTTP GET request to retrieve the query time series of all zones or one zone
+func handleAnalytics(ctx *fiber.Ctx) error {
+	err, _ := requireAdminAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone := ctx.Query("zone")
+	if zone != "" {
+		zone = dns.Fqdn(zone)
+	}
+	return sendSeries(ctx, zone)
+}
+
+// rollupAnalytics periodically rolls up old minute buckets and deletes expired buckets
+func rollupAnalytics(ctx context.Context, minuteRetention time.Duration, retention time.Duration, interval time.Duration) {
+	if interval <= 0 {
+		log.Debugln("query analytics rollup disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if minuteRetention > 0 {
+			rolled, err := db.RollupQueryStats(time.Now().Add(-minuteRetention).Unix())
+			if err != nil {
+				log.Warnf("rolling up query analytics: %v", err)
+			} else if rolled > 0 {
+				log.Infof("rolled up %d query analytics minute buckets", rolled)
+			}
+		}
+
+		if retention > 0 {
+			pruned, err := db.PruneQueryStats(time.Now().Add(-retention).Unix())
+			if err != nil {
+				log.Warnf("pruning query analytics: %v", err)
+			} else if pruned > 0 {
+				log.Infof("pruned %d query analytics buckets", pruned)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
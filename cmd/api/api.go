@@ -2,35 +2,52 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 
+	"github.com/natesales/cdn-tree/internal/alias"
 	"github.com/natesales/cdn-tree/internal/bgp"
+	"github.com/natesales/cdn-tree/internal/config"
 	"github.com/natesales/cdn-tree/internal/control"
 	"github.com/natesales/cdn-tree/internal/crypto"
 	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/soa"
 	"github.com/natesales/cdn-tree/internal/util"
 	"github.com/natesales/cdn-tree/internal/validation"
+	"github.com/natesales/cdn-tree/internal/worker"
 )
 
 var version = "development" // Set by build process
 
-var showVersion = flag.Bool("v", false, "show version information")
+var (
+	showVersion = flag.Bool("v", false, "show version information")
+	workers     = flag.Int("w", 4, "number of queue workers")
+	configFile  = flag.String("c", "", "JSON config file (optional, CDNV3_* environment variables take precedence)")
+	memoryStore = flag.Bool("memory", false, "use the in-memory store instead of MongoDB (development only)")
+)
 
 var (
-	db       *database.Database
-	validate *validator.Validate
+	db        database.Store
+	validate  *validator.Validate
+	pusher    *control.Pusher
+	refresher *control.Refresher
+	queryLog  *control.QueryLog // nil if query logging isn't configured
 )
 
 // Request types
@@ -71,10 +88,7 @@ func requireGenericAuth(ctx *fiber.Ctx) (error, database.User) {
 	apiKey := string(ctx.Request().Header.Peek("Authorization"))
 
 	// Find user by API key in the database
-	var user database.User
-	result := db.Db.Collection("users").FindOne(context.Background(), &bson.M{"apikey": apiKey})
-	// Decode database result into user struct
-	err := result.Decode(&user)
+	user, err := db.GetUserByAPIKey(apiKey)
 	if err != nil {
 		return err, database.User{}
 	}
@@ -82,6 +96,53 @@ func requireGenericAuth(ctx *fiber.Ctx) (error, database.User) {
 	return nil, user // no error; a user with this API key exists
 }
 
+// requireAdminAuth checks if a user is authenticated and is an administrator
+func requireAdminAuth(ctx *fiber.Ctx) (error, database.User) {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return err, database.User{}
+	}
+
+	if !user.Admin {
+		return errors.New("unauthorized"), database.User{}
+	}
+
+	return nil, user // no error; user is an administrator
+}
+
+// requireNodeAuth checks if a request comes from an authorized edge node
+func requireNodeAuth(ctx *fiber.Ctx) (error, database.Node) {
+	node, err := db.GetNode(ctx.Params("node"))
+	if err != nil || !node.Authorized || !crypto.TokenMatches(string(ctx.Request().Header.Peek("Authorization")), node.TokenHash) {
+		return errors.New("unauthorized"), database.Node{}
+	}
+
+	return nil, node
+}
+
+// requireZone looks up the zone given by the zone route parameter and checks that the user is authorized for it
+func requireZone(ctx *fiber.Ctx, user database.User) (database.Zone, error) {
+	zone, err := db.GetZone(ctx.Params("zone"))
+	if err != nil || !util.Includes(zone.Users, user.ID) { // If error or the zone doesn't contain this user as authorized
+		return database.Zone{}, errors.New("zone with given ID doesn't exist")
+	}
+
+	return zone, nil
+}
+
+// requirePrimaryZone looks up a zone like requireZone and checks that it isn't a secondary zone
+func requirePrimaryZone(ctx *fiber.Ctx, user database.User) (database.Zone, error) {
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return database.Zone{}, err
+	}
+	if zone.IsSecondary() {
+		return database.Zone{}, errors.New("records of secondary zones are transferred from their primaries")
+	}
+
+	return zone, nil
+}
+
 // HTTP endpoint handlers
 
 // handleAddNode handles a HTTP POST request to add a new node
@@ -100,10 +161,11 @@ func handleAddNode(ctx *fiber.Ctx) error {
 	}
 
 	// Insert the new node
-	_, err = db.Db.Collection("nodes").InsertOne(context.Background(), newNode)
+	err = db.AddNode(*newNode)
 	if err != nil {
 		return sendResponse(ctx, 500, err, nil)
 	}
+	auditChange(ctx, "node", "", nil, newNode)
 
 	// Return 201 Created OK response
 	return sendResponse(ctx, 201, "added new node", nil)
@@ -111,16 +173,9 @@ func handleAddNode(ctx *fiber.Ctx) error {
 
 // handleAddBgpSession handles a HTTP POST request to add a new BGP session to a node
 func handleAddBgpSession(ctx *fiber.Ctx) error {
-	// TODO: Better admin auth
-	err, user := requireGenericAuth(ctx)
-	if err != nil || user.Admin == false {
-		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
-	}
-
-	// Get node ID
-	nodeId, err := primitive.ObjectIDFromHex(ctx.Params("node"))
+	err, _ := requireAdminAuth(ctx)
 	if err != nil {
-		return sendResponse(ctx, 400, errors.New("invalid node ID"), nil)
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
 	}
 
 	// New session struct
@@ -137,25 +192,92 @@ func handleAddBgpSession(ctx *fiber.Ctx) error {
 		return sendResponse(ctx, 400, err, "validating record body")
 	}
 
-	// Push the new record
-	pushResult, err := db.Db.Collection("nodes").UpdateOne(
-		context.Background(),
-		bson.M{"_id": nodeId},
-		bson.M{"$push": bson.M{"sessions": newSession}},
-	)
-	if err != nil {
-		return sendResponse(ctx, 400, err, "pushing new record")
-	}
-
-	// If nothing was modified (and there wasn't a previously caught error) then the node must not exist. TODO: Is this really true?
-	if pushResult.ModifiedCount < 1 {
+	// Push the new session
+	err = db.AddSession(ctx.Params("node"), *newSession)
+	if err == database.ErrNotFound {
 		return sendResponse(ctx, 400, errors.New("node with given ID doesn't exist"), nil)
+	} else if err != nil {
+		return sendResponse(ctx, 500, err, "pushing new session")
 	}
+	auditChange(ctx, "session", "", nil, newSession)
 
 	// Return 201 Created OK response
 	return sendResponse(ctx, 201, "session added", nil)
 }
 
+// handleNodeManifest handles a HTTP GET request from an edge node for the zone manifest
+func handleNodeManifest(ctx *fiber.Ctx) error {
+	err, node := requireNodeAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, err, nil)
+	}
+
+	// Manifest requests double as node heartbeats for region health
+	if err := db.SetNodeSeen(node.ID, time.Now().UnixNano()); err != nil {
+		log.Warnf("set node seen: %v", err)
+	}
+
+	manifest, err := control.Manifest(db)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	regions, err := control.Regions(db)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	keys, err := control.NodeTSIGKeys(db)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	certificates, err := control.NodeCertificates(db)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	// Edge nodes only log queries while the controller receives them
+	rates := map[string]float64{}
+	if queryLog != nil {
+		rates, err = control.QueryLogRates(db)
+		if err != nil {
+			return sendResponse(ctx, 500, err, nil)
+		}
+	}
+
+	return sendResponse(ctx, 200, "retrieved zone manifest", map[string]interface{}{
+		"zones":        manifest,
+		"regions":      regions,
+		"region":       node.Region,
+		"tsig":         keys,
+		"querylog":     rates,
+		"certificates": certificates,
+	})
+}
+
+// handleNodeZone handles a HTTP GET request from an edge node for a single zone
+func handleNodeZone(ctx *fiber.Ctx) error {
+	if err, _ := requireNodeAuth(ctx); err != nil {
+		return sendResponse(ctx, 403, err, nil)
+	}
+
+	zoneName, err := url.PathUnescape(ctx.Params("zone"))
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	zone, err := control.Export(db, dns.Fqdn(zoneName))
+	if err != nil {
+		if err == database.ErrNotFound || err == control.ErrPending || err == control.ErrNotLoaded {
+			return sendResponse(ctx, 404, errors.New("zone not found"), nil)
+		}
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "retrieved zone", zone)
+}
+
 // handleAddZone handles a HTTP POST request to add a new zone
 func handleAddZone(ctx *fiber.Ctx) error {
 	err, user := requireGenericAuth(ctx)
@@ -179,27 +301,66 @@ func handleAddZone(ctx *fiber.Ctx) error {
 	// Remove trailing dot if present
 	newZone.Zone = dns.Fqdn(newZone.Zone)
 
-	// Set default zone serial
-	newZone.Serial = uint64(time.Now().UnixNano())
-
-	// Create DNSSEC key
-	newZone.DNSSEC = crypto.NewKey(newZone.Zone)
+	// Validate the serial scheme and SOA overrides
+	newZone.SerialScheme, err = soa.ParseScheme(string(newZone.SerialScheme))
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+	if err := newZone.SOA.Merge(soa.Defaults).Validate(); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
 
-	// Create empty arrays
+	// Create empty arrays, new zones use the platform nameservers
 	newZone.Users = []string{user.ID}
 	newZone.Records = []string{}
+	newZone.Nameservers = nil
+
+	// Validate the primaries of secondary zones. Zone TSIG keys are added after the zone is created, account keys can be used right away.
+	switch newZone.Type {
+	case database.ZonePrimary:
+		newZone.Secondary = database.SecondarySettings{}
+	case database.ZoneSecondary:
+		newZone.Secondary, err = validateSecondary(*newZone, newZone.Secondary)
+		if err != nil {
+			return sendResponse(ctx, 400, err, nil)
+		}
+	default:
+		return sendResponse(ctx, 400, errors.New("unknown zone type "+string(newZone.Type)), nil)
+	}
+
+	// Set initial zone serial
+	newZone.Serial = newZone.SerialScheme.Initial(time.Now())
+
+	// Create DNSSEC key, secondary zones are served as signed by their primary
+	if !newZone.IsSecondary() {
+		newZone.DNSSEC = crypto.NewKey(newZone.Zone)
+	}
+
+	// New zones aren't served until control of the domain is proven
+	newZone.Status = database.ZonePending
+	newZone.Challenge = crypto.RandomString()
+	newZone.Created = time.Now().UnixNano()
 
 	// Insert the new zone
-	_, err = db.Db.Collection("zones").InsertOne(context.Background(), newZone)
+	err = db.AddZone(*newZone)
 	if err != nil {
-		if strings.Contains(err.Error(), "duplicate key error collection") {
-			return sendResponse(ctx, 400, err, nil)
+		if err == database.ErrDuplicate {
+			return sendResponse(ctx, 400, errors.New("zone already exists"), nil)
 		}
 		return sendResponse(ctx, 500, err, nil)
 	}
+	auditChange(ctx, "zone", newZone.Zone, nil, zoneSnapshot(*newZone))
 
-	// Return 201 Created OK response
-	return sendResponse(ctx, 201, "added new zone", nil)
+	// Keep the initial version of the zone
+	if err := control.RecordVersion(db, newZone.Zone, user.ID, "create zone"); err != nil {
+		log.Warnf("record zone version: %v", err)
+	}
+
+	// Return 201 Created OK response with the ways to prove control of the domain
+	return sendResponse(ctx, 201, "added new zone, pending verification", map[string]interface{}{
+		"nameservers": control.ZoneNameservers(*newZone),
+		"challenge":   control.ZoneChallenge(*newZone),
+	})
 }
 
 // handleAddRecord handles a HTTP POST request to create a new DNS record
@@ -209,18 +370,10 @@ func handleAddRecord(ctx *fiber.Ctx) error {
 		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
 	}
 
-	// Get zone to add record to
-	zoneID, err := primitive.ObjectIDFromHex(ctx.Params("zone"))
+	// Find zone to add record to
+	zone, err := requirePrimaryZone(ctx, user)
 	if err != nil {
-		return sendResponse(ctx, 400, errors.New("invalid zone ID"), nil)
-	}
-
-	// Find zone
-	var zone database.Zone
-	result := db.Db.Collection("zones").FindOne(context.Background(), &bson.M{"_id": zoneID})
-	err = result.Decode(&zone)
-	if err != nil || !util.Includes(zone.Users, user.ID) { // If error or the zone doesn't contain this user as authorized
-		return sendResponse(ctx, 400, err, "decoding zone")
+		return sendResponse(ctx, 400, err, nil)
 	}
 
 	// New record struct
@@ -248,25 +401,370 @@ func handleAddRecord(ctx *fiber.Ctx) error {
 		return sendResponse(ctx, 400, errors.New("RR name outside of zone"), nil)
 	}
 
-	// Push the new record
-	pushResult, err := db.Db.Collection("zones").UpdateOne(
-		context.Background(),
-		bson.M{"_id": zoneID},
-		bson.M{"$push": bson.M{"records": recordRr.String()}},
-	)
-	if err != nil {
-		return sendResponse(ctx, 400, err, "pushing new record")
+	// The SOA record is generated from the zone settings
+	if recordRr.Header().Rrtype == dns.TypeSOA {
+		return sendResponse(ctx, 400, errors.New("SOA records are managed by the platform, use the zone SOA settings instead"), nil)
 	}
 
-	// If nothing was modified (and there wasn't a previously caught error) then the zone must not exist
-	if pushResult.ModifiedCount < 1 {
+	// The apex NS set is generated from the zone nameservers
+	if recordRr.Header().Rrtype == dns.TypeNS {
+		return sendResponse(ctx, 400, errors.New("NS records at the apex are managed by the platform, use the zone nameservers instead"), nil)
+	}
+
+	// ALIAS records are answered as A and AAAA records, so they can't share a name with address records, a CNAME or another ALIAS
+	if alias.Conflicts(recordRr.Header().Rrtype) {
+		for _, record := range zone.Records {
+			existing, err := dns.NewRR(record)
+			if err != nil || existing == nil || !strings.EqualFold(existing.Header().Name, recordRr.Header().Name) {
+				continue
+			}
+			if alias.Conflicts(existing.Header().Rrtype) && (existing.Header().Rrtype == alias.TypeALIAS || recordRr.Header().Rrtype == alias.TypeALIAS) {
+				return sendResponse(ctx, 400, errors.New("ALIAS records can't share their name with A, AAAA, CNAME or other ALIAS records"), nil)
+			}
+		}
+	}
+
+	// Push the new record and bump the zone serial, the change is stored with it so its version can't be lost
+	change := database.ZoneChange{Author: user.ID, Change: "add record " + recordRr.String(), Created: time.Now().UnixNano()}
+	_, err = db.AddRecord(zone.Zone, recordRr.String(), change)
+	if err == database.ErrNotFound {
 		return sendResponse(ctx, 400, errors.New("zone with given ID doesn't exist"), nil)
+	} else if err != nil {
+		return sendResponse(ctx, 500, err, "pushing new record")
+	}
+
+	// Record the change with the zone as stored
+	if updated, err := db.GetZone(zone.ID); err == nil {
+		auditChange(ctx, "record", zone.Zone, zoneSnapshot(zone), zoneSnapshot(updated))
+	} else {
+		auditChange(ctx, "record", zone.Zone, nil, newRecord)
+	}
+
+	// Failures are retried by the push job and the unpublished zone sweep
+	if err := control.RecordChange(db, zone.Zone); err != nil {
+		log.Warnf("record zone version: %v", err)
+	}
+
+	// Notify the edge nodes
+	if err := control.QueueZonePush(db, zone.Zone); err != nil {
+		log.Warnf("queue zone push: %v", err)
 	}
 
 	// Return 201 Created OK response
 	return sendResponse(ctx, 201, "record added", nil)
 }
 
+// handleDNSSECRollover handles a HTTP POST request to replace the DNSSEC signing key of a zone
+func handleDNSSECRollover(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	// Find zone to roll
+	zone, err := requirePrimaryZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	rollover := control.DNSSECRollover{Zone: zone.Zone}
+	if err := control.QueueJob(db, control.JobDNSSECRollover, rollover); err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "dnssec_rollover", zone.Zone, nil, rollover)
+
+	// Return 202 Accepted OK response
+	return sendResponse(ctx, 202, "queued DNSSEC rollover", nil)
+}
+
+// soaRequest stores the serial scheme and SOA overrides of a zone
+type soaRequest struct {
+	SerialScheme soa.Scheme   `json:"serial_scheme"`
+	SOA          soa.Settings `json:"soa"`
+}
+
+// handleGetSOA handles a HTTP GET request to retrieve the SOA settings and record of a zone
+func handleGetSOA(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "retrieved zone SOA", map[string]interface{}{
+		"serial":        zone.Serial,
+		"serial_scheme": zone.Scheme(),
+		"soa":           zone.SOA,
+		"record":        zone.SOA.Merge(soa.Defaults).Record(zone.Zone, zone.Serial).String(),
+	})
+}
+
+// handleSetSOA handles a HTTP PUT request to replace the serial scheme and SOA overrides of a zone
+func handleSetSOA(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requirePrimaryZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	request := new(soaRequest)
+
+	// Parse body into struct
+	if err := ctx.BodyParser(request); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	// Keep the current scheme unless a new one is given
+	scheme := zone.Scheme()
+	if request.SerialScheme != "" {
+		scheme, err = soa.ParseScheme(string(request.SerialScheme))
+		if err != nil {
+			return sendResponse(ctx, 400, err, nil)
+		}
+	}
+
+	if err := request.SOA.Merge(soa.Defaults).Validate(); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	serial, err := db.SetZoneSOA(zone.Zone, scheme, request.SOA)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "soa", zone.Zone,
+		soaRequest{SerialScheme: zone.Scheme(), SOA: zone.SOA},
+		soaRequest{SerialScheme: scheme, SOA: request.SOA},
+	)
+
+	if err := control.RecordVersion(db, zone.Zone, user.ID, "update SOA"); err != nil {
+		log.Warnf("record zone version: %v", err)
+	}
+
+	// Notify the edge nodes
+	if err := control.QueueZonePush(db, zone.Zone); err != nil {
+		log.Warnf("queue zone push: %v", err)
+	}
+
+	return sendResponse(ctx, 200, "updated zone SOA", map[string]interface{}{"serial": serial})
+}
+
+// handleProvisionNode handles a HTTP POST request to authorize a node and sync it
+func handleProvisionNode(ctx *fiber.Ctx) error {
+	err, _ := requireAdminAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	// Check that the node exists
+	if _, err := db.GetNode(ctx.Params("node")); err != nil {
+		return sendResponse(ctx, 400, errors.New("node with given ID doesn't exist"), nil)
+	}
+
+	// Issue the credential the node authenticates with, replacing an earlier one. Only its hash is stored.
+	token := crypto.RandomString()
+	if err := db.SetNodeToken(ctx.Params("node"), crypto.HashToken(token)); err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	provision := control.NodeProvision{Node: ctx.Params("node")}
+	if err := control.QueueJob(db, control.JobNodeProvision, provision); err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "node_provision", "", nil, provision)
+
+	// Return 202 Accepted OK response with the token for the node config file, it can't be retrieved again
+	return sendResponse(ctx, 202, "queued node provisioning", map[string]string{"token": token})
+}
+
+// handleAddCertificate handles a HTTP POST request to issue a TLS certificate
+func handleAddCertificate(ctx *fiber.Ctx) error {
+	err, _ := requireAdminAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	certRequest := new(control.CertificateRequest)
+
+	// Parse body into struct
+	if err := ctx.BodyParser(certRequest); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	if _, ok := dns.IsDomainName(certRequest.Domain); !ok {
+		return sendResponse(ctx, 400, errors.New("invalid domain"), nil)
+	}
+
+	if err := control.QueueJob(db, control.JobCertificate, certRequest); err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "certificate", "", nil, certRequest)
+
+	// Return 202 Accepted OK response
+	return sendResponse(ctx, 202, "queued certificate request", nil)
+}
+
+// handleListJobs handles a HTTP GET request to list pending and dead-lettered jobs
+func handleListJobs(ctx *fiber.Ctx) error {
+	err, _ := requireAdminAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	pending, err := db.ListQueue()
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	dead, err := db.ListDeadLetters()
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "retrieved jobs", map[string]interface{}{"pending": pending, "dead": dead})
+}
+
+// handleJobHistory handles a HTTP GET request to list recent job outcomes
+func handleJobHistory(ctx *fiber.Ctx) error {
+	err, _ := requireAdminAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	limit, err := strconv.ParseInt(ctx.Query("limit", "100"), 10, 64)
+	if err != nil || limit < 1 {
+		return sendResponse(ctx, 400, errors.New("invalid limit"), nil)
+	}
+
+	history, err := db.ListQueueHistory(database.JobType(ctx.Query("type")), limit)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "retrieved job history", history)
+}
+
+// metadataResponse assembles the API representation of a metadata element with its typed payload
+func metadataResponse(element database.MetadataElement) (map[string]interface{}, error) {
+	payload, err := element.Decode()
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"label":   element.Label,
+		"version": element.Version,
+		"updated": element.Updated,
+		"payload": payload,
+	}, nil
+}
+
+// handleListMetadata handles a HTTP GET request to list all metadata elements
+func handleListMetadata(ctx *fiber.Ctx) error {
+	err, _ := requireAdminAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	elements, err := db.ListMetadata()
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	var response []map[string]interface{}
+	for _, element := range elements {
+		item, err := metadataResponse(element)
+		if err != nil {
+			return sendResponse(ctx, 500, err, nil)
+		}
+		response = append(response, item)
+	}
+
+	return sendResponse(ctx, 200, "retrieved metadata", response)
+}
+
+// handleGetMetadata handles a HTTP GET request to read a single metadata element
+func handleGetMetadata(ctx *fiber.Ctx) error {
+	err, _ := requireAdminAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	label, err := database.ParseMetaLabel(ctx.Params("label"))
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	element, err := db.GetMetadata(label)
+	if err == database.ErrNotFound {
+		return sendResponse(ctx, 404, errors.New("metadata not found"), nil)
+	} else if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	response, err := metadataResponse(element)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "retrieved metadata", response)
+}
+
+// handleSetMetadata handles a HTTP PUT request to compare-and-swap a metadata element
+func handleSetMetadata(ctx *fiber.Ctx) error {
+	err, _ := requireAdminAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	label, err := database.ParseMetaLabel(ctx.Params("label"))
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	// Parse body with the typed payload of the label
+	body := struct {
+		Version int64       `json:"version"` // current version, 0 to create
+		Payload interface{} `json:"payload"`
+	}{Payload: label.NewPayload()}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	// Keep the current element for the audit log, and its write-only fields if it is the version being replaced
+	var before map[string]interface{}
+	if current, err := db.GetMetadata(label); err == nil {
+		before, _ = metadataResponse(current)
+		if current.Version == body.Version {
+			if err := database.KeepWriteOnly(body.Payload, current); err != nil {
+				return sendResponse(ctx, 500, err, nil)
+			}
+		}
+	}
+
+	element, err := db.CompareAndSwapMetadata(label, body.Payload, body.Version)
+	if err == database.ErrConflict {
+		return sendResponse(ctx, 409, err, nil)
+	} else if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	response, err := metadataResponse(element)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "metadata", "", before, response)
+
+	return sendResponse(ctx, 200, "updated metadata", response)
+}
+
 // handleAddUser handles a HTTP POST request to create a new USER
 func handleAddUser(ctx *fiber.Ctx) error {
 	newUser := new(database.User)
@@ -298,14 +796,15 @@ func handleAddUser(ctx *fiber.Ctx) error {
 	// Zero out the plaintext password
 	newUser.Password = ""
 
-	// Insert the new node
-	_, err = db.Db.Collection("users").InsertOne(context.Background(), newUser)
+	// Insert the new user
+	err = db.AddUser(*newUser)
 	if err != nil {
-		if strings.Contains(err.Error(), "duplicate key error collection") {
-			return sendResponse(ctx, 400, err, nil)
+		if err == database.ErrDuplicate {
+			return sendResponse(ctx, 400, errors.New("user already exists"), nil)
 		}
 		return sendResponse(ctx, 500, err, nil)
 	}
+	auditChange(ctx, "user", "", nil, map[string]string{"email": newUser.Email})
 
 	// Return 201 Created OK response
 	return sendResponse(ctx, 201, "added new user", nil)
@@ -326,13 +825,14 @@ func handleUserLogin(ctx *fiber.Ctx) error {
 		return sendResponse(ctx, 400, err, nil)
 	}
 
+	auditChange(ctx, "login", "", nil, nil)
+
 	// Find user by email
-	var user database.User
-	result := db.Db.Collection("users").FindOne(context.Background(), &bson.M{"email": loginReq.Email})
-	err = result.Decode(&user)
+	user, err := db.GetUserByEmail(loginReq.Email)
 	if err != nil {
-		return sendResponse(ctx, 400, err, nil)
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
 	}
+	auditActor(ctx, user)
 
 	// Validate the provided hash with the stored one in database
 	if crypto.ValidHash(user.Hash, loginReq.Password) {
@@ -343,40 +843,129 @@ func handleUserLogin(ctx *fiber.Ctx) error {
 	}
 }
 
-func main() {
-	flag.Parse()
-
-	if *showVersion {
-		fmt.Printf("Packetframe API version %s\n", version)
-		os.Exit(0)
+// runMigrate handles the migrate subcommand
+func runMigrate(store *database.Mongo, args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: migrate status|up|down <version>")
 	}
 
-	log.SetLevel(log.DebugLevel)
-
-	log.Debugln("connecting to database")
-	db = database.New()
-	log.Debugln("connected to database")
-
-	// Type/data validator
-	validate = validator.New()
-	err := validation.Register(validate)
-	if err != nil {
-		log.Fatal(err)
+	switch args[0] {
+	case "status":
+		status, err := store.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, migration := range status {
+			applied := "pending"
+			if migration.Applied {
+				applied = "applied " + migration.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-40s  %s\n", migration.Version, migration.Description, applied)
+		}
+		return nil
+	case "up":
+		return store.Migrate()
+	case "down":
+		if len(args) < 2 {
+			return errors.New("usage: migrate down <version>")
+		}
+		target, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+		return store.MigrateDown(target)
+	default:
+		return errors.New("unknown migrate command " + args[0])
 	}
+}
 
-	// Fiber API server
+// newApp constructs the API server with all routes
+func newApp() *fiber.App {
 	app := fiber.New()
 
+	// Record every mutating request in the audit log
+	app.Use(auditMiddleware)
+
 	// API Routes
 
 	// Node management
 	// TODO: Authenticate these routes
 	app.Post("/nodes/add", handleAddNode)
 	app.Post("/nodes/:node/new_session", handleAddBgpSession)
+	app.Post("/nodes/:node/provision", handleProvisionNode)
+	app.Get("/nodes/:node/manifest", handleNodeManifest)
+	app.Get("/nodes/:node/zones/:zone", handleNodeZone)
+	app.Post("/nodes/:node/health", handleNodeHealth)
+	app.Post("/nodes/:node/analytics", handleNodeAnalytics)
 
 	// DNS management
 	app.Post("/zones/add", handleAddZone)
 	app.Post("/zones/:zone/add", handleAddRecord)
+	app.Post("/zones/:zone/dnssec/rollover", handleDNSSECRollover)
+	app.Get("/zones/:zone/audit", handleZoneAudit)
+	app.Get("/zones/:zone/soa", handleGetSOA)
+	app.Put("/zones/:zone/soa", handleSetSOA)
+	app.Get("/zones/:zone/nameservers", handleGetNameservers)
+	app.Put("/zones/:zone/nameservers", handleSetNameservers)
+	app.Get("/zones/:zone/delegation", handleCheckDelegation)
+	app.Get("/zones/:zone/geo", handleGetGeoRecords)
+	app.Put("/zones/:zone/geo", handleSetGeoRecords)
+	app.Get("/zones/:zone/health-records", handleGetHealthRecords)
+	app.Put("/zones/:zone/health-records", handleSetHealthRecords)
+	app.Get("/zones/:zone/health", handleGetHealth)
+	app.Get("/zones/:zone/balanced", handleGetBalancedRecords)
+	app.Put("/zones/:zone/balanced", handleSetBalancedRecords)
+	app.Patch("/zones/:zone/balanced", handleSetBalancedWeights)
+	app.Get("/zones/:zone/verification", handleGetVerification)
+	app.Post("/zones/:zone/verify", handleVerifyZone)
+	app.Post("/zones/:zone/activate", handleActivateZone)
+	app.Get("/zones/:zone/versions", handleListVersions)
+	app.Get("/zones/:zone/versions/:serial", handleGetVersion)
+	app.Get("/zones/:zone/diff", handleDiffVersions)
+	app.Post("/zones/:zone/rollback", handleRollback)
+	app.Get("/zones/:zone/transfer", handleGetTransfer)
+	app.Put("/zones/:zone/transfer", handleSetTransfer)
+	app.Get("/zones/:zone/tsig", handleListTSIGKeys)
+	app.Post("/zones/:zone/tsig", handleAddTSIGKey)
+	app.Post("/zones/:zone/tsig/:key/rotate", handleRotateTSIGKey)
+	app.Put("/zones/:zone/tsig/:key/policy", handleSetTSIGPolicy)
+	app.Delete("/zones/:zone/tsig/:key", handleRevokeTSIGKey)
+	app.Get("/zones/:zone/analytics", handleZoneAnalytics)
+	app.Get("/zones/:zone/querylog", handleListQueryLog)
+	app.Get("/zones/:zone/querylog/settings", handleGetQueryLog)
+	app.Put("/zones/:zone/querylog/settings", handleSetQueryLog)
+	app.Get("/zones/:zone/secondary", handleGetSecondary)
+	app.Put("/zones/:zone/secondary", handleSetSecondary)
+	app.Post("/zones/:zone/secondary/refresh", handleRefreshSecondary)
+
+	// Certificates
+	app.Post("/certificates/add", handleAddCertificate)
+
+	// Metadata
+	app.Get("/metadata", handleListMetadata)
+	app.Get("/metadata/:label", handleGetMetadata)
+	app.Put("/metadata/:label", handleSetMetadata)
+
+	// Jobs
+	app.Get("/jobs", handleListJobs)
+	app.Get("/jobs/history", handleJobHistory)
+
+	// Query analytics
+	app.Get("/analytics", handleAnalytics)
+
+	// Account TSIG keys
+	app.Get("/tsig", handleListAccountTSIGKeys)
+	app.Post("/tsig", handleAddAccountTSIGKey)
+	app.Post("/tsig/:key/rotate", handleRotateAccountTSIGKey)
+	app.Put("/tsig/:key/policy", handleSetAccountTSIGPolicy)
+	app.Delete("/tsig/:key", handleRevokeAccountTSIGKey)
+
+	// Audit log
+	app.Get("/audit", handleListAudit)
+	app.Get("/audit/export", handleExportAudit)
+
+	// Users
+	app.Put("/users/:email/vanity", handleSetUserVanity)
 
 	// Authentication
 	app.Post("/auth/register", handleAddUser)
@@ -385,7 +974,7 @@ func main() {
 	// Debug
 	// TODO: Authenticate these routes
 	app.Get("/debug/manifest", func(ctx *fiber.Ctx) error {
-		err, manifest := control.Manifest(db)
+		manifest, err := control.Manifest(db)
 		if err != nil {
 			return sendResponse(ctx, 500, err, nil)
 		}
@@ -398,19 +987,152 @@ func main() {
 		return sendResponse(ctx, 200, "sent update", nil)
 	})
 
+	app.Get("/debug/convergence", func(ctx *fiber.Ctx) error {
+		return sendResponse(ctx, 200, "retrieved convergence stats", pusher.Stats())
+	})
+
 	app.Get("/debug/version", func(ctx *fiber.Ctx) error {
 		return sendResponse(ctx, 200, "retrieved version", "sent update")
 	})
 
-	app.Get("/debug/queue/list", func(ctx *fiber.Ctx) error {
-		messages, err := db.ListQueue()
+	return app
+}
+
+func main() {
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("Packetframe API version %s\n", version)
+		os.Exit(0)
+	}
+
+	// Load configuration
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatalf("loading config: %v", err)
+	}
+
+	if cfg.Development {
+		log.SetLevel(log.DebugLevel)
+		log.Debugln("running in development mode")
+	}
+
+	// Platform zone defaults
+	soa.DefaultScheme = cfg.DNS.SerialScheme
+	soa.Defaults = cfg.DNS.SOA
+	control.Nameservers = cfg.DNS.Nameservers
+	control.NameserverAddresses = cfg.DNS.Addresses
+	control.Resolver = cfg.DNS.Resolver
+	control.HealthQuorum = int(cfg.Health.Quorum)
+	control.HealthStaleness = time.Duration(cfg.Health.Staleness)
+	control.ACMEDirectory = cfg.ACME.Directory
+	control.ACMEEmail = cfg.ACME.Email
+
+	if *memoryStore {
+		if flag.Arg(0) == "migrate" {
+			log.Fatal("migrations are not supported by the in-memory store")
+		}
+		log.Warnln("using in-memory store, all data will be lost on exit")
+		db = database.NewMemory()
+	} else {
+		log.Debugln("connecting to database")
+		mongoStore, err := database.New(cfg.Database)
 		if err != nil {
-			return sendResponse(ctx, 500, err, nil)
+			log.Fatalf("connecting to database: %v", err)
+		}
+		log.Debugln("connected to database")
+
+		// Run the migrate subcommand instead of the API
+		if flag.Arg(0) == "migrate" {
+			if err := runMigrate(mongoStore, flag.Args()[1:]); err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(0)
 		}
 
-		return sendResponse(ctx, 200, "retrieved queue items", messages)
-	})
+		// Bring the schema up to date
+		if err := mongoStore.Migrate(); err != nil {
+			log.Fatalf("migrating database: %v", err)
+		}
+
+		db = mongoStore
+	}
+
+	// Key that TSIG secrets are encrypted with at rest. The in-memory store loses its keys on exit anyway, so it gets a throwaway key.
+	if cfg.Secrets.Key != "" {
+		control.SecretsKey, _ = base64.StdEncoding.DecodeString(cfg.Secrets.Key) // validated by config.Load
+	} else if *memoryStore {
+		control.SecretsKey = make([]byte, 32)
+		if _, err := rand.Read(control.SecretsKey); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		log.Warnln("no secrets key is configured, TSIG keys can't be created or rotated")
+	}
+	if sealed, err := control.SealTSIGKeys(db); err != nil {
+		log.Fatalf("encrypting TSIG keys: %v", err)
+	} else if sealed > 0 {
+		log.Infof("encrypted %d TSIG keys stored in plaintext", sealed)
+	}
+
+	// Type/data validator
+	validate = validator.New()
+	err = validation.Register(validate)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Fiber API server
+	app := newApp()
+
+	// Start the queue workers
+	ctx, cancel := context.WithCancel(context.Background())
+	pusher = control.NewPusher(db)
+	jobs := worker.New(db, *workers)
+	control.RegisterJobs(jobs, pusher)
+	go pruneAudit(ctx, time.Duration(cfg.Audit.Retention), time.Duration(cfg.Audit.PruneInterval))
+	go verifyZones(ctx, time.Duration(cfg.Verification.Interval), time.Duration(cfg.Verification.Expiry))
+	go rollupAnalytics(ctx, time.Duration(cfg.Analytics.MinuteRetention), time.Duration(cfg.Analytics.Retention), time.Duration(cfg.Analytics.Interval))
+	go publishZones(ctx, time.Minute)
+	refresher = control.NewRefresher(db)
+	go refresher.Run(ctx, 5*time.Second)
+	if cfg.Transfer.Listen != "" {
+		log.Printf("Serving zone transfers on %s", cfg.Transfer.Listen)
+		go control.NewTransferServer(db, cfg.Transfer.Listen, refresher).Run(ctx, 30*time.Second)
+	}
+	if cfg.QueryLog.Listen != "" {
+		log.Printf("Receiving dnstap query logs on %s", cfg.QueryLog.Listen)
+		queryLog = control.NewQueryLog(db, cfg.QueryLog.Listen, int(cfg.QueryLog.Entries))
+		go func() {
+			if err := queryLog.Run(ctx, 10*time.Second); err != nil {
+				log.Fatalf("query log receiver: %v", err)
+			}
+		}()
+	}
+	workersDone := make(chan struct{})
+	go func() {
+		jobs.Run(ctx)
+		close(workersDone)
+	}()
+
+	// Shut down gracefully on SIGINT/SIGTERM
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		log.Println("Shutting down")
+		cancel()
+		if err := app.Shutdown(); err != nil {
+			log.Warn(err)
+		}
+	}()
 
 	log.Println("Starting API")
-	log.Fatal(app.Listen(":5000"))
+	if err := app.Listen(":5000"); err != nil {
+		log.Fatal(err)
+	}
+
+	// Wait for in-flight jobs to finish
+	<-workersDone
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/natesales/cdn-tree/internal/control"
+	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/validation"
+)
+
+// Test users, see newTestApp
+const (
+	testAdminKey = "admin-key"
+	testUserKey  = "user-key"
+	testOtherKey = "other-key"
+)
+
+// testResponse is the body of an API response
+type testResponse struct {
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// newTestApp sets up the API with an in-memory store, an admin and two users
+func newTestApp(t *testing.T) *fiber.App {
+	db = database.NewMemory()
+	validate = validator.New()
+	if err := validation.Register(validate); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []database.User{
+		{Email: "admin@example.com", APIKey: testAdminKey, Enabled: true, Admin: true},
+		{Email: "user@example.com", APIKey: testUserKey, Enabled: true},
+		{Email: "other@example.com", APIKey: testOtherKey, Enabled: true},
+	} {
+		if err := db.AddUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return newApp()
+}
+
+// testRequest sends a request to the API with an API key, and a JSON body unless it is nil
+func testRequest(t *testing.T, app *fiber.App, method string, path string, apiKey string, body interface{}) (int, testResponse) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	r := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if apiKey != "" {
+		r.Header.Set("Authorization", apiKey)
+	}
+
+	response, err := app.Test(r, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var decoded testResponse
+	if err := json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+		t.Fatalf("%s %s: decoding response: %v", method, path, err)
+	}
+	return response.StatusCode, decoded
+}
+
+// TestZoneRoutes checks creating zones and adding records
+func TestZoneRoutes(t *testing.T) {
+	app := newTestApp(t)
+
+	if status, _ := testRequest(t, app, "POST", "/zones/add", "", map[string]string{"zone": "example.com"}); status != 403 {
+		t.Errorf("adding a zone without an API key: status %d, want 403", status)
+	}
+	if status, response := testRequest(t, app, "POST", "/zones/add", testUserKey, map[string]string{"zone": "example.com"}); status != 201 {
+		t.Fatalf("adding a zone: status %d: %s", status, response.Message)
+	}
+	if status, _ := testRequest(t, app, "POST", "/zones/add", testOtherKey, map[string]string{"zone": "example.com."}); status != 400 {
+		t.Errorf("adding an existing zone: status %d, want 400", status)
+	}
+
+	zone, err := db.GetZoneByName("example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone.Active() {
+		t.Error("new zone is served before it is verified")
+	}
+	if err := db.ActivateZone(zone.Zone, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		apiKey string
+		rr     string
+		status int
+	}{
+		{"record", testUserKey, "example.com. 300 IN A 192.0.2.1", 201},
+		{"other user", testOtherKey, "example.com. 300 IN A 192.0.2.2", 400},
+		{"no API key", "", "example.com. 300 IN A 192.0.2.3", 403},
+		{"outside of zone", testUserKey, "example.net. 300 IN A 192.0.2.4", 400},
+		{"invalid", testUserKey, "example.com. 300 IN A 192.0.2", 400},
+		{"SOA", testUserKey, "example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300", 400},
+		{"apex NS", testUserKey, "example.com. 300 IN NS ns1.example.com.", 400},
+	}
+	for _, test := range tests {
+		status, response := testRequest(t, app, "POST", "/zones/"+zone.ID+"/add", test.apiKey, map[string]string{"rr": test.rr})
+		if status != test.status {
+			t.Errorf("%s: status %d, want %d: %s", test.name, status, test.status, response.Message)
+		}
+	}
+
+	// Only the valid record was added, with a version and a queued push
+	zone, err = db.GetZoneByName("example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zone.Records) != 1 || zone.Records[0] != "example.com.\t300\tIN\tA\t192.0.2.1" {
+		t.Errorf("records = %q, want the added A record", zone.Records)
+	}
+	if _, err := db.GetZoneVersion(zone.Zone, zone.Serial); err != nil {
+		t.Errorf("version of the new serial: %v", err)
+	}
+	queue, err := db.ListQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 1 || queue[0].Type != control.JobZonePush {
+		t.Errorf("queue = %+v, want a zone push", queue)
+	}
+}
+
+// TestNodeRoutes checks adding and provisioning nodes, and that only provisioned nodes get the manifest and zones
+func TestNodeRoutes(t *testing.T) {
+	app := newTestApp(t)
+
+	node := map[string]interface{}{"endpoint": "192.0.2.10:8001", "provider": "test", "latitude": 37.4, "longitude": -122.1, "region": "us-west"}
+	if status, response := testRequest(t, app, "POST", "/nodes/add", "", node); status != 201 {
+		t.Fatalf("adding a node: status %d: %s", status, response.Message)
+	}
+	if status, _ := testRequest(t, app, "POST", "/nodes/add", "", map[string]string{"endpoint": "192.0.2.11:8001"}); status != 400 {
+		t.Errorf("adding an incomplete node: status %d, want 400", status)
+	}
+
+	nodes, err := db.ListNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 {
+		t.Fatalf("%d nodes, want 1", len(nodes))
+	}
+	id := nodes[0].ID
+
+	if status, _ := testRequest(t, app, "POST", "/nodes/"+id+"/provision", testUserKey, nil); status != 403 {
+		t.Errorf("provisioning as a user: status %d, want 403", status)
+	}
+	if status, _ := testRequest(t, app, "POST", "/nodes/unknown/provision", testAdminKey, nil); status != 400 {
+		t.Errorf("provisioning an unknown node: status %d, want 400", status)
+	}
+	status, response := testRequest(t, app, "POST", "/nodes/"+id+"/provision", testAdminKey, nil)
+	if status != 202 {
+		t.Fatalf("provisioning: status %d: %s", status, response.Message)
+	}
+	var provisioned struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(response.Data, &provisioned); err != nil || provisioned.Token == "" {
+		t.Fatalf("provisioning returned no token: %s", response.Data)
+	}
+
+	// The node is authorized by the provisioning job, which isn't running here
+	if status, _ := testRequest(t, app, "GET", "/nodes/"+id+"/manifest", provisioned.Token, nil); status != 403 {
+		t.Errorf("manifest before authorization: status %d, want 403", status)
+	}
+	if _, err := db.AuthorizeNode(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _ := testRequest(t, app, "GET", "/nodes/"+id+"/manifest", "", nil); status != 403 {
+		t.Errorf("manifest without a token: status %d, want 403", status)
+	}
+	if status, _ := testRequest(t, app, "GET", "/nodes/"+id+"/manifest", "wrong", nil); status != 403 {
+		t.Errorf("manifest with a wrong token: status %d, want 403", status)
+	}
+
+	// Serve a zone and check that the node gets it
+	if status, response := testRequest(t, app, "POST", "/zones/add", testUserKey, map[string]string{"zone": "example.com."}); status != 201 {
+		t.Fatalf("adding a zone: status %d: %s", status, response.Message)
+	}
+	if err := db.ActivateZone("example.com.", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	status, response = testRequest(t, app, "GET", "/nodes/"+id+"/manifest", provisioned.Token, nil)
+	if status != 200 {
+		t.Fatalf("manifest: status %d: %s", status, response.Message)
+	}
+	var manifest struct {
+		Zones []struct {
+			Zone string `json:"zone"`
+		} `json:"zones"`
+	}
+	if err := json.Unmarshal(response.Data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Zones) != 1 || manifest.Zones[0].Zone != "example.com." {
+		t.Errorf("manifest zones = %+v, want example.com.", manifest.Zones)
+	}
+
+	if status, response := testRequest(t, app, "GET", "/nodes/"+id+"/zones/example.com.", provisioned.Token, nil); status != 200 {
+		t.Errorf("zone: status %d: %s", status, response.Message)
+	}
+	if status, _ := testRequest(t, app, "GET", "/nodes/"+id+"/zones/example.net.", provisioned.Token, nil); status != 404 {
+		t.Errorf("unknown zone: status %d, want 404", status)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// auditRecord collects the details of a mutating request that only its handler knows
+type auditRecord struct {
+	Resource string
+	Zone     string
+	Before   interface{}
+	After    interface{}
+	Actor    *database.User // set by handlers that authenticate without an API key
+}
+
+// auditLocal is the fiber.Ctx local key of the auditRecord
+const auditLocal = "audit"
+
+// auditChange records the resource, zone and before/after state of an audited request
+func auditChange(ctx *fiber.Ctx, resource string, zone string, before interface{}, after interface{}) {
+	record, ok := ctx.Locals(auditLocal).(*auditRecord)
+	if !ok {
+		return
+	}
+
+	record.Resource = resource
+	record.Zone = zone
+	record.Before = before
+	record.After = after
+}
+
+// auditActor records the acting user of a request that isn't authenticated by API key
+func auditActor(ctx *fiber.Ctx, user database.User) {
+	if record, ok := ctx.Locals(auditLocal).(*auditRecord); ok {
+		record.Actor = &user
+	}
+}
+
+// tokenFingerprint identifies an API key in the audit log without storing it
+func tokenFingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// auditFields flattens a value into its top level JSON fields
+func auditFields(value interface{}) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if value == nil {
+		return fields, nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	// Keep numbers as json.Number so that serials don't lose precision as float64
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// auditDiff computes the top level JSON fields that differ between before and after
+func auditDiff(before interface{}, after interface{}) (map[string]database.AuditChange, error) {
+	beforeFields, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := map[string]database.AuditChange{}
+	for key, value := range beforeFields {
+		if !reflect.DeepEqual(value, afterFields[key]) {
+			diff[key] = database.AuditChange{Before: value, After: afterFields[key]}
+		}
+	}
+	for key, value := range afterFields {
+		if _, ok := beforeFields[key]; !ok {
+			diff[key] = database.AuditChange{Before: nil, After: value}
+		}
+	}
+	return diff, nil
+}
+
+// zoneSnapshot returns the audited state of a zone, leaving out the DNSSEC private key
+func zoneSnapshot(zone database.Zone) map[string]interface{} {
+	return map[string]interface{}{
+		"zone":    zone.Zone,
+		"users":   zone.Users,
+		"serial":  zone.Serial,
+		"records": zone.Records,
+		"ds":      zone.DNSSEC.DSRecordString,
+	}
+}
+
+// auditMiddleware appends every mutating request to the audit log once its handler has run
+func auditMiddleware(ctx *fiber.Ctx) error {
+	switch ctx.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		return ctx.Next()
+	}
+
+	record := &auditRecord{}
+	ctx.Locals(auditLocal, record)
+	handlerErr := ctx.Next()
+
+	// Request values are only valid until the handler returns, so copy everything that's stored
+	token := string(ctx.Request().Header.Peek("Authorization"))
+	entry := database.AuditEntry{
+		Time:     time.Now().UnixNano(),
+		Token:    tokenFingerprint(token),
+		SourceIP: utils.CopyString(ctx.IP()),
+		Method:   utils.CopyString(ctx.Method()),
+		Path:     utils.CopyString(ctx.Path()),
+		Resource: record.Resource,
+		Zone:     record.Zone,
+		Status:   ctx.Response().StatusCode(),
+	}
+
+	if entry.Resource == "" {
+		entry.Resource = utils.CopyString(ctx.Route().Path)
+	}
+
+	// Attribute the request to a user
+	if record.Actor != nil {
+		entry.Actor = record.Actor.ID
+		entry.ActorEmail = record.Actor.Email
+	} else if token != "" {
+		if user, err := db.GetUserByAPIKey(token); err == nil {
+			entry.Actor = user.ID
+			entry.ActorEmail = user.Email
+		}
+	}
+
+	// Only successful requests changed anything
+	if handlerErr == nil && entry.Status < 400 {
+		entry.Outcome = "success"
+		diff, err := auditDiff(record.Before, record.After)
+		if err != nil {
+			log.Warnf("audit diff: %v", err)
+		} else if len(diff) > 0 {
+			entry.Diff = diff
+		}
+	} else {
+		entry.Outcome = "failure"
+		if handlerErr != nil {
+			entry.Error = handlerErr.Error()
+		} else {
+			var response struct {
+				Message string `json:"message"`
+			}
+			if json.Unmarshal(ctx.Response().Body(), &response) == nil {
+				entry.Error = utils.CopyString(response.Message)
+			}
+		}
+	}
+
+	if err := db.AddAuditEntry(entry); err != nil {
+		log.Warnf("writing audit entry: %v", err)
+	}
+
+	return handlerErr
+}
+
+// parseAuditFilter builds an audit filter from the zone, user, since, until and limit query parameters
+func parseAuditFilter(ctx *fiber.Ctx, defaultLimit string) (database.AuditFilter, error) {
+	filter := database.AuditFilter{Actor: ctx.Query("user")}
+
+	if zone := ctx.Query("zone"); zone != "" {
+		filter.Zone = dns.Fqdn(zone)
+	}
+
+	for param, target := range map[string]*int64{"since": &filter.Since, "until": &filter.Until} {
+		if value := ctx.Query(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return database.AuditFilter{}, errors.New("invalid " + param + ", expected RFC 3339 time")
+			}
+			*target = parsed.UnixNano()
+		}
+	}
+
+	limit, err := strconv.ParseInt(ctx.Query("limit", defaultLimit), 10, 64)
+	if err != nil || limit < 0 {
+		return database.AuditFilter{}, errors.New("invalid limit")
+	}
+	filter.Limit = limit
+
+	return filter, nil
+}
+
+// handleListAudit handles a HTTP GET request to query the audit log
+func handleListAudit(ctx *fiber.Ctx) error {
+	err, _ := requireAdminAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	filter, err := parseAuditFilter(ctx, "100")
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	entries, err := db.ListAuditEntries(filter)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "retrieved audit log", entries)
+}
+
+// handleExportAudit handles a HTTP GET request to export the audit log as JSON lines
+func handleExportAudit(ctx *fiber.Ctx) error {
+	err, _ := requireAdminAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	// Export everything selected by the filter unless a limit is given
+	filter, err := parseAuditFilter(ctx, "0")
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	entries, err := db.ListAuditEntries(filter)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	ctx.Set(fiber.HeaderContentType, "application/x-ndjson")
+	ctx.Set(fiber.HeaderContentDisposition, `attachment; filename="audit.jsonl"`)
+	ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		encoder := json.NewEncoder(w)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				log.Warnf("exporting audit log: %v", err)
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// handleZoneAudit handles a HTTP GET request to query the audit log of a single zone
+func handleZoneAudit(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	filter, err := parseAuditFilter(ctx, "100")
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+	filter.Zone = zone.Zone
+
+	entries, err := db.ListAuditEntries(filter)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "retrieved zone audit log", entries)
+}
+
+// pruneAudit deletes audit entries older than retention every interval until the context is cancelled
+func pruneAudit(ctx context.Context, retention time.Duration, interval time.Duration) {
+	if retention <= 0 || interval <= 0 {
+		log.Debugln("audit log retention disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pruned, err := db.PruneAuditEntries(time.Now().Add(-retention).UnixNano())
+		if err != nil {
+			log.Warnf("pruning audit log: %v", err)
+		} else if pruned > 0 {
+			log.Infof("pruned %d audit entries", pruned)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
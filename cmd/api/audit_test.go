@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// TestAuditMiddleware checks that mutating requests are recorded with their actor, outcome and the fields their handlers changed
+func TestAuditMiddleware(t *testing.T) {
+	app := newTestApp(t)
+	user, err := db.GetUserByAPIKey(testUserKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status, response := testRequest(t, app, "POST", "/zones/add", testUserKey, map[string]string{"zone": "example.com"}); status != 201 {
+		t.Fatalf("adding a zone: status %d: %s", status, response.Message)
+	}
+	zone, err := db.GetZoneByName("example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ActivateZone(zone.Zone, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if status, response := testRequest(t, app, "POST", "/zones/"+zone.ID+"/add", testUserKey, map[string]string{"rr": "example.com. 300 IN A 192.0.2.1"}); status != 201 {
+		t.Fatalf("adding a record: status %d: %s", status, response.Message)
+	}
+	if status, _ := testRequest(t, app, "POST", "/zones/"+zone.ID+"/add", testOtherKey, map[string]string{"rr": "example.com. 300 IN A 192.0.2.2"}); status != 400 {
+		t.Fatalf("adding a record to another user's zone: status %d, want 400", status)
+	}
+	if status, _ := testRequest(t, app, "GET", "/zones/"+zone.ID+"/soa", testUserKey, nil); status != 200 {
+		t.Fatalf("getting the SOA settings: status %d, want 200", status)
+	}
+
+	entries, err := db.ListAuditEntries(database.AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("%d audit entries, want one per mutating request", len(entries))
+	}
+	failed, added, created := entries[0], entries[1], entries[2] // newest first
+
+	if created.Resource != "zone" || created.Zone != "example.com." || created.Actor != user.ID || created.Outcome != "success" {
+		t.Errorf("zone creation entry = %+v", created)
+	}
+	if created.Token == "" || created.Token == testUserKey {
+		t.Errorf("zone creation token = %q, want a fingerprint of the API key", created.Token)
+	}
+	if change, ok := created.Diff["zone"]; !ok || change.Before != nil || change.After != "example.com." {
+		t.Errorf("zone creation diff = %+v, want the new zone name", created.Diff)
+	}
+
+	// Records are compared before and after the handler changed them
+	if added.Resource != "record" || added.Zone != "example.com." || added.Outcome != "success" {
+		t.Errorf("record entry = %+v", added)
+	}
+	records, ok := added.Diff["records"]
+	if !ok || records.Before != nil || !reflect.DeepEqual(records.After, []interface{}{"example.com.\t300\tIN\tA\t192.0.2.1"}) {
+		t.Errorf("records diff = %+v, want the added record", records)
+	}
+	serial, ok := added.Diff["serial"]
+	if !ok || serial.After == nil || reflect.DeepEqual(serial.Before, serial.After) {
+		t.Errorf("serial diff = %+v, want a new serial", serial)
+	}
+	if _, ok := added.Diff["zone"]; ok {
+		t.Error("unchanged zone name in the record diff")
+	}
+
+	// Failed requests record the error and no changes
+	other, err := db.GetUserByAPIKey(testOtherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed.Outcome != "failure" || failed.Status != 400 || failed.Actor != other.ID || failed.Error == "" || len(failed.Diff) != 0 {
+		t.Errorf("failed request entry = %+v", failed)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/natesales/cdn-tree/internal/balance"
+	"github.com/natesales/cdn-tree/internal/control"
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// maxBalancedRecordSets is the largest number of load-balanced record sets a zone may have
+const maxBalancedRecordSets = 64
+
+// maxBalancedMembers is the largest number of members a load-balanced record set may have
+const maxBalancedMembers = 256
+
+// balancedRequest stores the load-balanced record sets of a zone
+type balancedRequest struct {
+	RecordSets []balance.RecordSet `json:"record_sets"`
+}
+
+// weightsRequest stores new weights for the members of a single load-balanced record set
+type weightsRequest struct {
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	Weights map[string]uint32 `json:"weights"` // member value to weight
+}
+
+// validateBalancedRecords validates the load-balanced record sets of a zone and returns them normalized
+func validateBalancedRecords(zone database.Zone, sets []balance.RecordSet) ([]balance.RecordSet, error) {
+	if len(sets) > maxBalancedRecordSets {
+		return nil, errors.New("too many load-balanced record sets")
+	}
+
+	seen := recordSetKeys(zone, "balanced")
+	var normalized []balance.RecordSet
+	for _, set := range sets {
+		set.Name = strings.ToLower(dns.Fqdn(set.Name))
+		set.Type = strings.ToUpper(set.Type)
+
+		if len(set.Members) > maxBalancedMembers {
+			return nil, errors.New(set.Name + " " + set.Type + ": too many members")
+		}
+		if err := set.Validate(); err != nil {
+			return nil, errors.New(set.Name + " " + set.Type + ": " + err.Error())
+		}
+		if !dns.IsSubDomain(zone.Zone, set.Name) {
+			return nil, errors.New(set.Name + " is outside of the zone")
+		}
+		if set.Type == "CNAME" && set.Name == zone.Zone {
+			return nil, errors.New("CNAME records can't be at the zone apex")
+		}
+
+		key := set.Name + " " + set.Type
+		if seen[key] {
+			return nil, errors.New("duplicate record set " + key)
+		}
+		seen[key] = true
+
+		normalized = append(normalized, set)
+	}
+	return normalized, nil
+}
+
+// saveBalancedRecords stores the load-balanced record sets of a zone, records the change and notifies the edge nodes
+func saveBalancedRecords(ctx *fiber.Ctx, user database.User, zone database.Zone, sets []balance.RecordSet, change string) (uint32, error) {
+	serial, err := db.SetZoneBalancedRecords(zone.Zone, sets)
+	if err != nil {
+		return 0, err
+	}
+	auditChange(ctx, "balanced", zone.Zone, balancedRequest{RecordSets: zone.BalancedRecords}, balancedRequest{RecordSets: sets})
+
+	if err := control.RecordVersion(db, zone.Zone, user.ID, change); err != nil {
+		log.Warnf("record zone version: %v", err)
+	}
+
+	// Notify the edge nodes
+	if err := control.QueueZonePush(db, zone.Zone); err != nil {
+		log.Warnf("queue zone push: %v", err)
+	}
+
+	return serial, nil
+}
+
+// handleGetBalancedRecords handles a HTTP GET request to retrieve the load-balanced record sets of a zone
+func handleGetBalancedRecords(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	sets := zone.BalancedRecords
+	if sets == nil {
+		sets = []balance.RecordSet{}
+	}
+	return sendResponse(ctx, 200, "retrieved load-balanced record sets", balancedRequest{RecordSets: sets})
+}
+
+// handleSetBalancedRecords handles a HTTP PUT request to replace the load-balanced record sets of a zone
+func handleSetBalancedRecords(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requirePrimaryZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	request := new(balancedRequest)
+
+	// Parse body into struct
+	if err := ctx.BodyParser(request); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	sets, err := validateBalancedRecords(zone, request.RecordSets)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	serial, err := saveBalancedRecords(ctx, user, zone, sets, "update load-balanced record sets")
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "updated load-balanced record sets", map[string]interface{}{"serial": serial})
+}
+
+// handleSetBalancedWeights handles a HTTP PATCH request to change the weights of a load-balanced set
+func handleSetBalancedWeights(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requirePrimaryZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	request := new(weightsRequest)
+
+	// Parse body into struct
+	if err := ctx.BodyParser(request); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	name := strings.ToLower(dns.Fqdn(request.Name))
+	rrType := strings.ToUpper(request.Type)
+
+	sets := append([]balance.RecordSet(nil), zone.BalancedRecords...)
+	found := false
+	for i, set := range sets {
+		if set.Name != name || set.Type != rrType {
+			continue
+		}
+
+		updated, err := set.SetWeights(request.Weights)
+		if err != nil {
+			return sendResponse(ctx, 400, err, nil)
+		}
+		if err := updated.Validate(); err != nil {
+			return sendResponse(ctx, 400, err, nil)
+		}
+		sets[i] = updated
+		found = true
+	}
+	if !found {
+		return sendResponse(ctx, 404, errors.New("load-balanced record set "+name+" "+rrType+" doesn't exist"), nil)
+	}
+
+	serial, err := saveBalancedRecords(ctx, user, zone, sets, "update weights of "+name+" "+rrType)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "updated member weights", map[string]interface{}{"serial": serial})
+}
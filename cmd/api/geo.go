@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/natesales/cdn-tree/internal/control"
+	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/geo"
+)
+
+// maxGeoRecordSets is the largest number of geo record sets a zone may have
+const maxGeoRecordSets = 64
+
+// geoRequest stores the geo record sets of a zone
+type geoRequest struct {
+	RecordSets []geo.RecordSet `json:"record_sets"`
+}
+
+// recordSetKeys gets the names and types of the record sets of a zone, except for the kind being replaced
+func recordSetKeys(zone database.Zone, replacing string) map[string]bool {
+	keys := map[string]bool{}
+	if replacing != "geo" {
+		for _, set := range zone.GeoRecords {
+			keys[set.Name+" "+set.Type] = true
+		}
+	}
+	if replacing != "health" {
+		for _, set := range zone.HealthRecords {
+			keys[set.Name+" "+set.Type] = true
+		}
+	}
+	if replacing != "balanced" {
+		for _, set := range zone.BalancedRecords {
+			keys[set.Name+" "+set.Type] = true
+		}
+	}
+	return keys
+}
+
+// validateGeoRecords validates the geo record sets of a zone and returns them normalized
+func validateGeoRecords(zone database.Zone, sets []geo.RecordSet) ([]geo.RecordSet, error) {
+	if len(sets) > maxGeoRecordSets {
+		return nil, errors.New("too many geo record sets")
+	}
+
+	seen := recordSetKeys(zone, "geo")
+	var normalized []geo.RecordSet
+	for _, set := range sets {
+		set.Name = strings.ToLower(dns.Fqdn(set.Name))
+		set.Type = strings.ToUpper(set.Type)
+
+		if err := set.Validate(); err != nil {
+			return nil, errors.New(set.Name + " " + set.Type + ": " + err.Error())
+		}
+		if !dns.IsSubDomain(zone.Zone, set.Name) {
+			return nil, errors.New(set.Name + " is outside of the zone")
+		}
+		if set.Type == "CNAME" && set.Name == zone.Zone {
+			return nil, errors.New("CNAME records can't be at the zone apex")
+		}
+		for region := range set.Regions {
+			if err := validate.Var(region, "region"); err != nil {
+				return nil, errors.New("unknown region " + region)
+			}
+		}
+
+		key := set.Name + " " + set.Type
+		if seen[key] {
+			return nil, errors.New("duplicate record set " + key)
+		}
+		seen[key] = true
+
+		normalized = append(normalized, set)
+	}
+	return normalized, nil
+}
+
+// handleGetGeoRecords handles a HTTP GET request to retrieve the geo record sets of a zone
+func handleGetGeoRecords(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	sets := zone.GeoRecords
+	if sets == nil {
+		sets = []geo.RecordSet{}
+	}
+	return sendResponse(ctx, 200, "retrieved geo record sets", geoRequest{RecordSets: sets})
+}
+
+// handleSetGeoRecords handles a HTTP PUT request to replace the geo record sets of a zone
+func handleSetGeoRecords(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requirePrimaryZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	request := new(geoRequest)
+
+	// Parse body into struct
+	if err := ctx.BodyParser(request); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	sets, err := validateGeoRecords(zone, request.RecordSets)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	serial, err := db.SetZoneGeoRecords(zone.Zone, sets)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "geo", zone.Zone, geoRequest{RecordSets: zone.GeoRecords}, geoRequest{RecordSets: sets})
+
+	if err := control.RecordVersion(db, zone.Zone, user.ID, "update geo record sets"); err != nil {
+		log.Warnf("record zone version: %v", err)
+	}
+
+	// Notify the edge nodes
+	if err := control.QueueZonePush(db, zone.Zone); err != nil {
+		log.Warnf("queue zone push: %v", err)
+	}
+
+	return sendResponse(ctx, 200, "updated geo record sets", map[string]interface{}{"serial": serial})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/natesales/cdn-tree/internal/control"
+	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/health"
+)
+
+// maxHealthRecordSets is the largest number of health checked record sets a zone may have
+const maxHealthRecordSets = 64
+
+// maxHealthResults is the largest number of results a node may report at once
+const maxHealthResults = 4096
+
+// healthRequest stores the health checked record sets of a zone
+type healthRequest struct {
+	RecordSets []health.RecordSet `json:"record_sets"`
+}
+
+// healthReport stores the check results reported by an edge node
+type healthReport struct {
+	Results []health.Result `json:"results"`
+}
+
+// targetHealth stores the state of a single target of a zone
+type targetHealth struct {
+	Target  health.Target            `json:"target"`
+	Healthy bool                     `json:"healthy"`
+	Changed int64                    `json:"changed,omitempty"`
+	Results map[string]health.Result `json:"results"` // by node ID
+}
+
+// validateHealthRecords validates the health checked record sets of a zone and returns them normalized
+func validateHealthRecords(zone database.Zone, sets []health.RecordSet) ([]health.RecordSet, error) {
+	if len(sets) > maxHealthRecordSets {
+		return nil, errors.New("too many health checked record sets")
+	}
+
+	seen := recordSetKeys(zone, "health")
+
+	var normalized []health.RecordSet
+	for _, set := range sets {
+		set.Name = strings.ToLower(dns.Fqdn(set.Name))
+		set.Type = strings.ToUpper(set.Type)
+		set.Check = set.Check.Normalize()
+
+		if err := set.Validate(); err != nil {
+			return nil, errors.New(set.Name + " " + set.Type + ": " + err.Error())
+		}
+		if !dns.IsSubDomain(zone.Zone, set.Name) {
+			return nil, errors.New(set.Name + " is outside of the zone")
+		}
+		if set.Type == "CNAME" && set.Name == zone.Zone {
+			return nil, errors.New("CNAME records can't be at the zone apex")
+		}
+
+		key := set.Name + " " + set.Type
+		if seen[key] {
+			return nil, errors.New("duplicate record set " + key)
+		}
+		seen[key] = true
+
+		normalized = append(normalized, set)
+	}
+	return normalized, nil
+}
+
+// handleGetHealthRecords handles a HTTP GET request to retrieve the health checked record sets of a zone
+func handleGetHealthRecords(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	sets := zone.HealthRecords
+	if sets == nil {
+		sets = []health.RecordSet{}
+	}
+	return sendResponse(ctx, 200, "retrieved health checked record sets", healthRequest{RecordSets: sets})
+}
+
+// handleSetHealthRecords handles a HTTP PUT request to replace the health checked record sets of a zone
+func handleSetHealthRecords(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requirePrimaryZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	request := new(healthRequest)
+
+	// Parse body into struct
+	if err := ctx.BodyParser(request); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	sets, err := validateHealthRecords(zone, request.RecordSets)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	serial, err := db.SetZoneHealthRecords(zone.Zone, sets)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "health", zone.Zone, healthRequest{RecordSets: zone.HealthRecords}, healthRequest{RecordSets: sets})
+
+	if err := control.RecordVersion(db, zone.Zone, user.ID, "update health checked record sets"); err != nil {
+		log.Warnf("record zone version: %v", err)
+	}
+
+	// Notify the edge nodes
+	if err := control.QueueZonePush(db, zone.Zone); err != nil {
+		log.Warnf("queue zone push: %v", err)
+	}
+
+	return sendResponse(ctx, 200, "updated health checked record sets", map[string]interface{}{"serial": serial})
+}
+
+// handleGetHealth handles a HTTP GET request to retrieve the state of every health check target of a zone
+func handleGetHealth(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	states, err := db.ListHealthStates()
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	stateByKey := map[string]database.HealthState{}
+	for _, state := range states {
+		stateByKey[state.Key] = state
+	}
+
+	// Targets without results yet are considered healthy
+	targets := []targetHealth{}
+	for _, target := range control.ZoneTargets(zone) {
+		entry := targetHealth{Target: target, Healthy: true, Results: map[string]health.Result{}}
+		if state, ok := stateByKey[target.Key]; ok {
+			entry.Healthy = state.Healthy
+			entry.Changed = state.Changed
+			entry.Results = state.Results
+		}
+		targets = append(targets, entry)
+	}
+
+	return sendResponse(ctx, 200, "retrieved zone health", map[string]interface{}{"targets": targets})
+}
+
+// handleNodeHealth handles a HTTP POST request from an edge node with health check results
+func handleNodeHealth(ctx *fiber.Ctx) error {
+	err, node := requireNodeAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, err, nil)
+	}
+
+	report := new(healthReport)
+
+	// Parse body into struct
+	if err := ctx.BodyParser(report); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	if len(report.Results) > maxHealthResults {
+		return sendResponse(ctx, 400, errors.New("too many results"), nil)
+	}
+
+	if err := control.ReportHealth(db, node.ID, report.Results); err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "stored health check results", nil)
+}
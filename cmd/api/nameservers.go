@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/natesales/cdn-tree/internal/control"
+	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/util"
+)
+
+// maxNameservers is the largest NS set a zone may use
+const maxNameservers = 8
+
+// nameserversRequest stores the vanity nameservers of a zone
+type nameserversRequest struct {
+	Nameservers []string `json:"nameservers"` // empty to use the platform nameservers
+}
+
+// vanityRequest stores whether a user may use vanity nameservers
+type vanityRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// ownedZone finds the zone owned by user that contains hostname
+func ownedZone(user database.User, hostname string) (database.Zone, error) {
+	labels := dns.SplitDomainName(hostname)
+	for i := 1; i < len(labels); i++ {
+		zone, err := db.GetZoneByName(dns.Fqdn(strings.Join(labels[i:], ".")))
+		if err == database.ErrNotFound {
+			continue
+		} else if err != nil {
+			return database.Zone{}, err
+		}
+
+		if !util.Includes(zone.Users, user.ID) || !zone.Active() {
+			break
+		}
+		return zone, nil
+	}
+	return database.Zone{}, errors.New("nameserver " + hostname + " isn't inside one of your verified zones")
+}
+
+// vanityNameservers validates a vanity NS set and returns it normalized
+func vanityNameservers(user database.User, nameservers []string) ([]string, []string, error) {
+	if len(nameservers) == 0 {
+		return nil, nil, nil // platform nameservers
+	}
+	if len(control.NameserverAddresses) == 0 {
+		return nil, nil, errors.New("vanity nameservers are not available")
+	}
+	if len(nameservers) < 2 || len(nameservers) > maxNameservers {
+		return nil, nil, errors.New("between 2 and 8 nameservers are required")
+	}
+
+	var normalized, zones []string
+	for _, hostname := range nameservers {
+		if _, ok := dns.IsDomainName(hostname); !ok {
+			return nil, nil, errors.New("invalid nameserver " + hostname)
+		}
+		hostname = strings.ToLower(dns.Fqdn(hostname))
+		if util.Includes(normalized, hostname) {
+			return nil, nil, errors.New("duplicate nameserver " + hostname)
+		}
+
+		zone, err := ownedZone(user, hostname)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		normalized = append(normalized, hostname)
+		if !util.Includes(zones, zone.Zone) {
+			zones = append(zones, zone.Zone)
+		}
+	}
+	return normalized, zones, nil
+}
+
+// glueZones finds the zones containing the given vanity nameservers, ignoring zones that no longer exist
+func glueZones(nameservers []string) []string {
+	var zones []string
+	for _, hostname := range nameservers {
+		labels := dns.SplitDomainName(hostname)
+		for i := 1; i < len(labels); i++ {
+			name := dns.Fqdn(strings.Join(labels[i:], "."))
+			if _, err := db.GetZoneByName(name); err == nil {
+				if !util.Includes(zones, name) {
+					zones = append(zones, name)
+				}
+				break
+			}
+		}
+	}
+	return zones
+}
+
+// handleGetNameservers handles a HTTP GET request to retrieve the nameservers a zone should be delegated to
+func handleGetNameservers(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "retrieved zone nameservers", map[string]interface{}{
+		"nameservers": control.ZoneNameservers(zone),
+		"vanity":      len(zone.Nameservers) > 0,
+		"glue":        control.VanityGlue(zone),
+	})
+}
+
+// handleSetNameservers handles a HTTP PUT request to replace the vanity nameservers of a zone
+func handleSetNameservers(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requirePrimaryZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	if !user.Vanity && !user.Admin {
+		return sendResponse(ctx, 403, errors.New("vanity nameservers are not enabled for this account"), nil)
+	}
+
+	request := new(nameserversRequest)
+
+	// Parse body into struct
+	if err := ctx.BodyParser(request); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	nameservers, zones, err := vanityNameservers(user, request.Nameservers)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	if _, err := db.SetZoneNameservers(zone.Zone, nameservers); err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "nameservers", zone.Zone,
+		nameserversRequest{Nameservers: zone.Nameservers},
+		nameserversRequest{Nameservers: nameservers},
+	)
+
+	if err := control.RecordVersion(db, zone.Zone, user.ID, "update nameservers"); err != nil {
+		log.Warnf("record zone version: %v", err)
+	}
+	if err := control.QueueZonePush(db, zone.Zone); err != nil {
+		log.Warnf("queue zone push: %v", err)
+	}
+
+	// The zones containing old and new vanity nameservers serve their addresses, so they change as well
+	for _, name := range append(glueZones(zone.Nameservers), zones...) {
+		if name == zone.Zone {
+			continue
+		}
+		if _, err := db.BumpZoneSerial(name); err != nil {
+			log.Warnf("bump zone serial: %v", err)
+			continue
+		}
+		if err := control.RecordVersion(db, name, user.ID, "vanity nameserver addresses for "+zone.Zone); err != nil {
+			log.Warnf("record zone version: %v", err)
+		}
+		if err := control.QueueZonePush(db, name); err != nil {
+			log.Warnf("queue zone push: %v", err)
+		}
+	}
+
+	updated := zone
+	updated.Nameservers = nameservers
+	return sendResponse(ctx, 200, "updated zone nameservers", map[string]interface{}{
+		"nameservers": control.ZoneNameservers(updated),
+		"glue":        control.VanityGlue(updated),
+	})
+}
+
+// handleCheckDelegation handles a HTTP GET request to check whether the parent zone delegates a zone to its nameservers
+func handleCheckDelegation(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "checked zone delegation", control.CheckDelegation(zone.Zone, control.ZoneNameservers(zone)))
+}
+
+// handleSetUserVanity handles a HTTP PUT request to allow or disallow a user to use vanity nameservers
+func handleSetUserVanity(ctx *fiber.Ctx) error {
+	err, _ := requireAdminAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	request := new(vanityRequest)
+
+	// Parse body into struct
+	if err := ctx.BodyParser(request); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	email, err := url.PathUnescape(ctx.Params("email"))
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	err = db.SetUserVanity(email, request.Enabled)
+	if err == database.ErrNotFound {
+		return sendResponse(ctx, 404, errors.New("user not found"), nil)
+	} else if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "user", "", nil, map[string]interface{}{"email": email, "vanity": request.Enabled})
+
+	return sendResponse(ctx, 200, "updated user", nil)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// handleGetQueryLog handles a HTTP GET request to retrieve the query log settings of a zone
+func handleGetQueryLog(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "retrieved query log settings", zone.QueryLog)
+}
+
+// handleSetQueryLog handles a HTTP PUT request to opt a zone in or out of query logging
+func handleSetQueryLog(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	settings := database.QueryLogSettings{Rate: 1}
+
+	// Parse body into struct
+	if err := ctx.BodyParser(&settings); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	if !(settings.Rate > 0 && settings.Rate <= 1) {
+		return sendResponse(ctx, 400, errors.New("rate has to be greater than 0 and at most 1"), nil)
+	}
+	if settings.Enabled && queryLog == nil {
+		return sendResponse(ctx, 400, errors.New("query logging isn't available on this platform"), nil)
+	}
+	if !settings.Enabled {
+		settings = database.QueryLogSettings{}
+	}
+
+	if err := db.SetZoneQueryLog(zone.Zone, settings); err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "querylog", zone.Zone, zone.QueryLog, settings)
+
+	return sendResponse(ctx, 200, "updated query log settings", settings)
+}
+
+// handleListQueryLog handles a HTTP GET request to list the recent logged queries of a zone
+func handleListQueryLog(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	if queryLog == nil {
+		return sendResponse(ctx, 400, errors.New("query logging isn't available on this platform"), nil)
+	}
+
+	limit, err := strconv.Atoi(ctx.Query("limit", "100"))
+	if err != nil || limit < 1 {
+		return sendResponse(ctx, 400, errors.New("invalid limit"), nil)
+	}
+
+	entries, summary := queryLog.Zone(zone.Zone, limit)
+	return sendResponse(ctx, 200, "retrieved query log", map[string]interface{}{"entries": entries, "summary": summary})
+}
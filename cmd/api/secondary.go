@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/natesales/cdn-tree/internal/control"
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// secondaryStatus stores the settings and transfer state of a secondary zone
+type secondaryStatus struct {
+	database.SecondarySettings
+	database.SecondaryState
+	Serial uint32    `json:"serial"`
+	Next   time.Time `json:"next"` // time of the next serial check
+}
+
+// validateSecondary validates the primaries and TSIG key of a secondary zone and returns them normalized
+func validateSecondary(zone database.Zone, settings database.SecondarySettings) (database.SecondarySettings, error) {
+	if len(settings.Primaries) == 0 {
+		return database.SecondarySettings{}, errors.New("secondary zones need at least one primary")
+	}
+	if len(settings.Primaries) > maxTransferEntries {
+		return database.SecondarySettings{}, errors.New("too many primaries")
+	}
+
+	var normalized database.SecondarySettings
+	for _, primary := range settings.Primaries {
+		primary, err := parseRemoteAddress(primary)
+		if err != nil {
+			return database.SecondarySettings{}, errors.New("primary: " + err.Error())
+		}
+		normalized.Primaries = append(normalized.Primaries, primary)
+	}
+
+	if settings.Key != "" {
+		name, err := usableTSIGKey(zone, settings.Key)
+		if err != nil {
+			return database.SecondarySettings{}, err
+		}
+		normalized.Key = name
+	}
+
+	return normalized, nil
+}
+
+// requireSecondaryZone looks up a zone like requireZone and checks that it is a secondary zone
+func requireSecondaryZone(ctx *fiber.Ctx, user database.User) (database.Zone, error) {
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return database.Zone{}, err
+	}
+	if !zone.IsSecondary() {
+		return database.Zone{}, errors.New("zone isn't a secondary zone")
+	}
+
+	return zone, nil
+}
+
+// handleGetSecondary handles a HTTP GET request to retrieve the primaries and transfer state of a secondary zone
+func handleGetSecondary(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireSecondaryZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "retrieved secondary zone", secondaryStatus{
+		SecondarySettings: zone.Secondary,
+		SecondaryState:    zone.SecondaryState,
+		Serial:            zone.Serial,
+		Next:              control.RefreshDue(zone),
+	})
+}
+
+// handleSetSecondary handles a HTTP PUT request to replace the primaries and TSIG key of a secondary zone
+func handleSetSecondary(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireSecondaryZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	request := new(database.SecondarySettings)
+
+	// Parse body into struct
+	if err := ctx.BodyParser(request); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	settings, err := validateSecondary(zone, *request)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	if err := db.SetZoneSecondary(zone.Zone, settings); err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "secondary", zone.Zone, zone.Secondary, settings)
+
+	// Check the new primaries right away
+	refresher.Notify(zone.Zone)
+
+	return sendResponse(ctx, 200, "updated secondary zone", settings)
+}
+
+// handleRefreshSecondary handles a HTTP POST request to check the primaries of a secondary zone for a new serial now
+func handleRefreshSecondary(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireSecondaryZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	refresher.Notify(zone.Zone)
+	return sendResponse(ctx, 200, "queued refresh", nil)
+}
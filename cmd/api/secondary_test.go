@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// TestValidateSecondaryPrimaries checks that primaries have to be public IP addresses, so NOTIFY sources can be matched against them
+func TestValidateSecondaryPrimaries(t *testing.T) {
+	zone := database.Zone{Zone: "example.com."}
+
+	settings, err := validateSecondary(zone, database.SecondarySettings{Primaries: []string{"192.0.2.53:53", "[2001:db8::53]:53"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(settings.Primaries) != 2 || settings.Primaries[0] != "192.0.2.53:53" || settings.Primaries[1] != "[2001:db8::53]:53" {
+		t.Errorf("primaries = %v", settings.Primaries)
+	}
+
+	for _, primary := range []string{"ns1.example.com:53", "127.0.0.1:53", "10.0.0.53:53", "[fe80::1]:53", "192.0.2.53"} {
+		if _, err := validateSecondary(zone, database.SecondarySettings{Primaries: []string{"192.0.2.53:53", primary}}); err == nil {
+			t.Errorf("primary %s accepted, want it rejected", primary)
+		}
+	}
+}
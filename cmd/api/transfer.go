@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/util"
+)
+
+// maxTransferEntries is the largest number of allowed prefixes, notified secondaries or accepted keys of a zone
+const maxTransferEntries = 32
+
+// privateNetworks are the unicast ranges that aren't reachable over the internet (RFC 1918, RFC 6598 and RFC 4193)
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// parseRemoteAddress parses the ip:port of a remote nameserver, which has to be a public unicast address
+func parseRemoteAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", errors.New("invalid address " + address + ", expected ip:port")
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", errors.New("invalid address " + address + ", expected ip:port")
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return "", errors.New("invalid port in " + address)
+	}
+
+	if !ip.IsGlobalUnicast() {
+		return "", errors.New(address + " isn't a global unicast address")
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return "", errors.New(address + " is a private address")
+		}
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// validateTransfer validates the transfer settings of a zone and returns them normalized
+func validateTransfer(zone database.Zone, settings database.TransferSettings) (database.TransferSettings, error) {
+	if len(settings.Allow) > maxTransferEntries || len(settings.Notify) > maxTransferEntries || len(settings.Keys) > maxTransferEntries {
+		return database.TransferSettings{}, errors.New("too many transfer entries")
+	}
+
+	var normalized database.TransferSettings
+	for _, prefix := range settings.Allow {
+		_, network, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return database.TransferSettings{}, errors.New("invalid prefix " + prefix)
+		}
+		normalized.Allow = append(normalized.Allow, network.String())
+	}
+
+	for _, target := range settings.Notify {
+		target, err := parseRemoteAddress(target)
+		if err != nil {
+			return database.TransferSettings{}, errors.New("notify target: " + err.Error())
+		}
+		normalized.Notify = append(normalized.Notify, target)
+	}
+
+	for _, name := range settings.Keys {
+		name, err := usableTSIGKey(zone, name)
+		if err != nil {
+			return database.TransferSettings{}, err
+		}
+		if !util.Includes(normalized.Keys, name) {
+			normalized.Keys = append(normalized.Keys, name)
+		}
+	}
+
+	return normalized, nil
+}
+
+// handleGetTransfer handles a HTTP GET request to retrieve the transfer settings of a zone
+func handleGetTransfer(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "retrieved transfer settings", zone.Transfer)
+}
+
+// handleSetTransfer handles a HTTP PUT request to replace the transfer settings of a zone
+func handleSetTransfer(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	request := new(database.TransferSettings)
+
+	// Parse body into struct
+	if err := ctx.BodyParser(request); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	settings, err := validateTransfer(zone, *request)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	if err := db.SetZoneTransfer(zone.Zone, settings); err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "transfer", zone.Zone, zone.Transfer, settings)
+
+	return sendResponse(ctx, 200, "updated transfer settings", settings)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// TestValidateTransferNotify checks that only public nameservers can be notified
+func TestValidateTransferNotify(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string // normalized target, empty if it is rejected
+	}{
+		{"192.0.2.53:53", "192.0.2.53:53"},
+		{"[2001:db8::53]:5353", "[2001:db8::53]:5353"},
+		{"[::ffff:192.0.2.53]:53", "192.0.2.53:53"},
+		{"127.0.0.1:53", ""},
+		{"[::1]:53", ""},
+		{"10.1.2.3:53", ""},
+		{"172.16.0.1:53", ""},
+		{"192.168.1.1:53", ""},
+		{"100.64.0.1:53", ""},
+		{"169.254.169.254:53", ""},
+		{"[fe80::1]:53", ""},
+		{"[fd00::1]:53", ""},
+		{"0.0.0.0:53", ""},
+		{"224.0.0.1:53", ""},
+		{"ns1.example.com:53", ""},
+		{"192.0.2.53", ""},
+		{"192.0.2.53:0", ""},
+	}
+	for _, test := range tests {
+		settings, err := validateTransfer(database.Zone{Zone: "example.com."}, database.TransferSettings{Notify: []string{test.target}})
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s accepted, want it rejected", test.target)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s rejected: %v", test.target, err)
+		} else if len(settings.Notify) != 1 || settings.Notify[0] != test.want {
+			t.Errorf("%s normalized to %v, want %s", test.target, settings.Notify, test.want)
+		}
+	}
+}
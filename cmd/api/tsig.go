@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/miekg/dns"
+
+	"github.com/natesales/cdn-tree/internal/control"
+	"github.com/natesales/cdn-tree/internal/crypto"
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// maxUpdateRules is the largest number of rules in the DNS UPDATE policy of a TSIG key
+const maxUpdateRules = 32
+
+// tsigKeyRequest stores a request to create or rotate a TSIG key
+type tsigKeyRequest struct {
+	Name      string                `json:"name"`
+	Algorithm string                `json:"algorithm"` // hmac-sha256 if empty
+	Secret    string                `json:"secret"`    // base64 encoded secret shared with a primary, generated if empty
+	Policy    []database.UpdateRule `json:"policy"`    // names and types the key may change with DNS UPDATE
+}
+
+// tsigPolicyRequest stores a request to replace the DNS UPDATE policy of a TSIG key
+type tsigPolicyRequest struct {
+	Policy []database.UpdateRule `json:"policy"`
+}
+
+// tsigScope is the owner of a set of TSIG keys, either an account or a single zone
+type tsigScope struct {
+	User string // account ID, empty for zone keys
+	Zone string // zone name, empty for account keys
+}
+
+// owns reports whether a key belongs to the scope
+func (s tsigScope) owns(key database.TSIGKey) bool {
+	return key.User == s.User && key.Zone == s.Zone
+}
+
+// usableTSIGKey checks that a TSIG key exists, isn't revoked and may be used by a zone, and returns its normalized name
+func usableTSIGKey(zone database.Zone, name string) (string, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+	key, err := db.GetTSIGKey(name)
+	if err != nil || !key.UsableBy(zone) {
+		return "", errors.New("TSIG key " + name + " doesn't exist")
+	}
+	if !key.Active() {
+		return "", errors.New("TSIG key " + name + " is revoked")
+	}
+	return name, nil
+}
+
+// validatePolicy validates the DNS UPDATE policy of a key in a scope and returns it normalized
+func validatePolicy(scope tsigScope, policy []database.UpdateRule) ([]database.UpdateRule, error) {
+	if len(policy) > maxUpdateRules {
+		return nil, errors.New("too many policy rules")
+	}
+
+	var normalized []database.UpdateRule
+	for _, rule := range policy {
+		name := strings.ToLower(dns.Fqdn(rule.Name))
+		if _, ok := dns.IsDomainName(strings.TrimPrefix(name, "*.")); !ok || name == "." {
+			return nil, errors.New("invalid policy name " + rule.Name)
+		}
+		if scope.Zone != "" && !dns.IsSubDomain(scope.Zone, strings.TrimPrefix(name, "*.")) {
+			return nil, errors.New("policy name " + rule.Name + " is outside of the zone")
+		}
+
+		types := []string{}
+		for _, t := range rule.Types {
+			t = strings.ToUpper(t)
+			rrtype, ok := dns.StringToType[t]
+			if !ok || rrtype == dns.TypeSOA || rrtype == dns.TypeANY {
+				return nil, errors.New("invalid policy type " + t)
+			}
+			types = append(types, t)
+		}
+		normalized = append(normalized, database.UpdateRule{Name: name, Types: types})
+	}
+	return normalized, nil
+}
+
+// parseTSIGSecret validates a base64 encoded secret, or generates one if none is given
+func parseTSIGSecret(algorithm string, secret string) (string, error) {
+	generated, err := crypto.TSIGSecret(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if secret == "" {
+		return generated, nil
+	}
+
+	if decoded, err := base64.StdEncoding.DecodeString(secret); err != nil || len(decoded) < 16 {
+		return "", errors.New("TSIG secrets have to be base64 encoded and at least 16 bytes long")
+	}
+	return secret, nil
+}
+
+// storedTSIGKey gets the copy of a key that is stored, with its secret encrypted
+func storedTSIGKey(key database.TSIGKey) (database.TSIGKey, error) {
+	if err := control.SealTSIGKey(&key); err != nil {
+		return database.TSIGKey{}, err
+	}
+	return key, nil
+}
+
+// auditedTSIGKey gets the copy of a key that is recorded in the audit log, without its secret
+func auditedTSIGKey(key database.TSIGKey) database.TSIGKey {
+	key.Secret = ""
+	key.Encrypted = false
+	return key
+}
+
+// listTSIGKeys responds with the keys of a scope without their secrets
+func listTSIGKeys(ctx *fiber.Ctx, scope tsigScope) error {
+	keys, err := db.ListTSIGKeys()
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	owned := []database.TSIGKey{}
+	for _, key := range keys {
+		if scope.owns(key) {
+			owned = append(owned, auditedTSIGKey(key))
+		}
+	}
+	return sendResponse(ctx, 200, "retrieved TSIG keys", map[string]interface{}{"keys": owned})
+}
+
+// addTSIGKey creates a key in a scope and responds with it. The secret is only returned in this response.
+func addTSIGKey(ctx *fiber.Ctx, scope tsigScope) error {
+	request := new(tsigKeyRequest)
+
+	// Parse body into struct
+	if err := ctx.BodyParser(request); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	name := strings.ToLower(dns.Fqdn(request.Name))
+	if _, ok := dns.IsDomainName(name); !ok || name == "." {
+		return sendResponse(ctx, 400, errors.New("invalid key name "+request.Name), nil)
+	}
+	algorithm := dns.HmacSHA256
+	if request.Algorithm != "" {
+		algorithm = strings.ToLower(dns.Fqdn(request.Algorithm))
+	}
+
+	secret, err := parseTSIGSecret(algorithm, request.Secret)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+	policy, err := validatePolicy(scope, request.Policy)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	key := database.TSIGKey{
+		Name:      name,
+		Zone:      scope.Zone,
+		User:      scope.User,
+		Algorithm: algorithm,
+		Secret:    secret,
+		Created:   time.Now().UnixNano(),
+		Policy:    policy,
+	}
+	stored, err := storedTSIGKey(key)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	if err := db.AddTSIGKey(stored); err != nil {
+		if err == database.ErrDuplicate {
+			return sendResponse(ctx, 400, errors.New("TSIG key already exists"), nil)
+		}
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "tsig", scope.Zone, nil, auditedTSIGKey(key))
+
+	return sendResponse(ctx, 200, "created TSIG key", key)
+}
+
+// requireOwnedTSIGKey looks up the active key given by the key route parameter and checks that it belongs to a scope
+func requireOwnedTSIGKey(ctx *fiber.Ctx, scope tsigScope) (database.TSIGKey, error) {
+	name := strings.ToLower(dns.Fqdn(ctx.Params("key")))
+	key, err := db.GetTSIGKey(name)
+	if err != nil || !scope.owns(key) {
+		return database.TSIGKey{}, errors.New("TSIG key " + name + " doesn't exist")
+	}
+	if key.Revoked != 0 {
+		return database.TSIGKey{}, errors.New("TSIG key " + name + " is revoked")
+	}
+	return key, nil
+}
+
+// rotateTSIGKey replaces the secret of a key in a scope and responds with the new secret
+func rotateTSIGKey(ctx *fiber.Ctx, scope tsigScope) error {
+	key, err := requireOwnedTSIGKey(ctx, scope)
+	if err != nil {
+		return sendResponse(ctx, 404, err, nil)
+	}
+
+	// The body is optional, it's only needed to rotate to a secret shared with a primary
+	request := new(tsigKeyRequest)
+	if len(ctx.Body()) > 0 {
+		// Parse body into struct
+		if err := ctx.BodyParser(request); err != nil {
+			return sendResponse(ctx, 400, err, nil)
+		}
+	}
+
+	secret, err := parseTSIGSecret(key.Algorithm, request.Secret)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	before := auditedTSIGKey(key)
+	key.Secret = secret
+	key.Encrypted = false
+	key.Rotated = time.Now().UnixNano()
+
+	stored, err := storedTSIGKey(key)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	if err := db.UpdateTSIGKey(stored); err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "tsig", scope.Zone, before, auditedTSIGKey(key))
+
+	return sendResponse(ctx, 200, "rotated TSIG key", key)
+}
+
+// setTSIGPolicy replaces the DNS UPDATE policy of a key in a scope
+func setTSIGPolicy(ctx *fiber.Ctx, scope tsigScope) error {
+	key, err := requireOwnedTSIGKey(ctx, scope)
+	if err != nil {
+		return sendResponse(ctx, 404, err, nil)
+	}
+
+	request := new(tsigPolicyRequest)
+
+	// Parse body into struct
+	if err := ctx.BodyParser(request); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	policy, err := validatePolicy(scope, request.Policy)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	before := auditedTSIGKey(key)
+	key.Policy = policy
+	if err := db.UpdateTSIGKey(key); err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "tsig", scope.Zone, before, auditedTSIGKey(key))
+
+	return sendResponse(ctx, 200, "updated TSIG key policy", auditedTSIGKey(key))
+}
+
+// revokeTSIGKey revokes a key in a scope and wipes its secret. The key name stays reserved.
+func revokeTSIGKey(ctx *fiber.Ctx, scope tsigScope) error {
+	key, err := requireOwnedTSIGKey(ctx, scope)
+	if err != nil {
+		return sendResponse(ctx, 404, err, nil)
+	}
+
+	before := auditedTSIGKey(key)
+	key.Secret = ""
+	key.Encrypted = false
+	key.Revoked = time.Now().UnixNano()
+
+	if err := db.UpdateTSIGKey(key); err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "tsig", scope.Zone, before, key)
+
+	return sendResponse(ctx, 200, "revoked TSIG key", key)
+}
+
+// handleListAccountTSIGKeys handles a HTTP GET request to list the TSIG keys of the account without their secrets
+func handleListAccountTSIGKeys(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	return listTSIGKeys(ctx, tsigScope{User: user.ID})
+}
+
+// handleAddAccountTSIGKey handles a HTTP POST request to create a TSIG key for all zones of the account
+func handleAddAccountTSIGKey(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	return addTSIGKey(ctx, tsigScope{User: user.ID})
+}
+
+// handleRotateAccountTSIGKey handles a HTTP POST request to replace the secret of a TSIG key of the account
+func handleRotateAccountTSIGKey(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	return rotateTSIGKey(ctx, tsigScope{User: user.ID})
+}
+
+// handleSetAccountTSIGPolicy handles a HTTP PUT request to replace the DNS UPDATE policy of a TSIG key of the account
+func handleSetAccountTSIGPolicy(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	return setTSIGPolicy(ctx, tsigScope{User: user.ID})
+}
+
+// handleRevokeAccountTSIGKey handles a HTTP DELETE request to revoke a TSIG key of the account
+func handleRevokeAccountTSIGKey(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	return revokeTSIGKey(ctx, tsigScope{User: user.ID})
+}
+
+// handleListTSIGKeys handles a HTTP GET request to list the TSIG keys of a zone without their secrets
+func handleListTSIGKeys(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	return listTSIGKeys(ctx, tsigScope{Zone: zone.Zone})
+}
+
+// handleAddTSIGKey handles a HTTP POST request to create a TSIG key for a zone, or to add the key of a primary
+func handleAddTSIGKey(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	return addTSIGKey(ctx, tsigScope{Zone: zone.Zone})
+}
+
+// handleRotateTSIGKey handles a HTTP POST request to replace the secret of a TSIG key of a zone
+func handleRotateTSIGKey(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	return rotateTSIGKey(ctx, tsigScope{Zone: zone.Zone})
+}
+
+// handleSetTSIGPolicy handles a HTTP PUT request to replace the DNS UPDATE policy of a TSIG key of a zone
+func handleSetTSIGPolicy(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	return setTSIGPolicy(ctx, tsigScope{Zone: zone.Zone})
+}
+
+// handleRevokeTSIGKey handles a HTTP DELETE request to revoke a TSIG key of a zone
+func handleRevokeTSIGKey(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	return revokeTSIGKey(ctx, tsigScope{Zone: zone.Zone})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/natesales/cdn-tree/internal/control"
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// TestTSIGKeyScopes checks that zone and account keys can only be rotated and revoked in the scope that owns them
+func TestTSIGKeyScopes(t *testing.T) {
+	app := newTestApp(t)
+	control.SecretsKey = bytes.Repeat([]byte{1}, 32)
+	defer func() { control.SecretsKey = nil }()
+
+	zoneIDs := map[string]string{}
+	for apiKey, zone := range map[string]string{testUserKey: "example.com", testOtherKey: "example.net"} {
+		if status, response := testRequest(t, app, "POST", "/zones/add", apiKey, map[string]string{"zone": zone}); status != 201 {
+			t.Fatalf("adding %s: status %d: %s", zone, status, response.Message)
+		}
+		z, err := db.GetZoneByName(zone + ".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		zoneIDs[apiKey] = z.ID
+	}
+	if status, response := testRequest(t, app, "POST", "/zones/"+zoneIDs[testUserKey]+"/tsig", testUserKey, map[string]string{"name": "zone-key"}); status != 200 {
+		t.Fatalf("adding a zone key: status %d: %s", status, response.Message)
+	}
+	if status, response := testRequest(t, app, "POST", "/tsig", testUserKey, map[string]string{"name": "account-key"}); status != 200 {
+		t.Fatalf("adding an account key: status %d: %s", status, response.Message)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		apiKey string
+		status int
+	}{
+		{"zone key through another user's zone", "POST", "/zones/" + zoneIDs[testOtherKey] + "/tsig/zone-key./rotate", testOtherKey, 404},
+		{"zone key of another user", "DELETE", "/zones/" + zoneIDs[testUserKey] + "/tsig/zone-key.", testOtherKey, 400},
+		{"zone key as an account key", "POST", "/tsig/zone-key./rotate", testUserKey, 404},
+		{"account key of another user", "POST", "/tsig/account-key./rotate", testOtherKey, 404},
+		{"revoking the account key of another user", "DELETE", "/tsig/account-key.", testOtherKey, 404},
+		{"account key as a zone key", "DELETE", "/zones/" + zoneIDs[testUserKey] + "/tsig/account-key.", testUserKey, 404},
+	}
+	for _, test := range tests {
+		if status, response := testRequest(t, app, test.method, test.path, test.apiKey, nil); status != test.status {
+			t.Errorf("%s: status %d, want %d: %s", test.name, status, test.status, response.Message)
+		}
+	}
+	for _, name := range []string{"zone-key.", "account-key."} {
+		key, err := db.GetTSIGKey(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.Rotated != 0 || key.Revoked != 0 {
+			t.Errorf("%s was changed from another scope: %+v", name, key)
+		}
+	}
+
+	// The owner can rotate and revoke
+	before, err := control.TSIGKey(db, "zone-key.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, response := testRequest(t, app, "POST", "/zones/"+zoneIDs[testUserKey]+"/tsig/zone-key./rotate", testUserKey, nil)
+	if status != 200 {
+		t.Fatalf("rotating the zone key: status %d: %s", status, response.Message)
+	}
+	var rotated database.TSIGKey
+	if err := json.Unmarshal(response.Data, &rotated); err != nil {
+		t.Fatal(err)
+	}
+	after, err := control.TSIGKey(db, "zone-key.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Secret == before.Secret || after.Secret != rotated.Secret {
+		t.Errorf("stored secret after rotation = %s, want the new secret %s", after.Secret, rotated.Secret)
+	}
+
+	if status, response := testRequest(t, app, "DELETE", "/tsig/account-key.", testUserKey, nil); status != 200 {
+		t.Fatalf("revoking the account key: status %d: %s", status, response.Message)
+	}
+	if status, _ := testRequest(t, app, "POST", "/tsig/account-key./rotate", testUserKey, nil); status != 404 {
+		t.Errorf("rotating a revoked key: status %d, want 404", status)
+	}
+	if _, err := control.TSIGKey(db, "account-key."); err != control.ErrKeyRevoked {
+		t.Errorf("revoked key lookup: %v, want %v", err, control.ErrKeyRevoked)
+	}
+}
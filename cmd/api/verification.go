@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/natesales/cdn-tree/internal/control"
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// verificationStatus stores the verification state of a zone as returned by the API
+type verificationStatus struct {
+	Zone        string              `json:"zone"`
+	Status      database.ZoneStatus `json:"status"`
+	Challenge   *control.Challenge  `json:"challenge,omitempty"` // only set while the zone is pending
+	Nameservers []string            `json:"nameservers"`
+	Created     int64               `json:"created,omitempty"`
+	Verified    int64               `json:"verified,omitempty"`
+	VerifiedBy  string              `json:"verified_by,omitempty"`
+}
+
+// zoneVerification builds the verification state of a zone
+func zoneVerification(zone database.Zone) verificationStatus {
+	status := verificationStatus{
+		Zone:        zone.Zone,
+		Status:      database.ZoneActive,
+		Nameservers: control.ZoneNameservers(zone),
+		Created:     zone.Created,
+		Verified:    zone.Verified,
+		VerifiedBy:  zone.VerifiedBy,
+	}
+	if !zone.Active() {
+		challenge := control.ZoneChallenge(zone)
+		status.Status = database.ZonePending
+		status.Challenge = &challenge
+	}
+	return status
+}
+
+// verifyZones periodically verifies pending zones and deletes the expired ones
+func verifyZones(ctx context.Context, interval time.Duration, expiry time.Duration) {
+	if interval <= 0 {
+		log.Debugln("zone verifier disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		zones, err := db.ListZones()
+		if err != nil {
+			log.Warnf("listing zones to verify: %v", err)
+		}
+
+		for _, zone := range zones {
+			if zone.Active() {
+				continue
+			}
+
+			if expiry > 0 && time.Since(time.Unix(0, zone.Created)) > expiry {
+				if err := db.DeleteZone(zone.Zone); err != nil {
+					log.Warnf("deleting expired zone %s: %v", zone.Zone, err)
+				} else {
+					log.Infof("deleted zone %s, it wasn't verified within %s", zone.Zone, expiry)
+				}
+				continue
+			}
+
+			method, err := control.VerifyZone(db, zone)
+			if err != nil {
+				log.Debugf("verifying %s: %v", zone.Zone, err)
+			} else if method != "" {
+				log.Infof("verified zone %s by %s", zone.Zone, method)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleGetVerification handles a HTTP GET request to retrieve the verification state of a zone
+func handleGetVerification(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "retrieved zone verification", zoneVerification(zone))
+}
+
+// handleVerifyZone handles a HTTP POST request to verify a pending zone without waiting for the background verifier
+func handleVerifyZone(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	if zone.Active() {
+		return sendResponse(ctx, 200, "zone is already verified", zoneVerification(zone))
+	}
+
+	method, err := control.VerifyZone(db, zone)
+	if method == "" {
+		message := "neither the TXT challenge nor the delegation to the zone nameservers was found"
+		if err != nil {
+			message += ": " + err.Error()
+		}
+		return sendResponse(ctx, 409, errors.New(message), zoneVerification(zone))
+	} else if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	zone, err = db.GetZoneByName(zone.Zone)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "zone", zone.Zone, map[string]interface{}{"status": database.ZonePending}, map[string]interface{}{"status": database.ZoneActive, "verified_by": method})
+
+	return sendResponse(ctx, 200, "verified zone", zoneVerification(zone))
+}
+
+// handleActivateZone handles a HTTP POST request from an administrator to activate a zone without proof of control
+func handleActivateZone(ctx *fiber.Ctx) error {
+	err, _ := requireAdminAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := db.GetZone(ctx.Params("zone"))
+	if err == database.ErrNotFound {
+		return sendResponse(ctx, 404, errors.New("zone not found"), nil)
+	} else if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	if zone.Active() {
+		return sendResponse(ctx, 200, "zone is already verified", zoneVerification(zone))
+	}
+
+	if err := control.ActivateZone(db, zone.Zone, control.VerifiedAdmin); err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	auditChange(ctx, "zone", zone.Zone, map[string]interface{}{"status": database.ZonePending}, map[string]interface{}{"status": database.ZoneActive, "verified_by": control.VerifiedAdmin})
+
+	zone, err = db.GetZoneByName(zone.Zone)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+	return sendResponse(ctx, 200, "activated zone", zoneVerification(zone))
+}
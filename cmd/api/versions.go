@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/natesales/cdn-tree/internal/control"
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// rollbackRequest stores the serial a zone is rolled back to
+type rollbackRequest struct {
+	Serial uint32 `json:"serial" validate:"required"`
+}
+
+// parseSerial parses a zone serial from a route or query parameter value
+func parseSerial(value string) (uint32, error) {
+	serial, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, errors.New("invalid serial " + value)
+	}
+	return uint32(serial), nil
+}
+
+// handleListVersions handles a HTTP GET request to list all versions of a zone
+func handleListVersions(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	versions, err := db.ListZoneVersions(zone.Zone)
+	if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "retrieved zone versions", versions)
+}
+
+// handleGetVersion handles a HTTP GET request to retrieve a single version of a zone with its records
+func handleGetVersion(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	serial, err := parseSerial(ctx.Params("serial"))
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	version, err := db.GetZoneVersion(zone.Zone, serial)
+	if err == database.ErrNotFound {
+		return sendResponse(ctx, 404, errors.New("zone version not found"), nil)
+	} else if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	return sendResponse(ctx, 200, "retrieved zone version", version)
+}
+
+// handleDiffVersions handles a HTTP GET request to compare the records of two versions of a zone
+func handleDiffVersions(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requireZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	// Look up both versions, defaulting to the current serial
+	var versions [2]database.ZoneVersion
+	for i, param := range []string{"from", "to"} {
+		serial, err := parseSerial(ctx.Query(param, strconv.FormatUint(uint64(zone.Serial), 10)))
+		if err != nil {
+			return sendResponse(ctx, 400, err, nil)
+		}
+
+		versions[i], err = db.GetZoneVersion(zone.Zone, serial)
+		if err == database.ErrNotFound {
+			return sendResponse(ctx, 404, errors.New("zone version "+strconv.FormatUint(uint64(serial), 10)+" not found"), nil)
+		} else if err != nil {
+			return sendResponse(ctx, 500, err, nil)
+		}
+	}
+
+	return sendResponse(ctx, 200, "compared zone versions", control.DiffVersions(versions[0], versions[1]))
+}
+
+// handleRollback handles a HTTP POST request to restore the records of a zone from an earlier version
+func handleRollback(ctx *fiber.Ctx) error {
+	err, user := requireGenericAuth(ctx)
+	if err != nil {
+		return sendResponse(ctx, 403, errors.New("unauthorized"), nil)
+	}
+
+	zone, err := requirePrimaryZone(ctx, user)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	request := new(rollbackRequest)
+
+	// Parse body into struct
+	if err := ctx.BodyParser(request); err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	// Validate struct
+	err = validate.Struct(request)
+	if err != nil {
+		return sendResponse(ctx, 400, err, nil)
+	}
+
+	version, err := control.Rollback(db, zone.Zone, request.Serial, user.ID)
+	if err == database.ErrNotFound {
+		return sendResponse(ctx, 404, errors.New("zone version not found"), nil)
+	} else if err != nil {
+		return sendResponse(ctx, 500, err, nil)
+	}
+
+	// Record the change with the zone as stored
+	if updated, err := db.GetZone(zone.ID); err == nil {
+		auditChange(ctx, "rollback", zone.Zone, zoneSnapshot(zone), zoneSnapshot(updated))
+	}
+
+	return sendResponse(ctx, 200, "rolled back zone", version)
+}
+
+// publishZones periodically queues a push of the zones whose current serial hasn't been published
+func publishZones(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := control.QueueUnpublished(db); err != nil {
+			log.Warnf("queueing unpublished zones: %v", err)
+		}
+	}
+}
@@ -1,23 +1,56 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
+	"time"
+
+	"github.com/natesales/cdn-tree/internal/alias"
+	"github.com/natesales/cdn-tree/internal/analytics"
+	"github.com/natesales/cdn-tree/internal/crypto"
+	"github.com/natesales/cdn-tree/internal/dnstap"
+	"github.com/natesales/cdn-tree/internal/edge"
+	"github.com/natesales/cdn-tree/internal/geo"
+	"github.com/natesales/cdn-tree/internal/tsig"
 )
 
 var release = "dev" // Set by build process
 
 type Config struct {
-	ID string `json:"id"`
+	ID         string `json:"id"`
+	Controller string `json:"controller"` // controller API base URL
+	Token      string `json:"token"`      // credential returned by the controller when the node was provisioned
 }
 
 var (
 	config            Config
+	syncer            *edge.Syncer
 	listenAddr        = flag.String("l", ":8001", "Listen address:port to bind to")
 	configFile        = flag.String("c", "/opt/packetframe-eca.json", "JSON config file")
+	syncInterval      = flag.Duration("i", 30*time.Second, "Interval between controller reconciliation passes")
+	dnsAddr           = flag.String("d", ":53", "DNS listen address:port to bind to")
+	dotAddr           = flag.String("dot", ":853", "DNS over TLS listen address:port to bind to, disabled if empty")
+	dohAddr           = flag.String("doh", ":443", "DNS over HTTPS listen address:port to bind to, disabled if empty")
+	geoIPFile         = flag.String("g", "", "GeoIP database CSV file (optional)")
+	aliasResolver     = flag.String("r", "1.1.1.1:53", "Recursive resolver address:port used to resolve ALIAS targets")
+	dnstapSink        = flag.String("t", "", "dnstap sink for query logging: unix:/path, tcp:host:port or file:/path (optional)")
+	reportInterval    = flag.Duration("a", time.Minute, "Interval between query count reports to the controller")
+	rrlResponses      = flag.Float64("rrl-responses", 20, "UDP responses per second to a client prefix, 0 to disable the limit")
+	rrlNXDomains      = flag.Float64("rrl-nxdomains", 10, "UDP NXDOMAIN responses per second to a client prefix, 0 to disable the limit")
+	rrlErrors         = flag.Float64("rrl-errors", 10, "UDP error responses per second to a client prefix, 0 to disable the limit")
+	rrlSlip           = flag.Int("rrl-slip", 2, "Truncate every Nth rate limited response instead of dropping it, 0 to drop all")
+	rrlIPv4Prefix     = flag.Int("rrl-ipv4-prefix", 24, "IPv4 prefix length clients are rate limited by")
+	rrlIPv6Prefix     = flag.Int("rrl-ipv6-prefix", 56, "IPv6 prefix length clients are rate limited by")
+	rrlExempt         = flag.String("rrl-exempt", "", "Comma separated networks that are never rate limited (optional)")
+	cookieSecret      = flag.String("cookie-secret", "", "Hex encoded 16 byte DNS cookie secret shared by the edge nodes, random if empty")
+	tap               *dnstap.Logger
+	server            *edge.Server
 	manifestDirectory = "/opt/packetframe-eca/zones/"
 )
 
@@ -37,17 +70,11 @@ func loadConfig() Config {
 	return config
 }
 
-//// localManifest returns a manifest of the locally installed zone files
-//func localManifest() {
-//	zoneFiles, _ := ioutil.ReadDir(manifestDirectory)
-//	for _, item := range zoneFiles {
-//		fmt.Println(item.Name())
-//	}
-//}
-
 // handleMeta handles a HTTP GET request for node metadata
 func handleMeta(w http.ResponseWriter, r *http.Request) {
-	jsonData, err := json.Marshal(config)
+	meta := config
+	meta.Token = "" // the credential never leaves the node
+	jsonData, err := json.Marshal(meta)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -57,10 +84,9 @@ func handleMeta(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonData)
 }
 
-// handleUpdate handles a HTTP POST request to submit a controller zone manifest
-func handleUpdate(w http.ResponseWriter, r *http.Request) {
-	var body interface{}
-	jsonData, err := json.Marshal(body)
+// handleSync handles a HTTP GET request for the reconciliation loop status
+func handleSync(w http.ResponseWriter, r *http.Request) {
+	jsonData, err := json.Marshal(syncer.Status())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -70,6 +96,77 @@ func handleUpdate(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonData)
 }
 
+// handleDnstap handles a HTTP GET request for the query logging counters
+func handleDnstap(w http.ResponseWriter, r *http.Request) {
+	if tap == nil {
+		http.Error(w, "query logging is disabled", http.StatusNotFound)
+		return
+	}
+
+	jsonData, err := json.Marshal(tap.Stats())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+// handleRRL handles a HTTP GET request for the response rate limiting and DNS cookie counters
+func handleRRL(w http.ResponseWriter, r *http.Request) {
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"rrl":     server.RRL.Stats(),
+		"cookies": server.Cookies.Stats(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+// handleUpdate handles a HTTP POST request from the controller to sync now, or to wait for a zone serial
+func handleUpdate(w http.ResponseWriter, r *http.Request) {
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only the controller knows the hash of the node token to sign requests with
+	if !crypto.NodeRequestValid(config.Token, r.Header.Get("Authorization"), r.URL.Path, payload, time.Now()) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		Zone   string `json:"zone"`
+		Serial uint32 `json:"serial"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if body.Zone == "" {
+		syncer.Trigger()
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+	if err := syncer.WaitFor(ctx, body.Zone, body.Serial); err != nil {
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
 func main() {
 	log.Printf("Initializing Packetframe ECA (%s)\n", release)
 
@@ -81,8 +178,125 @@ func main() {
 
 	log.Printf("Using node ID %s\n", config.ID)
 
+	// Seed backoff jitter
+	rand.Seed(time.Now().UnixNano())
+
+	// Open the local zone store
+	store, err := edge.NewStore(manifestDirectory)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Start the controller reconciliation loop
+	syncer = edge.NewSyncer(config.Controller, config.ID, store)
+	syncer.Token = config.Token
+	syncer.Interval = *syncInterval
+	go syncer.Run(context.Background())
+
+	// Run the health checks of the local zones
+	checker := edge.NewChecker(config.Controller, config.ID, store)
+	checker.Token = config.Token
+	go checker.Run(context.Background())
+
+	// Load the GeoIP database used to locate clients for geo record sets
+	var geoIP *geo.Database
+	if *geoIPFile != "" {
+		geoIP, err = geo.Open(*geoIPFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded %d GeoIP networks\n", geoIP.Len())
+	}
+
+	// Start the authoritative DNS server
+	server = edge.NewServer(store, geoIP, alias.NewResolver(*aliasResolver))
+
+	// Rate limit UDP responses, letting clients with a valid server cookie through
+	exempt, err := edge.ParseNetworks(*rrlExempt)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RRL, err = edge.NewRRL(edge.RRLConfig{
+		ResponsesPerSecond: *rrlResponses,
+		NXDomainsPerSecond: *rrlNXDomains,
+		ErrorsPerSecond:    *rrlErrors,
+		Slip:               *rrlSlip,
+		IPv4PrefixLength:   *rrlIPv4Prefix,
+		IPv6PrefixLength:   *rrlIPv6Prefix,
+		Exempt:             exempt,
+		MaxPrefixes:        100000,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.Cookies, err = edge.NewCookies(*cookieSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Count queries and report them to the controller
+	server.Counter = analytics.NewCounter(100000)
+	reporter := edge.NewReporter(config.Controller, config.ID, server.Counter)
+	reporter.Token = config.Token
+	reporter.Interval = *reportInterval
+	go reporter.Run(context.Background())
+
+	// Log queries of the zones that opted in to query logging
+	if *dnstapSink != "" {
+		tap, err = dnstap.NewLogger(*dnstapSink, 10000)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tap.Identity = config.ID
+		tap.Version = release
+		server.Tap = tap
+		go tap.Run(context.Background())
+	}
+
+	// Serve DNS over TLS with the certificates synced from the controller
+	tlsConfig := &tls.Config{GetCertificate: store.GetCertificate, MinVersion: tls.VersionTLS12}
+	listener := tsig.NewListener(*dnsAddr, server)
+	listener.TLSAddr = *dotAddr
+	listener.TLSConfig = tlsConfig.Clone()
+	listener.TLSConfig.NextProtos = []string{"dot"}
+	if err := listener.Update(store.TSIGSecrets()); err != nil {
+		log.Fatal(err)
+	}
+
+	// Restart the DNS server when the synced TSIG keys change
+	go func() {
+		for range time.Tick(5 * time.Second) {
+			if err := listener.Update(store.TSIGSecrets()); err != nil {
+				log.Printf("updating TSIG keys: %v\n", err)
+			}
+		}
+	}()
+
+	// Serve DNS over HTTPS with the same certificates
+	if *dohAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle(edge.DoHPath, edge.NewDoH(server))
+		dohServer := &http.Server{
+			Addr:         *dohAddr,
+			Handler:      mux,
+			TLSConfig:    tlsConfig.Clone(), // HTTP/2 support adds its protocols to the config
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+		go func() {
+			log.Printf("Starting DNS over HTTPS server on %s\n", *dohAddr)
+			if err := dohServer.ListenAndServeTLS("", ""); err != nil {
+				log.Printf("DNS over HTTPS server: %v\n", err)
+			}
+		}()
+	}
+
 	// HTTP handlers
 	http.HandleFunc("/meta", handleMeta)
+	http.HandleFunc("/sync", handleSync)
+	http.HandleFunc("/update", handleUpdate)
+	http.HandleFunc("/dnstap", handleDnstap)
+	http.HandleFunc("/rrl", handleRRL)
 
 	log.Println("Starting HTTP server")
 	// Start the HTTP server
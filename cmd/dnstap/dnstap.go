@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/natesales/cdn-tree/internal/dnstap"
+)
+
+var (
+	readFile   = flag.String("r", "", "Read a dnstap file")
+	unixSocket = flag.String("u", "", "Listen for dnstap streams on a unix socket")
+	listenAddr = flag.String("l", "", "Listen for dnstap streams on a TCP address:port")
+)
+
+// format formats a dnstap message as a single line
+func format(message dnstap.Message) string {
+	query := new(dns.Msg)
+	response := new(dns.Msg)
+	if err := query.Unpack(message.QueryMessage); err != nil || len(query.Question) != 1 {
+		return "unparseable query from " + message.Identity
+	}
+	if err := response.Unpack(message.ResponseMessage); err != nil {
+		return "unparseable response from " + message.Identity
+	}
+
+	return fmt.Sprintf("%s %s %s %s:%d %s %s %s %d answers %s",
+		message.QueryTime.Format(time.RFC3339Nano),
+		message.Identity,
+		message.Protocol,
+		message.QueryAddress,
+		message.QueryPort,
+		query.Question[0].Name,
+		dns.Type(query.Question[0].Qtype),
+		dns.RcodeToString[response.Rcode],
+		len(response.Answer),
+		message.ResponseTime.Sub(message.QueryTime),
+	)
+}
+
+// read prints the messages of a stream until it ends
+func read(rw io.ReadWriter, bidirectional bool) error {
+	reader, err := dnstap.NewReader(rw, bidirectional)
+	if err != nil {
+		return err
+	}
+	for {
+		frame, err := reader.Read()
+		if err == io.EOF || err == dnstap.ErrStopped {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		message, err := dnstap.Unmarshal(frame)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		fmt.Println(format(message))
+	}
+}
+
+// serve accepts streams on a listener
+func serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			defer conn.Close()
+			if err := read(conn, true); err != nil {
+				log.Printf("%s: %v\n", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	switch {
+	case *readFile != "":
+		file, err := os.Open(*readFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		if err := read(file, false); err != nil {
+			log.Fatal(err)
+		}
+	case *unixSocket != "":
+		_ = os.Remove(*unixSocket)
+		listener, err := net.Listen("unix", *unixSocket)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serve(listener)
+	case *listenAddr != "":
+		listener, err := net.Listen("tcp", *listenAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serve(listener)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
@@ -24,4 +24,5 @@ require (
 	go.uber.org/zap v1.16.0 // indirect
 	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 	google.golang.org/grpc v1.35.0 // indirect
+	google.golang.org/protobuf v1.25.0
 )
@@ -0,0 +1,90 @@
+// Package alias provides the ALIAS record type, a CNAME that is answered with its target's addresses
+package alias
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// TypeALIAS is the RR type code of ALIAS records, from the private use range (RFC 6895)
+const TypeALIAS uint16 = 65401
+
+// Rdata stores the target of an ALIAS record
+type Rdata struct {
+	Target string
+}
+
+// String returns the text presentation of the target
+func (r *Rdata) String() string {
+	return r.Target
+}
+
+// Parse parses the target from a zone file record
+func (r *Rdata) Parse(fields []string) error {
+	if len(fields) != 1 {
+		return errors.New("ALIAS records have a single target")
+	}
+	if _, ok := dns.IsDomainName(fields[0]); !ok {
+		return errors.New("invalid ALIAS target " + fields[0])
+	}
+	r.Target = strings.ToLower(dns.Fqdn(fields[0]))
+	return nil
+}
+
+// Pack writes the target in wire format
+func (r *Rdata) Pack(buf []byte) (int, error) {
+	return dns.PackDomainName(r.Target, buf, 0, nil, false)
+}
+
+// Unpack reads the target from wire format
+func (r *Rdata) Unpack(buf []byte) (int, error) {
+	target, off, err := dns.UnpackDomainName(buf, 0)
+	if err != nil {
+		return 0, err
+	}
+	r.Target = target
+	return off, nil
+}
+
+// Copy copies the target to another Rdata
+func (r *Rdata) Copy(dest dns.PrivateRdata) error {
+	d, ok := dest.(*Rdata)
+	if !ok {
+		return dns.ErrRdata
+	}
+	d.Target = r.Target
+	return nil
+}
+
+// Len returns the length of the target in wire format
+func (r *Rdata) Len() int {
+	if r.Target == "." {
+		return 1
+	}
+	return len(r.Target) + 1
+}
+
+// Register the ALIAS type so ALIAS records parse everywhere this package is imported
+func init() {
+	dns.PrivateHandle("ALIAS", TypeALIAS, func() dns.PrivateRdata { return new(Rdata) })
+}
+
+// Target gets the target of an ALIAS record
+func Target(rr dns.RR) (string, bool) {
+	private, ok := rr.(*dns.PrivateRR)
+	if !ok || rr.Header().Rrtype != TypeALIAS {
+		return "", false
+	}
+	data, ok := private.Data.(*Rdata)
+	if !ok {
+		return "", false
+	}
+	return data.Target, true
+}
+
+// Conflicts reports whether a record type can't share its name with an ALIAS record
+func Conflicts(rrtype uint16) bool {
+	return rrtype == TypeALIAS || rrtype == dns.TypeA || rrtype == dns.TypeAAAA || rrtype == dns.TypeCNAME
+}
@@ -0,0 +1,178 @@
+package alias
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Resolver defaults
+const (
+	DefaultTimeout  = 2 * time.Second
+	DefaultMaxStale = time.Hour
+	negativeTTL     = 60    // seconds to cache answers without addresses when the upstream gives no SOA
+	staleTTL        = 30    // TTL of stale answers (RFC 8767 section 4)
+	maxChain        = 8     // largest number of CNAMEs followed in an upstream answer
+	maxEntries      = 10000 // cache size at which expired entries are pruned
+)
+
+// cacheKey identifies a cached upstream answer
+type cacheKey struct {
+	target string
+	qtype  uint16
+}
+
+// entry stores a cached upstream answer
+type entry struct {
+	addresses []net.IP
+	expires   time.Time
+}
+
+// Resolver looks up the addresses of ALIAS targets through a recursive resolver and caches them for their upstream TTL
+type Resolver struct {
+	Upstream string        // recursive resolver address:port
+	MaxStale time.Duration // how long expired answers are still used while the upstream fails
+
+	client *dns.Client
+	lock   sync.Mutex
+	cache  map[cacheKey]entry
+}
+
+// NewResolver constructs a new Resolver
+func NewResolver(upstream string) *Resolver {
+	return &Resolver{
+		Upstream: upstream,
+		MaxStale: DefaultMaxStale,
+		client:   &dns.Client{Timeout: DefaultTimeout},
+		cache:    map[cacheKey]entry{},
+	}
+}
+
+// Resolve gets the A or AAAA addresses of a target and the number of seconds they may still be cached
+func (r *Resolver) Resolve(target string, qtype uint16) ([]net.IP, uint32, error) {
+	key := cacheKey{strings.ToLower(dns.Fqdn(target)), qtype}
+	now := time.Now()
+
+	r.lock.Lock()
+	cached, found := r.cache[key]
+	r.lock.Unlock()
+	if found && now.Before(cached.expires) {
+		return cached.addresses, uint32(cached.expires.Sub(now) / time.Second), nil
+	}
+
+	addresses, ttl, err := r.lookup(key.target, qtype)
+	if err != nil {
+		// Serve stale answers while the upstream is unreachable
+		if found && now.Before(cached.expires.Add(r.MaxStale)) {
+			return cached.addresses, staleTTL, nil
+		}
+		return nil, 0, err
+	}
+
+	r.lock.Lock()
+	if len(r.cache) >= maxEntries {
+		r.prune(now)
+	}
+	r.cache[key] = entry{addresses: addresses, expires: now.Add(time.Duration(ttl) * time.Second)}
+	r.lock.Unlock()
+
+	return addresses, ttl, nil
+}
+
+// prune removes the entries that are too old to be served stale. The lock must be held.
+func (r *Resolver) prune(now time.Time) {
+	for key, e := range r.cache {
+		if now.After(e.expires.Add(r.MaxStale)) {
+			delete(r.cache, key)
+		}
+	}
+	if len(r.cache) >= maxEntries {
+		r.cache = map[cacheKey]entry{}
+	}
+}
+
+// exchange sends a query to the upstream resolver, retrying over TCP if the answer is truncated
+func (r *Resolver) exchange(m *dns.Msg) (*dns.Msg, error) {
+	response, _, err := r.client.Exchange(m, r.Upstream)
+	if err == nil && response.Truncated {
+		tcp := &dns.Client{Net: "tcp", Timeout: r.client.Timeout}
+		response, _, err = tcp.Exchange(m, r.Upstream)
+	}
+	return response, err
+}
+
+// lookup queries the upstream resolver and follows the CNAME chain in its answer
+func (r *Resolver) lookup(target string, qtype uint16) ([]net.IP, uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(target, qtype)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+
+	response, err := r.exchange(m)
+	if err != nil {
+		return nil, 0, err
+	}
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return nil, 0, fmt.Errorf("upstream returned %s for %s %s", dns.RcodeToString[response.Rcode], target, dns.TypeToString[qtype])
+	}
+
+	ttl := uint32(math.MaxUint32)
+	lower := func(t uint32) {
+		if t < ttl {
+			ttl = t
+		}
+	}
+
+	name := target
+	for i := 0; i <= maxChain; i++ {
+		var addresses []net.IP
+		next := ""
+		for _, rr := range response.Answer {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			switch rr := rr.(type) {
+			case *dns.A:
+				if qtype == dns.TypeA {
+					addresses = append(addresses, rr.A)
+					lower(rr.Hdr.Ttl)
+				}
+			case *dns.AAAA:
+				if qtype == dns.TypeAAAA {
+					addresses = append(addresses, rr.AAAA)
+					lower(rr.Hdr.Ttl)
+				}
+			case *dns.CNAME:
+				next = rr.Target
+				lower(rr.Hdr.Ttl)
+			}
+		}
+
+		if len(addresses) > 0 {
+			return addresses, ttl, nil
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+
+	// Cache answers without addresses for the negative TTL of the upstream zone (RFC 2308 section 5)
+	negative := uint32(negativeTTL)
+	for _, rr := range response.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			negative = soa.Hdr.Ttl
+			if soa.Minttl < negative {
+				negative = soa.Minttl
+			}
+		}
+	}
+	if negative < ttl {
+		ttl = negative
+	}
+	return nil, ttl, nil
+}
@@ -0,0 +1,143 @@
+package alias
+
+import (
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testUpstream runs a recursive resolver stand-in on a local port and returns its address. It answers with SERVFAIL while failing is set.
+func testUpstream(t *testing.T, failing *int32) string {
+	records := map[string][]string{}
+	for _, rr := range []string{
+		"lb.example.net. 30 IN A 198.51.100.1",
+		"lb.example.net. 45 IN A 198.51.100.2",
+		"lb.example.net. 3600 IN AAAA 2001:db8::1",
+		"www.example.net. 10 IN CNAME lb.example.net.",
+		"short.example.net. 0 IN A 198.51.100.3",
+	} {
+		parsed, err := dns.NewRR(rr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records[parsed.Header().Name] = append(records[parsed.Header().Name], rr)
+	}
+	soa, err := dns.NewRR("example.net. 900 IN SOA ns1.example.net. hostmaster.example.net. 1 7200 3600 1209600 120")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+
+		switch {
+		case atomic.LoadInt32(failing) != 0, q.Name == "broken.example.net.":
+			m.Rcode = dns.RcodeServerFailure
+		case len(records[q.Name]) == 0:
+			m.Rcode = dns.RcodeNameError
+			m.Ns = []dns.RR{soa}
+		default:
+			// Answer like a resolver, with the CNAME chain and the records of its target
+			name := q.Name
+			for name != "" {
+				next := ""
+				for _, rr := range records[name] {
+					parsed, _ := dns.NewRR(rr)
+					if cname, ok := parsed.(*dns.CNAME); ok {
+						next = cname.Target
+						m.Answer = append(m.Answer, parsed)
+					} else if parsed.Header().Rrtype == q.Qtype {
+						m.Answer = append(m.Answer, parsed)
+					}
+				}
+				name = next
+			}
+			if len(m.Answer) == 0 {
+				m.Ns = []dns.RR{soa}
+			}
+		}
+		w.WriteMsg(m)
+	})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	return conn.LocalAddr().String()
+}
+
+// TestResolve checks the addresses and TTLs of upstream answers, and how upstream errors are handled
+func TestResolve(t *testing.T) {
+	var failing int32
+	resolver := NewResolver(testUpstream(t, &failing))
+
+	tests := []struct {
+		name      string
+		target    string
+		qtype     uint16
+		addresses []string
+		ttl       uint32
+		fails     bool
+	}{
+		{"A", "lb.example.net.", dns.TypeA, []string{"198.51.100.1", "198.51.100.2"}, 30, false},
+		{"AAAA", "LB.example.net", dns.TypeAAAA, []string{"2001:db8::1"}, 3600, false},
+		{"CNAME chain", "www.example.net.", dns.TypeA, []string{"198.51.100.1", "198.51.100.2"}, 10, false},
+		{"no addresses of the type", "short.example.net.", dns.TypeAAAA, nil, 120, false},
+		{"NXDOMAIN", "missing.example.net.", dns.TypeA, nil, 120, false},
+		{"SERVFAIL", "broken.example.net.", dns.TypeA, nil, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addresses, ttl, err := resolver.Resolve(test.target, test.qtype)
+			if test.fails {
+				if err == nil {
+					t.Errorf("resolved to %v, want an error", addresses)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, address := range addresses {
+				got = append(got, address.String())
+			}
+			if !reflect.DeepEqual(got, test.addresses) {
+				t.Errorf("addresses = %v, want %v", got, test.addresses)
+			}
+			if ttl != test.ttl {
+				t.Errorf("TTL = %d, want %d", ttl, test.ttl)
+			}
+		})
+	}
+
+	// Cached answers don't reach the upstream, and expired ones are served stale while it fails
+	atomic.StoreInt32(&failing, 1)
+	if addresses, ttl, err := resolver.Resolve("lb.example.net.", dns.TypeA); err != nil || len(addresses) != 2 || ttl > 30 || ttl < 29 {
+		t.Errorf("cached answer = %v, %d, %v, want 2 addresses with the remaining TTL", addresses, ttl, err)
+	}
+	atomic.StoreInt32(&failing, 0)
+	if _, _, err := resolver.Resolve("short.example.net.", dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&failing, 1)
+	if addresses, ttl, err := resolver.Resolve("short.example.net.", dns.TypeA); err != nil || len(addresses) != 1 || ttl != staleTTL {
+		t.Errorf("stale answer = %v, %d, %v, want 1 address with the stale TTL", addresses, ttl, err)
+	}
+	resolver.MaxStale = 0
+	if addresses, _, err := resolver.Resolve("short.example.net.", dns.TypeA); err == nil {
+		t.Errorf("answer %v past the stale limit, want an error", addresses)
+	}
+}
@@ -0,0 +1,92 @@
+// Package analytics provides the query counters edge nodes report to the controller
+package analytics
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is the time resolution of the counters, in seconds
+const Bucket = 60
+
+// Count stores the number of queries of a zone with a type and rcode answered in a minute
+type Count struct {
+	Bucket  int64  `json:"bucket"` // unix seconds of the start of the minute
+	Zone    string `json:"zone"`
+	Type    string `json:"type"`
+	Rcode   string `json:"rcode"`
+	Queries uint64 `json:"queries"`
+}
+
+// key identifies the counter of a Count
+type key struct {
+	bucket int64
+	zone   string
+	qtype  string
+	rcode  string
+}
+
+// Counter counts queries by minute, zone, type and rcode between reports
+type Counter struct {
+	Limit int // largest number of distinct counters kept, queries that would need more are dropped
+
+	lock    sync.Mutex
+	counts  map[key]uint64
+	dropped uint64
+}
+
+// NewCounter constructs a new Counter
+func NewCounter(limit int) *Counter {
+	return &Counter{Limit: limit, counts: map[key]uint64{}}
+}
+
+// Add counts a query answered at a time
+func (c *Counter) Add(t time.Time, zone string, qtype string, rcode string) {
+	k := key{bucket: t.Unix() - t.Unix()%Bucket, zone: zone, qtype: qtype, rcode: rcode}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.counts[k]; !ok && len(c.counts) >= c.Limit {
+		c.dropped++
+		return
+	}
+	c.counts[k]++
+}
+
+// Flush returns all counts and resets the counters
+func (c *Counter) Flush() []Count {
+	c.lock.Lock()
+	counts := c.counts
+	c.counts = map[key]uint64{}
+	c.lock.Unlock()
+
+	flushed := make([]Count, 0, len(counts))
+	for k, queries := range counts {
+		flushed = append(flushed, Count{Bucket: k.bucket, Zone: k.zone, Type: k.qtype, Rcode: k.rcode, Queries: queries})
+	}
+	return flushed
+}
+
+// Restore adds flushed counts back, e.g. after they couldn't be reported
+func (c *Counter) Restore(counts []Count) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, count := range counts {
+		k := key{bucket: count.Bucket, zone: count.Zone, qtype: count.Type, rcode: count.Rcode}
+		if _, ok := c.counts[k]; !ok && len(c.counts) >= c.Limit {
+			c.dropped += count.Queries
+			continue
+		}
+		c.counts[k] += count.Queries
+	}
+}
+
+// Dropped gets the number of queries that weren't counted because the counter was full
+func (c *Counter) Dropped() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.dropped
+}
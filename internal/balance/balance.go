@@ -0,0 +1,182 @@
+// Package balance provides load-balanced record sets that split answers between their members by weight
+package balance
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// MaxWeight is the largest weight of a member
+const MaxWeight = 10000
+
+// Member is a single value of a load-balanced record set
+type Member struct {
+	Value  string `json:"value" bson:"value"`
+	Weight uint32 `json:"weight" bson:"weight"` // relative share of answers, 0 drains the member
+}
+
+// RecordSet is a record set that answers with its members in a weighted random order
+type RecordSet struct {
+	Name    string   `json:"name" bson:"name"`
+	Type    string   `json:"type" bson:"type"`
+	TTL     uint32   `json:"ttl" bson:"ttl"`
+	Members []Member `json:"members" bson:"members"`
+	Limit   int      `json:"limit,omitempty" bson:"limit,omitempty"` // largest number of members in an answer, 0 answers with all members
+}
+
+// rrType parses the record type of a set
+func (s RecordSet) rrType() (uint16, bool) {
+	t, ok := dns.StringToType[strings.ToUpper(s.Type)]
+	return t, ok
+}
+
+// Matches reports whether a set answers a query for qname and qtype. CNAME sets answer queries of every type.
+func (s RecordSet) Matches(qname string, qtype uint16) bool {
+	t, ok := s.rrType()
+	if !ok || !strings.EqualFold(dns.Fqdn(s.Name), qname) {
+		return false
+	}
+	return t == qtype || t == dns.TypeCNAME || qtype == dns.TypeANY
+}
+
+// Records builds the RRs of a list of values of the set
+func (s RecordSet) Records(values []string) ([]dns.RR, error) {
+	var records []dns.RR
+	for _, value := range values {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(s.Name), s.TTL, strings.ToUpper(s.Type), value))
+		if err != nil {
+			return nil, err
+		}
+		if rr == nil {
+			return nil, errors.New("empty value")
+		}
+		records = append(records, rr)
+	}
+	return records, nil
+}
+
+// Validate checks that a set has a known type, that all members parse and that at least one member gets answers
+func (s RecordSet) Validate() error {
+	t, ok := s.rrType()
+	if !ok {
+		return errors.New("unknown record type " + s.Type)
+	}
+	if t == dns.TypeSOA || t == dns.TypeNS {
+		return errors.New(s.Type + " records are managed by the platform")
+	}
+	if _, ok := dns.IsDomainName(s.Name); !ok {
+		return errors.New("invalid name " + s.Name)
+	}
+	if len(s.Members) == 0 {
+		return errors.New("at least one member is required")
+	}
+	if s.Limit < 0 {
+		return errors.New("limit can't be negative")
+	}
+	if t == dns.TypeCNAME && s.Limit != 1 {
+		return errors.New("CNAME record sets must have a limit of 1")
+	}
+
+	seen := map[string]bool{}
+	weighted := false
+	for _, member := range s.Members {
+		if seen[member.Value] {
+			return errors.New("duplicate member " + member.Value)
+		}
+		seen[member.Value] = true
+
+		if member.Weight > MaxWeight {
+			return fmt.Errorf("member %s: weight must be at most %d", member.Value, MaxWeight)
+		}
+		if member.Weight > 0 {
+			weighted = true
+		}
+		if _, err := s.Records([]string{member.Value}); err != nil {
+			return fmt.Errorf("member %s: %v", member.Value, err)
+		}
+	}
+	if !weighted {
+		return errors.New("at least one member needs a weight above 0")
+	}
+	return nil
+}
+
+// SetWeights returns a copy of a set with the weights of some members changed. Unknown members are an error.
+func (s RecordSet) SetWeights(weights map[string]uint32) (RecordSet, error) {
+	members := append([]Member(nil), s.Members...)
+	for value, weight := range weights {
+		found := false
+		for i := range members {
+			if members[i].Value == value {
+				members[i].Weight = weight
+				found = true
+			}
+		}
+		if !found {
+			return RecordSet{}, errors.New("unknown member " + value)
+		}
+	}
+	s.Members = members
+	return s, nil
+}
+
+// Select picks the values of an answer by weighted random draws without replacement
+func (s RecordSet) Select(rng *rand.Rand) []string {
+	type draw struct {
+		value string
+		key   float64
+	}
+
+	// Weighted sampling without replacement by sorting on exponential keys (Efraimidis and Spirakis)
+	var draws []draw
+	for _, member := range s.Members {
+		if member.Weight == 0 {
+			continue
+		}
+		draws = append(draws, draw{member.Value, rng.ExpFloat64() / float64(member.Weight)})
+	}
+	sort.Slice(draws, func(i, j int) bool { return draws[i].key < draws[j].key })
+
+	if s.Limit > 0 && len(draws) > s.Limit {
+		draws = draws[:s.Limit]
+	}
+	values := make([]string, len(draws))
+	for i, d := range draws {
+		values[i] = d.value
+	}
+	return values
+}
+
+// source is a splitmix64 random source, which is cheap enough to seed for every query
+type source uint64
+
+// Uint64 returns the next random number
+func (s *source) Uint64() uint64 {
+	*s += 0x9e3779b97f4a7c15
+	z := uint64(*s)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// Int63 returns the next random number without the sign bit
+func (s *source) Int63() int64 {
+	return int64(s.Uint64() & math.MaxInt64)
+}
+
+// Seed resets the source
+func (s *source) Seed(seed int64) {
+	*s = source(seed)
+}
+
+// NewRand constructs a random number generator for a single query
+func NewRand(seed uint64) *rand.Rand {
+	s := source(seed)
+	return rand.New(&s)
+}
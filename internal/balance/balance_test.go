@@ -0,0 +1,84 @@
+package balance
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// TestSelectDistribution checks that members come first in proportion to their weight, and that drained members are never answered
+func TestSelectDistribution(t *testing.T) {
+	set := RecordSet{
+		Name: "www.example.com.",
+		Type: "A",
+		TTL:  60,
+		Members: []Member{
+			{Value: "192.0.2.1", Weight: 1},
+			{Value: "192.0.2.2", Weight: 2},
+			{Value: "192.0.2.3", Weight: 7},
+			{Value: "192.0.2.4", Weight: 0},
+			{Value: "192.0.2.5", Weight: 5},
+		},
+	}
+
+	// Take a member that is down out of rotation
+	set, err := set.SetWeights(map[string]uint32{"192.0.2.5": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"192.0.2.1": 0.1, "192.0.2.2": 0.2, "192.0.2.3": 0.7}
+
+	for _, limit := range []int{0, 1, 2} {
+		set.Limit = limit
+
+		const queries = 100000
+		first := map[string]int{}
+		for seed := uint64(0); seed < queries; seed++ {
+			values := set.Select(NewRand(seed))
+
+			answered := 3
+			if limit > 0 {
+				answered = limit
+			}
+			if len(values) != answered {
+				t.Fatalf("limit %d: answer %v, want %d values", limit, values, answered)
+			}
+			seen := map[string]bool{}
+			for _, value := range values {
+				if _, ok := want[value]; !ok {
+					t.Fatalf("limit %d: answer %v has drained member %s", limit, values, value)
+				}
+				if seen[value] {
+					t.Fatalf("limit %d: answer %v repeats %s", limit, values, value)
+				}
+				seen[value] = true
+			}
+			first[values[0]]++
+		}
+
+		for value, share := range want {
+			if got := float64(first[value]) / queries; math.Abs(got-share) > 0.01 {
+				t.Errorf("limit %d: %s is first in %.3f of answers, want %.3f", limit, value, got, share)
+			}
+		}
+	}
+}
+
+// TestSelectSeed checks that the same seed gives the same answer, so retries of a query are answered alike
+func TestSelectSeed(t *testing.T) {
+	set := RecordSet{Members: []Member{
+		{Value: "192.0.2.1", Weight: 1},
+		{Value: "192.0.2.2", Weight: 1},
+		{Value: "192.0.2.3", Weight: 1},
+	}}
+	for seed := uint64(0); seed < 100; seed++ {
+		if a, b := set.Select(NewRand(seed)), set.Select(NewRand(seed)); !reflect.DeepEqual(a, b) {
+			t.Fatalf("seed %d: answers %v and %v differ", seed, a, b)
+		}
+	}
+
+	set.Members = []Member{{Value: "192.0.2.1"}, {Value: "192.0.2.2"}}
+	if values := set.Select(NewRand(1)); len(values) != 0 {
+		t.Errorf("answer %v with all members drained, want none", values)
+	}
+}
@@ -0,0 +1,325 @@
+// Package config provides the controller configuration, loaded from a JSON file and overridden by environment variables
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/natesales/cdn-tree/internal/crypto"
+	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/soa"
+	"github.com/natesales/cdn-tree/internal/util"
+)
+
+// Config stores the controller configuration
+type Config struct {
+	Development  bool               `json:"development"` // relaxed database requirements and verbose logging
+	Database     database.Config    `json:"database"`
+	Audit        AuditConfig        `json:"audit"`
+	DNS          DNSConfig          `json:"dns"`
+	Verification VerificationConfig `json:"verification"`
+	Health       HealthConfig       `json:"health"`
+	Transfer     TransferConfig     `json:"transfer"`
+	Secrets      SecretsConfig      `json:"secrets"`
+	QueryLog     QueryLogConfig     `json:"querylog"`
+	Analytics    AnalyticsConfig    `json:"analytics"`
+	ACME         ACMEConfig         `json:"acme"`
+}
+
+// DNSConfig stores the platform zone defaults
+type DNSConfig struct {
+	SerialScheme soa.Scheme   `json:"serial_scheme"` // serial scheme of new zones
+	SOA          soa.Settings `json:"soa"`           // SOA fields of zones that don't override them
+	Nameservers  []string     `json:"nameservers"`   // platform NS set of every zone
+	Addresses    []string     `json:"addresses"`     // anycast addresses of the nameservers, required for vanity nameservers
+	Resolver     string       `json:"resolver"`      // recursive resolver used for delegation checks and zone verification
+}
+
+// VerificationConfig stores the settings of the background verifier of pending zones
+type VerificationConfig struct {
+	Interval util.Duration `json:"interval"` // time between verification passes
+	Expiry   util.Duration `json:"expiry"`   // age after which zones that are still pending are deleted, 0 keeps them forever
+}
+
+// HealthConfig stores how the health check results of the edge nodes are evaluated
+type HealthConfig struct {
+	Quorum    uint32        `json:"quorum"`    // number of nodes that have to agree before a target changes state
+	Staleness util.Duration `json:"staleness"` // age after which a node's result no longer counts
+}
+
+// TransferConfig stores the settings of the zone transfer server for secondary nameservers
+type TransferConfig struct {
+	Listen string `json:"listen"` // UDP and TCP address:port of the transfer server, empty disables zone transfers
+}
+
+// QueryLogConfig stores the settings of the receiver of the edge nodes' dnstap query logs
+type QueryLogConfig struct {
+	Listen  string `json:"listen"`  // TCP address:port edge nodes stream dnstap to, empty disables query logging
+	Entries uint32 `json:"entries"` // recent queries kept per zone
+}
+
+// AnalyticsConfig stores how long the query counts of the edge nodes are kept
+type AnalyticsConfig struct {
+	MinuteRetention util.Duration `json:"minute_retention"` // age after which minute buckets are rolled up into hour buckets, 0 never rolls them up
+	Retention       util.Duration `json:"retention"`        // age after which buckets are deleted, 0 keeps them forever
+	Interval        util.Duration `json:"interval"`         // time between rollup runs
+}
+
+// ACMEConfig stores the CA that TLS certificates are requested from
+type ACMEConfig struct {
+	Directory string `json:"directory"` // ACME directory URL of the CA
+	Email     string `json:"email"`     // contact of the ACME account, used when the account is registered
+}
+
+// SecretsConfig stores the key that secrets such as TSIG keys are encrypted with at rest
+type SecretsConfig struct {
+	Key string `json:"key"` // base64 encoded 32 byte AES-256 key
+}
+
+// AuditConfig stores the audit log settings
+type AuditConfig struct {
+	Retention     util.Duration `json:"retention"`      // age after which audit entries are deleted, 0 keeps them forever
+	PruneInterval util.Duration `json:"prune_interval"` // time between retention runs
+}
+
+// Default returns the configuration used when no file or environment variables are given
+func Default() Config {
+	return Config{
+		Database: database.DefaultConfig,
+		Audit: AuditConfig{
+			Retention:     util.Duration(365 * 24 * time.Hour),
+			PruneInterval: util.Duration(time.Hour),
+		},
+		DNS: DNSConfig{
+			SerialScheme: soa.DefaultScheme,
+			SOA:          soa.Defaults,
+			Nameservers:  []string{"ns1.packetframe.com.", "ns2.packetframe.com."},
+			Resolver:     "1.1.1.1:53",
+		},
+		Verification: VerificationConfig{
+			Interval: util.Duration(5 * time.Minute),
+			Expiry:   util.Duration(7 * 24 * time.Hour),
+		},
+		Health: HealthConfig{
+			Quorum:    2,
+			Staleness: util.Duration(2 * time.Minute),
+		},
+		QueryLog: QueryLogConfig{
+			Entries: 1000,
+		},
+		Analytics: AnalyticsConfig{
+			MinuteRetention: util.Duration(48 * time.Hour),
+			Retention:       util.Duration(90 * 24 * time.Hour),
+			Interval:        util.Duration(10 * time.Minute),
+		},
+		ACME: ACMEConfig{
+			Directory: crypto.LetsEncrypt,
+		},
+	}
+}
+
+// Load reads the configuration from a JSON file and applies environment variable overrides
+func Load(file string) (Config, error) {
+	config := Default()
+
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return Config{}, err
+		}
+
+		if err := json.Unmarshal(data, &config); err != nil {
+			return Config{}, fmt.Errorf("parsing %s: %v", file, err)
+		}
+	}
+
+	if err := applyEnv(&config); err != nil {
+		return Config{}, err
+	}
+
+	config.Database.Development = config.Development
+
+	if err := config.DNS.validate(); err != nil {
+		return Config{}, err
+	}
+
+	if config.Secrets.Key != "" {
+		if key, err := base64.StdEncoding.DecodeString(config.Secrets.Key); err != nil || len(key) != 32 {
+			return Config{}, errors.New("secrets.key: has to be 32 bytes, base64 encoded")
+		}
+	}
+
+	if config.Transfer.Listen != "" {
+		if _, _, err := net.SplitHostPort(config.Transfer.Listen); err != nil {
+			return Config{}, fmt.Errorf("transfer.listen: %v", err)
+		}
+	}
+
+	if config.QueryLog.Listen != "" {
+		if _, _, err := net.SplitHostPort(config.QueryLog.Listen); err != nil {
+			return Config{}, fmt.Errorf("querylog.listen: %v", err)
+		}
+		if config.QueryLog.Entries == 0 {
+			return Config{}, errors.New("querylog.entries: has to be positive")
+		}
+	}
+
+	if u, err := url.Parse(config.ACME.Directory); err != nil || u.Scheme != "https" || u.Host == "" {
+		return Config{}, errors.New("acme.directory: has to be an https URL")
+	}
+
+	return config, nil
+}
+
+// validate checks that the platform zone defaults are complete
+func (c *DNSConfig) validate() error {
+	scheme, err := soa.ParseScheme(string(c.SerialScheme))
+	if err != nil {
+		return fmt.Errorf("dns.serial_scheme: %v", err)
+	}
+	c.SerialScheme = scheme
+
+	if c.SOA.PrimaryNS == "" || c.SOA.Mbox == "" || c.SOA.Refresh == 0 || c.SOA.Retry == 0 || c.SOA.Expire == 0 || c.SOA.MinTTL == 0 || c.SOA.TTL == 0 {
+		return errors.New("dns.soa: all SOA defaults must be set")
+	}
+	if err := c.SOA.Validate(); err != nil {
+		return fmt.Errorf("dns.soa: %v", err)
+	}
+
+	if len(c.Nameservers) < 2 {
+		return errors.New("dns.nameservers: at least two nameservers are required")
+	}
+	for i, ns := range c.Nameservers {
+		if _, ok := dns.IsDomainName(ns); !ok {
+			return errors.New("dns.nameservers: invalid nameserver " + ns)
+		}
+		c.Nameservers[i] = dns.Fqdn(ns)
+	}
+
+	for _, address := range c.Addresses {
+		if net.ParseIP(address) == nil {
+			return errors.New("dns.addresses: invalid address " + address)
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(c.Resolver); err != nil {
+		return fmt.Errorf("dns.resolver: %v", err)
+	}
+	return nil
+}
+
+// applyEnv overrides configuration values with the CDNV3_* environment variables that are set
+func applyEnv(config *Config) error {
+	stringVars := map[string]*string{
+		"CDNV3_DB_URI":          &config.Database.URI,
+		"CDNV3_DB_USERNAME":     &config.Database.Username,
+		"CDNV3_DB_PASSWORD":     &config.Database.Password,
+		"CDNV3_DB_AUTH_SOURCE":  &config.Database.AuthSource,
+		"CDNV3_DB_NAME":         &config.Database.Name,
+		"CDNV3_DB_REPLICA_SET":  &config.Database.ReplicaSet,
+		"CDNV3_DB_TLS_CA":       &config.Database.TLS.CAFile,
+		"CDNV3_DB_TLS_CERT":     &config.Database.TLS.CertFile,
+		"CDNV3_DB_TLS_KEY":      &config.Database.TLS.KeyFile,
+		"CDNV3_SOA_PRIMARY_NS":  &config.DNS.SOA.PrimaryNS,
+		"CDNV3_SOA_MBOX":        &config.DNS.SOA.Mbox,
+		"CDNV3_RESOLVER":        &config.DNS.Resolver,
+		"CDNV3_TRANSFER_LISTEN": &config.Transfer.Listen,
+		"CDNV3_SECRETS_KEY":     &config.Secrets.Key,
+		"CDNV3_QUERYLOG_LISTEN": &config.QueryLog.Listen,
+		"CDNV3_ACME_DIRECTORY":  &config.ACME.Directory,
+		"CDNV3_ACME_EMAIL":      &config.ACME.Email,
+	}
+	for name, target := range stringVars {
+		if value, ok := os.LookupEnv(name); ok {
+			*target = value
+		}
+	}
+
+	if value, ok := os.LookupEnv("CDNV3_SERIAL_SCHEME"); ok {
+		config.DNS.SerialScheme = soa.Scheme(value)
+	}
+
+	listVars := map[string]*[]string{
+		"CDNV3_NAMESERVERS":          &config.DNS.Nameservers,
+		"CDNV3_NAMESERVER_ADDRESSES": &config.DNS.Addresses,
+	}
+	for name, target := range listVars {
+		if value, ok := os.LookupEnv(name); ok {
+			*target = nil
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*target = append(*target, item)
+				}
+			}
+		}
+	}
+
+	uintVars := map[string]*uint32{
+		"CDNV3_SOA_REFRESH":      &config.DNS.SOA.Refresh,
+		"CDNV3_SOA_RETRY":        &config.DNS.SOA.Retry,
+		"CDNV3_SOA_EXPIRE":       &config.DNS.SOA.Expire,
+		"CDNV3_SOA_MINTTL":       &config.DNS.SOA.MinTTL,
+		"CDNV3_SOA_TTL":          &config.DNS.SOA.TTL,
+		"CDNV3_HEALTH_QUORUM":    &config.Health.Quorum,
+		"CDNV3_QUERYLOG_ENTRIES": &config.QueryLog.Entries,
+	}
+	for name, target := range uintVars {
+		if value, ok := os.LookupEnv(name); ok {
+			parsed, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			*target = uint32(parsed)
+		}
+	}
+
+	boolVars := map[string]*bool{
+		"CDNV3_DEVELOPMENT":     &config.Development,
+		"CDNV3_DB_TLS":          &config.Database.TLS.Enabled,
+		"CDNV3_DB_TLS_INSECURE": &config.Database.TLS.Insecure,
+	}
+	for name, target := range boolVars {
+		if value, ok := os.LookupEnv(name); ok {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			*target = parsed
+		}
+	}
+
+	durationVars := map[string]*util.Duration{
+		"CDNV3_DB_CONNECT_TIMEOUT":          &config.Database.ConnectTimeout,
+		"CDNV3_DB_SERVER_SELECTION_TIMEOUT": &config.Database.ServerSelectionTimeout,
+		"CDNV3_AUDIT_RETENTION":             &config.Audit.Retention,
+		"CDNV3_AUDIT_PRUNE_INTERVAL":        &config.Audit.PruneInterval,
+		"CDNV3_VERIFICATION_INTERVAL":       &config.Verification.Interval,
+		"CDNV3_VERIFICATION_EXPIRY":         &config.Verification.Expiry,
+		"CDNV3_HEALTH_STALENESS":            &config.Health.Staleness,
+		"CDNV3_ANALYTICS_MINUTE_RETENTION":  &config.Analytics.MinuteRetention,
+		"CDNV3_ANALYTICS_RETENTION":         &config.Analytics.Retention,
+		"CDNV3_ANALYTICS_INTERVAL":          &config.Analytics.Interval,
+	}
+	for name, target := range durationVars {
+		if value, ok := os.LookupEnv(name); ok {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			*target = util.Duration(parsed)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package control
+
+import (
+	"errors"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/natesales/cdn-tree/internal/analytics"
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// Analytics limits
+const (
+	MaxAnalyticsPoints = 1500               // largest number of points of a time series
+	analyticsMaxAge    = 7 * 24 * time.Hour // oldest bucket a node may report
+	analyticsMaxSkew   = 5 * time.Minute    // newest bucket a node may report, ahead of the controller clock
+)
+
+// AnalyticsGroups are the dimensions a time series can be grouped by
+var AnalyticsGroups = map[string]func(database.QueryStats) string{
+	"type":   func(s database.QueryStats) string { return s.Type },
+	"rcode":  func(s database.QueryStats) string { return s.Rcode },
+	"node":   func(s database.QueryStats) string { return s.Node },
+	"region": func(s database.QueryStats) string { return s.Region },
+	"zone":   func(s database.QueryStats) string { return s.Zone },
+}
+
+// SeriesPoint stores the number of queries in a time step of a series
+type SeriesPoint struct {
+	Time    int64            `json:"time"` // unix seconds of the start of the step
+	Queries int64            `json:"queries"`
+	Groups  map[string]int64 `json:"groups,omitempty"` // queries by group, if the series is grouped
+}
+
+// ReportQueries stores the query counts reported by an edge node in minute buckets
+func ReportQueries(db database.Store, node database.Node, counts []analytics.Count) error {
+	now := time.Now()
+	oldest := now.Add(-analyticsMaxAge).Unix()
+	newest := now.Add(analyticsMaxSkew).Unix()
+
+	stats := make([]database.QueryStats, 0, len(counts))
+	for _, count := range counts {
+		if count.Queries == 0 || count.Bucket < oldest || count.Bucket > newest {
+			continue
+		}
+		if _, ok := dns.IsDomainName(count.Zone); !ok || count.Type == "" || count.Rcode == "" {
+			return errors.New("invalid count for zone " + count.Zone)
+		}
+		stats = append(stats, database.QueryStats{
+			Zone:       dns.Fqdn(count.Zone),
+			Resolution: database.MinuteResolution,
+			Bucket:     count.Bucket - count.Bucket%database.MinuteResolution,
+			Node:       node.ID,
+			Region:     node.Region,
+			Type:       count.Type,
+			Rcode:      count.Rcode,
+			Queries:    int64(count.Queries),
+		})
+	}
+	return db.AddQueryStats(stats)
+}
+
+// QuerySeries builds a time series of query counts from since to until, optionally grouped
+func QuerySeries(stats []database.QueryStats, since int64, until int64, resolution int64, by string) []SeriesPoint {
+	group := AnalyticsGroups[by]
+
+	points := make([]SeriesPoint, 0, (until-since+resolution-1)/resolution)
+	for t := since; t < until; t += resolution {
+		point := SeriesPoint{Time: t}
+		if group != nil {
+			point.Groups = map[string]int64{}
+		}
+		points = append(points, point)
+	}
+
+	for _, s := range stats {
+		if s.Bucket < since || s.Bucket >= until {
+			continue
+		}
+		point := &points[(s.Bucket-since)/resolution]
+		point.Queries += s.Queries
+		if group != nil {
+			point.Groups[group(s)] += s.Queries
+		}
+	}
+	return points
+}
@@ -0,0 +1,97 @@
+package control
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/natesales/cdn-tree/internal/analytics"
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// TestAnalyticsRollup checks that reported minute buckets are rolled up into hour buckets and pruned, and that series add up the same before and after
+func TestAnalyticsRollup(t *testing.T) {
+	db := database.NewMemory()
+	now := time.Now().Unix()
+	hour := now - now%database.HourResolution - database.HourResolution // start of the previous hour
+
+	west := database.Node{ID: "west", Region: "us-west"}
+	east := database.Node{ID: "east", Region: "us-east"}
+	if err := ReportQueries(db, west, []analytics.Count{
+		{Bucket: hour + 60, Zone: "example.com", Type: "A", Rcode: "NOERROR", Queries: 5},
+		{Bucket: hour + 125, Zone: "example.com.", Type: "A", Rcode: "NOERROR", Queries: 3},
+		{Bucket: hour + 120, Zone: "example.com.", Type: "AAAA", Rcode: "NXDOMAIN", Queries: 2},
+		{Bucket: hour + database.HourResolution, Zone: "example.com.", Type: "A", Rcode: "NOERROR", Queries: 7},
+		{Bucket: now - 8*24*3600, Zone: "example.com.", Type: "A", Rcode: "NOERROR", Queries: 100}, // too old
+		{Bucket: now + 3600, Zone: "example.com.", Type: "A", Rcode: "NOERROR", Queries: 100},      // in the future
+		{Bucket: hour, Zone: "example.com.", Type: "A", Rcode: "NOERROR", Queries: 0},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReportQueries(db, east, []analytics.Count{
+		{Bucket: hour + 60, Zone: "example.com.", Type: "A", Rcode: "NOERROR", Queries: 4},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReportQueries(db, east, []analytics.Count{{Bucket: hour, Zone: "example..com", Type: "A", Rcode: "NOERROR", Queries: 1}}); err == nil {
+		t.Error("reported a count of an invalid zone")
+	}
+
+	all := database.QueryStatsFilter{From: 0, To: now + 3600}
+	series := func() []SeriesPoint {
+		stats, err := db.ListQueryStats(all)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return QuerySeries(stats, hour, hour+2*database.HourResolution, database.HourResolution, "region")
+	}
+	want := []SeriesPoint{
+		{Time: hour, Queries: 14, Groups: map[string]int64{"us-west": 10, "us-east": 4}},
+		{Time: hour + database.HourResolution, Queries: 7, Groups: map[string]int64{"us-west": 7}},
+	}
+	if got := series(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("series of minute buckets = %+v, want %+v", got, want)
+	}
+
+	// Minute buckets of the previous hour are rolled up by node, type and rcode, the current hour is left alone
+	rolled, err := db.RollupQueryStats(hour + database.HourResolution)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rolled != 4 {
+		t.Errorf("rolled up %d minute buckets, want 4", rolled)
+	}
+	if rolled, err := db.RollupQueryStats(hour + database.HourResolution); err != nil || rolled != 0 {
+		t.Errorf("rolled up %d minute buckets again, %v, want 0", rolled, err)
+	}
+	stats, err := db.ListQueryStats(all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buckets := map[string]int64{}
+	for _, s := range stats {
+		if s.Bucket == hour && s.Resolution != database.HourResolution || s.Bucket > hour && s.Resolution != database.MinuteResolution {
+			t.Errorf("bucket %d has resolution %d", s.Bucket, s.Resolution)
+		}
+		buckets[s.Node+" "+s.Type+" "+s.Rcode] += s.Queries
+	}
+	if len(stats) != 4 || !reflect.DeepEqual(buckets, map[string]int64{"west A NOERROR": 15, "west AAAA NXDOMAIN": 2, "east A NOERROR": 4}) {
+		t.Errorf("buckets after rollup = %v in %d buckets, want 3 hour buckets and a minute bucket", buckets, len(stats))
+	}
+	if got := series(); !reflect.DeepEqual(got, want) {
+		t.Errorf("series after rollup = %+v, want %+v", got, want)
+	}
+
+	// Retention deletes whole buckets that start before the cutoff
+	pruned, err := db.PruneQueryStats(hour + database.HourResolution)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 3 {
+		t.Errorf("pruned %d buckets, want 3", pruned)
+	}
+	want[0] = SeriesPoint{Time: hour, Groups: map[string]int64{}}
+	if got := series(); !reflect.DeepEqual(got, want) {
+		t.Errorf("series after pruning = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,52 @@
+package control
+
+import (
+	"sort"
+
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// NodeCertificate stores the TLS certificate of a nameserver hostname as shipped to edge nodes
+type NodeCertificate struct {
+	Domain      string `json:"domain"`
+	Certificate []byte `json:"certificate"` // PEM, leaf first
+	PrivateKey  []byte `json:"key"`         // PEM
+}
+
+// NodeCertificates gets the certificates of the platform and vanity nameservers, sorted by domain
+func NodeCertificates(db database.Store) ([]NodeCertificate, error) {
+	certificates, err := db.ListCertificates()
+	if err != nil {
+		return nil, err
+	}
+	zones, err := db.ListZones()
+	if err != nil {
+		return nil, err
+	}
+
+	hostnames := map[string]bool{}
+	for _, ns := range Nameservers {
+		hostnames[canonical(ns)] = true
+	}
+	for _, zone := range zones {
+		if zone.Active() {
+			for _, ns := range zone.Nameservers {
+				hostnames[canonical(ns)] = true
+			}
+		}
+	}
+
+	nodeCertificates := []NodeCertificate{}
+	for _, c := range certificates {
+		if hostnames[canonical(c.Domain)] && len(c.Certificate) > 0 && len(c.PrivateKey) > 0 {
+			nodeCertificates = append(nodeCertificates, NodeCertificate{
+				Domain:      canonical(c.Domain),
+				Certificate: c.Certificate,
+				PrivateKey:  c.PrivateKey,
+			})
+		}
+	}
+
+	sort.Slice(nodeCertificates, func(i, j int) bool { return nodeCertificates[i].Domain < nodeCertificates[j].Domain })
+	return nodeCertificates, nil
+}
@@ -7,73 +7,176 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	log "github.com/sirupsen/logrus"
-	"go.mongodb.org/mongo-driver/bson"
 	"net/http"
 	"sync"
 	"time"
 
+	"github.com/natesales/cdn-tree/internal/balance"
+	"github.com/natesales/cdn-tree/internal/crypto"
 	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/geo"
+	"github.com/natesales/cdn-tree/internal/health"
+	"github.com/natesales/cdn-tree/internal/soa"
 )
 
-// Manifest gets a list of zone:serial pairs
-func Manifest(db *database.Database) ([]map[string]interface{}, error) {
+// ZoneExport stores a zone as served to edge nodes
+type ZoneExport struct {
+	Zone       string              `json:"zone"`
+	Serial     uint32              `json:"serial"`
+	Records    []string            `json:"records"`                    // SOA record first, followed by the generated apex records, the zone records and the answers of health checked record sets
+	GeoRecords []geo.RecordSet     `json:"geo_records,omitempty"`      // without the values that are down
+	Balanced   []balance.RecordSet `json:"balanced_records,omitempty"` // shuffled by the edge nodes for every query
+	Checks     []health.Target     `json:"checks,omitempty"`           // health checks the edge nodes run
+	DNSSEC     crypto.DNSSECKey    `json:"dnssec"`
+}
+
+// Manifest gets a list of zone:serial pairs of all active zones
+func Manifest(db database.Store) ([]map[string]interface{}, error) {
 	// Find all zones from database
-	cursor, err := db.Db.Collection("zones").Find(context.Background(), bson.M{})
+	zones, err := db.ListZones()
 	if err != nil {
 		return nil, err // nil data
 	}
 
 	// Declare local zones manifest
-	var zones []map[string]interface{}
+	var manifest []map[string]interface{}
+
+	// Iterate over each served zone and add to local zones manifest
+	for _, zone := range zones {
+		if !zone.Active() || !zone.Loaded() {
+			continue
+		}
+		manifest = append(manifest, map[string]interface{}{"zone": zone.Zone, "serial": zone.Serial})
+	}
+
+	return manifest, nil
+}
+
+// Export gets a single zone by name for transfer to an edge node
+func Export(db database.Store, zone string) (ZoneExport, error) {
+	z, err := db.GetZoneByName(zone)
+	if err != nil {
+		return ZoneExport{}, err
+	}
+	if !z.Active() {
+		return ZoneExport{}, ErrPending
+	}
+
+	// Secondary zones are served as transferred from their primary, with its SOA and NS records and signatures
+	if z.IsSecondary() {
+		if !z.Loaded() {
+			return ZoneExport{}, ErrNotLoaded
+		}
+		return ZoneExport{Zone: z.Zone, Serial: z.Serial, Records: z.Records}, nil
+	}
+
+	// Generate the SOA record from the zone's overrides and the platform defaults
+	records := []string{z.SOA.Merge(soa.Defaults).Record(z.Zone, z.Serial).String()}
 
-	// Iterate over each zone and add to local zones manifest
-	for cursor.Next(context.Background()) {
-		var zone database.Zone
-		err := cursor.Decode(&zone)
+	apex, err := apexRecords(db, z)
+	if err != nil {
+		return ZoneExport{}, err
+	}
+	records = append(records, apex...)
+	records = append(records, z.Records...)
+
+	// Leave the values that are down out of the health checked answers
+	states, err := HealthStates(db)
+	if err != nil {
+		return ZoneExport{}, err
+	}
+	for _, set := range z.HealthRecords {
+		answers, err := set.Records(set.Answer(states))
 		if err != nil {
-			return nil, err // nil error
+			return ZoneExport{}, err
 		}
+		records = append(records, answers...)
+	}
 
-		// Append to local zones manifest
-		zones = append(zones, map[string]interface{}{"zone": zone.Zone, "serial": zone.Serial})
+	var geoRecords []geo.RecordSet
+	for _, set := range z.GeoRecords {
+		geoRecords = append(geoRecords, set.WithoutUnhealthy(states))
 	}
 
-	return zones, nil // nil error
+	return ZoneExport{
+		Zone:       z.Zone,
+		Serial:     z.Serial,
+		Records:    records,
+		GeoRecords: geoRecords,
+		Balanced:   z.BalancedRecords,
+		Checks:     ZoneTargets(z),
+		DNSSEC:     z.DNSSEC,
+	}, nil
 }
 
-// MassRequest sends an HTTP POST request to all edge nodes
-func MassRequest(db *database.Database, endpoint string, body interface{}) ([]*http.Response, error) {
-	// Find all zones from database
-	cursor, err := db.Db.Collection("nodes").Find(context.Background(), bson.M{})
+// NodeResult stores the outcome of a request to a single edge node
+type NodeResult struct {
+	Node   string `json:"node"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// nodeClient is the HTTP client used to reach edge nodes. It ignores insecure TLS certificates (self signed).
+var nodeClient = &http.Client{
+	Timeout:   time.Second * 10,
+	Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+}
+
+// Request sends an HTTP POST request to a single edge node. The request is cancelled with ctx.
+func Request(ctx context.Context, node database.Node, endpoint string, jsonBody []byte) NodeResult {
+	result := NodeResult{Node: node.ID}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+node.Endpoint+endpoint, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", crypto.SignNodeRequest(node.TokenHash, endpoint, jsonBody, time.Now()))
+
+	// Send the HTTP request
+	log.Debugln("Sending HTTP POST to https://" + node.Endpoint + endpoint)
+	response, err := nodeClient.Do(request)
+	if err != nil {
+		log.Warnf("node %s failed: %v\n", node.ID, err)
+		result.Error = err.Error()
+		return result
+	}
+
+	log.Debugln("Received response from " + node.Endpoint)
+	result.Status = response.StatusCode
+	response.Body.Close()
+
+	return result
+}
+
+// MassRequest sends an HTTP POST request to all authorized edge nodes and waits for their responses
+func MassRequest(ctx context.Context, db database.Store, endpoint string, body interface{}) ([]NodeResult, error) {
+	// Find all nodes from database
+	nodes, err := db.ListNodes()
 	if err != nil {
 		return nil, err
 	}
 
+	// Marshal the body data to JSON
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err // nil data
+	}
+
 	// Store list of node responses
-	var responses []*http.Response
+	var results []NodeResult
+	var resultsLock sync.Mutex
 
 	// Response lock
 	var wg sync.WaitGroup
 
-	// Ignore insecure TLS certificates (self signed)
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-
-	// Iterate over each zone and add to local zones manifest
-	for cursor.Next(context.Background()) {
-		var node database.Node
-		err := cursor.Decode(&node)
-		if err != nil {
-			return nil, err // nil data
-		}
-
-		// Marshal the body data to JSON
-		jsonBody, err := json.Marshal(body)
-		if err != nil {
-			return nil, err // nil data
+	// Iterate over each authorized node and send the request, unauthorized nodes don't serve zones and can't sync
+	for _, node := range nodes {
+		if !node.Authorized {
+			continue
 		}
-
-		// Create a new client with timeout and send the request
-		httpClient := &http.Client{Timeout: time.Second * 10}
+		node := node // capture for the goroutine
 
 		// Add positive delta to WaitGroup
 		wg.Add(1)
@@ -83,33 +186,26 @@ func MassRequest(db *database.Database, endpoint string, body interface{}) ([]*h
 			// Defer lock release
 			defer wg.Done()
 
-			// Send the HTTP request
-			log.Debugln("Sending HTTP POST to https://" + node.Endpoint + "/" + endpoint)
-			response, err := httpClient.Post("https://"+node.Endpoint+"/"+endpoint, "application/json", bytes.NewBuffer(jsonBody))
-			if err != nil {
-				log.Warnf("node %s failed: %v\n", node.ID, err) // TODO: report this error...maybe return err?
-			}
-			log.Debugln("Received response from " + node.Endpoint)
+			result := Request(ctx, node, endpoint, jsonBody)
 
-			// Append the response to the array
-			responses = append(responses, response)
+			// Append the result to the array
+			resultsLock.Lock()
+			results = append(results, result)
+			resultsLock.Unlock()
 		}()
 	}
 
-	return responses, nil // nil error
-}
+	wg.Wait()
 
-// Update sends a update request to all nodes
-func Update(db *database.Database) {
-	manifest, err := Manifest(db)
-	if err != nil {
-		log.Debug(err)
-	}
+	return results, nil
+}
 
-	responses, err := MassRequest(db, "/update", manifest)
+// Update asks all nodes to reconcile their full zone manifest
+func Update(db database.Store) {
+	results, err := MassRequest(context.Background(), db, "/update", nil)
 	if err != nil {
 		log.Debug(err)
 	}
 
-	log.Println(responses)
+	log.Println(results)
 }
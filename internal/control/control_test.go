@@ -0,0 +1,51 @@
+package control
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/natesales/cdn-tree/internal/crypto"
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// TestMassRequestAuthorized checks that only authorized nodes are sent signed requests and counted in the results
+func TestMassRequestAuthorized(t *testing.T) {
+	var authorizedRequests, pendingRequests int32
+	authorized := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&authorizedRequests, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		if !crypto.NodeRequestValid("token", r.Header.Get("Authorization"), r.URL.Path, body, time.Now()) {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer authorized.Close()
+	pending := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&pendingRequests, 1)
+	}))
+	defer pending.Close()
+
+	db := database.NewMemory()
+	if err := db.AddNode(database.Node{Endpoint: strings.TrimPrefix(authorized.URL, "https://"), Authorized: true, TokenHash: crypto.HashToken("token")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddNode(database.Node{Endpoint: strings.TrimPrefix(pending.URL, "https://")}); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := MassRequest(context.Background(), db, "/update", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Status != http.StatusOK {
+		t.Errorf("results = %+v, want one successful request", results)
+	}
+	if authorizedRequests != 1 || pendingRequests != 0 {
+		t.Errorf("authorized node got %d requests and unauthorized node %d, want 1 and 0", authorizedRequests, pendingRequests)
+	}
+}
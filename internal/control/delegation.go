@@ -0,0 +1,169 @@
+package control
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Resolver is the recursive resolver used to find the parent nameservers of a zone
+var Resolver = "1.1.1.1:53"
+
+// delegationClient is the DNS client used for delegation checks
+var delegationClient = &dns.Client{Timeout: 5 * time.Second}
+
+// delegationPort is the port parent nameservers are queried on
+var delegationPort = "53"
+
+// DelegationReport stores the result of comparing the delegation of a zone with its expected nameservers
+type DelegationReport struct {
+	Zone      string   `json:"zone"`
+	Parent    string   `json:"parent"`
+	Server    string   `json:"server,omitempty"` // parent nameserver that answered
+	Expected  []string `json:"expected"`
+	Found     []string `json:"found"`
+	Missing   []string `json:"missing"` // expected but not delegated to
+	Extra     []string `json:"extra"`   // delegated to but not expected
+	Delegated bool     `json:"delegated"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// exchange sends a single query
+func exchange(server string, name string, qtype uint16, recurse bool) (*dns.Msg, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), qtype)
+	query.RecursionDesired = recurse
+
+	response, _, err := delegationClient.Exchange(query, server)
+	if err != nil {
+		return nil, err
+	}
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return nil, errors.New(name + ": " + dns.RcodeToString[response.Rcode])
+	}
+	return response, nil
+}
+
+// parentNameservers finds the closest enclosing zone of a zone and its nameservers
+func parentNameservers(zone string) (string, []string, error) {
+	labels := dns.SplitDomainName(zone)
+	for i := 1; i <= len(labels); i++ {
+		parent := "."
+		if i < len(labels) {
+			parent = dns.Fqdn(strings.Join(labels[i:], "."))
+		}
+
+		response, err := exchange(Resolver, parent, dns.TypeNS, true)
+		if err != nil {
+			return "", nil, err
+		}
+
+		var nameservers []string
+		for _, rr := range response.Answer {
+			if ns, ok := rr.(*dns.NS); ok {
+				nameservers = append(nameservers, ns.Ns)
+			}
+		}
+		if len(nameservers) > 0 {
+			return parent, nameservers, nil
+		}
+	}
+	return "", nil, errors.New("no parent zone found for " + zone)
+}
+
+// resolveAddress resolves a hostname to its first IPv4 address
+func resolveAddress(hostname string) (string, error) {
+	response, err := exchange(Resolver, hostname, dns.TypeA, true)
+	if err != nil {
+		return "", err
+	}
+
+	for _, rr := range response.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A.String(), nil
+		}
+	}
+	return "", errors.New("no address for " + hostname)
+}
+
+// delegatedNameservers asks a parent nameserver which nameservers a zone is delegated to
+func delegatedNameservers(server string, zone string) ([]string, error) {
+	response, err := exchange(server, zone, dns.TypeNS, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// The parent answers with a referral in the authority section, or in the answer section if it is also authoritative for the zone
+	var nameservers []string
+	for _, rr := range append(response.Answer, response.Ns...) {
+		if ns, ok := rr.(*dns.NS); ok && canonical(ns.Hdr.Name) == canonical(zone) {
+			nameservers = append(nameservers, canonical(ns.Ns))
+		}
+	}
+	return nameservers, nil
+}
+
+// setDifference returns the elements of a that aren't in b
+func setDifference(a []string, b []string) []string {
+	in := map[string]bool{}
+	for _, s := range b {
+		in[s] = true
+	}
+
+	difference := []string{}
+	for _, s := range a {
+		if !in[s] {
+			difference = append(difference, s)
+		}
+	}
+	return difference
+}
+
+// CheckDelegation reports whether the parent zone delegates zone to exactly the expected nameservers
+func CheckDelegation(zone string, expected []string) DelegationReport {
+	report := DelegationReport{Zone: canonical(zone), Found: []string{}}
+	for _, ns := range expected {
+		report.Expected = append(report.Expected, canonical(ns))
+	}
+	sort.Strings(report.Expected)
+
+	parent, parentServers, err := parentNameservers(report.Zone)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Parent = parent
+
+	// Ask the parent nameservers in turn until one answers
+	var lastErr error
+	for _, server := range parentServers {
+		address, err := resolveAddress(server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		found, err := delegatedNameservers(net.JoinHostPort(address, delegationPort), report.Zone)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		sort.Strings(found)
+		report.Server = server
+		report.Found = found
+		report.Missing = setDifference(report.Expected, found)
+		report.Extra = setDifference(found, report.Expected)
+		report.Delegated = len(found) > 0 && len(report.Missing) == 0 && len(report.Extra) == 0
+		return report
+	}
+
+	if lastErr != nil {
+		report.Error = lastErr.Error()
+	}
+	return report
+}
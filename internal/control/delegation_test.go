@@ -0,0 +1,69 @@
+package control
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// TestCheckDelegation checks delegation reports against a parent zone served by a local resolver stand-in
+func TestCheckDelegation(t *testing.T) {
+	records := []string{
+		"com. 300 IN NS ns.parent.test.",
+		"ns.parent.test. 300 IN A 127.0.0.1",
+		"example.com. 300 IN NS ns1.cdn.test.",
+		"example.com. 300 IN NS ns2.cdn.test.",
+	}
+
+	tests := []struct {
+		name      string
+		zone      string
+		expected  []string
+		failing   []string
+		found     []string
+		missing   []string
+		extra     []string
+		delegated bool
+		err       bool
+	}{
+		{"delegated", "example.com.", []string{"NS2.cdn.test", "ns1.cdn.test."}, nil, []string{"ns1.cdn.test.", "ns2.cdn.test."}, []string{}, []string{}, true, false},
+		{"moving", "example.com", []string{"ns1.cdn.test.", "ns3.cdn.test."}, nil, []string{"ns1.cdn.test.", "ns2.cdn.test."}, []string{"ns3.cdn.test."}, []string{"ns2.cdn.test."}, false, false},
+		{"not delegated", "other.com.", []string{"ns1.cdn.test."}, nil, nil, []string{"ns1.cdn.test."}, []string{}, false, false},
+		{"no parent", "example.invalid.", []string{"ns1.cdn.test."}, nil, []string{}, nil, nil, false, true},
+		{"parent nameserver unresolvable", "example.com.", []string{"ns1.cdn.test."}, []string{"ns.parent.test."}, []string{}, nil, nil, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testResolver(t, records, test.failing...)
+			_, port, err := net.SplitHostPort(Resolver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			delegationPort = port
+			defer func() { delegationPort = "53" }()
+
+			report := CheckDelegation(test.zone, test.expected)
+			if report.Zone != canonical(test.zone) {
+				t.Errorf("zone = %s, want %s", report.Zone, canonical(test.zone))
+			}
+			if (report.Error != "") != test.err {
+				t.Fatalf("error = %q, want an error %v", report.Error, test.err)
+			}
+			if test.err {
+				return
+			}
+			if report.Parent != "com." || report.Server != "ns.parent.test." {
+				t.Errorf("parent = %s at %s, want com. at ns.parent.test.", report.Parent, report.Server)
+			}
+			if (len(report.Found) != 0 || len(test.found) != 0) && !reflect.DeepEqual(report.Found, test.found) {
+				t.Errorf("found = %v, want %v", report.Found, test.found)
+			}
+			if !reflect.DeepEqual(report.Missing, test.missing) || !reflect.DeepEqual(report.Extra, test.extra) {
+				t.Errorf("missing = %v, extra = %v, want %v and %v", report.Missing, report.Extra, test.missing, test.extra)
+			}
+			if report.Delegated != test.delegated {
+				t.Errorf("delegated = %v, want %v", report.Delegated, test.delegated)
+			}
+		})
+	}
+}
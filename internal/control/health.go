@@ -0,0 +1,111 @@
+package control
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/health"
+)
+
+// HealthQuorum is the number of nodes that have to agree before a target changes state
+var HealthQuorum = 2
+
+// HealthStaleness is the age after which a node's result no longer counts
+var HealthStaleness = 2 * time.Minute
+
+// ZoneTargets gets the health check targets of all record sets of a zone
+func ZoneTargets(zone database.Zone) []health.Target {
+	seen := map[string]bool{}
+	var targets []health.Target
+	add := func(target health.Target) {
+		if !seen[target.Key] {
+			seen[target.Key] = true
+			targets = append(targets, target)
+		}
+	}
+
+	for _, set := range zone.HealthRecords {
+		for _, target := range set.Targets() {
+			add(target)
+		}
+	}
+	for _, set := range zone.GeoRecords {
+		for _, target := range set.Targets() {
+			add(target)
+		}
+	}
+
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Key < targets[j].Key })
+	return targets
+}
+
+// HealthStates gets whether each target is healthy by key
+func HealthStates(db database.Store) (map[string]bool, error) {
+	states, err := db.ListHealthStates()
+	if err != nil {
+		return nil, err
+	}
+
+	healthy := map[string]bool{}
+	for _, state := range states {
+		healthy[state.Key] = state.Healthy
+	}
+	return healthy, nil
+}
+
+// ReportHealth stores the check results of a node and pushes the zones whose targets changed state
+func ReportHealth(db database.Store, node string, results []health.Result) error {
+	zones, err := db.ListZones()
+	if err != nil {
+		return err
+	}
+
+	targets := map[string]health.Target{}
+	zonesByKey := map[string][]string{}
+	for _, zone := range zones {
+		for _, target := range ZoneTargets(zone) {
+			targets[target.Key] = target
+			zonesByKey[target.Key] = append(zonesByKey[target.Key], zone.Zone)
+		}
+	}
+
+	changed := map[string]bool{}
+	for _, result := range results {
+		target, ok := targets[result.Key]
+		if !ok {
+			continue
+		}
+
+		state, err := db.AddHealthResult(target, node, result)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		healthy := health.Evaluate(state.Results, state.Healthy, HealthQuorum, HealthStaleness, now)
+		if healthy == state.Healthy {
+			continue
+		}
+
+		if err := db.SetHealthState(state.Key, healthy, now.UnixNano()); err != nil {
+			return err
+		}
+		log.Infof("health check %s is now healthy: %v", state.Key, healthy)
+		for _, zone := range zonesByKey[state.Key] {
+			changed[zone] = true
+		}
+	}
+
+	for zone := range changed {
+		if _, err := db.BumpZoneSerial(zone); err != nil {
+			return err
+		}
+		if err := QueueZonePush(db, zone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/natesales/cdn-tree/internal/crypto"
+	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/worker"
+)
+
+// Queue job types
+const (
+	JobCertificate    database.JobType = "certificate"
+	JobDNSSECRollover database.JobType = "dnssec_rollover"
+	JobNodeProvision  database.JobType = "node_provision"
+)
+
+// ACME CA directory of certificate requests and the contact email of a new ACME account
+var (
+	ACMEDirectory = crypto.LetsEncrypt
+	ACMEEmail     string
+)
+
+// CertificateRequest is the queue payload of a certificate issuance job
+type CertificateRequest struct {
+	Domain string `bson:"domain" json:"domain"`
+}
+
+// DNSSECRollover is the queue payload of a DNSSEC key rollover job
+type DNSSECRollover struct {
+	Zone string `bson:"zone" json:"zone"`
+}
+
+// NodeProvision is the queue payload of a node provisioning job
+type NodeProvision struct {
+	Node string `bson:"node" json:"node"`
+}
+
+// QueueJob adds a job with a typed payload to the queue
+func QueueJob(db database.Store, jobType database.JobType, payload interface{}) error {
+	message, err := database.NewQueueMessage(jobType, payload)
+	if err != nil {
+		return err
+	}
+
+	return db.AddQueueMessage(message)
+}
+
+// RegisterJobs registers all control plane job handlers with a worker runtime
+func RegisterJobs(r *worker.Runtime, pusher *Pusher) {
+	r.Register(JobZonePush, pusher.Handle)
+	r.Register(JobCertificate, func(ctx context.Context, message database.QueueMessage) error {
+		return handleCertificate(ctx, r.DB, message)
+	})
+	r.Register(JobDNSSECRollover, func(ctx context.Context, message database.QueueMessage) error {
+		return handleDNSSECRollover(ctx, r.DB, message)
+	})
+	r.Register(JobNodeProvision, func(ctx context.Context, message database.QueueMessage) error {
+		return handleNodeProvision(ctx, r.DB, message)
+	})
+}
+
+// handleCertificate issues a TLS certificate over ACME and stores it
+func handleCertificate(ctx context.Context, db database.Store, message database.QueueMessage) error {
+	var payload CertificateRequest
+	if err := message.Decode(&payload); err != nil {
+		return err
+	}
+
+	user, version, err := acmeAccount(db)
+	if err != nil {
+		return err
+	}
+	registered := user.Registration != nil
+
+	resource, err := crypto.NewCertRequest(ctx, ACMEDirectory, user, payload.Domain)
+	if !registered && user.Registration != nil {
+		// The account is kept even if the certificate wasn't issued, so retries don't register another one
+		if err := saveAcmeAccount(db, user, version); err != nil {
+			log.Warnf("storing ACME account: %v", err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err // the job was cancelled, another worker may own it now
+	}
+
+	return db.SetCertificate(database.Certificate{
+		Domain:            payload.Domain,
+		Certificate:       resource.Certificate,
+		IssuerCertificate: resource.IssuerCertificate,
+		PrivateKey:        resource.PrivateKey,
+		Issued:            time.Now().UnixNano(),
+	})
+}
+
+// acmeAccount loads the stored ACME account or makes a new one, with the version of the stored account
+func acmeAccount(db database.Store) (*crypto.AcmeUser, int64, error) {
+	element, err := db.GetMetadata(database.LabelAcmeAccount)
+	if err == database.ErrNotFound {
+		user, err := crypto.NewAcmeUser(ACMEEmail, nil, "")
+		return user, 0, err
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	payload, err := element.Decode()
+	if err != nil {
+		return nil, 0, err
+	}
+	account := payload.(*database.AcmeAccount)
+	if account.Email == "" {
+		account.Email = ACMEEmail
+	}
+
+	// An account set over the API has no key yet and is registered with a new one
+	if len(account.PrivateKey) == 0 {
+		account.Registration = ""
+	}
+	user, err := crypto.NewAcmeUser(account.Email, account.PrivateKey, account.Registration)
+	return user, element.Version, err
+}
+
+// saveAcmeAccount stores a registered ACME account under the ACME account label, if it is still at version
+func saveAcmeAccount(db database.Store, user *crypto.AcmeUser, version int64) error {
+	key, err := user.KeyPEM()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.CompareAndSwapMetadata(database.LabelAcmeAccount, &database.AcmeAccount{
+		Email:        user.Email,
+		Registration: user.Registration.URI,
+		PrivateKey:   key,
+	}, version)
+	return err
+}
+
+// handleDNSSECRollover replaces the DNSSEC signing key of a zone and pushes the zone to the edges
+func handleDNSSECRollover(ctx context.Context, db database.Store, message database.QueueMessage) error {
+	var payload DNSSECRollover
+	if err := message.Decode(&payload); err != nil {
+		return err
+	}
+
+	key := crypto.NewKey(payload.Zone)
+	if err := ctx.Err(); err != nil {
+		return err // the job was cancelled, another worker may own it now
+	}
+	if _, err := db.SetZoneDNSSEC(payload.Zone, key); err != nil {
+		return err
+	}
+
+	if err := RecordVersion(db, payload.Zone, "", "dnssec rollover"); err != nil {
+		return err
+	}
+
+	return QueueZonePush(db, payload.Zone)
+}
+
+// handleNodeProvision authorizes a node and asks it to sync all zones
+func handleNodeProvision(ctx context.Context, db database.Store, message database.QueueMessage) error {
+	var payload NodeProvision
+	if err := message.Decode(&payload); err != nil {
+		return err
+	}
+
+	node, err := db.AuthorizeNode(payload.Node)
+	if err != nil {
+		return err
+	}
+
+	jsonBody, err := json.Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	result := Request(ctx, node, "/update", jsonBody)
+	if result.Error != "" {
+		return errors.New(result.Error)
+	}
+
+	return nil
+}
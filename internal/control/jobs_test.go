@@ -0,0 +1,67 @@
+package control
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-acme/lego/v4/registration"
+
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// TestAcmeAccount checks that a registered ACME account is stored and reused, and that an account set over the API without a key gets a new one
+func TestAcmeAccount(t *testing.T) {
+	db := database.NewMemory()
+	ACMEEmail = "hostmaster@example.com"
+	defer func() { ACMEEmail = "" }()
+
+	user, version, err := acmeAccount(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 || user.Registration != nil || user.Email != "hostmaster@example.com" {
+		t.Fatalf("new account: version = %d, registration = %v, email = %s", version, user.Registration, user.Email)
+	}
+
+	// Registering the account is up to the CA, storing it is up to the job
+	user.Registration = &registration.Resource{URI: "https://ca.example/acct/1"}
+	if err := saveAcmeAccount(db, user, version); err != nil {
+		t.Fatal(err)
+	}
+	key, err := user.KeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reused, version, err := acmeAccount(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 || reused.Registration == nil || reused.Registration.URI != "https://ca.example/acct/1" {
+		t.Fatalf("stored account: version = %d, registration = %v", version, reused.Registration)
+	}
+	reusedKey, err := reused.KeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, reusedKey) {
+		t.Error("stored account has another key")
+	}
+
+	// A second registration from a stale version doesn't replace the account
+	if err := saveAcmeAccount(db, user, 0); err != database.ErrConflict {
+		t.Errorf("saving over a newer account: err = %v, want %v", err, database.ErrConflict)
+	}
+
+	// An account replaced over the API without a key is registered again with a new key
+	if _, err := db.CompareAndSwapMetadata(database.LabelAcmeAccount, &database.AcmeAccount{Email: "ops@example.com", Registration: "https://ca.example/acct/1"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	replaced, version, err := acmeAccount(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 || replaced.Registration != nil || replaced.Email != "ops@example.com" {
+		t.Errorf("account without a key: version = %d, registration = %v, email = %s", version, replaced.Registration, replaced.Email)
+	}
+}
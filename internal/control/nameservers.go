@@ -0,0 +1,99 @@
+package control
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// Nameservers are the platform nameserver hostnames that zones are delegated to unless they use vanity nameservers
+var Nameservers = []string{"ns1.packetframe.com.", "ns2.packetframe.com."}
+
+// NameserverAddresses are the anycast addresses of the platform nameservers, which vanity nameservers resolve to
+var NameserverAddresses []string
+
+// NameserverTTL is the TTL of generated NS records and vanity nameserver addresses
+var NameserverTTL uint32 = 86400
+
+// Glue stores the addresses that a vanity nameserver hostname resolves to
+type Glue struct {
+	Hostname  string   `json:"hostname"`
+	Addresses []string `json:"addresses"`
+}
+
+// canonical normalizes a hostname for comparison
+func canonical(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+// ZoneNameservers gets the nameservers a zone is delegated to
+func ZoneNameservers(zone database.Zone) []string {
+	if len(zone.Nameservers) > 0 {
+		return zone.Nameservers
+	}
+	return Nameservers
+}
+
+// VanityGlue gets the glue records of the vanity nameservers of a zone
+func VanityGlue(zone database.Zone) []Glue {
+	var glue []Glue
+	for _, hostname := range zone.Nameservers {
+		glue = append(glue, Glue{Hostname: hostname, Addresses: NameserverAddresses})
+	}
+	return glue
+}
+
+// addressRecord builds an A or AAAA record for a nameserver address
+func addressRecord(hostname string, address string) dns.RR {
+	ip := net.ParseIP(address)
+	header := dns.RR_Header{Name: hostname, Class: dns.ClassINET, Ttl: NameserverTTL}
+	if ip4 := ip.To4(); ip4 != nil {
+		header.Rrtype = dns.TypeA
+		return &dns.A{Hdr: header, A: ip4}
+	}
+	header.Rrtype = dns.TypeAAAA
+	return &dns.AAAA{Hdr: header, AAAA: ip}
+}
+
+// apexRecords generates the NS records of a zone and the addresses of the vanity nameservers inside it
+func apexRecords(db database.Store, zone database.Zone) ([]string, error) {
+	var records []string
+	for _, ns := range ZoneNameservers(zone) {
+		records = append(records, (&dns.NS{
+			Hdr: dns.RR_Header{Name: zone.Zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: NameserverTTL},
+			Ns:  dns.Fqdn(ns),
+		}).String())
+	}
+
+	zones, err := db.ListZones()
+	if err != nil {
+		return nil, err
+	}
+
+	hostnames := map[string]bool{}
+	for _, z := range zones {
+		for _, hostname := range z.Nameservers {
+			if dns.IsSubDomain(zone.Zone, hostname) {
+				hostnames[canonical(hostname)] = true
+			}
+		}
+	}
+
+	var sorted []string
+	for hostname := range hostnames {
+		sorted = append(sorted, hostname)
+	}
+	sort.Strings(sorted)
+
+	for _, hostname := range sorted {
+		for _, address := range NameserverAddresses {
+			records = append(records, addressRecord(hostname, address).String())
+		}
+	}
+
+	return records, nil
+}
@@ -0,0 +1,175 @@
+package control
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// JobZonePush is the queue job type of a zone push request
+const JobZonePush database.JobType = "zone_push"
+
+// ZonePush is the queue payload of a zone push request
+type ZonePush struct {
+	Zone string `bson:"zone" json:"zone"`
+}
+
+// ConvergenceStats stores commit to fleet-wide convergence timings for zone pushes
+type ConvergenceStats struct {
+	Pushes    int                      `json:"pushes"`    // number of completed pushes
+	Converged int                      `json:"converged"` // number of pushes that every node acknowledged
+	Last      time.Duration            `json:"last"`      // convergence time of the last converged push
+	Average   time.Duration            `json:"average"`   // mean convergence time of all converged pushes
+	Max       time.Duration            `json:"max"`       // longest convergence time
+	Zones     map[string]ZoneConverged `json:"zones"`     // last push result per zone
+}
+
+// ZoneConverged stores the last push result of a single zone
+type ZoneConverged struct {
+	Serial    uint32        `json:"serial"`
+	Committed time.Time     `json:"committed"` // time of the earliest coalesced change
+	Converged bool          `json:"converged"` // did every node acknowledge the new serial?
+	Duration  time.Duration `json:"duration"`  // time from commit to the last node acknowledgement
+	Nodes     []NodeResult  `json:"nodes"`
+}
+
+// PushWindow is the time zone changes are collected before they are pushed
+var PushWindow = 2 * time.Second
+
+// QueueZonePush adds a zone push request to the queue, coalesced with a waiting one
+func QueueZonePush(db database.Store, zone string) error {
+	message, err := database.NewQueueMessage(JobZonePush, ZonePush{Zone: zone})
+	if err != nil {
+		return err
+	}
+
+	message.Key = zone
+	message.Available = time.Now().Add(PushWindow).UnixNano()
+	return db.AddQueueMessage(message)
+}
+
+// QueueUnpublished queues a push of every served zone whose current serial hasn't been published
+func QueueUnpublished(db database.Store) error {
+	zones, err := db.ListZones()
+	if err != nil {
+		return err
+	}
+
+	for _, zone := range zones {
+		if !zone.Active() || !zone.Loaded() {
+			continue
+		}
+		if _, err := db.GetJournalEntry(zone.Zone, zone.Serial); err != database.ErrNotFound {
+			continue // published, or the journal can't be read right now
+		}
+
+		log.Debugf("queueing push of unpublished %s serial %d", zone.Zone, zone.Serial)
+		if err := QueueZonePush(db, zone.Zone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pusher handles zone push jobs by notifying all edge nodes of zone changes
+type Pusher struct {
+	DB database.Store
+
+	lock  sync.Mutex
+	stats ConvergenceStats
+	total time.Duration
+}
+
+// NewPusher constructs a new Pusher
+func NewPusher(db database.Store) *Pusher {
+	return &Pusher{
+		DB:    db,
+		stats: ConvergenceStats{Zones: map[string]ZoneConverged{}},
+	}
+}
+
+// push notifies all nodes of a new zone serial and records the convergence time
+func (p *Pusher) push(ctx context.Context, zone string, committed time.Time) error {
+	// Record the version in case the change's handler failed to
+	if err := RecordChange(p.DB, zone); err != nil {
+		return err
+	}
+
+	export, err := Export(p.DB, zone)
+	if err == ErrPending || err == ErrNotLoaded {
+		log.Debugf("not pushing %s: %v", zone, err)
+		return nil // pushed when it is activated
+	} else if err != nil {
+		return err
+	}
+
+	// Journal the serial and notify the secondary nameservers
+	if err := PublishTransfer(p.DB, export); err != nil {
+		log.Warnf("publishing %s to secondaries: %v", zone, err)
+	}
+
+	results, err := MassRequest(ctx, p.DB, "/update", map[string]interface{}{"zone": export.Zone, "serial": export.Serial})
+	if err != nil {
+		return err
+	}
+
+	converged := true
+	for _, result := range results {
+		if result.Status != 200 {
+			converged = false
+		}
+	}
+	duration := time.Since(committed)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.stats.Pushes++
+	if converged {
+		p.stats.Converged++
+		p.stats.Last = duration
+		p.total += duration
+		p.stats.Average = p.total / time.Duration(p.stats.Converged)
+		if duration > p.stats.Max {
+			p.stats.Max = duration
+		}
+	}
+	p.stats.Zones[zone] = ZoneConverged{
+		Serial:    export.Serial,
+		Committed: committed,
+		Converged: converged,
+		Duration:  duration,
+		Nodes:     results,
+	}
+
+	log.Debugf("pushed %s serial %d to %d nodes in %s (converged: %v)", zone, export.Serial, len(results), duration, converged)
+	return nil
+}
+
+// Handle processes a single zone push job
+func (p *Pusher) Handle(ctx context.Context, message database.QueueMessage) error {
+	var payload ZonePush
+	if err := message.Decode(&payload); err != nil {
+		return err
+	}
+
+	return p.push(ctx, payload.Zone, time.Unix(0, message.Created))
+}
+
+// Stats gets a copy of the current convergence statistics
+func (p *Pusher) Stats() ConvergenceStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	stats := p.stats
+	stats.Zones = map[string]ZoneConverged{}
+	for zone, result := range p.stats.Zones {
+		stats.Zones[zone] = result
+	}
+
+	return stats
+}
@@ -0,0 +1,311 @@
+package control
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/dnstap"
+)
+
+// QueryLogEntry stores a single query logged by an edge node
+type QueryLogEntry struct {
+	Node     string `json:"node"`
+	Time     int64  `json:"time"`     // unix nanoseconds the query was received at
+	Duration int64  `json:"duration"` // nanoseconds until the response was sent
+	Protocol string `json:"protocol"`
+	Client   string `json:"client"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Rcode    string `json:"rcode"`
+	Answers  int    `json:"answers"`
+	Size     int    `json:"size"` // response size in bytes
+}
+
+// QueryLogSummary stores the counts of the queries logged for a zone since it opted in or the controller started
+type QueryLogSummary struct {
+	Since    int64             `json:"since"` // unix nanoseconds
+	Received uint64            `json:"received"`
+	Nodes    map[string]uint64 `json:"nodes"`
+	Types    map[string]uint64 `json:"types"`
+	Rcodes   map[string]uint64 `json:"rcodes"`
+}
+
+// zoneLog stores the recent entries of a zone in a ring and its summary
+type zoneLog struct {
+	entries []QueryLogEntry
+	next    int // ring index the next entry is written to
+	summary QueryLogSummary
+}
+
+// QueryLog receives the dnstap streams of the edge nodes and aggregates the logged queries
+type QueryLog struct {
+	DB      database.Store
+	Listen  string // TCP address:port edge nodes stream to
+	Entries int    // recent entries kept per zone
+
+	lock    sync.Mutex
+	nodes   map[string]bool     // IDs of authorized nodes
+	enabled map[string]bool     // lowercase names of the zones that opted in
+	zones   map[string]*zoneLog // by lowercase zone name
+}
+
+// NewQueryLog constructs a new QueryLog
+func NewQueryLog(db database.Store, listen string, entries int) *QueryLog {
+	return &QueryLog{
+		DB:      db,
+		Listen:  listen,
+		Entries: entries,
+		nodes:   map[string]bool{},
+		enabled: map[string]bool{},
+		zones:   map[string]*zoneLog{},
+	}
+}
+
+// Run accepts dnstap streams until ctx is cancelled, reloading the authorized nodes and opted in zones every interval
+func (q *QueryLog) Run(ctx context.Context, interval time.Duration) error {
+	if err := q.refresh(); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", q.Listen)
+	if err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				listener.Close()
+				return
+			case <-ticker.C:
+				if err := q.refresh(); err != nil {
+					log.Warnf("refreshing query log zones: %v", err)
+				}
+			}
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Warnf("accepting dnstap connection: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go q.receive(conn)
+	}
+}
+
+// refresh reloads the authorized nodes and the zones that opted in, dropping the entries of zones that opted out
+func (q *QueryLog) refresh() error {
+	nodes, err := q.DB.ListNodes()
+	if err != nil {
+		return err
+	}
+	zones, err := q.DB.ListZones()
+	if err != nil {
+		return err
+	}
+
+	authorized := map[string]bool{}
+	for _, node := range nodes {
+		if node.Authorized {
+			authorized[node.ID] = true
+		}
+	}
+	enabled := map[string]bool{}
+	for _, zone := range zones {
+		if zone.QueryLog.Enabled {
+			enabled[strings.ToLower(dns.Fqdn(zone.Zone))] = true
+		}
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.nodes = authorized
+	q.enabled = enabled
+	for zone := range q.zones {
+		if !enabled[zone] {
+			delete(q.zones, zone)
+		}
+	}
+	return nil
+}
+
+// receive reads a dnstap stream of an edge node identified by the first message
+func (q *QueryLog) receive(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader, err := dnstap.NewReader(conn, true)
+	if err != nil {
+		log.Debugf("dnstap handshake with %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	node := ""
+	for {
+		frame, err := reader.Read()
+		if err != nil {
+			if err != io.EOF && err != dnstap.ErrStopped {
+				log.Debugf("reading dnstap stream of %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		message, err := dnstap.Unmarshal(frame)
+		if err != nil {
+			continue
+		}
+		if node == "" {
+			q.lock.Lock()
+			authorized := q.nodes[message.Identity]
+			q.lock.Unlock()
+			if !authorized {
+				log.Warnf("dnstap stream from %s with unknown node ID %q", conn.RemoteAddr(), message.Identity)
+				return
+			}
+			node = message.Identity
+			log.Debugf("receiving dnstap stream of node %s from %s", node, conn.RemoteAddr())
+		} else if message.Identity != node {
+			log.Warnf("dnstap stream of node %s switched to node ID %q", node, message.Identity)
+			return
+		}
+
+		q.add(node, message)
+	}
+}
+
+// add stores a dnstap message if its zone opted in
+func (q *QueryLog) add(node string, message dnstap.Message) {
+	if message.Type != dnstap.AuthResponse {
+		return
+	}
+	zone, _, err := dns.UnpackDomainName(message.QueryZone, 0)
+	if err != nil {
+		return
+	}
+	zone = strings.ToLower(zone)
+
+	query := new(dns.Msg)
+	if err := query.Unpack(message.QueryMessage); err != nil || len(query.Question) != 1 {
+		return
+	}
+	response := new(dns.Msg)
+	if err := response.Unpack(message.ResponseMessage); err != nil {
+		return
+	}
+
+	entry := QueryLogEntry{
+		Node:     node,
+		Time:     message.QueryTime.UnixNano(),
+		Protocol: message.Protocol.String(),
+		Name:     query.Question[0].Name,
+		Type:     dns.Type(query.Question[0].Qtype).String(),
+		Rcode:    dns.RcodeToString[response.Rcode],
+		Answers:  len(response.Answer),
+		Size:     len(message.ResponseMessage),
+	}
+	if !message.ResponseTime.IsZero() && !message.QueryTime.IsZero() {
+		entry.Duration = message.ResponseTime.Sub(message.QueryTime).Nanoseconds()
+	}
+	if message.QueryAddress != nil {
+		entry.Client = message.QueryAddress.String()
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if !q.enabled[zone] {
+		return
+	}
+	z, ok := q.zones[zone]
+	if !ok {
+		z = &zoneLog{
+			entries: make([]QueryLogEntry, 0, q.Entries),
+			summary: QueryLogSummary{
+				Since:  time.Now().UnixNano(),
+				Nodes:  map[string]uint64{},
+				Types:  map[string]uint64{},
+				Rcodes: map[string]uint64{},
+			},
+		}
+		q.zones[zone] = z
+	}
+
+	if len(z.entries) < q.Entries {
+		z.entries = append(z.entries, entry)
+	} else if q.Entries > 0 {
+		z.entries[z.next] = entry
+	}
+	if q.Entries > 0 {
+		z.next = (z.next + 1) % q.Entries
+	}
+
+	z.summary.Received++
+	z.summary.Nodes[entry.Node]++
+	z.summary.Types[entry.Type]++
+	z.summary.Rcodes[entry.Rcode]++
+}
+
+// Zone gets up to limit of the most recent entries of a zone, newest first, and its summary
+func (q *QueryLog) Zone(zone string, limit int) ([]QueryLogEntry, QueryLogSummary) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	z, ok := q.zones[strings.ToLower(dns.Fqdn(zone))]
+	if !ok {
+		return []QueryLogEntry{}, QueryLogSummary{Nodes: map[string]uint64{}, Types: map[string]uint64{}, Rcodes: map[string]uint64{}}
+	}
+
+	entries := []QueryLogEntry{}
+	for i := 1; i <= len(z.entries) && len(entries) < limit; i++ {
+		entries = append(entries, z.entries[(z.next-i+len(z.entries))%len(z.entries)])
+	}
+
+	summary := z.summary
+	summary.Nodes = copyCounts(z.summary.Nodes)
+	summary.Types = copyCounts(z.summary.Types)
+	summary.Rcodes = copyCounts(z.summary.Rcodes)
+	return entries, summary
+}
+
+// copyCounts copies a map of counters
+func copyCounts(counts map[string]uint64) map[string]uint64 {
+	c := make(map[string]uint64, len(counts))
+	for key, count := range counts {
+		c[key] = count
+	}
+	return c
+}
+
+// QueryLogRates gets the query log sample rates of the served zones that opted in, as shipped to the edge nodes
+func QueryLogRates(db database.Store) (map[string]float64, error) {
+	zones, err := db.ListZones()
+	if err != nil {
+		return nil, err
+	}
+
+	rates := map[string]float64{}
+	for _, zone := range zones {
+		if zone.QueryLog.Enabled && zone.Active() && zone.Loaded() {
+			rates[zone.Zone] = zone.QueryLog.Rate
+		}
+	}
+	return rates, nil
+}
@@ -0,0 +1,148 @@
+package control
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/dnstap"
+	"github.com/natesales/cdn-tree/internal/edge"
+)
+
+// TestQueryLogStream checks that queries answered by an edge node reach the query log over dnstap, only for the zones that opted in
+func TestQueryLogStream(t *testing.T) {
+	db := database.NewMemory()
+	if err := db.AddNode(database.Node{Endpoint: "192.0.2.10:8001", Authorized: true}); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := db.ListNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := nodes[0].ID
+
+	// example.com. and example.net. opt in, example.org. doesn't
+	directory, err := ioutil.TempDir("", "control-querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	store, err := edge.NewStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, zone := range []string{"example.com.", "example.net.", "example.org."} {
+		if err := db.AddZone(database.Zone{Zone: zone}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.ActivateZone(zone, "test"); err != nil {
+			t.Fatal(err)
+		}
+		if zone != "example.org." {
+			if err := db.SetZoneQueryLog(zone, database.QueryLogSettings{Enabled: true, Rate: 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Put(edge.Zone{Zone: zone, Serial: 1, Records: []string{
+			zone + " 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300",
+			"www." + zone + " 300 IN A 192.0.2.1",
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rates, err := QueryLogRates(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetQueryLog(rates)
+
+	// example.net. opts out before the edge node learns about it
+	if err := db.SetZoneQueryLog("example.net.", database.QueryLogSettings{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Controller receiver
+	queryLog := NewQueryLog(db, "", 10)
+	if err := queryLog.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go queryLog.receive(conn)
+		}
+	}()
+
+	// Edge output
+	tap, err := dnstap.NewLogger("tcp:"+listener.Addr().String(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tap.Identity = node
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tap.Run(ctx)
+
+	server := edge.NewServer(store, nil, nil)
+	server.Tap = tap
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	nameserver := &dns.Server{PacketConn: conn, Handler: server, NotifyStartedFunc: func() { close(started) }}
+	go nameserver.ActivateAndServe()
+	<-started
+	defer nameserver.Shutdown()
+
+	// The stream is in order, so the other zones' queries are handled once the one of example.com. arrives
+	client := new(dns.Client)
+	for _, zone := range []string{"example.org.", "example.net.", "example.com."} {
+		m := new(dns.Msg)
+		m.SetQuestion("www."+zone, dns.TypeA)
+		if _, _, err := client.Exchange(m, conn.LocalAddr().String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var entries []QueryLogEntry
+	var summary QueryLogSummary
+	for deadline := time.Now().Add(5 * time.Second); len(entries) == 0 || tap.Stats().Sent < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("no query of example.com. logged, dnstap stats %+v", tap.Stats())
+		}
+		entries, summary = queryLog.Zone("example.com.", 10)
+	}
+
+	entry := entries[0]
+	if len(entries) != 1 || summary.Received != 1 || summary.Nodes[node] != 1 {
+		t.Errorf("entries = %+v, summary = %+v, want the single query of node %s", entries, summary, node)
+	}
+	if entry.Node != node || entry.Name != "www.example.com." || entry.Type != "A" || entry.Rcode != "NOERROR" || entry.Answers != 1 || entry.Protocol != "udp" || entry.Client != "127.0.0.1" {
+		t.Errorf("entry = %+v, want the A query of www.example.com. over UDP from 127.0.0.1", entry)
+	}
+
+	// The edge node only sent the zones it knows opted in, and the controller dropped the one that opted out since
+	if stats := tap.Stats(); stats.Sent != 2 || stats.Dropped != 0 {
+		t.Errorf("dnstap stats = %+v, want 2 messages sent", stats)
+	}
+	for _, zone := range []string{"example.net.", "example.org."} {
+		if entries, summary := queryLog.Zone(zone, 10); len(entries) != 0 || summary.Received != 0 {
+			t.Errorf("%s has %d logged queries, want none", zone, summary.Received)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package control
+
+import (
+	"sort"
+	"time"
+
+	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/geo"
+)
+
+// RegionTimeout is the time after its last manifest request that a node is considered down
+var RegionTimeout = 2 * time.Minute
+
+// Regions gets the center of the nodes of every region and whether any of them is up
+func Regions(db database.Store) ([]geo.Region, error) {
+	nodes, err := db.ListNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	type center struct {
+		latitude, longitude float64
+		nodes               int
+		healthy             bool
+	}
+	centers := map[string]*center{}
+	for _, node := range nodes {
+		if !node.Authorized || node.Region == "" {
+			continue
+		}
+
+		c, ok := centers[node.Region]
+		if !ok {
+			c = &center{}
+			centers[node.Region] = c
+		}
+		c.latitude += float64(node.Latitude)
+		c.longitude += float64(node.Longitude)
+		c.nodes++
+		if time.Since(time.Unix(0, node.LastSeen)) < RegionTimeout {
+			c.healthy = true
+		}
+	}
+
+	regions := []geo.Region{}
+	for name, c := range centers {
+		regions = append(regions, geo.Region{
+			Name:     name,
+			Location: geo.Location{Latitude: c.latitude / float64(c.nodes), Longitude: c.longitude / float64(c.nodes)},
+			Healthy:  c.healthy,
+		})
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].Name < regions[j].Name })
+
+	return regions, nil
+}
@@ -0,0 +1,409 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/soa"
+)
+
+// ErrNotLoaded is returned when a secondary zone without a current copy is requested for serving
+var ErrNotLoaded = errors.New("secondary zone isn't loaded")
+
+// Secondary zone limits, so a primary can't make the controller poll too often or store too much
+const (
+	minRefresh          = 30 * time.Second
+	maxRefresh          = 24 * time.Hour
+	maxSecondaryRecords = 100000
+	transferTimeout     = 30 * time.Second
+)
+
+// serialNewer reports whether serial a is newer than serial b in serial number arithmetic (RFC 1982)
+func serialNewer(a uint32, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// clampTimer limits a SOA timer in seconds to the refresh bounds
+func clampTimer(seconds uint32) time.Duration {
+	d := time.Duration(seconds) * time.Second
+	if d < minRefresh {
+		return minRefresh
+	}
+	if d > maxRefresh {
+		return maxRefresh
+	}
+	return d
+}
+
+// secondarySOA gets the SOA record of the transferred copy of a secondary zone
+func secondarySOA(zone database.Zone) (*dns.SOA, bool) {
+	if len(zone.Records) == 0 {
+		return nil, false
+	}
+	rr, err := dns.NewRR(zone.Records[0])
+	if err != nil {
+		return nil, false
+	}
+	s, ok := rr.(*dns.SOA)
+	return s, ok
+}
+
+// RefreshDue gets when a secondary zone has to be checked for a new serial next
+func RefreshDue(zone database.Zone) time.Time {
+	s, ok := secondarySOA(zone)
+	if !ok {
+		if zone.SecondaryState.Attempted == 0 {
+			return time.Time{} // never tried
+		}
+		return time.Unix(0, zone.SecondaryState.Attempted).Add(clampTimer(soa.Defaults.Retry))
+	}
+
+	if zone.SecondaryState.Error != "" {
+		return time.Unix(0, zone.SecondaryState.Attempted).Add(clampTimer(s.Retry))
+	}
+	return time.Unix(0, zone.SecondaryState.Refreshed).Add(clampTimer(s.Refresh))
+}
+
+// expired reports whether the primaries of a secondary zone haven't answered within the SOA expire time
+func expired(zone database.Zone, now time.Time) bool {
+	s, ok := secondarySOA(zone)
+	if !ok {
+		return false
+	}
+	return now.After(time.Unix(0, zone.SecondaryState.Refreshed).Add(time.Duration(s.Expire) * time.Second))
+}
+
+// Refresher keeps secondary zones up to date with their primaries
+type Refresher struct {
+	DB database.Store
+
+	lock     sync.Mutex
+	running  map[string]bool
+	notified map[string]bool
+}
+
+// NewRefresher constructs a new Refresher
+func NewRefresher(db database.Store) *Refresher {
+	return &Refresher{
+		DB:       db,
+		running:  map[string]bool{},
+		notified: map[string]bool{},
+	}
+}
+
+// Notify makes the next pass check a secondary zone for a new serial regardless of its refresh timer
+func (r *Refresher) Notify(zone string) {
+	r.lock.Lock()
+	r.notified[zone] = true
+	r.lock.Unlock()
+}
+
+// Run checks the secondary zones that are due every interval until ctx is cancelled
+func (r *Refresher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		r.pass(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pass starts a refresh of every secondary zone that is due and expires the ones whose primaries stopped answering
+func (r *Refresher) pass(now time.Time) {
+	zones, err := r.DB.ListZones()
+	if err != nil {
+		log.Warnf("listing secondary zones: %v", err)
+		return
+	}
+
+	for _, zone := range zones {
+		if !zone.IsSecondary() {
+			continue
+		}
+
+		if !zone.SecondaryState.Expired && expired(zone, now) {
+			log.Warnf("secondary zone %s expired, last refreshed %s", zone.Zone, time.Unix(0, zone.SecondaryState.Refreshed))
+			state := zone.SecondaryState
+			state.Expired = true
+			if err := r.DB.SetSecondaryState(zone.Zone, state); err != nil {
+				log.Warnf("expiring %s: %v", zone.Zone, err)
+			}
+			zone.SecondaryState = state
+		}
+
+		r.lock.Lock()
+		due := r.notified[zone.Zone] || !now.Before(RefreshDue(zone))
+		if !due || r.running[zone.Zone] {
+			r.lock.Unlock()
+			continue
+		}
+		delete(r.notified, zone.Zone)
+		r.running[zone.Zone] = true
+		r.lock.Unlock()
+
+		go func(zone database.Zone) {
+			if err := r.Refresh(zone); err != nil {
+				log.Warnf("refreshing %s: %v", zone.Zone, err)
+			}
+			r.lock.Lock()
+			delete(r.running, zone.Zone)
+			r.lock.Unlock()
+		}(zone)
+	}
+}
+
+// Refresh checks the primaries of a secondary zone for a new serial and transfers the zone if there is one
+func (r *Refresher) Refresh(zone database.Zone) error {
+	state := zone.SecondaryState
+	state.Attempted = time.Now().UnixNano()
+
+	serial, refreshErr := r.refresh(zone)
+	if refreshErr != nil {
+		state.Error = refreshErr.Error()
+	} else {
+		state.Error = ""
+		state.Refreshed = state.Attempted
+		if state.Expired {
+			log.Infof("secondary zone %s is loaded again at serial %d", zone.Zone, serial)
+		}
+		state.Expired = false
+	}
+
+	if err := r.DB.SetSecondaryState(zone.Zone, state); err != nil {
+		return err
+	}
+	if refreshErr != nil {
+		return refreshErr
+	}
+
+	// Push new serials and zones that are served again to the edge nodes
+	if serial != zone.Serial || zone.SecondaryState.Expired {
+		if err := QueueZonePush(r.DB, zone.Zone); err != nil {
+			log.Warnf("queue zone push: %v", err)
+		}
+	}
+	return nil
+}
+
+// refresh transfers a zone from the first primary that answers if its serial is new, and returns the serial
+func (r *Refresher) refresh(zone database.Zone) (uint32, error) {
+	if len(zone.Secondary.Primaries) == 0 {
+		return 0, errors.New("no primaries")
+	}
+
+	var key *database.TSIGKey
+	if zone.Secondary.Key != "" {
+		k, err := TSIGKey(r.DB, zone.Secondary.Key)
+		if err != nil {
+			return 0, fmt.Errorf("TSIG key %s: %v", zone.Secondary.Key, err)
+		}
+		key = &k
+	}
+
+	var errs []string
+	for _, primary := range zone.Secondary.Primaries {
+		serial, err := primarySerial(zone.Zone, primary, key)
+		if err != nil {
+			errs = append(errs, primary+": "+err.Error())
+			continue
+		}
+		if len(zone.Records) > 0 && !serialNewer(serial, zone.Serial) {
+			return zone.Serial, nil // up to date
+		}
+
+		records, err := pull(zone, primary, key)
+		if err != nil {
+			errs = append(errs, primary+": "+err.Error())
+			continue
+		}
+		newSerial := records[0].(*dns.SOA).Serial
+
+		if err := r.DB.SetSecondaryRecords(zone.Zone, newSerial, recordStrings(records)); err != nil {
+			return 0, err
+		}
+		if err := RecordVersion(r.DB, zone.Zone, "secondary", fmt.Sprintf("transfer serial %d from %s", newSerial, primary)); err != nil {
+			log.Warnf("record zone version: %v", err)
+		}
+		log.Infof("transferred %s serial %d from %s (%d records)", zone.Zone, newSerial, primary, len(records))
+		return newSerial, nil
+	}
+	return 0, errors.New(strings.Join(errs, "; "))
+}
+
+// sign adds a TSIG record to a message if a key is given, and returns the secrets a client needs to verify the response
+func sign(m *dns.Msg, key *database.TSIGKey) map[string]string {
+	if key == nil {
+		return nil
+	}
+	m.SetTsig(key.Name, key.Algorithm, tsigFudge, time.Now().Unix())
+	return map[string]string{key.Name: key.Secret}
+}
+
+// primarySerial asks a primary for the serial of a zone over UDP
+func primarySerial(zone string, primary string, key *database.TSIGKey) (uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeSOA)
+	m.RecursionDesired = false
+	client := &dns.Client{Timeout: notifyTimeout}
+	client.TsigSecret = sign(m, key)
+
+	response, _, err := client.Exchange(m, primary)
+	if err != nil {
+		return 0, err
+	}
+	if response.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("SOA query returned %s", dns.RcodeToString[response.Rcode])
+	}
+	for _, rr := range response.Answer {
+		if s, ok := rr.(*dns.SOA); ok && strings.EqualFold(s.Hdr.Name, zone) {
+			return s.Serial, nil
+		}
+	}
+	return 0, errors.New("no SOA record in the answer")
+}
+
+// pull transfers a zone from a primary and returns the new records, SOA record first
+func pull(zone database.Zone, primary string, key *database.TSIGKey) ([]dns.RR, error) {
+	var current []dns.RR
+	for _, record := range zone.Records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return nil, err
+		}
+		current = append(current, rr)
+	}
+
+	m := new(dns.Msg)
+	if old, ok := secondarySOA(zone); ok {
+		m.SetIxfr(zone.Zone, old.Serial, old.Ns, old.Mbox)
+	} else {
+		m.SetAxfr(zone.Zone)
+	}
+	t := &dns.Transfer{DialTimeout: notifyTimeout, ReadTimeout: transferTimeout, WriteTimeout: notifyTimeout}
+	t.TsigSecret = sign(m, key)
+
+	envelopes, err := t.In(m, primary)
+	if err != nil {
+		return nil, err
+	}
+	var answer []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, envelope.Error
+		}
+		answer = append(answer, envelope.RR...)
+		if len(answer) > maxSecondaryRecords {
+			return nil, errors.New("zone has too many records")
+		}
+	}
+
+	records, err := applyTransfer(current, answer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the records of the zone only, so a primary can't inject records of other zones
+	var inZone []dns.RR
+	for _, rr := range records {
+		if dns.IsSubDomain(zone.Zone, rr.Header().Name) && rr.Header().Class == dns.ClassINET {
+			inZone = append(inZone, rr)
+		}
+	}
+	if len(inZone) == 0 || !strings.EqualFold(inZone[0].Header().Name, zone.Zone) {
+		return nil, errors.New("transfer doesn't start with the zone's SOA record")
+	}
+	return inZone, nil
+}
+
+// rrKey identifies a record regardless of its TTL, which IXFR deletions don't have to match
+func rrKey(rr dns.RR) string {
+	c := dns.Copy(rr)
+	c.Header().Ttl = 0
+	return strings.ToLower(c.Header().Name) + " " + strings.TrimPrefix(c.String(), c.Header().String())
+}
+
+// applyTransfer gets the records of a zone after an AXFR or IXFR answer (RFC 1995 section 4)
+func applyTransfer(current []dns.RR, answer []dns.RR) ([]dns.RR, error) {
+	if len(answer) == 0 {
+		return nil, errors.New("empty transfer")
+	}
+	newSOA, ok := answer[0].(*dns.SOA)
+	if !ok {
+		return nil, errors.New("transfer doesn't start with a SOA record")
+	}
+
+	// Up to date
+	if len(answer) == 1 {
+		if len(current) == 0 {
+			return nil, errors.New("transfer has no records")
+		}
+		return append([]dns.RR{newSOA}, current[1:]...), nil
+	}
+
+	if last, ok := answer[len(answer)-1].(*dns.SOA); !ok || last.Serial != newSOA.Serial {
+		return nil, errors.New("transfer doesn't end with the SOA record")
+	}
+
+	// Full transfer
+	if _, incremental := answer[1].(*dns.SOA); !incremental {
+		return append([]dns.RR{newSOA}, answer[1:len(answer)-1]...), nil
+	}
+
+	// Incremental transfer, a sequence of deletions and additions each started by a SOA record
+	if len(current) == 0 {
+		return nil, errors.New("incremental transfer without a copy of the zone")
+	}
+	if answer[1].(*dns.SOA).Serial != current[0].(*dns.SOA).Serial {
+		return nil, errors.New("incremental transfer from a different serial")
+	}
+
+	records := map[string]dns.RR{}
+	var order []string
+	for _, rr := range current[1:] {
+		key := rrKey(rr)
+		if _, ok := records[key]; !ok {
+			order = append(order, key)
+		}
+		records[key] = rr
+	}
+
+	adding := true // toggled to deleting by the first SOA record
+	for _, rr := range answer[1 : len(answer)-1] {
+		if _, ok := rr.(*dns.SOA); ok {
+			adding = !adding
+			continue
+		}
+		key := rrKey(rr)
+		if adding {
+			if _, ok := records[key]; !ok {
+				order = append(order, key)
+			}
+			records[key] = rr
+		} else {
+			delete(records, key)
+		}
+	}
+
+	result := []dns.RR{newSOA}
+	for _, key := range order {
+		if rr, ok := records[key]; ok {
+			result = append(result, rr)
+			delete(records, key) // keys can be in order twice if deleted and added again
+		}
+	}
+	return result, nil
+}
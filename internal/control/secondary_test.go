@@ -0,0 +1,256 @@
+package control
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// testPrimary is a primary nameserver of example.com. that serves its zone over AXFR, and over IXFR from the previous serial
+type testPrimary struct {
+	lock      sync.Mutex
+	serial    uint32
+	versions  map[uint32][]string // records of every serial without the SOA record
+	transfers []uint16            // types of the transfers that were requested
+}
+
+// soa builds the SOA record of a serial
+func (p *testPrimary) soa(serial uint32) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:      "ns1.example.com.",
+		Mbox:    "hostmaster.example.com.",
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  604800,
+		Minttl:  300,
+	}
+}
+
+// requested gets the types of the transfers that were requested so far
+func (p *testPrimary) requested() []uint16 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]uint16(nil), p.transfers...)
+}
+
+// records parses the records of a serial
+func (p *testPrimary) records(t *testing.T, serial uint32) []dns.RR {
+	var records []dns.RR
+	for _, record := range p.versions[serial] {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Error(err)
+		}
+		records = append(records, rr)
+	}
+	return records
+}
+
+// diff gets the records of a serial that aren't in another
+func (p *testPrimary) diff(t *testing.T, serial uint32, other uint32) []dns.RR {
+	var records []dns.RR
+	for _, rr := range p.records(t, serial) {
+		found := false
+		for _, o := range p.records(t, other) {
+			if dns.IsDuplicate(rr, o) {
+				found = true
+			}
+		}
+		if !found {
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+// serve starts the primary on a local port for both UDP and TCP and returns its address
+func (p *testPrimary) serve(t *testing.T) string {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		q := r.Question[0]
+		current := p.soa(p.serial)
+
+		switch q.Qtype {
+		case dns.TypeSOA:
+			m.Answer = []dns.RR{current}
+		case dns.TypeAXFR, dns.TypeIXFR:
+			p.transfers = append(p.transfers, q.Qtype)
+			from := uint32(0)
+			if q.Qtype == dns.TypeIXFR && len(r.Ns) > 0 {
+				from = r.Ns[0].(*dns.SOA).Serial
+			}
+			_, known := p.versions[from]
+
+			switch {
+			case from == p.serial:
+				m.Answer = []dns.RR{current}
+			case known:
+				m.Answer = append(m.Answer, current, p.soa(from))
+				m.Answer = append(m.Answer, p.diff(t, from, p.serial)...)
+				m.Answer = append(m.Answer, current)
+				m.Answer = append(m.Answer, p.diff(t, p.serial, from)...)
+				m.Answer = append(m.Answer, current)
+			default:
+				m.Answer = append(m.Answer, current)
+				m.Answer = append(m.Answer, p.records(t, p.serial)...)
+				m.Answer = append(m.Answer, current)
+			}
+		default:
+			m.Rcode = dns.RcodeRefused
+		}
+		w.WriteMsg(m)
+	})
+
+	// Transfers use TCP and serial queries UDP on the same port
+	var tcp net.Listener
+	var udp net.PacketConn
+	for i := 0; udp == nil; i++ {
+		var err error
+		tcp, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		udp, err = net.ListenPacket("udp", tcp.Addr().String())
+		if err != nil {
+			tcp.Close()
+			if i == 10 {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, server := range []*dns.Server{{Listener: tcp, Handler: handler}, {PacketConn: udp, Handler: handler}} {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go server.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { server.Shutdown() })
+	}
+	return tcp.Addr().String()
+}
+
+// TestRefresh checks that a secondary zone follows the serial of its primary, by AXFR first and IXFR afterwards, and keeps only records of the zone
+func TestRefresh(t *testing.T) {
+	primary := &testPrimary{
+		serial: 1,
+		versions: map[uint32][]string{
+			1: {
+				"example.com. 3600 IN NS ns1.example.com.",
+				"ns1.example.com. 3600 IN A 192.0.2.53",
+				"www.example.com. 300 IN A 192.0.2.1",
+				"mail.example.com. 300 IN A 192.0.2.25",
+				"www.example.net. 300 IN A 203.0.113.1",
+			},
+			2: {
+				"example.com. 3600 IN NS ns1.example.com.",
+				"ns1.example.com. 3600 IN A 192.0.2.53",
+				"www.example.com. 300 IN A 192.0.2.2",
+				"mail.example.com. 300 IN A 192.0.2.25",
+				"api.example.com. 300 IN A 192.0.2.3",
+				"www.example.net. 300 IN A 203.0.113.1",
+				"example.org. 300 IN A 203.0.113.2",
+			},
+		},
+	}
+	address := primary.serve(t)
+
+	db := database.NewMemory()
+	if err := db.AddZone(database.Zone{
+		Zone:      "example.com.",
+		Type:      database.ZoneSecondary,
+		Secondary: database.SecondarySettings{Primaries: []string{address}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	refresher := NewRefresher(db)
+
+	// refresh refreshes the zone and checks its serial and records afterwards
+	refresh := func(serial uint32, want []string) {
+		t.Helper()
+		zone, err := db.GetZoneByName("example.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := refresher.Refresh(zone); err != nil {
+			t.Fatal(err)
+		}
+
+		zone, err = db.GetZoneByName("example.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if zone.Serial != serial || zone.SecondaryState.Error != "" || !zone.Loaded() {
+			t.Errorf("zone at serial %d (%s), want loaded at serial %d", zone.Serial, zone.SecondaryState.Error, serial)
+		}
+		if s, ok := secondarySOA(zone); !ok || s.Serial != serial {
+			t.Errorf("zone doesn't start with the SOA record of serial %d: %v", serial, zone.Records)
+		}
+
+		var got []string
+		for _, record := range zone.Records[1:] {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, rr.String())
+		}
+		var expected []string
+		for _, record := range want {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected = append(expected, rr.String())
+		}
+		sort.Strings(got)
+		sort.Strings(expected)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("records = %q, want %q", got, expected)
+		}
+	}
+
+	refresh(1, primary.versions[1][:4])
+	if transfers := primary.requested(); !reflect.DeepEqual(transfers, []uint16{dns.TypeAXFR}) {
+		t.Errorf("transfers = %v, want an AXFR", transfers)
+	}
+
+	// An unchanged serial isn't transferred again
+	refresh(1, primary.versions[1][:4])
+	if transfers := primary.requested(); len(transfers) != 1 {
+		t.Errorf("transfers = %v, want no transfer of an unchanged serial", transfers)
+	}
+
+	primary.lock.Lock()
+	primary.serial = 2
+	primary.lock.Unlock()
+	refresh(2, primary.versions[2][:5])
+	if transfers := primary.requested(); !reflect.DeepEqual(transfers, []uint16{dns.TypeAXFR, dns.TypeIXFR}) {
+		t.Errorf("transfers = %v, want an IXFR after the AXFR", transfers)
+	}
+
+	for _, serial := range []uint32{1, 2} {
+		if _, err := db.GetZoneVersion("example.com.", serial); err != nil {
+			t.Errorf("version of serial %d: %v", serial, err)
+		}
+	}
+	queue, err := db.ListQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 1 || queue[0].Type != JobZonePush {
+		t.Errorf("queue = %+v, want a zone push", queue)
+	}
+}
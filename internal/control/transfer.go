@@ -0,0 +1,462 @@
+package control
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/natesales/cdn-tree/internal/alias"
+	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/soa"
+	"github.com/natesales/cdn-tree/internal/tsig"
+)
+
+// JournalSize is the number of serials of a zone kept to answer IXFR requests with differences
+var JournalSize = 20
+
+// Transfer defaults
+const (
+	envelopeSize   = 100 // records per AXFR/IXFR message
+	notifyAttempts = 3
+	notifyTimeout  = 2 * time.Second
+	tsigFudge      = 300
+)
+
+// TransferRecords gets the static records of a zone as transferred to secondaries, SOA record first
+func TransferRecords(export ZoneExport) ([]dns.RR, error) {
+	var records []dns.RR
+	for _, record := range export.Records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return nil, err
+		}
+		if rr == nil || rr.Header().Rrtype == alias.TypeALIAS {
+			continue
+		}
+		records = append(records, rr)
+	}
+
+	for _, set := range export.GeoRecords {
+		values := set.Default
+		if len(values) == 0 {
+			var regions []string
+			for region := range set.Regions {
+				regions = append(regions, region)
+			}
+			sort.Strings(regions)
+			if len(regions) > 0 {
+				values = set.Regions[regions[0]]
+			}
+		}
+
+		rrs, err := set.Records(values)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rrs...)
+	}
+
+	for _, set := range export.Balanced {
+		var values []string
+		for _, member := range set.Members {
+			if member.Weight > 0 {
+				values = append(values, member.Value)
+			}
+		}
+
+		rrs, err := set.Records(values)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rrs...)
+	}
+
+	return records, nil
+}
+
+// recordStrings gets the text presentation of a list of records
+func recordStrings(records []dns.RR) []string {
+	var strs []string
+	for _, rr := range records {
+		strs = append(strs, rr.String())
+	}
+	return strs
+}
+
+// PublishTransfer journals a newly pushed serial of a zone and notifies its secondaries once
+func PublishTransfer(db database.Store, export ZoneExport) error {
+	records, err := TransferRecords(export)
+	if err != nil {
+		return err
+	}
+
+	err = db.AddJournalEntry(database.JournalEntry{
+		Zone:    export.Zone,
+		Serial:  export.Serial,
+		Records: recordStrings(records),
+		Created: time.Now().UnixNano(),
+	})
+	if err == database.ErrDuplicate {
+		return nil // already published
+	} else if err != nil {
+		return err
+	}
+	if err := db.PruneJournal(export.Zone, JournalSize); err != nil {
+		return err
+	}
+
+	zone, err := db.GetZoneByName(export.Zone)
+	if err != nil {
+		return err
+	}
+	if len(zone.Transfer.Notify) == 0 {
+		return nil
+	}
+
+	// Sign the NOTIFY messages with the first key the zone accepts
+	var key *database.TSIGKey
+	if len(zone.Transfer.Keys) > 0 {
+		k, err := TSIGKey(db, zone.Transfer.Keys[0])
+		if err != nil {
+			return err
+		}
+		key = &k
+	}
+
+	for _, target := range zone.Transfer.Notify {
+		go Notify(export.Zone, target, key)
+	}
+	return nil
+}
+
+// Notify sends a NOTIFY message for a zone to a secondary (RFC 1996) until it is acknowledged
+func Notify(zone string, target string, key *database.TSIGKey) {
+	m := new(dns.Msg)
+	m.SetNotify(zone)
+
+	client := &dns.Client{Timeout: notifyTimeout}
+	if key != nil {
+		client.TsigSecret = map[string]string{key.Name: key.Secret}
+	}
+
+	for attempt := 1; attempt <= notifyAttempts; attempt++ {
+		m.Extra = nil // drop the TSIG record of the previous attempt
+		if key != nil {
+			m.SetTsig(key.Name, key.Algorithm, tsigFudge, time.Now().Unix())
+		}
+
+		response, _, err := client.Exchange(m, target)
+		if err == nil && response.Rcode == dns.RcodeSuccess {
+			log.Debugf("notified %s of %s", target, zone)
+			return
+		}
+		if err == nil {
+			log.Warnf("notify %s of %s: %s (attempt %d)", target, zone, dns.RcodeToString[response.Rcode], attempt)
+		} else {
+			log.Warnf("notify %s of %s: %v (attempt %d)", target, zone, err, attempt)
+		}
+		if attempt < notifyAttempts {
+			time.Sleep(time.Duration(attempt) * notifyTimeout)
+		}
+	}
+}
+
+// TransferServer answers zone transfers, NOTIFY messages for secondary zones and UPDATE messages
+type TransferServer struct {
+	DB        database.Store
+	Listen    string     // address:port, served over UDP and TCP
+	Refresher *Refresher // refreshes notified secondary zones
+
+	listener *tsig.Listener
+}
+
+// NewTransferServer constructs a new TransferServer
+func NewTransferServer(db database.Store, listen string, refresher *Refresher) *TransferServer {
+	t := &TransferServer{DB: db, Listen: listen, Refresher: refresher}
+	t.listener = tsig.NewListener(listen, t)
+	t.listener.Accept = acceptMsg
+	return t
+}
+
+// Run serves transfers until ctx is cancelled, restarting the listeners when the TSIG keys change
+func (t *TransferServer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		secrets, err := TSIGSecrets(t.DB)
+		if err != nil {
+			log.Warnf("loading TSIG keys: %v", err)
+		} else if err := t.listener.Update(secrets); err != nil {
+			log.Warnf("starting transfer server on %s: %v", t.Listen, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			t.listener.Shutdown()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// acceptMsg accepts what the default accept function does, and UPDATE messages of any size
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	if opcode := int(dh.Bits>>11) & 0xF; opcode == dns.OpcodeUpdate && dh.Bits&(1<<15) == 0 {
+		if dh.Qdcount != 1 || dh.Arcount > 2 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// refuse answers a query with an error rcode
+func refuse(w dns.ResponseWriter, r *dns.Msg, rcode int) {
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	_ = w.WriteMsg(m)
+}
+
+// remoteIP gets the address a message was received from
+func remoteIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// authorized reports whether a query may transfer a zone according to its ACL and keys
+func authorized(zone database.Zone, w dns.ResponseWriter, r *dns.Msg) bool {
+	ip := remoteIP(w)
+	allowed := false
+	for _, prefix := range zone.Transfer.Allow {
+		if _, network, err := net.ParseCIDR(prefix); err == nil && network.Contains(ip) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+
+	if len(zone.Transfer.Keys) == 0 {
+		return true
+	}
+	signature := r.IsTsig()
+	if signature == nil || w.TsigStatus() != nil {
+		return false
+	}
+	for _, key := range zone.Transfer.Keys {
+		if strings.EqualFold(key, signature.Hdr.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// notified reports whether a NOTIFY message comes from a primary of a secondary zone
+func notified(zone database.Zone, w dns.ResponseWriter, r *dns.Msg) bool {
+	ip := remoteIP(w)
+	primary := false
+	for _, address := range zone.Secondary.Primaries {
+		if host, _, err := net.SplitHostPort(address); err == nil && net.ParseIP(host).Equal(ip) {
+			primary = true
+			break
+		}
+	}
+	if !primary {
+		return false
+	}
+
+	if zone.Secondary.Key == "" {
+		return true
+	}
+	signature := r.IsTsig()
+	return signature != nil && w.TsigStatus() == nil && strings.EqualFold(signature.Hdr.Name, zone.Secondary.Key)
+}
+
+// notify handles a NOTIFY message of a primary by refreshing the secondary zone (RFC 1996 section 3)
+func (t *TransferServer) notify(w dns.ResponseWriter, r *dns.Msg) {
+	name := strings.ToLower(r.Question[0].Name)
+	zone, err := t.DB.GetZoneByName(name)
+	if err != nil || !zone.IsSecondary() || t.Refresher == nil {
+		refuse(w, r, dns.RcodeNotAuth)
+		return
+	}
+	if !notified(zone, w, r) {
+		log.Debugf("refused %s NOTIFY from %s", name, w.RemoteAddr())
+		refuse(w, r, dns.RcodeRefused)
+		return
+	}
+
+	log.Debugf("received %s NOTIFY from %s", name, w.RemoteAddr())
+	t.Refresher.Notify(zone.Zone)
+	t.reply(w, r, nil)
+}
+
+// ServeDNS answers a single query of a secondary nameserver or NOTIFY message of a primary
+func (t *TransferServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if r.Opcode == dns.OpcodeNotify && len(r.Question) == 1 {
+		t.notify(w, r)
+		return
+	}
+	if r.Opcode == dns.OpcodeUpdate {
+		t.update(w, r)
+		return
+	}
+	if r.Opcode != dns.OpcodeQuery || len(r.Question) != 1 {
+		refuse(w, r, dns.RcodeNotImplemented)
+		return
+	}
+	question := r.Question[0]
+	name := strings.ToLower(question.Name)
+
+	zone, err := t.DB.GetZoneByName(name)
+	if err != nil || !zone.Active() || !zone.Loaded() {
+		refuse(w, r, dns.RcodeNotAuth)
+		return
+	}
+	if !authorized(zone, w, r) {
+		log.Debugf("refused %s %s transfer to %s", name, dns.TypeToString[question.Qtype], w.RemoteAddr())
+		refuse(w, r, dns.RcodeRefused)
+		return
+	}
+
+	export, err := Export(t.DB, name)
+	if err != nil {
+		log.Warnf("exporting %s for transfer: %v", name, err)
+		refuse(w, r, dns.RcodeServerFailure)
+		return
+	}
+	records, err := TransferRecords(export)
+	if err != nil {
+		log.Warnf("building %s transfer: %v", name, err)
+		refuse(w, r, dns.RcodeServerFailure)
+		return
+	}
+	head := records[0]
+	_, tcp := w.RemoteAddr().(*net.TCPAddr)
+
+	switch question.Qtype {
+	case dns.TypeSOA:
+		t.reply(w, r, []dns.RR{head})
+	case dns.TypeAXFR:
+		if !tcp {
+			refuse(w, r, dns.RcodeRefused)
+			return
+		}
+		t.transfer(w, r, append(records, head))
+	case dns.TypeIXFR:
+		// Answer UDP queries and secondaries that are up to date or ahead with the SOA record only, which makes UDP clients retry over TCP (RFC 1995 section 2)
+		var serial uint32
+		known := false
+		if len(r.Ns) > 0 {
+			if s, ok := r.Ns[0].(*dns.SOA); ok {
+				serial, known = s.Serial, true
+			}
+		}
+		if !tcp || (known && !soa.Less(serial, export.Serial)) {
+			t.reply(w, r, []dns.RR{head})
+			return
+		}
+
+		entry, err := t.DB.GetJournalEntry(export.Zone, serial)
+		if !known || err != nil {
+			t.transfer(w, r, append(records, head)) // too old to be journaled, send the whole zone
+			return
+		}
+		diff, err := ixfr(entry, records)
+		if err != nil {
+			log.Warnf("building %s IXFR from %d: %v", name, serial, err)
+			t.transfer(w, r, append(records, head))
+			return
+		}
+		t.transfer(w, r, diff)
+	default:
+		refuse(w, r, dns.RcodeRefused)
+	}
+}
+
+// reply sends a single authoritative answer, signed if the query was
+func (t *TransferServer) reply(w dns.ResponseWriter, r *dns.Msg, answer []dns.RR) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.Answer = answer
+	if signature := r.IsTsig(); signature != nil && w.TsigStatus() == nil {
+		m.SetTsig(signature.Hdr.Name, signature.Algorithm, signature.Fudge, time.Now().Unix())
+	}
+	_ = w.WriteMsg(m)
+}
+
+// transfer streams records to a secondary in as many messages as needed
+func (t *TransferServer) transfer(w dns.ResponseWriter, r *dns.Msg, records []dns.RR) {
+	ch := make(chan *dns.Envelope)
+	tr := new(dns.Transfer)
+	done := make(chan error, 1)
+	go func() {
+		done <- tr.Out(w, r, ch)
+	}()
+
+	for i := 0; i < len(records); i += envelopeSize {
+		end := i + envelopeSize
+		if end > len(records) {
+			end = len(records)
+		}
+		ch <- &dns.Envelope{RR: records[i:end]}
+	}
+	close(ch)
+
+	if err := <-done; err != nil {
+		log.Warnf("transferring %s to %s: %v", r.Question[0].Name, w.RemoteAddr(), err)
+	}
+	_ = w.Close()
+}
+
+// ixfr builds an incremental transfer from a journaled serial to the current records
+func ixfr(entry database.JournalEntry, records []dns.RR) ([]dns.RR, error) {
+	if len(entry.Records) == 0 {
+		return nil, database.ErrNotFound
+	}
+	old, err := dns.NewRR(entry.Records[0])
+	if err != nil {
+		return nil, err
+	}
+
+	current := map[string]bool{}
+	for _, rr := range records[1:] {
+		current[rr.String()] = true
+	}
+	previous := map[string]bool{}
+	for _, record := range entry.Records[1:] {
+		previous[record] = true
+	}
+
+	soa := records[0]
+	diff := []dns.RR{soa, old}
+	for _, record := range entry.Records[1:] {
+		if !current[record] {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				return nil, err
+			}
+			diff = append(diff, rr)
+		}
+	}
+	diff = append(diff, soa)
+	for _, rr := range records[1:] {
+		if !previous[rr.String()] {
+			diff = append(diff, rr)
+		}
+	}
+	return append(diff, soa), nil
+}
@@ -0,0 +1,139 @@
+package control
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/soa"
+)
+
+// transferWriter records the messages sent to a secondary
+type transferWriter struct {
+	remote   net.Addr
+	messages []*dns.Msg
+}
+
+func (w *transferWriter) LocalAddr() net.Addr         { return &net.TCPAddr{Port: 53} }
+func (w *transferWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *transferWriter) WriteMsg(m *dns.Msg) error   { w.messages = append(w.messages, m); return nil }
+func (w *transferWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *transferWriter) Close() error                { return nil }
+func (w *transferWriter) TsigStatus() error           { return nil }
+func (w *transferWriter) TsigTimersOnly(bool)         {}
+func (w *transferWriter) Hijack()                     {}
+
+// answer gets the records of all messages sent
+func (w *transferWriter) answer() []dns.RR {
+	var records []dns.RR
+	for _, m := range w.messages {
+		records = append(records, m.Answer...)
+	}
+	return records
+}
+
+// TestTransfer checks IXFR from a journaled serial across a serial wraparound, AXFR fallback for serials outside the journal, and SOA only answers for secondaries that are current
+func TestTransfer(t *testing.T) {
+	db := database.NewMemory()
+	if err := db.AddZone(database.Zone{
+		Zone:         "example.com.",
+		Serial:       4294967295,
+		SerialScheme: soa.SchemeCounter,
+		Records:      []string{"www.example.com.\t300\tIN\tA\t192.0.2.1"},
+		Transfer:     database.TransferSettings{Allow: []string{"127.0.0.0/8"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	publish := func() {
+		export, err := Export(db, "example.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := PublishTransfer(db, export); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish()
+
+	// The next serial wraps around
+	serial, err := db.UpdateZoneRecords("example.com.", func(zone database.Zone) ([]string, error) {
+		return []string{"www.example.com.\t300\tIN\tA\t192.0.2.2"}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial >= 4294967295 || !soa.Less(4294967295, serial) {
+		t.Fatalf("serial after 4294967295 = %d, want a wrapped serial", serial)
+	}
+	publish()
+
+	server := NewTransferServer(db, "127.0.0.1:0", nil)
+	query := func(qtype uint16, from *uint32, tcp bool) []dns.RR {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", qtype)
+		if from != nil {
+			r.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET}, Serial: *from}}
+		}
+		w := &transferWriter{remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+		if !tcp {
+			w.remote = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+		}
+		server.ServeDNS(w, r)
+		if len(w.messages) == 0 || w.messages[0].Rcode != dns.RcodeSuccess {
+			t.Fatalf("%s from %v: messages = %v, want an answer", dns.TypeToString[qtype], from, w.messages)
+		}
+		return w.answer()
+	}
+	serials := func(records []dns.RR) []uint32 {
+		var s []uint32
+		for _, rr := range records {
+			if record, ok := rr.(*dns.SOA); ok {
+				s = append(s, record.Serial)
+			}
+		}
+		return s
+	}
+	equal := func(a []uint32, b []uint32) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+	u32 := func(s uint32) *uint32 { return &s }
+
+	// IXFR from the journaled serial before the wraparound is a single difference sequence
+	diff := query(dns.TypeIXFR, u32(4294967295), true)
+	if got := serials(diff); !equal(got, []uint32{serial, 4294967295, serial, serial}) {
+		t.Errorf("IXFR SOA serials = %v, want a difference from 4294967295 to %d", got, serial)
+	}
+	if len(diff) != 6 || diff[2].(*dns.A).A.String() != "192.0.2.1" || diff[4].(*dns.A).A.String() != "192.0.2.2" {
+		t.Errorf("IXFR = %v, want 192.0.2.1 removed and 192.0.2.2 added", diff)
+	}
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		from    *uint32
+		tcp     bool
+		serials []uint32 // SOA serials of the answer
+	}{
+		{"AXFR", dns.TypeAXFR, nil, true, []uint32{serial, serial}},
+		{"IXFR outside the journal", dns.TypeIXFR, u32(4294967000), true, []uint32{serial, serial}},
+		{"IXFR without a serial", dns.TypeIXFR, nil, true, []uint32{serial, serial}},
+		{"IXFR up to date", dns.TypeIXFR, u32(serial), true, []uint32{serial}},
+		{"IXFR ahead across the wraparound", dns.TypeIXFR, u32(serial + 10), true, []uint32{serial}},
+		{"IXFR over UDP", dns.TypeIXFR, u32(4294967295), false, []uint32{serial}},
+	}
+	for _, test := range tests {
+		if got := serials(query(test.qtype, test.from, test.tcp)); !equal(got, test.serials) {
+			t.Errorf("%s: SOA serials = %v, want %v", test.name, got, test.serials)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package control
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/natesales/cdn-tree/internal/crypto"
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// SecretsKey is the AES-256 key TSIG secrets are encrypted with at rest
+var SecretsKey []byte
+
+// ErrKeyRevoked is returned when a revoked TSIG key is used
+var ErrKeyRevoked = errors.New("TSIG key is revoked")
+
+// NodeTSIGKey stores a TSIG key as shipped to the edge nodes in the manifest
+type NodeTSIGKey struct {
+	Name      string   `json:"name"`
+	Algorithm string   `json:"algorithm"`
+	Secret    string   `json:"secret"`
+	Zones     []string `json:"zones"` // zones the key may query signed
+}
+
+// SealTSIGKey encrypts the secret of a key with SecretsKey
+func SealTSIGKey(key *database.TSIGKey) error {
+	if key.Encrypted || key.Secret == "" {
+		return nil
+	}
+	if SecretsKey == nil {
+		return errors.New("no secrets key is configured")
+	}
+
+	sealed, err := crypto.Seal(SecretsKey, []byte(key.Secret))
+	if err != nil {
+		return err
+	}
+	key.Secret = sealed
+	key.Encrypted = true
+	return nil
+}
+
+// OpenTSIGKey gets a copy of a key with its secret decrypted
+func OpenTSIGKey(key database.TSIGKey) (database.TSIGKey, error) {
+	if !key.Encrypted {
+		return key, nil
+	}
+	if SecretsKey == nil {
+		return database.TSIGKey{}, errors.New("no secrets key is configured to decrypt TSIG key " + key.Name)
+	}
+
+	secret, err := crypto.Open(SecretsKey, key.Secret)
+	if err != nil {
+		return database.TSIGKey{}, err
+	}
+	key.Secret = string(secret)
+	key.Encrypted = false
+	return key, nil
+}
+
+// TSIGKey looks up an active TSIG key by name with its secret decrypted
+func TSIGKey(db database.Store, name string) (database.TSIGKey, error) {
+	key, err := db.GetTSIGKey(name)
+	if err != nil {
+		return database.TSIGKey{}, err
+	}
+	if !key.Active() {
+		return database.TSIGKey{}, ErrKeyRevoked
+	}
+	return OpenTSIGKey(key)
+}
+
+// activeTSIGKeys gets all active TSIG keys with their secrets decrypted. Keys that can't be decrypted are left out.
+func activeTSIGKeys(db database.Store) ([]database.TSIGKey, error) {
+	keys, err := db.ListTSIGKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	var active []database.TSIGKey
+	for _, key := range keys {
+		if !key.Active() {
+			continue
+		}
+		opened, err := OpenTSIGKey(key)
+		if err != nil {
+			log.Warnf("decrypting TSIG key %s: %v", key.Name, err)
+			continue
+		}
+		active = append(active, opened)
+	}
+	return active, nil
+}
+
+// TSIGSecrets gets the secrets of all active TSIG keys by key name
+func TSIGSecrets(db database.Store) (map[string]string, error) {
+	keys, err := activeTSIGKeys(db)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := map[string]string{}
+	for _, key := range keys {
+		secrets[key.Name] = key.Secret
+	}
+	return secrets, nil
+}
+
+// NodeTSIGKeys gets all active TSIG keys that may query at least one served zone, with the zones they may query
+func NodeTSIGKeys(db database.Store) ([]NodeTSIGKey, error) {
+	keys, err := activeTSIGKeys(db)
+	if err != nil {
+		return nil, err
+	}
+	zones, err := db.ListZones()
+	if err != nil {
+		return nil, err
+	}
+
+	nodeKeys := []NodeTSIGKey{}
+	for _, key := range keys {
+		var served []string
+		for _, zone := range zones {
+			if zone.Active() && zone.Loaded() && key.UsableBy(zone) {
+				served = append(served, zone.Zone)
+			}
+		}
+		if len(served) > 0 {
+			nodeKeys = append(nodeKeys, NodeTSIGKey{Name: key.Name, Algorithm: key.Algorithm, Secret: key.Secret, Zones: served})
+		}
+	}
+	return nodeKeys, nil
+}
+
+// SealTSIGKeys encrypts the secrets of keys stored in plaintext and returns the number encrypted
+func SealTSIGKeys(db database.Store) (int, error) {
+	if SecretsKey == nil {
+		return 0, nil
+	}
+
+	keys, err := db.ListTSIGKeys()
+	if err != nil {
+		return 0, err
+	}
+
+	sealed := 0
+	for _, key := range keys {
+		if key.Encrypted || key.Secret == "" {
+			continue
+		}
+		if err := SealTSIGKey(&key); err != nil {
+			return sealed, err
+		}
+		if err := db.UpdateTSIGKey(key); err != nil {
+			return sealed, err
+		}
+		sealed++
+	}
+	return sealed, nil
+}
@@ -0,0 +1,91 @@
+package control
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// TestTSIGKeySecrets checks that secrets are sealed with SecretsKey, that plaintext secrets of earlier versions are sealed once, and that revoked keys aren't served
+func TestTSIGKeySecrets(t *testing.T) {
+	SecretsKey = bytes.Repeat([]byte{1}, 32)
+	defer func() { SecretsKey = nil }()
+
+	// A sealed secret opens to the same secret
+	key := database.TSIGKey{Name: "zone.", Zone: "example.com.", Algorithm: "hmac-sha256.", Secret: "c2VjcmV0c2VjcmV0c2VjcmV0"}
+	sealed := key
+	if err := SealTSIGKey(&sealed); err != nil {
+		t.Fatal(err)
+	}
+	if !sealed.Encrypted || sealed.Secret == key.Secret {
+		t.Fatalf("sealed key = %+v, want an encrypted secret", sealed)
+	}
+	if opened, err := OpenTSIGKey(sealed); err != nil || !reflect.DeepEqual(opened, key) {
+		t.Fatalf("opened key = %+v, %v, want %+v", opened, err, key)
+	}
+
+	// Keys stored in plaintext are sealed by SealTSIGKeys, revoked keys have no secret to seal
+	db := database.NewMemory()
+	if err := db.AddZone(database.Zone{Zone: "example.com.", Users: []string{"user"}, Records: []string{}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []database.TSIGKey{
+		key,
+		{Name: "account.", User: "user", Algorithm: "hmac-sha256.", Secret: "YWNjb3VudGFjY291bnRhY2NvdW50"},
+		{Name: "revoked.", Zone: "example.com.", Algorithm: "hmac-sha256.", Revoked: 1},
+		{Name: "other.", User: "other", Algorithm: "hmac-sha256.", Secret: "b3RoZXJvdGhlcm90aGVyb3RoZXI="},
+	} {
+		if err := db.AddTSIGKey(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sealedKeys, err := SealTSIGKeys(db); err != nil || sealedKeys != 3 {
+		t.Fatalf("sealed %d keys, %v, want 3", sealedKeys, err)
+	}
+	if sealedKeys, err := SealTSIGKeys(db); err != nil || sealedKeys != 0 {
+		t.Errorf("sealed %d keys again, %v, want 0", sealedKeys, err)
+	}
+	stored, err := db.GetTSIGKey("zone.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Encrypted || stored.Secret == key.Secret {
+		t.Errorf("stored key = %+v, want an encrypted secret", stored)
+	}
+
+	secrets, err := TSIGSecrets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"zone.": key.Secret, "account.": "YWNjb3VudGFjY291bnRhY2NvdW50", "other.": "b3RoZXJvdGhlcm90aGVyb3RoZXI="}
+	if !reflect.DeepEqual(secrets, want) {
+		t.Errorf("secrets = %v, want %v", secrets, want)
+	}
+
+	// Only keys that may query a served zone are shipped to the nodes
+	nodeKeys, err := NodeTSIGKeys(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string][]string{}
+	for _, k := range nodeKeys {
+		names[k.Name] = k.Zones
+		if k.Secret != want[k.Name] {
+			t.Errorf("node key %s has secret %s, want %s", k.Name, k.Secret, want[k.Name])
+		}
+	}
+	if !reflect.DeepEqual(names, map[string][]string{"zone.": {"example.com."}, "account.": {"example.com."}}) {
+		t.Errorf("node keys = %v, want zone. and account. for example.com.", names)
+	}
+
+	// Keys sealed with another secrets key are left out
+	SecretsKey = bytes.Repeat([]byte{2}, 32)
+	if _, err := OpenTSIGKey(stored); err == nil {
+		t.Error("opened a key with the wrong secrets key")
+	}
+	if secrets, err := TSIGSecrets(db); err != nil || len(secrets) != 0 {
+		t.Errorf("secrets with the wrong secrets key = %v, %v, want none", secrets, err)
+	}
+}
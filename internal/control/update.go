@@ -0,0 +1,391 @@
+package control
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// maxUpdateRecords is the largest number of prerequisites or updates in a single UPDATE message
+const maxUpdateRecords = 1000
+
+// rcodeError is a failed UPDATE, answered with the rcode
+type rcodeError int
+
+// Error gets the name of the rcode
+func (e rcodeError) Error() string {
+	return dns.RcodeToString[int(e)]
+}
+
+// UpdateAllowed reports whether a TSIG key's policy allows changing records of a name and type
+func UpdateAllowed(policy []database.UpdateRule, name string, rrtype uint16) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, rule := range policy {
+		ruleName := strings.ToLower(dns.Fqdn(rule.Name))
+		if strings.HasPrefix(ruleName, "*.") {
+			parent := ruleName[2:]
+			if name == parent || !dns.IsSubDomain(parent, name) {
+				continue
+			}
+		} else if name != ruleName {
+			continue
+		}
+
+		if len(rule.Types) == 0 {
+			return true
+		}
+		// Deleting all records of a name needs a rule for all types
+		if rrtype == dns.TypeANY {
+			continue
+		}
+		for _, t := range rule.Types {
+			if dns.StringToType[strings.ToUpper(t)] == rrtype {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// updateView stores the parsed records of a zone for prerequisite checks
+type updateView struct {
+	apex    string
+	records []dns.RR
+}
+
+// inUse reports whether a name has any records. The apex always has its SOA and NS records.
+func (v updateView) inUse(name string) bool {
+	if strings.EqualFold(name, v.apex) {
+		return true
+	}
+	for _, rr := range v.records {
+		if strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// rrset gets the records of a name and type
+func (v updateView) rrset(name string, rrtype uint16) []dns.RR {
+	var set []dns.RR
+	for _, rr := range v.records {
+		if rr.Header().Rrtype == rrtype && strings.EqualFold(rr.Header().Name, name) {
+			set = append(set, rr)
+		}
+	}
+	return set
+}
+
+// exists reports whether a name has records of a type, counting the apex SOA and NS records
+func (v updateView) exists(name string, rrtype uint16) bool {
+	if strings.EqualFold(name, v.apex) && (rrtype == dns.TypeSOA || rrtype == dns.TypeNS) {
+		return true
+	}
+	return len(v.rrset(name, rrtype)) > 0
+}
+
+// sameRRset reports whether two record sets have the same records, ignoring TTLs and order
+func sameRRset(a []dns.RR, b []dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if dns.IsDuplicate(x, y) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPrerequisites checks the prerequisites of an UPDATE message (RFC 2136 section 3.2)
+func checkPrerequisites(view updateView, prerequisites []dns.RR) error {
+	valueDependent := map[string][]dns.RR{}
+	for _, rr := range prerequisites {
+		header := rr.Header()
+		if header.Ttl != 0 {
+			return rcodeError(dns.RcodeFormatError)
+		}
+		if !dns.IsSubDomain(view.apex, header.Name) {
+			return rcodeError(dns.RcodeNotZone)
+		}
+
+		switch header.Class {
+		case dns.ClassANY:
+			if header.Rdlength != 0 {
+				return rcodeError(dns.RcodeFormatError)
+			}
+			if header.Rrtype == dns.TypeANY {
+				if !view.inUse(header.Name) {
+					return rcodeError(dns.RcodeNameError)
+				}
+			} else if !view.exists(header.Name, header.Rrtype) {
+				return rcodeError(dns.RcodeNXRrset)
+			}
+		case dns.ClassNONE:
+			if header.Rdlength != 0 {
+				return rcodeError(dns.RcodeFormatError)
+			}
+			if header.Rrtype == dns.TypeANY {
+				if view.inUse(header.Name) {
+					return rcodeError(dns.RcodeYXDomain)
+				}
+			} else if view.exists(header.Name, header.Rrtype) {
+				return rcodeError(dns.RcodeYXRrset)
+			}
+		case dns.ClassINET:
+			key := strings.ToLower(header.Name) + "/" + dns.TypeToString[header.Rrtype]
+			valueDependent[key] = append(valueDependent[key], rr)
+		default:
+			return rcodeError(dns.RcodeFormatError)
+		}
+	}
+
+	// Value dependent prerequisites need the whole RRset to match
+	for _, set := range valueDependent {
+		header := set[0].Header()
+		if !sameRRset(set, view.rrset(header.Name, header.Rrtype)) {
+			return rcodeError(dns.RcodeNXRrset)
+		}
+	}
+	return nil
+}
+
+// prescanUpdates checks the updates of an UPDATE message and the key's policy (RFC 2136 section 3.4.1)
+func prescanUpdates(apex string, policy []database.UpdateRule, updates []dns.RR) error {
+	for _, rr := range updates {
+		header := rr.Header()
+		if !dns.IsSubDomain(apex, header.Name) {
+			return rcodeError(dns.RcodeNotZone)
+		}
+
+		switch header.Class {
+		case dns.ClassINET:
+			if header.Rrtype == dns.TypeANY || header.Rrtype == dns.TypeAXFR || header.Rrtype == dns.TypeIXFR || header.Rrtype == dns.TypeMAILA || header.Rrtype == dns.TypeMAILB {
+				return rcodeError(dns.RcodeFormatError)
+			}
+		case dns.ClassANY:
+			if header.Ttl != 0 || header.Rdlength != 0 || header.Rrtype == dns.TypeAXFR || header.Rrtype == dns.TypeIXFR || header.Rrtype == dns.TypeMAILA || header.Rrtype == dns.TypeMAILB {
+				return rcodeError(dns.RcodeFormatError)
+			}
+		case dns.ClassNONE:
+			if header.Ttl != 0 || header.Rrtype == dns.TypeANY || header.Rrtype == dns.TypeAXFR || header.Rrtype == dns.TypeIXFR || header.Rrtype == dns.TypeMAILA || header.Rrtype == dns.TypeMAILB {
+				return rcodeError(dns.RcodeFormatError)
+			}
+		default:
+			return rcodeError(dns.RcodeFormatError)
+		}
+
+		// The SOA record and apex NS records are generated from the zone settings
+		if header.Rrtype == dns.TypeSOA || (header.Rrtype == dns.TypeNS && strings.EqualFold(header.Name, apex)) {
+			return rcodeError(dns.RcodeRefused)
+		}
+		if !UpdateAllowed(policy, header.Name, header.Rrtype) {
+			return rcodeError(dns.RcodeRefused)
+		}
+	}
+	return nil
+}
+
+// applyUpdates applies the update section of an UPDATE message to a set of records (RFC 2136 section 3.4.2)
+func applyUpdates(records []dns.RR, updates []dns.RR) []dns.RR {
+	for _, update := range updates {
+		header := update.Header()
+		switch header.Class {
+		case dns.ClassINET:
+			// CNAME records can't share their name with other records, conflicting additions are ignored
+			conflict := false
+			for _, rr := range records {
+				if strings.EqualFold(rr.Header().Name, header.Name) && (rr.Header().Rrtype == dns.TypeCNAME) != (header.Rrtype == dns.TypeCNAME) {
+					conflict = true
+					break
+				}
+			}
+			if conflict {
+				continue
+			}
+
+			replaced := false
+			for i, rr := range records {
+				if dns.IsDuplicate(rr, update) || (header.Rrtype == dns.TypeCNAME && rr.Header().Rrtype == dns.TypeCNAME && strings.EqualFold(rr.Header().Name, header.Name)) {
+					records[i] = dns.Copy(update) // a duplicate only changes the TTL
+					replaced = true
+					break
+				}
+			}
+			if !replaced {
+				records = append(records, dns.Copy(update))
+			}
+		case dns.ClassANY, dns.ClassNONE:
+			var kept []dns.RR
+			for _, rr := range records {
+				remove := strings.EqualFold(rr.Header().Name, header.Name)
+				if header.Class == dns.ClassNONE {
+					deleted := dns.Copy(update)
+					deleted.Header().Class = dns.ClassINET
+					remove = dns.IsDuplicate(rr, deleted)
+				} else if header.Rrtype != dns.TypeANY {
+					remove = remove && rr.Header().Rrtype == header.Rrtype
+				}
+				if !remove {
+					kept = append(kept, rr)
+				}
+			}
+			records = kept
+		}
+	}
+	return records
+}
+
+// ApplyUpdate applies an UPDATE message to a zone atomically. Refusals are rcodeErrors.
+func ApplyUpdate(db database.Store, zone string, key database.TSIGKey, r *dns.Msg) (uint32, error) {
+	if len(r.Answer) > maxUpdateRecords || len(r.Ns) > maxUpdateRecords {
+		return 0, rcodeError(dns.RcodeFormatError)
+	}
+
+	var before, after []string
+	serial, err := db.UpdateZoneRecords(zone, func(current database.Zone) ([]string, error) {
+		view := updateView{apex: current.Zone}
+		for _, record := range current.Records {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				return nil, err
+			}
+			if rr != nil {
+				view.records = append(view.records, rr)
+			}
+		}
+
+		if err := checkPrerequisites(view, r.Answer); err != nil {
+			return nil, err
+		}
+		if err := prescanUpdates(current.Zone, key.Policy, r.Ns); err != nil {
+			return nil, err
+		}
+
+		updated := applyUpdates(append([]dns.RR(nil), view.records...), r.Ns)
+		before = current.Records
+		after = make([]string, 0, len(updated))
+		for _, rr := range updated {
+			after = append(after, rr.String())
+		}
+		return after, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if !equalStrings(before, after) {
+		if err := RecordVersion(db, zone, "tsig:"+key.Name, "dns update"); err != nil {
+			log.Warnf("record zone version: %v", err)
+		}
+		if err := QueueZonePush(db, zone); err != nil {
+			log.Warnf("queue zone push: %v", err)
+		}
+	}
+	auditUpdate(db, zone, key, before, after, nil)
+	return serial, nil
+}
+
+// equalStrings reports whether two string slices are the same
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// auditUpdate records a DNS UPDATE in the audit log
+func auditUpdate(db database.Store, zone string, key database.TSIGKey, before []string, after []string, cause error) {
+	entry := database.AuditEntry{
+		Time:     time.Now().UnixNano(),
+		Actor:    key.User,
+		Method:   "UPDATE",
+		Path:     key.Name,
+		Resource: "record",
+		Zone:     zone,
+		Outcome:  "success",
+	}
+	if cause != nil {
+		entry.Outcome = "failure"
+		entry.Error = cause.Error()
+	} else if !equalStrings(before, after) {
+		entry.Diff = map[string]database.AuditChange{"records": {Before: before, After: after}}
+	}
+	if err := db.AddAuditEntry(entry); err != nil {
+		log.Warnf("audit DNS update: %v", err)
+	}
+}
+
+// update handles an UPDATE message (RFC 2136) signed with a TSIG key of the zone
+func (t *TransferServer) update(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		refuse(w, r, dns.RcodeFormatError)
+		return
+	}
+	name := strings.ToLower(r.Question[0].Name)
+
+	signature := r.IsTsig()
+	if signature == nil {
+		refuse(w, r, dns.RcodeRefused)
+		return
+	}
+	if w.TsigStatus() != nil {
+		refuse(w, r, dns.RcodeNotAuth)
+		return
+	}
+
+	zone, err := t.DB.GetZoneByName(name)
+	if err != nil || !zone.Active() {
+		t.replyRcode(w, r, dns.RcodeNotAuth)
+		return
+	}
+	key, err := t.DB.GetTSIGKey(strings.ToLower(signature.Hdr.Name))
+	if err != nil || !key.Active() || !key.UsableBy(zone) || zone.IsSecondary() {
+		log.Debugf("refused %s UPDATE signed with %s from %s", name, signature.Hdr.Name, w.RemoteAddr())
+		t.replyRcode(w, r, dns.RcodeRefused)
+		return
+	}
+
+	serial, err := ApplyUpdate(t.DB, zone.Zone, key, r)
+	if err != nil {
+		var rcode rcodeError
+		if !errors.As(err, &rcode) {
+			log.Warnf("applying %s UPDATE: %v", name, err)
+			rcode = rcodeError(dns.RcodeServerFailure)
+		}
+		auditUpdate(t.DB, zone.Zone, key, nil, nil, rcode)
+		t.replyRcode(w, r, int(rcode))
+		return
+	}
+
+	log.Debugf("applied %s UPDATE signed with %s, serial %d", name, key.Name, serial)
+	t.replyRcode(w, r, dns.RcodeSuccess)
+}
+
+// replyRcode answers a message with a rcode, signed if the message was
+func (t *TransferServer) replyRcode(w dns.ResponseWriter, r *dns.Msg, rcode int) {
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	if signature := r.IsTsig(); signature != nil && w.TsigStatus() == nil {
+		m.SetTsig(signature.Hdr.Name, signature.Algorithm, signature.Fudge, time.Now().Unix())
+	}
+	_ = w.WriteMsg(m)
+}
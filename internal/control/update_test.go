@@ -0,0 +1,172 @@
+package control
+
+import (
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/soa"
+)
+
+// testRR parses a record for an UPDATE message
+func testRR(t *testing.T, record string) dns.RR {
+	rr, err := dns.NewRR(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// TestApplyUpdate checks the prerequisites, the key policy and the update semantics of DNS UPDATE messages
+func TestApplyUpdate(t *testing.T) {
+	records := []string{
+		"example.com.\t300\tIN\tA\t192.0.2.1",
+		"www.example.com.\t300\tIN\tA\t192.0.2.2",
+		"www.example.com.\t300\tIN\tA\t192.0.2.3",
+		"txt.example.com.\t300\tIN\tTXT\t\"hello\"",
+		"txt.example.com.\t300\tIN\tA\t192.0.2.4",
+	}
+	key := database.TSIGKey{Name: "key.", Policy: []database.UpdateRule{
+		{Name: "example.com."},
+		{Name: "www.example.com.", Types: []string{"A"}},
+		{Name: "txt.example.com."},
+	}}
+
+	tests := []struct {
+		name  string
+		build func(t *testing.T, m *dns.Msg)
+		rcode int
+		want  []string // records after the update, unchanged if nil
+	}{
+		// Prerequisites (RFC 2136 section 2.4)
+		{"name in use", func(t *testing.T, m *dns.Msg) {
+			m.NameUsed([]dns.RR{testRR(t, "www.example.com. 0 IN A 0.0.0.0")})
+		}, dns.RcodeSuccess, nil},
+		{"name not in use", func(t *testing.T, m *dns.Msg) {
+			m.NameUsed([]dns.RR{testRR(t, "missing.example.com. 0 IN A 0.0.0.0")})
+		}, dns.RcodeNameError, nil},
+		{"name used but shouldn't be", func(t *testing.T, m *dns.Msg) {
+			m.NameNotUsed([]dns.RR{testRR(t, "www.example.com. 0 IN A 0.0.0.0")})
+		}, dns.RcodeYXDomain, nil},
+		{"apex always in use", func(t *testing.T, m *dns.Msg) {
+			m.NameNotUsed([]dns.RR{testRR(t, "example.com. 0 IN A 0.0.0.0")})
+		}, dns.RcodeYXDomain, nil},
+		{"rrset exists", func(t *testing.T, m *dns.Msg) {
+			m.RRsetUsed([]dns.RR{testRR(t, "www.example.com. 0 IN A 0.0.0.0")})
+		}, dns.RcodeSuccess, nil},
+		{"rrset missing", func(t *testing.T, m *dns.Msg) {
+			m.RRsetUsed([]dns.RR{testRR(t, "www.example.com. 0 IN TXT \"\"")})
+		}, dns.RcodeNXRrset, nil},
+		{"apex NS exists", func(t *testing.T, m *dns.Msg) {
+			m.RRsetUsed([]dns.RR{testRR(t, "example.com. 0 IN NS ns.example.com.")})
+		}, dns.RcodeSuccess, nil},
+		{"rrset exists but shouldn't", func(t *testing.T, m *dns.Msg) {
+			m.RRsetNotUsed([]dns.RR{testRR(t, "www.example.com. 0 IN A 0.0.0.0")})
+		}, dns.RcodeYXRrset, nil},
+		{"whole rrset matches", func(t *testing.T, m *dns.Msg) {
+			m.Used([]dns.RR{testRR(t, "www.example.com. 0 IN A 192.0.2.3"), testRR(t, "www.example.com. 0 IN A 192.0.2.2")})
+		}, dns.RcodeSuccess, nil},
+		{"part of rrset", func(t *testing.T, m *dns.Msg) {
+			m.Used([]dns.RR{testRR(t, "www.example.com. 0 IN A 192.0.2.2")})
+		}, dns.RcodeNXRrset, nil},
+		{"prerequisite outside the zone", func(t *testing.T, m *dns.Msg) {
+			m.NameUsed([]dns.RR{testRR(t, "example.net. 0 IN A 0.0.0.0")})
+		}, dns.RcodeNotZone, nil},
+		{"failed prerequisite leaves records", func(t *testing.T, m *dns.Msg) {
+			m.RRsetNotUsed([]dns.RR{testRR(t, "www.example.com. 0 IN A 0.0.0.0")})
+			m.RemoveRRset([]dns.RR{testRR(t, "www.example.com. 0 IN A 0.0.0.0")})
+		}, dns.RcodeYXRrset, nil},
+
+		// Updates (RFC 2136 section 2.5)
+		{"add", func(t *testing.T, m *dns.Msg) {
+			m.Insert([]dns.RR{testRR(t, "www.example.com. 300 IN A 192.0.2.5")})
+		}, dns.RcodeSuccess, append(append([]string{}, records...), "www.example.com.\t300\tIN\tA\t192.0.2.5")},
+		{"delete rrset with ANY", func(t *testing.T, m *dns.Msg) {
+			m.RemoveRRset([]dns.RR{testRR(t, "txt.example.com. 0 IN TXT \"\"")})
+		}, dns.RcodeSuccess, []string{records[0], records[1], records[2], records[4]}},
+		{"delete name with ANY", func(t *testing.T, m *dns.Msg) {
+			m.RemoveName([]dns.RR{testRR(t, "txt.example.com. 0 IN A 0.0.0.0")})
+		}, dns.RcodeSuccess, records[:3]},
+		{"delete record with NONE", func(t *testing.T, m *dns.Msg) {
+			m.Remove([]dns.RR{testRR(t, "www.example.com. 0 IN A 192.0.2.2")})
+		}, dns.RcodeSuccess, []string{records[0], records[2], records[3], records[4]}},
+		{"delete missing record", func(t *testing.T, m *dns.Msg) {
+			m.Remove([]dns.RR{testRR(t, "www.example.com. 0 IN A 192.0.2.9")})
+		}, dns.RcodeSuccess, nil},
+
+		// Policy and platform managed records
+		{"type not allowed", func(t *testing.T, m *dns.Msg) {
+			m.Insert([]dns.RR{testRR(t, "www.example.com. 300 IN TXT \"denied\"")})
+		}, dns.RcodeRefused, nil},
+		{"name not allowed", func(t *testing.T, m *dns.Msg) {
+			m.Insert([]dns.RR{testRR(t, "other.example.com. 300 IN A 192.0.2.5")})
+		}, dns.RcodeRefused, nil},
+		{"delete name without a rule for all types", func(t *testing.T, m *dns.Msg) {
+			m.RemoveName([]dns.RR{testRR(t, "www.example.com. 0 IN A 0.0.0.0")})
+		}, dns.RcodeRefused, nil},
+		{"SOA", func(t *testing.T, m *dns.Msg) {
+			m.Insert([]dns.RR{testRR(t, "example.com. 300 IN SOA ns.example.com. hostmaster.example.com. 100 7200 3600 1209600 300")})
+		}, dns.RcodeRefused, nil},
+		{"apex NS", func(t *testing.T, m *dns.Msg) {
+			m.RemoveRRset([]dns.RR{testRR(t, "example.com. 0 IN NS ns.example.com.")})
+		}, dns.RcodeRefused, nil},
+		{"delegation NS", func(t *testing.T, m *dns.Msg) {
+			m.Insert([]dns.RR{testRR(t, "txt.example.com. 300 IN NS ns.example.net.")})
+		}, dns.RcodeSuccess, append(append([]string{}, records...), "txt.example.com.\t300\tIN\tNS\tns.example.net.")},
+		{"update outside the zone", func(t *testing.T, m *dns.Msg) {
+			m.Insert([]dns.RR{testRR(t, "www.example.net. 300 IN A 192.0.2.5")})
+		}, dns.RcodeNotZone, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := database.NewMemory()
+			if err := db.AddZone(database.Zone{Zone: "example.com.", Serial: 1, SerialScheme: soa.SchemeCounter, Records: records}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Go through the wire format like a received message
+			m := new(dns.Msg)
+			m.SetUpdate("example.com.")
+			test.build(t, m)
+			packed, err := m.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := new(dns.Msg)
+			if err := r.Unpack(packed); err != nil {
+				t.Fatal(err)
+			}
+
+			serial, err := ApplyUpdate(db, "example.com.", key, r)
+			var rcode rcodeError
+			if err != nil && !errors.As(err, &rcode) {
+				t.Fatal(err)
+			}
+			if int(rcode) != test.rcode {
+				t.Fatalf("rcode = %s, want %s", dns.RcodeToString[int(rcode)], dns.RcodeToString[test.rcode])
+			}
+
+			zone, err := db.GetZoneByName("example.com.")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, wantSerial := test.want, uint32(2)
+			if want == nil {
+				want, wantSerial = records, 1
+			}
+			got := append([]string{}, zone.Records...)
+			want = append([]string{}, want...)
+			sort.Strings(got)
+			sort.Strings(want)
+			if !equalStrings(got, want) {
+				t.Errorf("records = %q, want %q", got, want)
+			}
+			if zone.Serial != wantSerial || (test.rcode == dns.RcodeSuccess && serial != wantSerial) {
+				t.Errorf("serial = %d, returned %d, want %d", zone.Serial, serial, wantSerial)
+			}
+		})
+	}
+}
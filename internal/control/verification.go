@@ -0,0 +1,84 @@
+package control
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// ChallengeLabel is the label under a pending zone that the TXT challenge record is published at
+const ChallengeLabel = "_cdnv3-challenge"
+
+// Ways control of a domain can be proven
+const (
+	VerifiedChallenge  = "txt"        // the TXT challenge record was found
+	VerifiedDelegation = "delegation" // the parent delegates the zone to its nameservers
+	VerifiedAdmin      = "admin"      // an administrator activated the zone
+)
+
+// ErrPending is returned when a zone that hasn't been verified is requested for serving
+var ErrPending = errors.New("zone is pending verification")
+
+// Challenge stores the TXT record that proves control of a pending zone
+type Challenge struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// ZoneChallenge gets the TXT challenge of a zone
+func ZoneChallenge(zone database.Zone) Challenge {
+	return Challenge{Name: ChallengeLabel + "." + zone.Zone, Value: zone.Challenge}
+}
+
+// checkChallenge looks up the TXT challenge record of a zone through the resolver
+func checkChallenge(zone database.Zone) (bool, error) {
+	challenge := ZoneChallenge(zone)
+	response, err := exchange(Resolver, challenge.Name, dns.TypeTXT, true)
+	if err != nil {
+		return false, err
+	}
+
+	for _, rr := range response.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == challenge.Value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ActivateZone marks a zone as verified and pushes it to the edges
+func ActivateZone(db database.Store, zone string, method string) error {
+	if err := db.ActivateZone(zone, method); err != nil {
+		return err
+	}
+	return QueueZonePush(db, zone)
+}
+
+// VerifyZone activates a pending zone if control was proven, and returns how it was proven
+func VerifyZone(db database.Store, zone database.Zone) (string, error) {
+	if zone.Active() {
+		return zone.VerifiedBy, nil
+	}
+
+	method := ""
+	found, challengeErr := checkChallenge(zone)
+	if found {
+		method = VerifiedChallenge
+	} else {
+		// Every expected nameserver must be delegated to, the old provider's nameservers may still be listed while moving
+		report := CheckDelegation(zone.Zone, ZoneNameservers(zone))
+		if len(report.Found) > 0 && len(report.Missing) == 0 {
+			method = VerifiedDelegation
+		} else if challengeErr == nil && report.Error != "" {
+			challengeErr = errors.New(report.Error)
+		}
+	}
+
+	if method == "" {
+		return "", challengeErr
+	}
+	return method, ActivateZone(db, zone.Zone, method)
+}
@@ -0,0 +1,125 @@
+package control
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// testResolver runs a resolver stand-in with the given records on a local port and points Resolver at it. Names in failing are answered with SERVFAIL.
+func testResolver(t *testing.T, records []string, failing ...string) {
+	zone := map[string][]dns.RR{}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zone[rr.Header().Name] = append(zone[rr.Header().Name], rr)
+	}
+	broken := map[string]bool{}
+	for _, name := range failing {
+		broken[name] = true
+	}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+
+		if broken[q.Name] {
+			m.Rcode = dns.RcodeServerFailure
+		} else if len(zone[q.Name]) == 0 {
+			m.Rcode = dns.RcodeNameError
+		}
+		for _, rr := range zone[q.Name] {
+			if rr.Header().Rrtype == q.Qtype {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		w.WriteMsg(m)
+	})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+
+	resolver := Resolver
+	Resolver = conn.LocalAddr().String()
+	t.Cleanup(func() {
+		Resolver = resolver
+		server.Shutdown()
+	})
+}
+
+// TestVerifyZone checks that a pending zone is activated by a matching TXT challenge, and stays pending if the record is missing, wrong or can't be resolved
+func TestVerifyZone(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []string
+		failing []string
+		method  string
+		err     bool
+	}{
+		{
+			name:    "matching",
+			records: []string{`_cdnv3-challenge.example.com. 300 IN TXT "challenge"`},
+			method:  VerifiedChallenge,
+		},
+		{
+			name:    "other value",
+			records: []string{`_cdnv3-challenge.example.com. 300 IN TXT "other"`},
+			err:     true, // the delegation fallback finds no parent
+		},
+		{
+			name: "missing",
+			err:  true,
+		},
+		{
+			name:    "resolver failure",
+			records: []string{`_cdnv3-challenge.example.com. 300 IN TXT "challenge"`},
+			failing: []string{"_cdnv3-challenge.example.com."},
+			err:     true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testResolver(t, test.records, test.failing...)
+			db := database.NewMemory()
+			if err := db.AddZone(database.Zone{Zone: "example.com.", Status: database.ZonePending, Challenge: "challenge"}); err != nil {
+				t.Fatal(err)
+			}
+			zone, err := db.GetZoneByName("example.com.")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			method, err := VerifyZone(db, zone)
+			if method != test.method || (err != nil) != test.err {
+				t.Fatalf("verify = %q, %v, want %q and error %v", method, err, test.method, test.err)
+			}
+
+			zone, err = db.GetZoneByName("example.com.")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if zone.Active() != (test.method != "") || zone.VerifiedBy != test.method {
+				t.Errorf("zone status = %s verified by %q, want verified by %q", zone.Status, zone.VerifiedBy, test.method)
+			}
+			queue, err := db.ListQueue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pushed := len(queue) == 1 && queue[0].Type == JobZonePush; pushed != (test.method != "") {
+				t.Errorf("queue = %+v, want a push only once verified", queue)
+			}
+		})
+	}
+}
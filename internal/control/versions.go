@@ -0,0 +1,97 @@
+package control
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// VersionDiff stores the records that differ between two versions of a zone
+type VersionDiff struct {
+	Zone    string   `json:"zone"`
+	From    uint32   `json:"from"`
+	To      uint32   `json:"to"`
+	Added   []string `json:"added"`   // records in To but not in From
+	Removed []string `json:"removed"` // records in From but not in To
+}
+
+// RecordVersion snapshots the current state of a zone as a new version
+func RecordVersion(db database.Store, zone string, author string, change string) error {
+	current, err := db.GetZoneByName(zone)
+	if err != nil {
+		return err
+	}
+
+	err = db.AddZoneVersion(database.NewZoneVersion(current, author, change, time.Now().UnixNano()))
+	if err == database.ErrDuplicate {
+		return nil // this serial is already recorded
+	}
+	return err
+}
+
+// RecordChange records the version of a zone's current serial with the change stored on the zone
+func RecordChange(db database.Store, zone string) error {
+	current, err := db.GetZoneByName(zone)
+	if err != nil {
+		return err
+	}
+	if current.Change.Change == "" || current.Change.Serial != current.Serial {
+		return nil // the current serial wasn't produced by a described change
+	}
+
+	err = db.AddZoneVersion(database.NewZoneVersion(current, current.Change.Author, current.Change.Change, current.Change.Created))
+	if err == database.ErrDuplicate {
+		return nil // this serial is already recorded
+	}
+	return err
+}
+
+// DiffVersions computes the records added and removed between two versions of a zone
+func DiffVersions(from database.ZoneVersion, to database.ZoneVersion) VersionDiff {
+	diff := VersionDiff{Zone: to.Zone, From: from.Serial, To: to.Serial, Added: []string{}, Removed: []string{}}
+
+	fromRecords := map[string]bool{}
+	for _, record := range from.Records {
+		fromRecords[record] = true
+	}
+	toRecords := map[string]bool{}
+	for _, record := range to.Records {
+		toRecords[record] = true
+	}
+
+	for _, record := range to.Records {
+		if !fromRecords[record] {
+			diff.Added = append(diff.Added, record)
+		}
+	}
+	for _, record := range from.Records {
+		if !toRecords[record] {
+			diff.Removed = append(diff.Removed, record)
+		}
+	}
+	return diff
+}
+
+// Rollback restores the records of a zone from an earlier version under a new serial and pushes the zone to the edges
+func Rollback(db database.Store, zone string, serial uint32, author string) (database.ZoneVersion, error) {
+	version, err := db.GetZoneVersion(zone, serial)
+	if err != nil {
+		return database.ZoneVersion{}, err
+	}
+
+	newSerial, err := db.SetZoneRecords(zone, version.Records)
+	if err != nil {
+		return database.ZoneVersion{}, err
+	}
+
+	if err := RecordVersion(db, zone, author, fmt.Sprintf("rollback to %d", serial)); err != nil {
+		return database.ZoneVersion{}, err
+	}
+
+	if err := QueueZonePush(db, zone); err != nil {
+		return database.ZoneVersion{}, err
+	}
+
+	return db.GetZoneVersion(zone, newSerial)
+}
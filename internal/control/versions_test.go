@@ -0,0 +1,59 @@
+package control
+
+import (
+	"testing"
+
+	"github.com/natesales/cdn-tree/internal/database"
+	"github.com/natesales/cdn-tree/internal/soa"
+)
+
+// TestRecordChange checks that the version of a record change can be recorded and pushed after the request that made it failed to
+func TestRecordChange(t *testing.T) {
+	db := database.NewMemory()
+	if err := db.AddZone(database.Zone{Zone: "example.com.", Serial: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The change is stored with the record, nothing else is done yet
+	serial, err := db.AddRecord("example.com.", "example.com.\t300\tIN\tA\t192.0.2.1", database.ZoneChange{Author: "user", Change: "add record"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := QueueUnpublished(db); err != nil {
+		t.Fatal(err)
+	}
+	queue, err := db.ListQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 1 || queue[0].Type != JobZonePush || queue[0].Key != "example.com." {
+		t.Errorf("queue = %+v, want a push of example.com.", queue)
+	}
+
+	// Recording twice is the same as recording once
+	for i := 0; i < 2; i++ {
+		if err := RecordChange(db, "example.com."); err != nil {
+			t.Fatal(err)
+		}
+	}
+	version, err := db.GetZoneVersion("example.com.", serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Author != "user" || version.Change != "add record" || len(version.Records) != 1 {
+		t.Errorf("version = %+v, want the added record by user", version)
+	}
+
+	// Changes without a description don't reuse the description of the previous change
+	serial, err = db.SetZoneSOA("example.com.", soa.DefaultScheme, soa.Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordChange(db, "example.com."); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetZoneVersion("example.com.", serial); err != database.ErrNotFound {
+		t.Errorf("version of undescribed change: %v, want ErrNotFound", err)
+	}
+}
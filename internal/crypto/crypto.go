@@ -2,14 +2,28 @@
 package crypto
 
 import (
+	"context"
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
@@ -74,6 +88,112 @@ func RandomString() string {
 	return string(ret)
 }
 
+// HashToken hashes a node token for storage. Tokens are random, so they don't need a slow password hash.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// TokenMatches compares a node token with its stored hash in constant time
+func TokenMatches(token string, hash string) bool {
+	return hash != "" && subtle.ConstantTimeCompare([]byte(HashToken(token)), []byte(hash)) == 1
+}
+
+// nodeRequestMaxSkew is the largest clock difference accepted for signed node requests
+const nodeRequestMaxSkew = 5 * time.Minute
+
+// SignNodeRequest signs a controller request to a node with the node's token hash
+func SignNodeRequest(tokenHash string, path string, body []byte, now time.Time) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	return timestamp + ":" + nodeRequestMAC(tokenHash, timestamp, path, body)
+}
+
+// NodeRequestValid checks the signature of a controller request with the node token
+func NodeRequestValid(token string, signature string, path string, body []byte, now time.Time) bool {
+	parts := strings.SplitN(signature, ":", 2)
+	if token == "" || len(parts) != 2 {
+		return false
+	}
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := now.Sub(time.Unix(timestamp, 0)); skew > nodeRequestMaxSkew || skew < -nodeRequestMaxSkew {
+		return false
+	}
+	return hmac.Equal([]byte(parts[1]), []byte(nodeRequestMAC(HashToken(token), parts[0], path, body)))
+}
+
+// nodeRequestMAC computes the HMAC of a node request
+func nodeRequestMAC(tokenHash string, timestamp string, path string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(tokenHash))
+	mac.Write([]byte(timestamp + "\n" + path + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// TSIGSecret generates a base64 encoded TSIG secret as long as the output of the HMAC algorithm (RFC 8945 section 6)
+func TSIGSecret(algorithm string) (string, error) {
+	var size int
+	switch dns.Fqdn(algorithm) {
+	case dns.HmacSHA256:
+		size = 32
+	case dns.HmacSHA512:
+		size = 64
+	default:
+		return "", errors.New("unsupported TSIG algorithm " + algorithm)
+	}
+
+	secret := make([]byte, size)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(secret), nil
+}
+
+// Seal encrypts a secret with AES-256-GCM for storage and returns the nonce and ciphertext base64 encoded
+func Seal(key []byte, plaintext []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+// Open decrypts a secret encrypted by Seal
+func Open(key []byte, sealed string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("sealed secret is too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+// newGCM constructs an AES-256-GCM cipher
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("encryption keys have to be 32 bytes long")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
 // argon2IDKey computes an argon2 hash by given input and salt
 func argon2IDKey(input []byte, salt []byte) []byte {
 	return argon2.IDKey(input, salt, 1, 64*1024, 4, 32)
@@ -122,53 +242,97 @@ func (u *AcmeUser) GetPrivateKey() crypto.PrivateKey {
 	return u.key
 }
 
-// NewCertRequest requests a new TLS certificate
-func NewCertRequest(domain string) {
-	// Create a user. New accounts need an email and private key to start.
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		log.Fatal(err)
+// contextTransport sends HTTP requests with a context, so they are cancelled with it
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t contextTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(r.WithContext(t.ctx))
+}
+
+// LetsEncrypt is the ACME directory of the Let's Encrypt production CA
+const LetsEncrypt = "https://acme-v02.api.letsencrypt.org/directory"
+
+// NewAcmeUser builds an ACME account from its email and PEM encoded key, generating a key if there is none
+func NewAcmeUser(email string, keyPEM []byte, registrationURI string) (*AcmeUser, error) {
+	user := &AcmeUser{Email: email}
+	if registrationURI != "" {
+		user.Registration = &registration.Resource{URI: registrationURI}
+	}
+
+	if len(keyPEM) == 0 {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		user.key = key
+		return user, nil
 	}
 
-	myUser := AcmeUser{
-		Email: "you@yours.com",
-		key:   privateKey,
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("ACME account key isn't PEM encoded")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
 	}
+	user.key = key
+	return user, nil
+}
 
-	config := lego.NewConfig(&myUser)
+// KeyPEM encodes the account key for storage
+func (u *AcmeUser) KeyPEM() ([]byte, error) {
+	key, ok := u.key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("unsupported ACME account key")
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
 
-	//config.CADirURL = "https://acme-v02.api.letsencrypt.org/directory"
-	config.CADirURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+// NewCertRequest requests a TLS certificate from an ACME directory, registering the account if needed
+func NewCertRequest(ctx context.Context, directory string, user *AcmeUser, domain string) (*certificate.Resource, error) {
+	config := lego.NewConfig(user)
+	base := config.HTTPClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	config.HTTPClient.Transport = contextTransport{ctx: ctx, base: base}
+	config.CADirURL = directory
 	config.Certificate.KeyType = certcrypto.RSA2048
 
 	// A client facilitates communication with the CA server.
 	client, err := lego.NewClient(config)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	err = client.Challenge.SetHTTP01Provider(http01.NewProviderServer("", "5001"))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	// New users will need to register
-	reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
-	if err != nil {
-		log.Fatal(err)
+	if user.Registration == nil {
+		reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+		if err != nil {
+			return nil, err
+		}
+		user.Registration = reg
 	}
-	myUser.Registration = reg
 
 	request := certificate.ObtainRequest{
 		Domains: []string{domain},
 		Bundle:  true,
 	}
 
-	certificates, err := client.Certificate.Obtain(request)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	// Each certificate comes back with the cert bytes, the bytes of the client's private key, and a certificate URL.
-	fmt.Printf("%#v\n", certificates)
+	return client.Certificate.Obtain(request)
 }
@@ -0,0 +1,39 @@
+package crypto
+
+import (
+	"testing"
+	"time"
+)
+
+// TestNodeRequest checks that node requests signed with the token hash verify with the token, and nothing else does
+func TestNodeRequest(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	body := []byte(`{"zone":"example.com.","serial":2}`)
+	signature := SignNodeRequest(HashToken("token"), "/update", body, now)
+
+	tests := []struct {
+		name      string
+		token     string
+		signature string
+		path      string
+		body      []byte
+		at        time.Time
+		want      bool
+	}{
+		{"valid", "token", signature, "/update", body, now, true},
+		{"within skew", "token", signature, "/update", body, now.Add(4 * time.Minute), true},
+		{"wrong token", "other", signature, "/update", body, now, false},
+		{"empty token", "", SignNodeRequest(HashToken(""), "/update", body, now), "/update", body, now, false},
+		{"other path", "token", signature, "/sync", body, now, false},
+		{"tampered body", "token", signature, "/update", []byte(`{"zone":"example.com.","serial":3}`), now, false},
+		{"expired", "token", signature, "/update", body, now.Add(6 * time.Minute), false},
+		{"from the future", "token", signature, "/update", body, now.Add(-6 * time.Minute), false},
+		{"missing", "token", "", "/update", body, now, false},
+		{"malformed", "token", "now:" + signature, "/update", body, now, false},
+	}
+	for _, test := range tests {
+		if got := NodeRequestValid(test.token, test.signature, test.path, test.body, test.at); got != test.want {
+			t.Errorf("%s: valid = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
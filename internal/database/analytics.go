@@ -0,0 +1,224 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Resolutions of query statistics in seconds
+const (
+	MinuteResolution int64 = 60
+	HourResolution   int64 = 3600
+)
+
+// rollupBatch is the number of minute buckets rolled up at once
+const rollupBatch = 10000
+
+// QueryStats stores the number of queries of a zone with a type and rcode that an edge node answered in a time bucket
+type QueryStats struct {
+	ID         primitive.ObjectID `json:"-" bson:"_id,omitempty"`
+	Zone       string             `json:"zone" bson:"zone"`
+	Resolution int64              `json:"resolution" bson:"resolution"` // bucket length in seconds
+	Bucket     int64              `json:"bucket" bson:"bucket"`         // unix seconds of the start of the bucket
+	Node       string             `json:"node" bson:"node"`
+	Region     string             `json:"region" bson:"region"` // region of the node when the queries were reported
+	Type       string             `json:"type" bson:"type"`
+	Rcode      string             `json:"rcode" bson:"rcode"`
+	Queries    int64              `json:"queries" bson:"queries"`
+}
+
+// key identifies the bucket of a QueryStats
+func (s QueryStats) key() string {
+	return fmt.Sprintf("%s|%d|%d|%s|%s|%s", s.Zone, s.Resolution, s.Bucket, s.Node, s.Type, s.Rcode)
+}
+
+// QueryStatsFilter selects query statistics by zone and time
+type QueryStatsFilter struct {
+	Zone string // all zones if empty
+	From int64  // unix seconds, inclusive
+	To   int64  // unix seconds, exclusive
+}
+
+// matches reports whether query statistics are selected by a filter
+func (f QueryStatsFilter) matches(s QueryStats) bool {
+	return (f.Zone == "" || s.Zone == f.Zone) && s.Bucket >= f.From && s.Bucket < f.To
+}
+
+// rollup adds minute buckets into hour buckets
+func rollup(stats []QueryStats) []QueryStats {
+	hours := map[string]QueryStats{}
+	for _, s := range stats {
+		s.ID = primitive.NilObjectID
+		s.Resolution = HourResolution
+		s.Bucket -= s.Bucket % HourResolution
+		hour, ok := hours[s.key()]
+		if ok {
+			s.Queries += hour.Queries
+		}
+		hours[s.key()] = s
+	}
+
+	rolled := make([]QueryStats, 0, len(hours))
+	for _, s := range hours {
+		rolled = append(rolled, s)
+	}
+	return rolled
+}
+
+// AddQueryStats adds query counts to their buckets
+func (d Mongo) AddQueryStats(stats []QueryStats) error {
+	if len(stats) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(stats))
+	for _, s := range stats {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"zone": s.Zone, "resolution": s.Resolution, "bucket": s.Bucket, "node": s.Node, "type": s.Type, "rcode": s.Rcode}).
+			SetUpdate(bson.M{"$inc": bson.M{"queries": s.Queries}, "$set": bson.M{"region": s.Region}}).
+			SetUpsert(true))
+	}
+	_, err := d.Db.Collection("query_stats").BulkWrite(context.Background(), models, options.BulkWrite().SetOrdered(false))
+	return mongoErr(err)
+}
+
+// ListQueryStats returns the query statistics selected by a filter, oldest first
+func (d Mongo) ListQueryStats(filter QueryStatsFilter) ([]QueryStats, error) {
+	query := bson.M{"bucket": bson.M{"$gte": filter.From, "$lt": filter.To}}
+	if filter.Zone != "" {
+		query["zone"] = filter.Zone
+	}
+
+	cursor, err := d.Db.Collection("query_stats").Find(context.Background(), query, options.Find().SetSort(bson.M{"bucket": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []QueryStats
+	if err := cursor.All(context.Background(), &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// RollupQueryStats rolls minute buckets older than before into hour buckets
+func (d Mongo) RollupQueryStats(before int64) (int64, error) {
+	var total int64
+	for {
+		cursor, err := d.Db.Collection("query_stats").Find(
+			context.Background(),
+			bson.M{"resolution": MinuteResolution, "bucket": bson.M{"$lt": before}},
+			options.Find().SetLimit(rollupBatch),
+		)
+		if err != nil {
+			return total, err
+		}
+
+		var minutes []QueryStats
+		if err := cursor.All(context.Background(), &minutes); err != nil {
+			return total, err
+		}
+		if len(minutes) == 0 {
+			return total, nil
+		}
+
+		ids := make([]primitive.ObjectID, 0, len(minutes))
+		for _, s := range minutes {
+			ids = append(ids, s.ID)
+		}
+		if err := d.AddQueryStats(rollup(minutes)); err != nil {
+			return total, err
+		}
+		result, err := d.Db.Collection("query_stats").DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return total, mongoErr(err)
+		}
+		total += result.DeletedCount
+	}
+}
+
+// PruneQueryStats deletes the buckets older than before
+func (d Mongo) PruneQueryStats(before int64) (int64, error) {
+	result, err := d.Db.Collection("query_stats").DeleteMany(context.Background(), bson.M{"bucket": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// AddQueryStats adds query counts to their buckets
+func (m *Memory) AddQueryStats(stats []QueryStats) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.addQueryStats(stats)
+	return nil
+}
+
+// addQueryStats adds query counts to their buckets, the caller must hold the lock
+func (m *Memory) addQueryStats(stats []QueryStats) {
+	for _, s := range stats {
+		existing, ok := m.queryStats[s.key()]
+		if ok {
+			existing.Queries += s.Queries
+			existing.Region = s.Region
+			m.queryStats[s.key()] = existing
+			continue
+		}
+		s.ID = primitive.NewObjectID()
+		m.queryStats[s.key()] = s
+	}
+}
+
+// ListQueryStats returns the query statistics selected by a filter, oldest first
+func (m *Memory) ListQueryStats(filter QueryStatsFilter) ([]QueryStats, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var stats []QueryStats
+	for _, s := range m.queryStats {
+		if filter.matches(s) {
+			stats = append(stats, s)
+		}
+	}
+
+	sort.SliceStable(stats, func(i, j int) bool { return stats[i].Bucket < stats[j].Bucket })
+	return stats, nil
+}
+
+// RollupQueryStats rolls minute buckets older than before into hour buckets
+func (m *Memory) RollupQueryStats(before int64) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var minutes []QueryStats
+	for key, s := range m.queryStats {
+		if s.Resolution == MinuteResolution && s.Bucket < before {
+			minutes = append(minutes, s)
+			delete(m.queryStats, key)
+		}
+	}
+	m.addQueryStats(rollup(minutes))
+	return int64(len(minutes)), nil
+}
+
+// PruneQueryStats deletes the buckets older than before
+func (m *Memory) PruneQueryStats(before int64) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var pruned int64
+	for key, s := range m.queryStats {
+		if s.Bucket < before {
+			delete(m.queryStats, key)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"context"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuditChange stores the before and after value of a changed field
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditEntry stores a single mutating API action
+type AuditEntry struct {
+	ID         primitive.ObjectID     `json:"id" bson:"_id,omitempty"`
+	Time       int64                  `json:"time"`
+	Actor      string                 `json:"actor"` // user ID, empty if unauthenticated
+	ActorEmail string                 `json:"actor_email,omitempty"`
+	Token      string                 `json:"token,omitempty"` // fingerprint of the API key used
+	SourceIP   string                 `json:"source_ip"`
+	Method     string                 `json:"method"`
+	Path       string                 `json:"path"`
+	Resource   string                 `json:"resource"`       // type of the changed resource, e.g. zone or record
+	Zone       string                 `json:"zone,omitempty"` // zone the action applies to
+	Diff       map[string]AuditChange `json:"diff,omitempty"`
+	Status     int                    `json:"status"`
+	Outcome    string                 `json:"outcome"` // success or failure
+	Error      string                 `json:"error,omitempty"`
+}
+
+// AuditFilter selects audit entries. Empty fields match everything.
+type AuditFilter struct {
+	Zone  string
+	Actor string
+	Since int64
+	Until int64
+	Limit int64
+}
+
+// matches checks if an entry is selected by the filter
+func (f AuditFilter) matches(entry AuditEntry) bool {
+	return (f.Zone == "" || entry.Zone == f.Zone) &&
+		(f.Actor == "" || entry.Actor == f.Actor) &&
+		(f.Since == 0 || entry.Time >= f.Since) &&
+		(f.Until == 0 || entry.Time < f.Until)
+}
+
+// query builds the MongoDB filter document of the filter
+func (f AuditFilter) query() bson.M {
+	query := bson.M{}
+	if f.Zone != "" {
+		query["zone"] = f.Zone
+	}
+	if f.Actor != "" {
+		query["actor"] = f.Actor
+	}
+	if f.Since != 0 || f.Until != 0 {
+		timeRange := bson.M{}
+		if f.Since != 0 {
+			timeRange["$gte"] = f.Since
+		}
+		if f.Until != 0 {
+			timeRange["$lt"] = f.Until
+		}
+		query["time"] = timeRange
+	}
+	return query
+}
+
+// AddAuditEntry appends an entry to the audit log
+func (d Mongo) AddAuditEntry(entry AuditEntry) error {
+	_, err := d.Db.Collection("audit").InsertOne(context.Background(), entry)
+	return err
+}
+
+// ListAuditEntries returns the audit entries selected by a filter, newest first
+func (d Mongo) ListAuditEntries(filter AuditFilter) ([]AuditEntry, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}})
+	if filter.Limit > 0 {
+		opts.SetLimit(filter.Limit)
+	}
+
+	cursor, err := d.Db.Collection("audit").Find(context.Background(), filter.query(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []AuditEntry
+	if err := cursor.All(context.Background(), &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// PruneAuditEntries deletes all audit entries older than before and returns the number of deleted entries
+func (d Mongo) PruneAuditEntries(before int64) (int64, error) {
+	result, err := d.Db.Collection("audit").DeleteMany(context.Background(), bson.M{"time": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// AddAuditEntry appends an entry to the audit log
+func (m *Memory) AddAuditEntry(entry AuditEntry) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry.ID = primitive.NewObjectID()
+	m.audit = append(m.audit, entry)
+	return nil
+}
+
+// ListAuditEntries returns the audit entries selected by a filter, newest first
+func (m *Memory) ListAuditEntries(filter AuditFilter) ([]AuditEntry, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var entries []AuditEntry
+	for _, entry := range m.audit {
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time > entries[j].Time })
+	if filter.Limit > 0 && int64(len(entries)) > filter.Limit {
+		entries = entries[:filter.Limit]
+	}
+	return entries, nil
+}
+
+// PruneAuditEntries deletes all audit entries older than before and returns the number of deleted entries
+func (m *Memory) PruneAuditEntries(before int64) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var kept []AuditEntry
+	for _, entry := range m.audit {
+		if entry.Time >= before {
+			kept = append(kept, entry)
+		}
+	}
+
+	pruned := int64(len(m.audit) - len(kept))
+	m.audit = kept
+	return pruned, nil
+}
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"context"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/natesales/cdn-tree/internal/health"
+)
+
+// HealthState stores the aggregated state of a health check target and the latest result of every node
+type HealthState struct {
+	Key     string                   `json:"key" bson:"_id"`
+	Target  health.Target            `json:"target" bson:"target"`
+	Healthy bool                     `json:"healthy" bson:"healthy"`
+	Changed int64                    `json:"changed,omitempty" bson:"changed,omitempty"` // unix nanoseconds of the last state change
+	Results map[string]health.Result `json:"results" bson:"results"`                     // by node ID
+}
+
+// AddHealthResult stores the latest result of a node for a target and returns the target's state
+func (d Mongo) AddHealthResult(target health.Target, node string, result health.Result) (HealthState, error) {
+	var state HealthState
+	err := d.Db.Collection("health").FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": target.Key},
+		bson.M{
+			"$set":         bson.M{"target": target, "results." + node: result},
+			"$setOnInsert": bson.M{"healthy": true},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&state)
+	if err != nil {
+		return HealthState{}, mongoErr(err)
+	}
+	return state, nil
+}
+
+// SetHealthState sets the aggregated state of a target
+func (d Mongo) SetHealthState(key string, healthy bool, changed int64) error {
+	result, err := d.Db.Collection("health").UpdateOne(
+		context.Background(),
+		bson.M{"_id": key},
+		bson.M{"$set": bson.M{"healthy": healthy, "changed": changed}},
+	)
+	if err != nil {
+		return mongoErr(err)
+	}
+
+	if result.MatchedCount < 1 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListHealthStates returns the state of all targets that have results
+func (d Mongo) ListHealthStates() ([]HealthState, error) {
+	cursor, err := d.Db.Collection("health").Find(context.Background(), bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	states := []HealthState{}
+	if err := cursor.All(context.Background(), &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// copyHealthState returns a copy of a state that doesn't share the results map with the stored one
+func copyHealthState(state HealthState) HealthState {
+	results := map[string]health.Result{}
+	for node, result := range state.Results {
+		results[node] = result
+	}
+	state.Results = results
+	return state
+}
+
+// AddHealthResult stores the latest result of a node for a target and returns the target's state
+func (m *Memory) AddHealthResult(target health.Target, node string, result health.Result) (HealthState, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	state, ok := m.health[target.Key]
+	if !ok {
+		state = HealthState{Key: target.Key, Healthy: true, Results: map[string]health.Result{}}
+	}
+	state.Target = target
+	state.Results[node] = result
+	m.health[target.Key] = state
+
+	return copyHealthState(state), nil
+}
+
+// SetHealthState sets the aggregated state of a target
+func (m *Memory) SetHealthState(key string, healthy bool, changed int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	state, ok := m.health[key]
+	if !ok {
+		return ErrNotFound
+	}
+	state.Healthy = healthy
+	state.Changed = changed
+	m.health[key] = state
+	return nil
+}
+
+// ListHealthStates returns the state of all targets that have results
+func (m *Memory) ListHealthStates() ([]HealthState, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	states := []HealthState{}
+	for _, state := range m.health {
+		states = append(states, copyHealthState(state))
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Key < states[j].Key })
+	return states, nil
+}
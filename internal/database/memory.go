@@ -0,0 +1,640 @@
+package database
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/natesales/cdn-tree/internal/balance"
+	"github.com/natesales/cdn-tree/internal/bgp"
+	"github.com/natesales/cdn-tree/internal/crypto"
+	"github.com/natesales/cdn-tree/internal/geo"
+	"github.com/natesales/cdn-tree/internal/health"
+	"github.com/natesales/cdn-tree/internal/soa"
+)
+
+// Memory is a Store that keeps all data in memory, for tests and local development
+type Memory struct {
+	Queue QueueOptions
+
+	lock         sync.Mutex
+	users        map[string]User
+	zones        map[string]Zone
+	nodes        map[string]Node
+	queue        map[primitive.ObjectID]QueueMessage
+	dead         map[primitive.ObjectID]QueueMessage
+	history      []QueueHistory
+	metadata     map[string]MetadataElement
+	certificates map[string]Certificate
+	audit        []AuditEntry
+	versions     []ZoneVersion
+	health       map[string]HealthState
+	keys         map[string]TSIGKey
+	journal      []JournalEntry
+	queryStats   map[string]QueryStats // by bucket key
+}
+
+// NewMemory constructs a new empty Memory store
+func NewMemory() *Memory {
+	return &Memory{
+		Queue:        DefaultQueueOptions,
+		users:        map[string]User{},
+		zones:        map[string]Zone{},
+		nodes:        map[string]Node{},
+		queue:        map[primitive.ObjectID]QueueMessage{},
+		dead:         map[primitive.ObjectID]QueueMessage{},
+		metadata:     map[string]MetadataElement{},
+		certificates: map[string]Certificate{},
+		health:       map[string]HealthState{},
+		keys:         map[string]TSIGKey{},
+		queryStats:   map[string]QueryStats{},
+	}
+}
+
+// copyZone returns a copy of a zone that doesn't share slices with the stored one
+func copyZone(zone Zone) Zone {
+	zone.Users = append([]string(nil), zone.Users...)
+	zone.Records = append([]string(nil), zone.Records...)
+	zone.Nameservers = append([]string(nil), zone.Nameservers...)
+	zone.GeoRecords = append([]geo.RecordSet(nil), zone.GeoRecords...)
+	zone.HealthRecords = append([]health.RecordSet(nil), zone.HealthRecords...)
+	zone.BalancedRecords = append([]balance.RecordSet(nil), zone.BalancedRecords...)
+	zone.Transfer = copyTransferSettings(zone.Transfer)
+	zone.Secondary.Primaries = append([]string(nil), zone.Secondary.Primaries...)
+	return zone
+}
+
+// Users
+
+// AddUser adds a new user
+func (m *Memory) AddUser(user User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, u := range m.users {
+		if u.Email == user.Email {
+			return ErrDuplicate
+		}
+	}
+
+	user.ID = primitive.NewObjectID().Hex()
+	m.users[user.ID] = user
+	return nil
+}
+
+// findUser returns the first user matching a predicate
+func (m *Memory) findUser(match func(User) bool) (User, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, user := range m.users {
+		if match(user) {
+			return user, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+// GetUserByAPIKey looks up a user by API key
+func (m *Memory) GetUserByAPIKey(apiKey string) (User, error) {
+	return m.findUser(func(u User) bool { return u.APIKey == apiKey })
+}
+
+// GetUserByEmail looks up a user by email address
+func (m *Memory) GetUserByEmail(email string) (User, error) {
+	return m.findUser(func(u User) bool { return u.Email == email })
+}
+
+// SetUserVanity allows or disallows a user to use vanity nameservers
+func (m *Memory) SetUserVanity(email string, enabled bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for id, user := range m.users {
+		if user.Email == email {
+			user.Vanity = enabled
+			m.users[id] = user
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// Zones
+
+// AddZone adds a new zone
+func (m *Memory) AddZone(zone Zone) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, z := range m.zones {
+		if z.Zone == zone.Zone {
+			return ErrDuplicate
+		}
+	}
+
+	zone.ID = primitive.NewObjectID().Hex()
+	m.zones[zone.ID] = copyZone(zone)
+	return nil
+}
+
+// GetZone looks up a zone by ID
+func (m *Memory) GetZone(id string) (Zone, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	zone, ok := m.zones[id]
+	if !ok {
+		return Zone{}, ErrNotFound
+	}
+	return copyZone(zone), nil
+}
+
+// zoneByName returns the ID of a zone by name. The caller must hold the lock.
+func (m *Memory) zoneByName(name string) (string, bool) {
+	for id, zone := range m.zones {
+		if zone.Zone == name {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// GetZoneByName looks up a zone by its FQDN
+func (m *Memory) GetZoneByName(name string) (Zone, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	id, ok := m.zoneByName(name)
+	if !ok {
+		return Zone{}, ErrNotFound
+	}
+	return copyZone(m.zones[id]), nil
+}
+
+// ListZones returns all zones
+func (m *Memory) ListZones() ([]Zone, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var zones []Zone
+	for _, zone := range m.zones {
+		zones = append(zones, copyZone(zone))
+	}
+	return zones, nil
+}
+
+// changeZone applies a modification to a zone by name and bumps its serial
+func (m *Memory) changeZone(name string, change func(*Zone)) (uint32, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	id, ok := m.zoneByName(name)
+	if !ok {
+		return 0, ErrNotFound
+	}
+
+	zone := copyZone(m.zones[id])
+	zone.Change = ZoneChange{}
+	change(&zone)
+	zone.Serial = zone.Scheme().Next(zone.Serial, time.Now())
+	if zone.Change.Change != "" {
+		zone.Change.Serial = zone.Serial
+	}
+	m.zones[id] = zone
+	return zone.Serial, nil
+}
+
+// AddRecord appends a RR string to a zone and returns the new zone serial, see Mongo.AddRecord
+func (m *Memory) AddRecord(zone string, rr string, change ZoneChange) (uint32, error) {
+	return m.changeZone(zone, func(z *Zone) {
+		z.Records = append(z.Records, rr)
+		z.Change = change
+	})
+}
+
+// SetZoneDNSSEC replaces the DNSSEC key of a zone and returns the new zone serial
+func (m *Memory) SetZoneDNSSEC(zone string, key crypto.DNSSECKey) (uint32, error) {
+	return m.changeZone(zone, func(z *Zone) {
+		z.DNSSEC = key
+	})
+}
+
+// SetZoneSOA replaces the serial scheme and SOA overrides of a zone and returns the new zone serial
+func (m *Memory) SetZoneSOA(zone string, scheme soa.Scheme, settings soa.Settings) (uint32, error) {
+	return m.changeZone(zone, func(z *Zone) {
+		z.SerialScheme = scheme
+		z.SOA = settings
+	})
+}
+
+// SetZoneNameservers replaces the vanity nameservers of a zone and returns the new zone serial
+func (m *Memory) SetZoneNameservers(zone string, nameservers []string) (uint32, error) {
+	return m.changeZone(zone, func(z *Zone) {
+		z.Nameservers = append([]string(nil), nameservers...)
+	})
+}
+
+// SetZoneGeoRecords replaces the geo record sets of a zone and returns the new zone serial
+func (m *Memory) SetZoneGeoRecords(zone string, sets []geo.RecordSet) (uint32, error) {
+	return m.changeZone(zone, func(z *Zone) {
+		z.GeoRecords = append([]geo.RecordSet(nil), sets...)
+	})
+}
+
+// SetZoneHealthRecords replaces the health checked record sets of a zone and returns the new zone serial
+func (m *Memory) SetZoneHealthRecords(zone string, sets []health.RecordSet) (uint32, error) {
+	return m.changeZone(zone, func(z *Zone) {
+		z.HealthRecords = append([]health.RecordSet(nil), sets...)
+	})
+}
+
+// SetZoneBalancedRecords replaces the load-balanced record sets of a zone and returns the new zone serial
+func (m *Memory) SetZoneBalancedRecords(zone string, sets []balance.RecordSet) (uint32, error) {
+	return m.changeZone(zone, func(z *Zone) {
+		z.BalancedRecords = append([]balance.RecordSet(nil), sets...)
+	})
+}
+
+// BumpZoneSerial increments the serial of a zone whose generated records changed
+func (m *Memory) BumpZoneSerial(zone string) (uint32, error) {
+	return m.changeZone(zone, func(z *Zone) {})
+}
+
+// ActivateZone marks a pending zone as verified so it is served
+func (m *Memory) ActivateZone(zone string, method string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	id, ok := m.zoneByName(zone)
+	if !ok {
+		return ErrNotFound
+	}
+
+	z := m.zones[id]
+	z.Status = ZoneActive
+	z.Verified = time.Now().UnixNano()
+	z.VerifiedBy = method
+	z.Challenge = ""
+	m.zones[id] = z
+	return nil
+}
+
+// DeleteZone removes a zone with its versions, TSIG keys and transfer journal
+func (m *Memory) DeleteZone(zone string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	id, ok := m.zoneByName(zone)
+	if !ok {
+		return ErrNotFound
+	}
+	delete(m.zones, id)
+
+	var versions []ZoneVersion
+	for _, version := range m.versions {
+		if version.Zone != zone {
+			versions = append(versions, version)
+		}
+	}
+	m.versions = versions
+
+	for name, key := range m.keys {
+		if key.Zone == zone {
+			delete(m.keys, name)
+		}
+	}
+	var journal []JournalEntry
+	for _, entry := range m.journal {
+		if entry.Zone != zone {
+			journal = append(journal, entry)
+		}
+	}
+	m.journal = journal
+	return nil
+}
+
+// Nodes
+
+// AddNode adds a new edge node
+func (m *Memory) AddNode(node Node) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	node.ID = primitive.NewObjectID().Hex()
+	m.nodes[node.ID] = node
+	return nil
+}
+
+// GetNode looks up a node by ID
+func (m *Memory) GetNode(id string) (Node, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	node, ok := m.nodes[id]
+	if !ok {
+		return Node{}, ErrNotFound
+	}
+	return node, nil
+}
+
+// ListNodes returns all nodes
+func (m *Memory) ListNodes() ([]Node, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var nodes []Node
+	for _, node := range m.nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// AuthorizeNode marks a node as authorized and returns it
+func (m *Memory) AuthorizeNode(id string) (Node, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	node, ok := m.nodes[id]
+	if !ok {
+		return Node{}, ErrNotFound
+	}
+
+	node.Authorized = true
+	m.nodes[id] = node
+	return node, nil
+}
+
+// SetNodeToken replaces the hash of the credential of a node
+func (m *Memory) SetNodeToken(id string, tokenHash string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	node, ok := m.nodes[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	node.TokenHash = tokenHash
+	m.nodes[id] = node
+	return nil
+}
+
+// SetNodeSeen records the time a node last requested the zone manifest
+func (m *Memory) SetNodeSeen(id string, seen int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	node, ok := m.nodes[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	node.LastSeen = seen
+	m.nodes[id] = node
+	return nil
+}
+
+// AddSession adds a BGP session to a node
+func (m *Memory) AddSession(id string, session bgp.Session) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	node, ok := m.nodes[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	node.Sessions = append(append([]bgp.Session(nil), node.Sessions...), session)
+	m.nodes[id] = node
+	return nil
+}
+
+// Message queue
+
+// QueueOptions gets the delivery settings of the queue
+func (m *Memory) QueueOptions() QueueOptions {
+	return m.Queue
+}
+
+// AddQueueMessage appends a message to the queue, see Mongo.AddQueueMessage
+func (m *Memory) AddQueueMessage(message QueueMessage) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	message.Created = time.Now().UnixNano()
+	if message.Available == 0 {
+		message.Available = message.Created
+	}
+	message.Locked = false
+	message.Attempts = 0
+
+	if message.Key != "" {
+		for _, queued := range m.queue {
+			if queued.Type == message.Type && queued.Key == message.Key && !queued.Locked && queued.Attempts == 0 {
+				return nil // coalesced into the queued message
+			}
+		}
+	}
+
+	message.ID = primitive.NewObjectID()
+	m.queue[message.ID] = message
+	return nil
+}
+
+// NextQueueMessage claims the oldest available message, see Mongo.NextQueueMessage
+func (m *Memory) NextQueueMessage(types ...JobType) (QueueMessage, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for {
+		now := time.Now().UnixNano()
+
+		// Collect claimable messages
+		var candidates []QueueMessage
+		for _, message := range m.queue {
+			if message.Available > now {
+				continue
+			}
+			if message.Locked && message.LockedAt >= now-int64(m.Queue.VisibilityTimeout) {
+				continue
+			}
+			if len(types) > 0 && !includesType(types, message.Type) {
+				continue
+			}
+			candidates = append(candidates, message)
+		}
+
+		if len(candidates) == 0 {
+			return QueueMessage{}, ErrNotFound
+		}
+
+		// FIFO by creation time
+		sort.Slice(candidates, func(i, j int) bool {
+			if candidates[i].Created != candidates[j].Created {
+				return candidates[i].Created < candidates[j].Created
+			}
+			return candidates[i].ID.Hex() < candidates[j].ID.Hex()
+		})
+
+		message := candidates[0]
+		message.Locked = true
+		message.LockedAt = now
+		message.Attempts++
+		m.queue[message.ID] = message
+
+		if message.Attempts > m.Queue.MaxAttempts {
+			m.deadLetter(message, "visibility timeout expired")
+			continue
+		}
+
+		return message, nil
+	}
+}
+
+// includesType checks if a job type is in a list of job types
+func includesType(types []JobType, jobType JobType) bool {
+	for _, t := range types {
+		if t == jobType {
+			return true
+		}
+	}
+	return false
+}
+
+// claimed checks if a message is still claimed with the given lock token. The caller must hold the lock.
+func (m *Memory) claimed(message QueueMessage) bool {
+	queued, ok := m.queue[message.ID]
+	return ok && queued.LockedAt == message.LockedAt
+}
+
+// deadLetter moves a message to the dead letter list. The caller must hold the lock.
+func (m *Memory) deadLetter(message QueueMessage, reason string) {
+	message.Locked = false
+	message.LastError = reason
+	message.Failed = time.Now().UnixNano()
+	delete(m.queue, message.ID)
+	m.dead[message.ID] = message
+}
+
+// QueueConfirm marks a queue message as complete
+func (m *Memory) QueueConfirm(message QueueMessage) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.claimed(message) {
+		return ErrQueueLockLost
+	}
+
+	delete(m.queue, message.ID)
+	return nil
+}
+
+// QueueExtend restarts the visibility timeout of a claimed message, see Mongo.QueueExtend
+func (m *Memory) QueueExtend(message QueueMessage) (QueueMessage, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.claimed(message) {
+		return QueueMessage{}, ErrQueueLockLost
+	}
+
+	message = m.queue[message.ID]
+	message.LockedAt = time.Now().UnixNano()
+	m.queue[message.ID] = message
+	return message, nil
+}
+
+// QueueFail releases a queue message for retry, see Mongo.QueueFail
+func (m *Memory) QueueFail(message QueueMessage, cause error) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.claimed(message) {
+		return ErrQueueLockLost
+	}
+
+	if message.Attempts >= m.Queue.MaxAttempts {
+		m.deadLetter(message, cause.Error())
+		return nil
+	}
+
+	message.Locked = false
+	message.LastError = cause.Error()
+	message.Available = time.Now().Add(m.Queue.retryDelay(message.Attempts)).UnixNano()
+	m.queue[message.ID] = message
+	return nil
+}
+
+// sortedMessages returns the messages of a map in FIFO order
+func sortedMessages(messages map[primitive.ObjectID]QueueMessage) []QueueMessage {
+	var list []QueueMessage
+	for _, message := range messages {
+		list = append(list, message)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created < list[j].Created })
+	return list
+}
+
+// ListQueue returns all messages in queue
+func (m *Memory) ListQueue() ([]QueueMessage, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return sortedMessages(m.queue), nil
+}
+
+// ListDeadLetters returns all messages that have been dead-lettered
+func (m *Memory) ListDeadLetters() ([]QueueMessage, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return sortedMessages(m.dead), nil
+}
+
+// AddQueueHistory records the outcome of a queue message delivery
+func (m *Memory) AddQueueHistory(entry QueueHistory) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry.ID = primitive.NewObjectID()
+	m.history = append(m.history, entry)
+	return nil
+}
+
+// ListQueueHistory returns the most recent delivery outcomes, newest first, optionally filtered by job type
+func (m *Memory) ListQueueHistory(jobType JobType, limit int64) ([]QueueHistory, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var history []QueueHistory
+	for i := len(m.history) - 1; i >= 0 && int64(len(history)) < limit; i-- {
+		if jobType == "" || m.history[i].Type == jobType {
+			history = append(history, m.history[i])
+		}
+	}
+	return history, nil
+}
+
+// Certificates
+
+// SetCertificate adds or replaces the certificate of a domain
+func (m *Memory) SetCertificate(c Certificate) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.certificates[c.Domain] = c
+	return nil
+}
+
+// ListCertificates returns all certificates
+func (m *Memory) ListCertificates() ([]Certificate, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	certificates := make([]Certificate, 0, len(m.certificates))
+	for _, c := range m.certificates {
+		certificates = append(certificates, c)
+	}
+	return certificates, nil
+}
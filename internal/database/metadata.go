@@ -0,0 +1,244 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrConflict is returned when a compare-and-swap update finds a different version than expected
+var ErrConflict = errors.New("version conflict")
+
+// Metadata label "enum"
+type MetaLabel int
+
+const (
+	LabelAcmeAccount MetaLabel = iota
+	LabelNetworkConfig
+)
+
+// metaLabels maps each MetaLabel to its string representation
+var metaLabels = [...]string{"acme_account", "network_config"}
+
+// String gets the string representation of MetaLabel
+func (l MetaLabel) String() string {
+	return metaLabels[l]
+}
+
+// ParseMetaLabel gets a MetaLabel from its string representation
+func ParseMetaLabel(label string) (MetaLabel, error) {
+	for i, name := range metaLabels {
+		if name == label {
+			return MetaLabel(i), nil
+		}
+	}
+	return 0, errors.New("unknown metadata label " + label)
+}
+
+// MetaLabels gets all metadata labels
+func MetaLabels() []MetaLabel {
+	labels := make([]MetaLabel, len(metaLabels))
+	for i := range metaLabels {
+		labels[i] = MetaLabel(i)
+	}
+	return labels
+}
+
+// AcmeAccount is the metadata payload of LabelAcmeAccount
+type AcmeAccount struct {
+	Email        string `json:"email" bson:"email"`
+	Registration string `json:"registration" bson:"registration"` // account URI returned by the ACME server
+	PrivateKey   []byte `json:"-" bson:"privatekey"`              // PEM encoded account key
+}
+
+// NetworkConfig is the metadata payload of LabelNetworkConfig
+type NetworkConfig struct {
+	Asn      uint32   `json:"asn" bson:"asn"`
+	Prefixes []string `json:"prefixes" bson:"prefixes"` // anycast prefixes announced by the edge nodes
+}
+
+// NewPayload returns a pointer to a new zero value of the payload type of the label
+func (l MetaLabel) NewPayload() interface{} {
+	switch l {
+	case LabelAcmeAccount:
+		return &AcmeAccount{}
+	case LabelNetworkConfig:
+		return &NetworkConfig{}
+	}
+	return nil
+}
+
+// checkPayload validates that payload is (a pointer to) the payload type of the label
+func (l MetaLabel) checkPayload(payload interface{}) error {
+	want := reflect.TypeOf(l.NewPayload()).Elem()
+	got := reflect.TypeOf(payload)
+	if got != nil && got.Kind() == reflect.Ptr {
+		got = got.Elem()
+	}
+	if got != want {
+		return errors.New(l.String() + " payload must be a " + want.Name())
+	}
+	return nil
+}
+
+// MetadataElement stores a document in the metadata collection
+type MetadataElement struct {
+	Label   string   `json:"label" bson:"label"`
+	Version int64    `json:"version" bson:"version"` // incremented on every write
+	Updated int64    `json:"updated" bson:"updated"`
+	Payload bson.Raw `json:"-" bson:"payload"`
+}
+
+// Decode unmarshals the payload of the element into its typed payload struct
+func (e MetadataElement) Decode() (interface{}, error) {
+	label, err := ParseMetaLabel(e.Label)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := label.NewPayload()
+	if err := bson.Unmarshal(e.Payload, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// KeepWriteOnly copies the write-only fields of a stored element into a new payload
+func KeepWriteOnly(payload interface{}, stored MetadataElement) error {
+	account, ok := payload.(*AcmeAccount)
+	if !ok {
+		return nil
+	}
+
+	current, err := stored.Decode()
+	if err != nil {
+		return err
+	}
+	if current, ok := current.(*AcmeAccount); ok {
+		account.PrivateKey = current.PrivateKey
+	}
+	return nil
+}
+
+// newMetadataElement validates and marshals a typed payload
+func newMetadataElement(l MetaLabel, payload interface{}, version int64) (MetadataElement, error) {
+	if err := l.checkPayload(payload); err != nil {
+		return MetadataElement{}, err
+	}
+
+	raw, err := bson.Marshal(payload)
+	if err != nil {
+		return MetadataElement{}, err
+	}
+
+	return MetadataElement{
+		Label:   l.String(),
+		Version: version,
+		Updated: time.Now().UnixNano(),
+		Payload: raw,
+	}, nil
+}
+
+// CompareAndSwapMetadata replaces the payload of a label at an expected version, 0 to create it
+func (d Mongo) CompareAndSwapMetadata(l MetaLabel, payload interface{}, expected int64) (MetadataElement, error) {
+	element, err := newMetadataElement(l, payload, expected+1)
+	if err != nil {
+		return MetadataElement{}, err
+	}
+
+	if expected == 0 {
+		if _, err := d.Db.Collection("metadata").InsertOne(context.Background(), element); err != nil {
+			if mongoErr(err) == ErrDuplicate {
+				return MetadataElement{}, ErrConflict
+			}
+			return MetadataElement{}, err
+		}
+		return element, nil
+	}
+
+	result, err := d.Db.Collection("metadata").ReplaceOne(
+		context.Background(),
+		bson.M{"label": element.Label, "version": expected},
+		element,
+	)
+	if err != nil {
+		return MetadataElement{}, err
+	}
+
+	if result.MatchedCount < 1 {
+		return MetadataElement{}, ErrConflict
+	}
+	return element, nil
+}
+
+// GetMetadata returns the metadata object with specified label
+func (d Mongo) GetMetadata(l MetaLabel) (MetadataElement, error) {
+	var element MetadataElement
+	if err := d.findOne("metadata", bson.M{"label": l.String()}, &element); err != nil {
+		return MetadataElement{}, err
+	}
+
+	return element, nil
+}
+
+// ListMetadata returns all metadata objects
+func (d Mongo) ListMetadata() ([]MetadataElement, error) {
+	cursor, err := d.Db.Collection("metadata").Find(context.Background(), bson.M{}, options.Find().SetSort(bson.M{"label": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var elements []MetadataElement
+	if err := cursor.All(context.Background(), &elements); err != nil {
+		return nil, err
+	}
+	return elements, nil
+}
+
+// CompareAndSwapMetadata replaces the payload of a label at an expected version
+func (m *Memory) CompareAndSwapMetadata(l MetaLabel, payload interface{}, expected int64) (MetadataElement, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.metadata[l.String()].Version != expected {
+		return MetadataElement{}, ErrConflict
+	}
+
+	element, err := newMetadataElement(l, payload, expected+1)
+	if err != nil {
+		return MetadataElement{}, err
+	}
+
+	m.metadata[element.Label] = element
+	return element, nil
+}
+
+// GetMetadata returns the metadata object with specified label
+func (m *Memory) GetMetadata(l MetaLabel) (MetadataElement, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	element, ok := m.metadata[l.String()]
+	if !ok {
+		return MetadataElement{}, ErrNotFound
+	}
+	return element, nil
+}
+
+// ListMetadata returns all metadata objects
+func (m *Memory) ListMetadata() ([]MetadataElement, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var elements []MetadataElement
+	for _, l := range MetaLabels() {
+		if element, ok := m.metadata[l.String()]; ok {
+			elements = append(elements, element)
+		}
+	}
+	return elements, nil
+}
@@ -0,0 +1,612 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/natesales/cdn-tree/internal/crypto"
+	"github.com/natesales/cdn-tree/internal/soa"
+)
+
+// Migration is a single versioned schema change. Up and Down must be idempotent.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(db *mongo.Database) error
+	Down        func(db *mongo.Database) error
+}
+
+// MigrationStatus stores whether a migration has been applied
+type MigrationStatus struct {
+	Version     int       `json:"version"`
+	Description string    `json:"description"`
+	Applied     bool      `json:"applied"`
+	AppliedAt   time.Time `json:"applied_at,omitempty"`
+}
+
+// appliedMigration stores a document in the migrations collection
+type appliedMigration struct {
+	Version     int    `bson:"_id"`
+	Description string `bson:"description"`
+	Applied     int64  `bson:"applied"`
+}
+
+// migrationLockTTL is the time after which a lock held by a crashed controller can be taken over
+var migrationLockTTL = 5 * time.Minute
+
+// ErrMigrationLockLost is returned when another controller took over the migration lock while migrations were running
+var ErrMigrationLockLost = errors.New("migration lock lost")
+
+// createIndex creates an index, which is a no-op if an identical index already exists
+func createIndex(db *mongo.Database, collection string, keys bson.D, unique bool) error {
+	model := mongo.IndexModel{Keys: keys}
+	if unique {
+		model.Options = options.Index().SetUnique(true)
+	}
+
+	_, err := db.Collection(collection).Indexes().CreateOne(context.Background(), model)
+	return err
+}
+
+// dropIndex drops an index by name, ignoring indexes that don't exist
+func dropIndex(db *mongo.Database, collection string, name string) error {
+	_, err := db.Collection(collection).Indexes().DropOne(context.Background(), name)
+	if err != nil && (strings.Contains(err.Error(), "index not found") || strings.Contains(err.Error(), "ns not found")) {
+		return nil // already dropped
+	}
+	return err
+}
+
+// migrations is the ordered list of all schema migrations
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "unique indexes on zones.zone and users.email",
+		Up: func(db *mongo.Database) error {
+			if err := createIndex(db, "zones", bson.D{{Key: "zone", Value: 1}}, true); err != nil {
+				return err
+			}
+			// Earlier versions indexed users.user, which doesn't exist and only ever allowed a single user
+			if err := dropIndex(db, "users", "user_1"); err != nil {
+				return err
+			}
+			return createIndex(db, "users", bson.D{{Key: "email", Value: 1}}, true)
+		},
+		Down: func(db *mongo.Database) error {
+			if err := dropIndex(db, "zones", "zone_1"); err != nil {
+				return err
+			}
+			return dropIndex(db, "users", "email_1")
+		},
+	},
+	{
+		Version:     2,
+		Description: "queue claim index and API key lookup index",
+		Up: func(db *mongo.Database) error {
+			if err := createIndex(db, "queue", bson.D{{Key: "type", Value: 1}, {Key: "available", Value: 1}, {Key: "created", Value: 1}}, false); err != nil {
+				return err
+			}
+			return createIndex(db, "users", bson.D{{Key: "apikey", Value: 1}}, false)
+		},
+		Down: func(db *mongo.Database) error {
+			if err := dropIndex(db, "queue", "type_1_available_1_created_1"); err != nil {
+				return err
+			}
+			return dropIndex(db, "users", "apikey_1")
+		},
+	},
+	{
+		Version:     3,
+		Description: "move colliding legacy metadata aside and index metadata.label",
+		Up: func(db *mongo.Database) error {
+			// Earlier versions stored every label as LabelNetworkConfig, so these documents can't be attributed to a label
+			cursor, err := db.Collection("metadata").Find(context.Background(), bson.M{"label": "LabelNetworkConfig"})
+			if err != nil {
+				return err
+			}
+			var legacy []bson.M
+			if err := cursor.All(context.Background(), &legacy); err != nil {
+				return err
+			}
+			for _, doc := range legacy {
+				if _, err := db.Collection("metadata_legacy").ReplaceOne(context.Background(), bson.M{"_id": doc["_id"]}, doc, options.Replace().SetUpsert(true)); err != nil {
+					return err
+				}
+				if _, err := db.Collection("metadata").DeleteOne(context.Background(), bson.M{"_id": doc["_id"]}); err != nil {
+					return err
+				}
+			}
+
+			return createIndex(db, "metadata", bson.D{{Key: "label", Value: 1}}, true)
+		},
+		Down: func(db *mongo.Database) error {
+			return dropIndex(db, "metadata", "label_1")
+		},
+	},
+	{
+		Version:     4,
+		Description: "audit log indexes for per zone and per user queries and retention pruning",
+		Up: func(db *mongo.Database) error {
+			if err := createIndex(db, "audit", bson.D{{Key: "time", Value: -1}}, false); err != nil {
+				return err
+			}
+			if err := createIndex(db, "audit", bson.D{{Key: "zone", Value: 1}, {Key: "time", Value: -1}}, false); err != nil {
+				return err
+			}
+			return createIndex(db, "audit", bson.D{{Key: "actor", Value: 1}, {Key: "time", Value: -1}}, false)
+		},
+		Down: func(db *mongo.Database) error {
+			for _, name := range []string{"time_-1", "zone_1_time_-1", "actor_1_time_-1"} {
+				if err := dropIndex(db, "audit", name); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     5,
+		Description: "zone version index and baseline versions of existing zones",
+		Up: func(db *mongo.Database) error {
+			if err := createIndex(db, "zone_versions", bson.D{{Key: "zone", Value: 1}, {Key: "serial", Value: -1}}, true); err != nil {
+				return err
+			}
+
+			cursor, err := db.Collection("zones").Find(context.Background(), bson.M{})
+			if err != nil {
+				return err
+			}
+
+			// Zones are decoded as stored by this version, so later changes to Zone don't change the baseline versions
+			var zones []struct {
+				Zone    string
+				Serial  int64
+				Records []string
+			}
+			if err := cursor.All(context.Background(), &zones); err != nil {
+				return err
+			}
+			for _, zone := range zones {
+				version := bson.M{
+					"zone":    zone.Zone,
+					"serial":  zone.Serial,
+					"records": append([]string{}, zone.Records...),
+					"created": time.Now().UnixNano(),
+					"author":  "",
+					"change":  "baseline",
+				}
+				if _, err := db.Collection("zone_versions").InsertOne(context.Background(), version); err != nil && mongoErr(err) != ErrDuplicate {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(db *mongo.Database) error {
+			return dropIndex(db, "zone_versions", "zone_1_serial_-1")
+		},
+	},
+	{
+		Version:     6,
+		Description: "replace nanosecond zone serials with 32-bit SOA serials",
+		Up: func(db *mongo.Database) error {
+			// Versions with nanosecond serials can't be addressed by a 32-bit serial anymore
+			legacy := bson.M{"serial": bson.M{"$gt": math.MaxUint32}}
+			cursor, err := db.Collection("zone_versions").Find(context.Background(), legacy)
+			if err != nil {
+				return err
+			}
+			var versions []bson.M
+			if err := cursor.All(context.Background(), &versions); err != nil {
+				return err
+			}
+			for _, doc := range versions {
+				if _, err := db.Collection("zone_versions_legacy").ReplaceOne(context.Background(), bson.M{"_id": doc["_id"]}, doc, options.Replace().SetUpsert(true)); err != nil {
+					return err
+				}
+			}
+			if _, err := db.Collection("zone_versions").DeleteMany(context.Background(), legacy); err != nil {
+				return err
+			}
+
+			cursor, err = db.Collection("zones").Find(context.Background(), legacy)
+			if err != nil {
+				return err
+			}
+			var zones []bson.M
+			if err := cursor.All(context.Background(), &zones); err != nil {
+				return err
+			}
+			for _, doc := range zones {
+				// The nanosecond serial is kept for Down
+				serial := soa.DefaultScheme.Initial(time.Now())
+				if _, err := db.Collection("zones").UpdateOne(
+					context.Background(),
+					bson.M{"_id": doc["_id"]},
+					bson.M{"$set": bson.M{"serial": serial, "serialscheme": soa.DefaultScheme, "legacyserial": doc["serial"]}},
+				); err != nil {
+					return err
+				}
+
+				var zone Zone
+				if err := db.Collection("zones").FindOne(context.Background(), bson.M{"_id": doc["_id"]}).Decode(&zone); err != nil {
+					return err
+				}
+				version := NewZoneVersion(zone, "", "baseline", time.Now().UnixNano())
+				if _, err := db.Collection("zone_versions").InsertOne(context.Background(), version); err != nil && mongoErr(err) != ErrDuplicate {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(db *mongo.Database) error {
+			// Restore the nanosecond serials, which are higher than the 32-bit serials, so earlier versions keep counting up from them
+			cursor, err := db.Collection("zones").Find(context.Background(), bson.M{"legacyserial": bson.M{"$exists": true}})
+			if err != nil {
+				return err
+			}
+			var zones []bson.M
+			if err := cursor.All(context.Background(), &zones); err != nil {
+				return err
+			}
+			for _, doc := range zones {
+				if _, err := db.Collection("zones").UpdateOne(
+					context.Background(),
+					bson.M{"_id": doc["_id"]},
+					bson.M{"$set": bson.M{"serial": doc["legacyserial"]}, "$unset": bson.M{"legacyserial": ""}},
+				); err != nil {
+					return err
+				}
+			}
+
+			// Move the versions with nanosecond serials back, versions with 32-bit serials stay valid
+			cursor, err = db.Collection("zone_versions_legacy").Find(context.Background(), bson.M{})
+			if err != nil {
+				return err
+			}
+			var versions []bson.M
+			if err := cursor.All(context.Background(), &versions); err != nil {
+				return err
+			}
+			for _, doc := range versions {
+				if _, err := db.Collection("zone_versions").ReplaceOne(context.Background(), bson.M{"_id": doc["_id"]}, doc, options.Replace().SetUpsert(true)); err != nil {
+					return err
+				}
+			}
+			return db.Collection("zone_versions_legacy").Drop(context.Background())
+		},
+	},
+	{
+		Version:     7,
+		Description: "zone verification status, existing zones stay active",
+		Up: func(db *mongo.Database) error {
+			if _, err := db.Collection("zones").UpdateMany(
+				context.Background(),
+				bson.M{"status": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"status": ZoneActive, "verifiedby": "legacy"}},
+			); err != nil {
+				return err
+			}
+			return createIndex(db, "zones", bson.D{{Key: "status", Value: 1}}, false)
+		},
+		Down: func(db *mongo.Database) error {
+			return dropIndex(db, "zones", "status_1") // statuses are ignored by earlier versions
+		},
+	},
+	{
+		Version:     8,
+		Description: "zone transfer journal and TSIG key indexes",
+		Up: func(db *mongo.Database) error {
+			if err := createIndex(db, "transfer_journal", bson.D{{Key: "zone", Value: 1}, {Key: "serial", Value: 1}}, true); err != nil {
+				return err
+			}
+			return createIndex(db, "tsig_keys", bson.D{{Key: "zone", Value: 1}}, false)
+		},
+		Down: func(db *mongo.Database) error {
+			if err := dropIndex(db, "transfer_journal", "zone_1_serial_1"); err != nil {
+				return err
+			}
+			return dropIndex(db, "tsig_keys", "zone_1")
+		},
+	},
+	{
+		Version:     9,
+		Description: "account TSIG key index",
+		Up: func(db *mongo.Database) error {
+			return createIndex(db, "tsig_keys", bson.D{{Key: "user", Value: 1}}, false)
+		},
+		Down: func(db *mongo.Database) error {
+			return dropIndex(db, "tsig_keys", "user_1") // account keys are ignored by earlier versions
+		},
+	},
+	{
+		Version:     10,
+		Description: "query statistics bucket indexes",
+		Up: func(db *mongo.Database) error {
+			if err := createIndex(db, "query_stats", bson.D{
+				{Key: "zone", Value: 1}, {Key: "bucket", Value: 1}, {Key: "resolution", Value: 1},
+				{Key: "node", Value: 1}, {Key: "type", Value: 1}, {Key: "rcode", Value: 1},
+			}, true); err != nil {
+				return err
+			}
+			return createIndex(db, "query_stats", bson.D{{Key: "bucket", Value: 1}}, false)
+		},
+		Down: func(db *mongo.Database) error {
+			if err := dropIndex(db, "query_stats", "zone_1_bucket_1_resolution_1_node_1_type_1_rcode_1"); err != nil {
+				return err
+			}
+			return dropIndex(db, "query_stats", "bucket_1")
+		},
+	},
+	{
+		Version:     11,
+		Description: "unique index on unclaimed queue messages by type and coalescing key",
+		Up: func(db *mongo.Database) error {
+			// Concurrent upserts could queue the same key twice before the index existed, keep the oldest
+			cursor, err := db.Collection("queue").Aggregate(context.Background(), mongo.Pipeline{
+				{{Key: "$match", Value: unclaimedKeyed}},
+				{{Key: "$sort", Value: bson.M{"created": 1}}},
+				{{Key: "$group", Value: bson.M{"_id": bson.M{"type": "$type", "key": "$key"}, "ids": bson.M{"$push": "$_id"}}}},
+				{{Key: "$match", Value: bson.M{"ids.1": bson.M{"$exists": true}}}},
+			})
+			if err != nil {
+				return err
+			}
+			var duplicates []struct {
+				IDs []interface{} `bson:"ids"`
+			}
+			if err := cursor.All(context.Background(), &duplicates); err != nil {
+				return err
+			}
+			for _, duplicate := range duplicates {
+				if _, err := db.Collection("queue").DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": duplicate.IDs[1:]}}); err != nil {
+					return err
+				}
+			}
+
+			_, err = db.Collection("queue").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+				Keys:    bson.D{{Key: "type", Value: 1}, {Key: "key", Value: 1}},
+				Options: options.Index().SetUnique(true).SetPartialFilterExpression(unclaimedKeyed).SetName("unclaimed_type_key"),
+			})
+			return err
+		},
+		Down: func(db *mongo.Database) error {
+			return dropIndex(db, "queue", "unclaimed_type_key")
+		},
+	},
+}
+
+// lockOwner identifies this process as the holder of the migration lock
+var lockOwner = func() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d/%s", hostname, os.Getpid(), crypto.RandomString()[:8])
+}()
+
+// acquireMigrationLock takes the distributed migration lock, waiting up to timeout for another controller to release it
+func (d Mongo) acquireMigrationLock(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		now := time.Now()
+		_, err := d.Db.Collection("migrations_lock").UpdateOne(
+			context.Background(),
+			bson.M{"_id": "lock", "expires": bson.M{"$lt": now.UnixNano()}},
+			bson.M{"$set": bson.M{"owner": lockOwner, "expires": now.Add(migrationLockTTL).UnixNano()}},
+			options.Update().SetUpsert(true),
+		)
+		if err == nil {
+			return nil
+		}
+
+		// A duplicate key error means the lock exists and hasn't expired
+		if mongoErr(err) != ErrDuplicate {
+			return err
+		}
+
+		if now.After(deadline) {
+			return errors.New("timed out waiting for migration lock")
+		}
+
+		log.Debugln("waiting for migration lock")
+		time.Sleep(time.Second)
+	}
+}
+
+// releaseMigrationLock releases the migration lock if this process holds it
+func (d Mongo) releaseMigrationLock() error {
+	_, err := d.Db.Collection("migrations_lock").DeleteOne(context.Background(), bson.M{"_id": "lock", "owner": lockOwner})
+	return err
+}
+
+// renewMigrationLock extends the migration lock if this process still holds it
+func (d Mongo) renewMigrationLock() error {
+	result, err := d.Db.Collection("migrations_lock").UpdateOne(
+		context.Background(),
+		bson.M{"_id": "lock", "owner": lockOwner},
+		bson.M{"$set": bson.M{"expires": time.Now().Add(migrationLockTTL).UnixNano()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount < 1 {
+		return ErrMigrationLockLost
+	}
+	return nil
+}
+
+// holdMigrationLock takes the migration lock and renews it until release is called
+func (d Mongo) holdMigrationLock() (held func() error, release func(), err error) {
+	if err := d.acquireMigrationLock(migrationLockTTL); err != nil {
+		return nil, nil, err
+	}
+
+	var lock sync.Mutex
+	var lost error
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(migrationLockTTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				err := d.renewMigrationLock()
+				if err == ErrMigrationLockLost {
+					lock.Lock()
+					lost = err
+					lock.Unlock()
+					return
+				} else if err != nil {
+					log.Warnf("renewing migration lock: %v", err)
+				}
+			}
+		}
+	}()
+
+	held = func() error {
+		lock.Lock()
+		defer lock.Unlock()
+		return lost
+	}
+	release = func() {
+		close(stop)
+		<-done
+		if err := d.releaseMigrationLock(); err != nil {
+			log.Warnf("releasing migration lock: %v", err)
+		}
+	}
+	return held, release, nil
+}
+
+// appliedMigrations gets all applied migrations by version
+func (d Mongo) appliedMigrations() (map[int]appliedMigration, error) {
+	cursor, err := d.Db.Collection("migrations").Find(context.Background(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var list []appliedMigration
+	if err := cursor.All(context.Background(), &list); err != nil {
+		return nil, err
+	}
+
+	applied := map[int]appliedMigration{}
+	for _, migration := range list {
+		applied[migration.Version] = migration
+	}
+	return applied, nil
+}
+
+// MigrationStatus gets the state of all known migrations
+func (d Mongo) MigrationStatus() ([]MigrationStatus, error) {
+	applied, err := d.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var status []MigrationStatus
+	for _, migration := range migrations {
+		s := MigrationStatus{Version: migration.Version, Description: migration.Description}
+		if a, ok := applied[migration.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = time.Unix(0, a.Applied)
+		}
+		status = append(status, s)
+	}
+	return status, nil
+}
+
+// Migrate applies all pending migrations in order under the distributed migration lock
+func (d Mongo) Migrate() error {
+	held, release, err := d.holdMigrationLock()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	applied, err := d.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		if err := held(); err != nil {
+			return err
+		}
+		log.Infof("applying migration %d: %s", migration.Version, migration.Description)
+		if err := migration.Up(d.Db); err != nil {
+			return fmt.Errorf("migration %d up: %v", migration.Version, err)
+		}
+		if err := held(); err != nil {
+			return fmt.Errorf("migration %d up: %v", migration.Version, err)
+		}
+
+		if _, err := d.Db.Collection("migrations").InsertOne(context.Background(), appliedMigration{
+			Version:     migration.Version,
+			Description: migration.Description,
+			Applied:     time.Now().UnixNano(),
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MigrateDown reverts applied migrations in reverse order until only migrations up to and including target remain
+func (d Mongo) MigrateDown(target int) error {
+	held, release, err := d.holdMigrationLock()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	applied, err := d.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if migration.Version <= target {
+			break
+		}
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+
+		if err := held(); err != nil {
+			return err
+		}
+		log.Infof("reverting migration %d: %s", migration.Version, migration.Description)
+		if err := migration.Down(d.Db); err != nil {
+			return fmt.Errorf("migration %d down: %v", migration.Version, err)
+		}
+		if err := held(); err != nil {
+			return fmt.Errorf("migration %d down: %v", migration.Version, err)
+		}
+
+		if _, err := d.Db.Collection("migrations").DeleteOne(context.Background(), bson.M{"_id": migration.Version}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,519 @@
+package database
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/natesales/cdn-tree/internal/balance"
+	"github.com/natesales/cdn-tree/internal/bgp"
+	"github.com/natesales/cdn-tree/internal/crypto"
+	"github.com/natesales/cdn-tree/internal/geo"
+	"github.com/natesales/cdn-tree/internal/health"
+	"github.com/natesales/cdn-tree/internal/soa"
+	"github.com/natesales/cdn-tree/internal/util"
+)
+
+// Mongo is a Store backed by a *mongo.Database
+type Mongo struct {
+	Db    *mongo.Database
+	Queue QueueOptions
+}
+
+// Config stores the MongoDB connection settings
+type Config struct {
+	URI                    string        `json:"uri"`         // seed list, e.g. mongodb://10.0.0.1:27017,10.0.0.2:27017
+	Username               string        `json:"username"`    // optional
+	Password               string        `json:"password"`    // optional
+	AuthSource             string        `json:"auth_source"` // optional, defaults to the driver's default (admin)
+	Name                   string        `json:"name"`        // database name
+	ReplicaSet             string        `json:"replica_set"` // replica set name, ignored in development mode
+	TLS                    TLSConfig     `json:"tls"`
+	ConnectTimeout         util.Duration `json:"connect_timeout"`
+	ServerSelectionTimeout util.Duration `json:"server_selection_timeout"`
+	Development            bool          `json:"-"` // connect directly to a single server instead of expecting a replica set
+}
+
+// TLSConfig stores the MongoDB TLS settings
+type TLSConfig struct {
+	Enabled  bool   `json:"enabled"`
+	CAFile   string `json:"ca_file"`   // optional CA bundle to verify the server with
+	CertFile string `json:"cert_file"` // optional client certificate
+	KeyFile  string `json:"key_file"`  // optional client certificate key
+	Insecure bool   `json:"insecure"`  // skip server certificate verification
+}
+
+// DefaultConfig is the connection configuration used when no other settings are given
+var DefaultConfig = Config{
+	URI:                    "mongodb://localhost:27017",
+	Name:                   "cdnv3db",
+	ReplicaSet:             "packetframe",
+	ConnectTimeout:         util.Duration(10 * time.Second),
+	ServerSelectionTimeout: util.Duration(10 * time.Second),
+}
+
+// clientOptions assembles driver options from a Config
+func (c Config) clientOptions() (*options.ClientOptions, error) {
+	opts := options.Client().
+		ApplyURI(c.URI).
+		SetConnectTimeout(time.Duration(c.ConnectTimeout)).
+		SetServerSelectionTimeout(time.Duration(c.ServerSelectionTimeout))
+
+	if c.Development {
+		opts.SetDirect(true)
+	} else if c.ReplicaSet != "" {
+		opts.SetReplicaSet(c.ReplicaSet)
+	}
+
+	if c.Username != "" {
+		opts.SetAuth(options.Credential{
+			Username:   c.Username,
+			Password:   c.Password,
+			AuthSource: c.AuthSource,
+		})
+	}
+
+	if c.TLS.Enabled {
+		tlsConfig := &tls.Config{InsecureSkipVerify: c.TLS.Insecure}
+
+		if c.TLS.CAFile != "" {
+			ca, err := ioutil.ReadFile(c.TLS.CAFile)
+			if err != nil {
+				return nil, errors.New("reading CA file: " + err.Error())
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, errors.New("no certificates found in CA file " + c.TLS.CAFile)
+			}
+		}
+
+		if c.TLS.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+			if err != nil {
+				return nil, errors.New("loading client certificate: " + err.Error())
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	return opts, opts.Validate()
+}
+
+// New connects to MongoDB and constructs a new Mongo store. Call Migrate before using the store.
+func New(config Config) (*Mongo, error) {
+	opts, err := config.clientOptions()
+	if err != nil {
+		return nil, errors.New("client options: " + err.Error())
+	}
+
+	client, err := mongo.Connect(context.Background(), opts)
+	if err != nil {
+		return nil, errors.New("client connect: " + err.Error())
+	}
+
+	// Check the connection
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ServerSelectionTimeout))
+	defer cancel()
+	if err := client.Ping(ctx, nil); err != nil {
+		return nil, errors.New("ping: " + err.Error())
+	}
+
+	log.Debugf("connected to database %s", config.Name)
+	db := client.Database(config.Name)
+
+	// Return database pointer
+	return &Mongo{Db: db, Queue: DefaultQueueOptions}, nil
+}
+
+// mongoErr converts driver errors into the errors defined by Store
+func mongoErr(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	if err != nil && strings.Contains(err.Error(), "duplicate key error") {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// objectID parses a hex ID, treating invalid IDs as not found
+func objectID(id string) (primitive.ObjectID, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return primitive.ObjectID{}, ErrNotFound
+	}
+	return oid, nil
+}
+
+// findOne decodes a single document from a collection into out
+func (d Mongo) findOne(collection string, filter interface{}, out interface{}) error {
+	return mongoErr(d.Db.Collection(collection).FindOne(context.Background(), filter).Decode(out))
+}
+
+// Users
+
+// AddUser adds a new user
+func (d Mongo) AddUser(user User) error {
+	_, err := d.Db.Collection("users").InsertOne(context.Background(), user)
+	return mongoErr(err)
+}
+
+// GetUserByAPIKey looks up a user by API key
+func (d Mongo) GetUserByAPIKey(apiKey string) (User, error) {
+	var user User
+	if err := d.findOne("users", bson.M{"apikey": apiKey}, &user); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// GetUserByEmail looks up a user by email address
+func (d Mongo) GetUserByEmail(email string) (User, error) {
+	var user User
+	if err := d.findOne("users", bson.M{"email": email}, &user); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// SetUserVanity allows or disallows a user to use vanity nameservers
+func (d Mongo) SetUserVanity(email string, enabled bool) error {
+	result, err := d.Db.Collection("users").UpdateOne(context.Background(), bson.M{"email": email}, bson.M{"$set": bson.M{"vanity": enabled}})
+	if err != nil {
+		return mongoErr(err)
+	}
+
+	if result.MatchedCount < 1 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Zones
+
+// AddZone adds a new zone
+func (d Mongo) AddZone(zone Zone) error {
+	_, err := d.Db.Collection("zones").InsertOne(context.Background(), zone)
+	return mongoErr(err)
+}
+
+// GetZone looks up a zone by ID
+func (d Mongo) GetZone(id string) (Zone, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return Zone{}, err
+	}
+
+	var zone Zone
+	if err := d.findOne("zones", bson.M{"_id": oid}, &zone); err != nil {
+		return Zone{}, err
+	}
+	return zone, nil
+}
+
+// GetZoneByName looks up a zone by its FQDN
+func (d Mongo) GetZoneByName(name string) (Zone, error) {
+	var zone Zone
+	if err := d.findOne("zones", bson.M{"zone": name}, &zone); err != nil {
+		return Zone{}, err
+	}
+	return zone, nil
+}
+
+// ListZones returns all zones
+func (d Mongo) ListZones() ([]Zone, error) {
+	cursor, err := d.Db.Collection("zones").Find(context.Background(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var zones []Zone
+	if err := cursor.All(context.Background(), &zones); err != nil {
+		return nil, err
+	}
+	return zones, nil
+}
+
+// zoneSerialRetries is the number of times a change is retried when the zone serial is bumped concurrently
+const zoneSerialRetries = 10
+
+// changeZone applies the fields set by change to a zone and bumps its serial, retrying on conflicts
+func (d Mongo) changeZone(zone string, change func(current *Zone) bson.M) (uint32, error) {
+	for i := 0; i < zoneSerialRetries; i++ {
+		current, err := d.GetZoneByName(zone)
+		if err != nil {
+			return 0, err
+		}
+
+		set := change(&current)
+		serial := current.Scheme().Next(current.Serial, time.Now())
+		set["serial"] = serial
+
+		update := bson.M{"$set": set}
+		if c, ok := set["change"].(ZoneChange); ok {
+			c.Serial = serial
+			set["change"] = c
+		} else {
+			update["$unset"] = bson.M{"change": ""}
+		}
+
+		result, err := d.Db.Collection("zones").UpdateOne(
+			context.Background(),
+			bson.M{"zone": zone, "serial": current.Serial},
+			update,
+		)
+		if err != nil {
+			return 0, mongoErr(err)
+		}
+		if result.MatchedCount > 0 {
+			return serial, nil
+		}
+	}
+	return 0, ErrConflict
+}
+
+// AddRecord appends a RR string to a zone and returns the new zone serial. The change is stored in the same update.
+func (d Mongo) AddRecord(zone string, rr string, change ZoneChange) (uint32, error) {
+	return d.changeZone(zone, func(current *Zone) bson.M {
+		return bson.M{"records": append(current.Records, rr), "change": change}
+	})
+}
+
+// SetZoneDNSSEC replaces the DNSSEC key of a zone and returns the new zone serial
+func (d Mongo) SetZoneDNSSEC(zone string, key crypto.DNSSECKey) (uint32, error) {
+	return d.changeZone(zone, func(current *Zone) bson.M {
+		return bson.M{"dnssec": key}
+	})
+}
+
+// SetZoneSOA replaces the serial scheme and SOA overrides of a zone and returns the new zone serial
+func (d Mongo) SetZoneSOA(zone string, scheme soa.Scheme, settings soa.Settings) (uint32, error) {
+	return d.changeZone(zone, func(current *Zone) bson.M {
+		current.SerialScheme = scheme
+		return bson.M{"serialscheme": scheme, "soa": settings}
+	})
+}
+
+// SetZoneNameservers replaces the vanity nameservers of a zone and returns the new zone serial
+func (d Mongo) SetZoneNameservers(zone string, nameservers []string) (uint32, error) {
+	return d.changeZone(zone, func(current *Zone) bson.M {
+		return bson.M{"nameservers": nameservers}
+	})
+}
+
+// SetZoneGeoRecords replaces the geo record sets of a zone and returns the new zone serial
+func (d Mongo) SetZoneGeoRecords(zone string, sets []geo.RecordSet) (uint32, error) {
+	return d.changeZone(zone, func(current *Zone) bson.M {
+		return bson.M{"georecords": sets}
+	})
+}
+
+// SetZoneHealthRecords replaces the health checked record sets of a zone and returns the new zone serial
+func (d Mongo) SetZoneHealthRecords(zone string, sets []health.RecordSet) (uint32, error) {
+	return d.changeZone(zone, func(current *Zone) bson.M {
+		return bson.M{"healthrecords": sets}
+	})
+}
+
+// SetZoneBalancedRecords replaces the load-balanced record sets of a zone and returns the new zone serial
+func (d Mongo) SetZoneBalancedRecords(zone string, sets []balance.RecordSet) (uint32, error) {
+	return d.changeZone(zone, func(current *Zone) bson.M {
+		return bson.M{"balancedrecords": sets}
+	})
+}
+
+// BumpZoneSerial increments the serial of a zone whose generated records changed
+func (d Mongo) BumpZoneSerial(zone string) (uint32, error) {
+	return d.changeZone(zone, func(current *Zone) bson.M {
+		return bson.M{}
+	})
+}
+
+// ActivateZone marks a pending zone as verified so it is served
+func (d Mongo) ActivateZone(zone string, method string) error {
+	result, err := d.Db.Collection("zones").UpdateOne(
+		context.Background(),
+		bson.M{"zone": zone},
+		bson.M{
+			"$set":   bson.M{"status": ZoneActive, "verified": time.Now().UnixNano(), "verifiedby": method},
+			"$unset": bson.M{"challenge": ""},
+		},
+	)
+	if err != nil {
+		return mongoErr(err)
+	}
+
+	if result.MatchedCount < 1 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteZone removes a zone with its versions, TSIG keys and transfer journal
+func (d Mongo) DeleteZone(zone string) error {
+	result, err := d.Db.Collection("zones").DeleteOne(context.Background(), bson.M{"zone": zone})
+	if err != nil {
+		return mongoErr(err)
+	}
+	if result.DeletedCount < 1 {
+		return ErrNotFound
+	}
+
+	for _, collection := range []string{"zone_versions", "tsig_keys", "transfer_journal"} {
+		if _, err := d.Db.Collection(collection).DeleteMany(context.Background(), bson.M{"zone": zone}); err != nil {
+			return mongoErr(err)
+		}
+	}
+	return nil
+}
+
+// Nodes
+
+// AddNode adds a new edge node
+func (d Mongo) AddNode(node Node) error {
+	_, err := d.Db.Collection("nodes").InsertOne(context.Background(), node)
+	return mongoErr(err)
+}
+
+// GetNode looks up a node by ID
+func (d Mongo) GetNode(id string) (Node, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return Node{}, err
+	}
+
+	var node Node
+	if err := d.findOne("nodes", bson.M{"_id": oid}, &node); err != nil {
+		return Node{}, err
+	}
+	return node, nil
+}
+
+// ListNodes returns all nodes
+func (d Mongo) ListNodes() ([]Node, error) {
+	cursor, err := d.Db.Collection("nodes").Find(context.Background(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []Node
+	if err := cursor.All(context.Background(), &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// AuthorizeNode marks a node as authorized and returns it
+func (d Mongo) AuthorizeNode(id string) (Node, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return Node{}, err
+	}
+
+	var node Node
+	if err := d.Db.Collection("nodes").FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": oid},
+		bson.M{"$set": bson.M{"authorized": true}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&node); err != nil {
+		return Node{}, mongoErr(err)
+	}
+	return node, nil
+}
+
+// SetNodeToken replaces the hash of the credential of a node
+func (d Mongo) SetNodeToken(id string, tokenHash string) error {
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+
+	result, err := d.Db.Collection("nodes").UpdateOne(context.Background(), bson.M{"_id": oid}, bson.M{"$set": bson.M{"tokenhash": tokenHash}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetNodeSeen records the time a node last requested the zone manifest
+func (d Mongo) SetNodeSeen(id string, seen int64) error {
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+
+	result, err := d.Db.Collection("nodes").UpdateOne(context.Background(), bson.M{"_id": oid}, bson.M{"$set": bson.M{"lastseen": seen}})
+	if err != nil {
+		return mongoErr(err)
+	}
+
+	if result.MatchedCount < 1 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// AddSession adds a BGP session to a node
+func (d Mongo) AddSession(node string, session bgp.Session) error {
+	oid, err := objectID(node)
+	if err != nil {
+		return err
+	}
+
+	result, err := d.Db.Collection("nodes").UpdateOne(
+		context.Background(),
+		bson.M{"_id": oid},
+		bson.M{"$push": bson.M{"sessions": session}},
+	)
+	if err != nil {
+		return mongoErr(err)
+	}
+
+	if result.MatchedCount < 1 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Certificates
+
+// SetCertificate adds or replaces the certificate of a domain
+func (d Mongo) SetCertificate(c Certificate) error {
+	_, err := d.Db.Collection("certificates").ReplaceOne(
+		context.Background(),
+		bson.M{"domain": c.Domain},
+		c,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// ListCertificates returns all certificates
+func (d Mongo) ListCertificates() ([]Certificate, error) {
+	cursor, err := d.Db.Collection("certificates").Find(context.Background(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var certificates []Certificate
+	if err := cursor.All(context.Background(), &certificates); err != nil {
+		return nil, err
+	}
+	return certificates, nil
+}
@@ -0,0 +1,21 @@
+package database
+
+import "go.mongodb.org/mongo-driver/bson"
+
+// QueryLogSettings stores whether the edge nodes log the queries of a zone and which fraction of them
+type QueryLogSettings struct {
+	Enabled bool    `json:"enabled" bson:"enabled,omitempty"`
+	Rate    float64 `json:"rate" bson:"rate,omitempty"` // fraction of queries that are logged, in (0, 1]
+}
+
+// SetZoneQueryLog replaces the query log settings of a zone without changing its serial
+func (d Mongo) SetZoneQueryLog(zone string, settings QueryLogSettings) error {
+	return d.setZoneFields(zone, bson.M{"querylog": settings})
+}
+
+// SetZoneQueryLog replaces the query log settings of a zone without changing its serial
+func (m *Memory) SetZoneQueryLog(zone string, settings QueryLogSettings) error {
+	return m.setZoneFields(zone, func(z *Zone) {
+		z.QueryLog = settings
+	})
+}
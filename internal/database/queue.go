@@ -0,0 +1,330 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrQueueLockLost is returned when a message is confirmed or failed after another worker claimed it
+var ErrQueueLockLost = errors.New("queue message lock lost")
+
+// JobType identifies the kind of work a queue message carries
+type JobType string
+
+// QueueOptions stores the delivery settings of the message queue
+type QueueOptions struct {
+	VisibilityTimeout time.Duration // time a claimed message stays invisible to other workers
+	MaxAttempts       int           // number of deliveries before a message is dead-lettered
+	RetryBase         time.Duration // retry delay after the first failed attempt, doubled every attempt
+	RetryMax          time.Duration // upper bound of the retry delay
+}
+
+// DefaultQueueOptions are the queue settings used by New
+var DefaultQueueOptions = QueueOptions{
+	VisibilityTimeout: 30 * time.Second,
+	MaxAttempts:       5,
+	RetryBase:         5 * time.Second,
+	RetryMax:          10 * time.Minute,
+}
+
+// QueueMessage stores a single queue entry
+type QueueMessage struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Type      JobType            `json:"type"`
+	Key       string             `json:"key,omitempty"` // coalescing key, see AddQueueMessage
+	Payload   bson.Raw           `json:"-"`
+	Created   int64              `json:"created"`
+	Available int64              `json:"available"` // time after which the message may be claimed
+	Locked    bool               `json:"locked"`
+	LockedAt  int64              `json:"-"` // claim time, also used as the lock token
+	Attempts  int                `json:"attempts"`
+	LastError string             `json:"last_error,omitempty"`
+	Failed    int64              `json:"failed,omitempty"` // time the message was dead-lettered
+}
+
+// unclaimedKeyed matches the messages AddQueueMessage coalesces with
+var unclaimedKeyed = bson.M{"key": bson.M{"$gt": ""}, "locked": false, "attempts": 0}
+
+// NewQueueMessage constructs a new QueueMessage with a typed payload
+func NewQueueMessage(jobType JobType, payload interface{}) (QueueMessage, error) {
+	raw, err := bson.Marshal(payload)
+	if err != nil {
+		return QueueMessage{}, err
+	}
+
+	return QueueMessage{Type: jobType, Payload: raw}, nil
+}
+
+// Decode unmarshals the message payload into out
+func (m QueueMessage) Decode(out interface{}) error {
+	return bson.Unmarshal(m.Payload, out)
+}
+
+// retryDelay gets the exponential retry delay for a number of attempts
+func (o QueueOptions) retryDelay(attempts int) time.Duration {
+	delay := o.RetryBase
+	for i := 1; i < attempts && delay < o.RetryMax; i++ {
+		delay *= 2
+	}
+	if delay > o.RetryMax {
+		delay = o.RetryMax
+	}
+
+	return delay
+}
+
+// QueueHistory stores the outcome of a single delivery of a queue message
+type QueueHistory struct {
+	ID       primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Message  primitive.ObjectID `json:"message"`
+	Type     JobType            `json:"type"`
+	Key      string             `json:"key,omitempty"`
+	Attempt  int                `json:"attempt"`
+	Status   string             `json:"status"` // one of succeeded, failed or panicked
+	Error    string             `json:"error,omitempty"`
+	Started  int64              `json:"started"`
+	Finished int64              `json:"finished"`
+}
+
+// QueueOptions gets the delivery settings of the queue
+func (d Mongo) QueueOptions() QueueOptions {
+	return d.Queue
+}
+
+// AddQueueMessage appends a message to the queue, coalescing it with an unclaimed one of the same key
+func (d Mongo) AddQueueMessage(message QueueMessage) error {
+	// Set created timestamp and make the message available
+	message.Created = time.Now().UnixNano()
+	if message.Available == 0 {
+		message.Available = message.Created
+	}
+
+	// Disable work lock
+	message.Locked = false
+	message.Attempts = 0
+
+	if message.Key != "" {
+		_, err := d.Db.Collection("queue").UpdateOne(
+			context.Background(),
+			bson.M{"type": message.Type, "key": message.Key, "locked": false, "attempts": 0},
+			bson.M{"$setOnInsert": message},
+			options.Update().SetUpsert(true),
+		)
+		if mongoErr(err) == ErrDuplicate {
+			return nil // a concurrent upsert queued the same key first
+		}
+		return err
+	}
+
+	// Insert the new message
+	_, err := d.Db.Collection("queue").InsertOne(context.Background(), message)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// NextQueueMessage claims the oldest available message of one of the given types, or returns ErrNotFound
+func (d Mongo) NextQueueMessage(types ...JobType) (QueueMessage, error) {
+	for {
+		now := time.Now().UnixNano()
+
+		filter := bson.M{
+			"available": bson.M{"$lte": now},
+			"$or": bson.A{
+				bson.M{"locked": false},
+				bson.M{"lockedat": bson.M{"$lt": now - int64(d.Queue.VisibilityTimeout)}},
+			},
+		}
+		if len(types) > 0 {
+			filter["type"] = bson.M{"$in": types}
+		}
+
+		var message QueueMessage
+		err := d.Db.Collection("queue").FindOneAndUpdate(
+			context.Background(),
+			filter,
+			bson.M{
+				"$set": bson.M{"locked": true, "lockedat": now},
+				"$inc": bson.M{"attempts": 1},
+			},
+			options.FindOneAndUpdate().
+				SetSort(bson.D{{Key: "created", Value: 1}, {Key: "_id", Value: 1}}).
+				SetReturnDocument(options.After),
+		).Decode(&message)
+		if err != nil {
+			return QueueMessage{}, mongoErr(err) // ErrNotFound if nothing is available
+		}
+
+		// A message reclaimed after too many expired locks is dead-lettered instead of delivered again
+		if message.Attempts > d.Queue.MaxAttempts {
+			if err := d.deadLetter(message, "visibility timeout expired"); err != nil && err != ErrQueueLockLost {
+				return QueueMessage{}, err
+			}
+			continue
+		}
+
+		return message, nil
+	}
+}
+
+// QueueConfirm marks a queue message as complete
+func (d Mongo) QueueConfirm(message QueueMessage) error {
+	result, err := d.Db.Collection("queue").DeleteOne(context.Background(), bson.M{"_id": message.ID, "lockedat": message.LockedAt})
+	if err != nil {
+		return err
+	}
+
+	if result.DeletedCount < 1 {
+		return ErrQueueLockLost
+	}
+
+	return nil
+}
+
+// QueueExtend restarts the visibility timeout of a claimed message and returns it with its new lock token
+func (d Mongo) QueueExtend(message QueueMessage) (QueueMessage, error) {
+	var extended QueueMessage
+	err := d.Db.Collection("queue").FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": message.ID, "lockedat": message.LockedAt},
+		bson.M{"$set": bson.M{"lockedat": time.Now().UnixNano()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&extended)
+	if err != nil {
+		if err = mongoErr(err); err == ErrNotFound {
+			return QueueMessage{}, ErrQueueLockLost
+		}
+		return QueueMessage{}, err
+	}
+
+	return extended, nil
+}
+
+// QueueFail releases a queue message for retry, or dead-letters it once it has used all attempts
+func (d Mongo) QueueFail(message QueueMessage, cause error) error {
+	if message.Attempts >= d.Queue.MaxAttempts {
+		return d.deadLetter(message, cause.Error())
+	}
+
+	result, err := d.Db.Collection("queue").UpdateOne(
+		context.Background(),
+		bson.M{"_id": message.ID, "lockedat": message.LockedAt},
+		bson.M{"$set": bson.M{
+			"locked":    false,
+			"lasterror": cause.Error(),
+			"available": time.Now().Add(d.Queue.retryDelay(message.Attempts)).UnixNano(),
+		}},
+	)
+	if err != nil {
+		return err
+	}
+
+	if result.ModifiedCount < 1 {
+		return ErrQueueLockLost
+	}
+
+	return nil
+}
+
+// deadLetter moves a claimed message to the dead letter collection
+func (d Mongo) deadLetter(message QueueMessage, reason string) error {
+	message.Locked = false
+	message.LastError = reason
+	message.Failed = time.Now().UnixNano()
+
+	// Insert before deleting so a crash in between can only duplicate, never lose, a message
+	if _, err := d.Db.Collection("queue_dead").InsertOne(context.Background(), message); err != nil {
+		return err
+	}
+
+	result, err := d.Db.Collection("queue").DeleteOne(context.Background(), bson.M{"_id": message.ID, "lockedat": message.LockedAt})
+	if err != nil {
+		return err
+	}
+
+	if result.DeletedCount < 1 {
+		// Another worker reclaimed the message in the meantime, so it isn't dead after all
+		_, err := d.Db.Collection("queue_dead").DeleteOne(context.Background(), bson.M{"_id": message.ID})
+		if err != nil {
+			return err
+		}
+		return ErrQueueLockLost
+	}
+
+	return nil
+}
+
+// listMessages returns all messages in a queue collection in FIFO order
+func (d Mongo) listMessages(collection string) ([]QueueMessage, error) {
+	cursor, err := d.Db.Collection(collection).Find(
+		context.Background(),
+		bson.M{},
+		options.Find().SetSort(bson.D{{Key: "created", Value: 1}, {Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err // nil message array
+	}
+
+	var messages []QueueMessage
+	for cursor.Next(context.Background()) {
+		var message QueueMessage
+		if err := cursor.Decode(&message); err != nil {
+			return nil, err // nil message array
+		}
+		// Append the message to the list
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
+
+// ListQueue returns all messages in queue
+func (d Mongo) ListQueue() ([]QueueMessage, error) {
+	return d.listMessages("queue")
+}
+
+// ListDeadLetters returns all messages that have been dead-lettered
+func (d Mongo) ListDeadLetters() ([]QueueMessage, error) {
+	return d.listMessages("queue_dead")
+}
+
+// AddQueueHistory records the outcome of a queue message delivery
+func (d Mongo) AddQueueHistory(entry QueueHistory) error {
+	_, err := d.Db.Collection("queue_history").InsertOne(context.Background(), entry)
+	return err
+}
+
+// ListQueueHistory returns the most recent delivery outcomes, newest first, optionally filtered by job type
+func (d Mongo) ListQueueHistory(jobType JobType, limit int64) ([]QueueHistory, error) {
+	filter := bson.M{}
+	if jobType != "" {
+		filter["type"] = jobType
+	}
+
+	cursor, err := d.Db.Collection("queue_history").Find(
+		context.Background(),
+		filter,
+		options.Find().SetSort(bson.D{{Key: "finished", Value: -1}}).SetLimit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var history []QueueHistory
+	for cursor.Next(context.Background()) {
+		var entry QueueHistory
+		if err := cursor.Decode(&entry); err != nil {
+			return nil, err
+		}
+		history = append(history, entry)
+	}
+
+	return history, nil
+}
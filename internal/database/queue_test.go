@@ -0,0 +1,282 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/natesales/cdn-tree/internal/util"
+)
+
+// testMongoURI is the environment variable with the URI of a MongoDB server to run the Mongo store tests against, they are skipped without it
+const testMongoURI = "CDNV3_TEST_DB_URI"
+
+// testStores constructs an empty Memory store, and a Mongo store in a new database if a test server is configured, with the given queue options
+func testStores(t *testing.T, options QueueOptions) map[string]Store {
+	memory := NewMemory()
+	memory.Queue = options
+	stores := map[string]Store{"memory": memory}
+
+	uri := os.Getenv(testMongoURI)
+	if uri == "" {
+		t.Logf("%s isn't set, skipping the Mongo store", testMongoURI)
+		return stores
+	}
+
+	config := DefaultConfig
+	config.URI = uri
+	config.Name = "cdnv3test_" + primitive.NewObjectID().Hex()
+	config.Development = true
+	config.ServerSelectionTimeout = util.Duration(5 * time.Second)
+	mongo, err := New(config)
+	if err != nil {
+		t.Fatalf("connecting to %s: %v", uri, err)
+	}
+	t.Cleanup(func() {
+		if err := mongo.Db.Drop(context.Background()); err != nil {
+			t.Logf("dropping %s: %v", config.Name, err)
+		}
+	})
+	if err := mongo.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	mongo.Queue = options
+	stores["mongo"] = mongo
+	return stores
+}
+
+// TestQueueExactlyOnce checks that concurrent consumers deliver every message once
+func TestQueueExactlyOnce(t *testing.T) {
+	const messages = 200
+	const consumers = 8
+
+	for name, db := range testStores(t, DefaultQueueOptions) {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < messages; i++ {
+				message, err := NewQueueMessage("test", struct{ N int }{i})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := db.AddQueueMessage(message); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var lock sync.Mutex
+			delivered := map[primitive.ObjectID]int{}
+			var wg sync.WaitGroup
+			for i := 0; i < consumers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						message, err := db.NextQueueMessage("test")
+						if err == ErrNotFound {
+							return
+						} else if err != nil {
+							t.Error(err)
+							return
+						}
+
+						lock.Lock()
+						delivered[message.ID]++
+						lock.Unlock()
+
+						if err := db.QueueConfirm(message); err != nil {
+							t.Errorf("confirming %s: %v", message.ID.Hex(), err)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			if len(delivered) != messages {
+				t.Errorf("%d messages delivered, want %d", len(delivered), messages)
+			}
+			for id, count := range delivered {
+				if count != 1 {
+					t.Errorf("message %s delivered %d times", id.Hex(), count)
+				}
+			}
+			queue, err := db.ListQueue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(queue) != 0 {
+				t.Errorf("%d messages left in the queue", len(queue))
+			}
+		})
+	}
+}
+
+// TestQueueVisibilityTimeout checks that a message that isn't confirmed in time is delivered again, and the first consumer can't confirm it anymore
+func TestQueueVisibilityTimeout(t *testing.T) {
+	options := DefaultQueueOptions
+	options.VisibilityTimeout = 100 * time.Millisecond
+
+	for name, db := range testStores(t, options) {
+		t.Run(name, func(t *testing.T) {
+			message, err := NewQueueMessage("test", struct{}{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.AddQueueMessage(message); err != nil {
+				t.Fatal(err)
+			}
+
+			first, err := db.NextQueueMessage("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.NextQueueMessage("test"); err != ErrNotFound {
+				t.Fatalf("claimed message was delivered again before the timeout: %v", err)
+			}
+
+			time.Sleep(options.VisibilityTimeout + 20*time.Millisecond)
+			second, err := db.NextQueueMessage("test")
+			if err != nil {
+				t.Fatalf("message wasn't reclaimed after the timeout: %v", err)
+			}
+			if second.ID != first.ID || second.Attempts != 2 {
+				t.Errorf("reclaimed %s attempt %d, want %s attempt 2", second.ID.Hex(), second.Attempts, first.ID.Hex())
+			}
+
+			if err := db.QueueConfirm(first); err != ErrQueueLockLost {
+				t.Errorf("confirming with the expired claim: %v, want ErrQueueLockLost", err)
+			}
+			if err := db.QueueConfirm(second); err != nil {
+				t.Errorf("confirming with the current claim: %v", err)
+			}
+		})
+	}
+}
+
+// TestQueueDeadLetter checks that a message is dead-lettered once it has used all attempts, by failing or by timing out
+func TestQueueDeadLetter(t *testing.T) {
+	options := QueueOptions{
+		VisibilityTimeout: 50 * time.Millisecond,
+		MaxAttempts:       3,
+		RetryBase:         time.Millisecond,
+		RetryMax:          time.Millisecond,
+	}
+
+	for name, db := range testStores(t, options) {
+		t.Run(name, func(t *testing.T) {
+			failing, err := NewQueueMessage("failing", struct{}{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.AddQueueMessage(failing); err != nil {
+				t.Fatal(err)
+			}
+			for attempt := 1; attempt <= options.MaxAttempts; attempt++ {
+				time.Sleep(5 * time.Millisecond) // retry delay
+				message, err := db.NextQueueMessage("failing")
+				if err != nil {
+					t.Fatalf("attempt %d: %v", attempt, err)
+				}
+				if err := db.QueueFail(message, errors.New("broken")); err != nil {
+					t.Fatalf("attempt %d: %v", attempt, err)
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			if _, err := db.NextQueueMessage("failing"); err != ErrNotFound {
+				t.Errorf("message delivered after its last attempt: %v", err)
+			}
+
+			expiring, err := NewQueueMessage("expiring", struct{}{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.AddQueueMessage(expiring); err != nil {
+				t.Fatal(err)
+			}
+			for attempt := 1; attempt <= options.MaxAttempts; attempt++ {
+				if _, err := db.NextQueueMessage("expiring"); err != nil {
+					t.Fatalf("attempt %d: %v", attempt, err)
+				}
+				time.Sleep(options.VisibilityTimeout + 10*time.Millisecond)
+			}
+			if _, err := db.NextQueueMessage("expiring"); err != ErrNotFound {
+				t.Errorf("message delivered after its last attempt: %v", err)
+			}
+
+			dead, err := db.ListDeadLetters()
+			if err != nil {
+				t.Fatal(err)
+			}
+			reasons := map[JobType]string{}
+			for _, message := range dead {
+				reasons[message.Type] = message.LastError
+			}
+			if len(dead) != 2 || reasons["failing"] != "broken" || reasons["expiring"] != "visibility timeout expired" {
+				t.Errorf("dead letters = %+v, want both messages with their last error", dead)
+			}
+			queue, err := db.ListQueue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(queue) != 0 {
+				t.Errorf("%d messages left in the queue", len(queue))
+			}
+		})
+	}
+}
+
+// TestQueueCoalesce checks that concurrent messages with the same key are queued once until it is claimed
+func TestQueueCoalesce(t *testing.T) {
+	for name, db := range testStores(t, DefaultQueueOptions) {
+		t.Run(name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					message, err := NewQueueMessage("test", struct{}{})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					message.Key = "example.com."
+					if err := db.AddQueueMessage(message); err != nil {
+						t.Errorf("adding a message with a queued key: %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			queue, err := db.ListQueue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(queue) != 1 {
+				t.Fatalf("%d messages queued, want 1", len(queue))
+			}
+
+			// A claimed message doesn't coalesce, so changes made while it runs are picked up
+			claimed, err := db.NextQueueMessage("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			message, err := NewQueueMessage("test", struct{}{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			message.Key = "example.com."
+			if err := db.AddQueueMessage(message); err != nil {
+				t.Fatal(err)
+			}
+			if queue, err := db.ListQueue(); err != nil || len(queue) != 2 {
+				t.Errorf("queue after adding to a claimed key = %d messages, %v, want 2", len(queue), err)
+			}
+			if err := db.QueueConfirm(claimed); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
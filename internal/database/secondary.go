@@ -0,0 +1,105 @@
+package database
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ZoneType is where the records of a zone come from
+type ZoneType string
+
+const (
+	ZonePrimary   ZoneType = ""          // records are managed through the API
+	ZoneSecondary ZoneType = "secondary" // records are transferred from the customer's primary nameservers
+)
+
+// SecondarySettings stores where a secondary zone is transferred from
+type SecondarySettings struct {
+	Primaries []string `json:"primaries" bson:"primaries,omitempty"` // address:port of the primary nameservers, tried in order
+	Key       string   `json:"key,omitempty" bson:"key,omitempty"`   // name of the TSIG key that signs transfers and NOTIFY messages, optional
+}
+
+// SecondaryState stores the transfer state of a secondary zone
+type SecondaryState struct {
+	Refreshed int64  `json:"refreshed,omitempty" bson:"refreshed,omitempty"` // unix nanoseconds of the last successful serial check
+	Attempted int64  `json:"attempted,omitempty" bson:"attempted,omitempty"` // unix nanoseconds of the last serial check
+	Error     string `json:"error,omitempty" bson:"error,omitempty"`         // why the last serial check failed
+	Expired   bool   `json:"expired" bson:"expired,omitempty"`               // the primaries haven't answered for the SOA expire time, the zone isn't served
+}
+
+// IsSecondary reports whether a zone is transferred from an external primary
+func (z Zone) IsSecondary() bool {
+	return z.Type == ZoneSecondary
+}
+
+// Loaded reports whether a zone has records that can be served
+func (z Zone) Loaded() bool {
+	return !z.IsSecondary() || (len(z.Records) > 0 && !z.SecondaryState.Expired)
+}
+
+// SetZoneSecondary replaces the primaries and TSIG key of a secondary zone
+func (d Mongo) SetZoneSecondary(zone string, settings SecondarySettings) error {
+	return d.setZoneFields(zone, bson.M{"secondary": settings})
+}
+
+// SetSecondaryState replaces the transfer state of a secondary zone
+func (d Mongo) SetSecondaryState(zone string, state SecondaryState) error {
+	return d.setZoneFields(zone, bson.M{"secondarystate": state})
+}
+
+// SetSecondaryRecords replaces the records and serial of a secondary zone with a transferred copy
+func (d Mongo) SetSecondaryRecords(zone string, serial uint32, records []string) error {
+	return d.setZoneFields(zone, bson.M{"serial": serial, "records": records})
+}
+
+// setZoneFields sets fields of a zone without changing its serial
+func (d Mongo) setZoneFields(zone string, set bson.M) error {
+	result, err := d.Db.Collection("zones").UpdateOne(context.Background(), bson.M{"zone": zone}, bson.M{"$set": set})
+	if err != nil {
+		return mongoErr(err)
+	}
+
+	if result.MatchedCount < 1 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetZoneSecondary replaces the primaries and TSIG key of a secondary zone
+func (m *Memory) SetZoneSecondary(zone string, settings SecondarySettings) error {
+	return m.setZoneFields(zone, func(z *Zone) {
+		z.Secondary = SecondarySettings{Primaries: append([]string(nil), settings.Primaries...), Key: settings.Key}
+	})
+}
+
+// SetSecondaryState replaces the transfer state of a secondary zone
+func (m *Memory) SetSecondaryState(zone string, state SecondaryState) error {
+	return m.setZoneFields(zone, func(z *Zone) {
+		z.SecondaryState = state
+	})
+}
+
+// SetSecondaryRecords replaces the records and serial of a secondary zone with a transferred copy
+func (m *Memory) SetSecondaryRecords(zone string, serial uint32, records []string) error {
+	return m.setZoneFields(zone, func(z *Zone) {
+		z.Serial = serial
+		z.Records = append([]string(nil), records...)
+	})
+}
+
+// setZoneFields changes fields of a zone without changing its serial
+func (m *Memory) setZoneFields(name string, change func(*Zone)) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	id, ok := m.zoneByName(name)
+	if !ok {
+		return ErrNotFound
+	}
+
+	zone := copyZone(m.zones[id])
+	change(&zone)
+	m.zones[id] = zone
+	return nil
+}
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/natesales/cdn-tree/internal/balance"
+	"github.com/natesales/cdn-tree/internal/bgp"
+	"github.com/natesales/cdn-tree/internal/crypto"
+	"github.com/natesales/cdn-tree/internal/geo"
+	"github.com/natesales/cdn-tree/internal/health"
+	"github.com/natesales/cdn-tree/internal/soa"
+)
+
+var (
+	// ErrNotFound is returned when a requested document doesn't exist or the queue is empty
+	ErrNotFound = errors.New("not found")
+
+	// ErrDuplicate is returned when a document violates a unique index
+	ErrDuplicate = errors.New("already exists")
+)
+
+// Store is implemented by all storage backends
+type Store interface {
+	// Users
+	AddUser(user User) error
+	GetUserByAPIKey(apiKey string) (User, error)
+	GetUserByEmail(email string) (User, error)
+	SetUserVanity(email string, enabled bool) error
+
+	// Zones and records
+	AddZone(zone Zone) error
+	GetZone(id string) (Zone, error)
+	GetZoneByName(zone string) (Zone, error)
+	ListZones() ([]Zone, error)
+	AddRecord(zone string, rr string, change ZoneChange) (uint32, error)
+	SetZoneDNSSEC(zone string, key crypto.DNSSECKey) (uint32, error)
+	SetZoneRecords(zone string, records []string) (uint32, error)
+	UpdateZoneRecords(zone string, update RecordsUpdate) (uint32, error)
+	SetZoneSOA(zone string, scheme soa.Scheme, settings soa.Settings) (uint32, error)
+	SetZoneNameservers(zone string, nameservers []string) (uint32, error)
+	SetZoneGeoRecords(zone string, sets []geo.RecordSet) (uint32, error)
+	SetZoneHealthRecords(zone string, sets []health.RecordSet) (uint32, error)
+	SetZoneBalancedRecords(zone string, sets []balance.RecordSet) (uint32, error)
+	BumpZoneSerial(zone string) (uint32, error)
+	ActivateZone(zone string, method string) error
+	DeleteZone(zone string) error
+	SetZoneTransfer(zone string, settings TransferSettings) error
+	SetZoneSecondary(zone string, settings SecondarySettings) error
+	SetSecondaryState(zone string, state SecondaryState) error
+	SetSecondaryRecords(zone string, serial uint32, records []string) error
+	SetZoneQueryLog(zone string, settings QueryLogSettings) error
+
+	// Zone transfers and TSIG keys
+	AddTSIGKey(key TSIGKey) error
+	GetTSIGKey(name string) (TSIGKey, error)
+	ListTSIGKeys() ([]TSIGKey, error)
+	UpdateTSIGKey(key TSIGKey) error
+	AddJournalEntry(entry JournalEntry) error
+	GetJournalEntry(zone string, serial uint32) (JournalEntry, error)
+	PruneJournal(zone string, keep int) error
+
+	// Zone versions
+	AddZoneVersion(version ZoneVersion) error
+	ListZoneVersions(zone string) ([]ZoneVersion, error)
+	GetZoneVersion(zone string, serial uint32) (ZoneVersion, error)
+
+	// Nodes and BGP sessions
+	AddNode(node Node) error
+	GetNode(id string) (Node, error)
+	ListNodes() ([]Node, error)
+	AuthorizeNode(id string) (Node, error)
+	SetNodeToken(id string, tokenHash string) error
+	SetNodeSeen(id string, seen int64) error
+	AddSession(node string, session bgp.Session) error
+
+	// Message queue
+	QueueOptions() QueueOptions
+	AddQueueMessage(message QueueMessage) error
+	NextQueueMessage(types ...JobType) (QueueMessage, error)
+	QueueConfirm(message QueueMessage) error
+	QueueExtend(message QueueMessage) (QueueMessage, error)
+	QueueFail(message QueueMessage, cause error) error
+	ListQueue() ([]QueueMessage, error)
+	ListDeadLetters() ([]QueueMessage, error)
+	AddQueueHistory(entry QueueHistory) error
+	ListQueueHistory(jobType JobType, limit int64) ([]QueueHistory, error)
+
+	// Health check states
+	AddHealthResult(target health.Target, node string, result health.Result) (HealthState, error)
+	SetHealthState(key string, healthy bool, changed int64) error
+	ListHealthStates() ([]HealthState, error)
+
+	// Metadata and certificates
+	CompareAndSwapMetadata(l MetaLabel, payload interface{}, expected int64) (MetadataElement, error)
+	GetMetadata(l MetaLabel) (MetadataElement, error)
+	ListMetadata() ([]MetadataElement, error)
+	SetCertificate(c Certificate) error
+	ListCertificates() ([]Certificate, error)
+
+	// Query analytics
+	AddQueryStats(stats []QueryStats) error
+	ListQueryStats(filter QueryStatsFilter) ([]QueryStats, error)
+	RollupQueryStats(before int64) (int64, error)
+	PruneQueryStats(before int64) (int64, error)
+
+	// Audit log
+	AddAuditEntry(entry AuditEntry) error
+	ListAuditEntries(filter AuditFilter) ([]AuditEntry, error)
+	PruneAuditEntries(before int64) (int64, error)
+}
+
+// Both backends must implement Store
+var (
+	_ Store = (*Mongo)(nil)
+	_ Store = (*Memory)(nil)
+)
@@ -0,0 +1,156 @@
+package database
+
+import (
+	"context"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TransferSettings stores which secondaries may transfer a zone and which are notified of new serials
+type TransferSettings struct {
+	Allow  []string `json:"allow" bson:"allow,omitempty"`   // CIDR prefixes of secondaries allowed to transfer the zone
+	Notify []string `json:"notify" bson:"notify,omitempty"` // address:port of secondaries notified of new serials
+	Keys   []string `json:"keys" bson:"keys,omitempty"`     // names of the TSIG keys accepted for transfers, transfers have to be signed if any are set
+}
+
+// JournalEntry stores the contents of a zone as transferred at a serial, for IXFR
+type JournalEntry struct {
+	Zone    string   `json:"zone" bson:"zone"`
+	Serial  uint32   `json:"serial" bson:"serial"`
+	Records []string `json:"records" bson:"records"`
+	Created int64    `json:"created" bson:"created"` // unix nanoseconds
+}
+
+// SetZoneTransfer replaces the transfer settings of a zone without changing its serial
+func (d Mongo) SetZoneTransfer(zone string, settings TransferSettings) error {
+	result, err := d.Db.Collection("zones").UpdateOne(
+		context.Background(),
+		bson.M{"zone": zone},
+		bson.M{"$set": bson.M{"transfer": settings}},
+	)
+	if err != nil {
+		return mongoErr(err)
+	}
+
+	if result.MatchedCount < 1 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// AddJournalEntry stores the contents of a zone at a serial, returning ErrDuplicate if the serial is already journaled
+func (d Mongo) AddJournalEntry(entry JournalEntry) error {
+	_, err := d.Db.Collection("transfer_journal").InsertOne(context.Background(), entry)
+	return mongoErr(err)
+}
+
+// GetJournalEntry looks up the contents of a zone at a serial
+func (d Mongo) GetJournalEntry(zone string, serial uint32) (JournalEntry, error) {
+	var entry JournalEntry
+	if err := d.findOne("transfer_journal", bson.M{"zone": zone, "serial": serial}, &entry); err != nil {
+		return JournalEntry{}, err
+	}
+	return entry, nil
+}
+
+// PruneJournal removes all but the newest keep journal entries of a zone
+func (d Mongo) PruneJournal(zone string, keep int) error {
+	cursor, err := d.Db.Collection("transfer_journal").Find(
+		context.Background(),
+		bson.M{"zone": zone},
+		options.Find().SetSort(bson.M{"created": -1}).SetSkip(int64(keep)).SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return err
+	}
+
+	var old []bson.M
+	if err := cursor.All(context.Background(), &old); err != nil {
+		return err
+	}
+	for _, entry := range old {
+		if _, err := d.Db.Collection("transfer_journal").DeleteOne(context.Background(), bson.M{"_id": entry["_id"]}); err != nil {
+			return mongoErr(err)
+		}
+	}
+	return nil
+}
+
+// SetZoneTransfer replaces the transfer settings of a zone without changing its serial
+func (m *Memory) SetZoneTransfer(zone string, settings TransferSettings) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	id, ok := m.zoneByName(zone)
+	if !ok {
+		return ErrNotFound
+	}
+
+	z := m.zones[id]
+	z.Transfer = copyTransferSettings(settings)
+	m.zones[id] = z
+	return nil
+}
+
+// copyTransferSettings returns a copy of transfer settings that doesn't share slices with the original
+func copyTransferSettings(settings TransferSettings) TransferSettings {
+	return TransferSettings{
+		Allow:  append([]string(nil), settings.Allow...),
+		Notify: append([]string(nil), settings.Notify...),
+		Keys:   append([]string(nil), settings.Keys...),
+	}
+}
+
+// AddJournalEntry stores the contents of a zone at a serial, returning ErrDuplicate if the serial is already journaled
+func (m *Memory) AddJournalEntry(entry JournalEntry) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, e := range m.journal {
+		if e.Zone == entry.Zone && e.Serial == entry.Serial {
+			return ErrDuplicate
+		}
+	}
+
+	entry.Records = append([]string(nil), entry.Records...)
+	m.journal = append(m.journal, entry)
+	return nil
+}
+
+// GetJournalEntry looks up the contents of a zone at a serial
+func (m *Memory) GetJournalEntry(zone string, serial uint32) (JournalEntry, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, entry := range m.journal {
+		if entry.Zone == zone && entry.Serial == serial {
+			entry.Records = append([]string(nil), entry.Records...)
+			return entry, nil
+		}
+	}
+	return JournalEntry{}, ErrNotFound
+}
+
+// PruneJournal removes all but the newest keep journal entries of a zone
+func (m *Memory) PruneJournal(zone string, keep int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	sort.SliceStable(m.journal, func(i, j int) bool { return m.journal[i].Created > m.journal[j].Created })
+
+	var journal []JournalEntry
+	kept := 0
+	for _, entry := range m.journal {
+		if entry.Zone == zone {
+			if kept >= keep {
+				continue
+			}
+			kept++
+		}
+		journal = append(journal, entry)
+	}
+	m.journal = journal
+	return nil
+}
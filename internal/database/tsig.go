@@ -0,0 +1,134 @@
+package database
+
+import (
+	"context"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/natesales/cdn-tree/internal/util"
+)
+
+// TSIGKey stores a TSIG shared secret of a zone or an account
+type TSIGKey struct {
+	Name      string       `json:"name" bson:"_id"`                            // key name in domain name form
+	Zone      string       `json:"zone,omitempty" bson:"zone,omitempty"`       // zone the key belongs to, empty for account keys
+	User      string       `json:"-" bson:"user,omitempty"`                    // ID of the account the key belongs to, empty for zone keys
+	Algorithm string       `json:"algorithm" bson:"algorithm"`                 // HMAC algorithm name, such as hmac-sha256.
+	Secret    string       `json:"secret,omitempty" bson:"secret"`             // base64 encoded, sealed with the secrets key if Encrypted is set
+	Encrypted bool         `json:"-" bson:"encrypted,omitempty"`               // Secret is sealed with the secrets key
+	Created   int64        `json:"created" bson:"created"`                     // unix nanoseconds
+	Rotated   int64        `json:"rotated,omitempty" bson:"rotated,omitempty"` // unix nanoseconds of the last secret change
+	Revoked   int64        `json:"revoked,omitempty" bson:"revoked,omitempty"` // unix nanoseconds of the revocation, revoked keys have no secret and are kept so their names aren't reused
+	Policy    []UpdateRule `json:"policy,omitempty" bson:"policy,omitempty"`   // names and types the key may change with DNS UPDATE, none if empty
+}
+
+// UpdateRule allows a TSIG key to change records with DNS UPDATE
+type UpdateRule struct {
+	Name  string   `json:"name" bson:"name"`                       // owner name, or *.name for all names below name
+	Types []string `json:"types,omitempty" bson:"types,omitempty"` // record type mnemonics, all types if empty
+}
+
+// Active reports whether a key can sign and verify messages
+func (k TSIGKey) Active() bool {
+	return k.Revoked == 0 && k.Secret != ""
+}
+
+// AddTSIGKey stores a new TSIG key, returning ErrDuplicate if a key with the same name exists
+func (d Mongo) AddTSIGKey(key TSIGKey) error {
+	_, err := d.Db.Collection("tsig_keys").InsertOne(context.Background(), key)
+	return mongoErr(err)
+}
+
+// GetTSIGKey looks up a TSIG key by name
+func (d Mongo) GetTSIGKey(name string) (TSIGKey, error) {
+	var key TSIGKey
+	if err := d.findOne("tsig_keys", bson.M{"_id": name}, &key); err != nil {
+		return TSIGKey{}, err
+	}
+	return key, nil
+}
+
+// ListTSIGKeys returns all TSIG keys sorted by name
+func (d Mongo) ListTSIGKeys() ([]TSIGKey, error) {
+	cursor, err := d.Db.Collection("tsig_keys").Find(context.Background(), bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []TSIGKey{}
+	if err := cursor.All(context.Background(), &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// UpdateTSIGKey replaces a stored TSIG key, used to rotate, revoke and encrypt keys
+func (d Mongo) UpdateTSIGKey(key TSIGKey) error {
+	result, err := d.Db.Collection("tsig_keys").ReplaceOne(context.Background(), bson.M{"_id": key.Name}, key)
+	if err != nil {
+		return mongoErr(err)
+	}
+	if result.MatchedCount < 1 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// AddTSIGKey stores a new TSIG key, returning ErrDuplicate if a key with the same name exists
+func (m *Memory) AddTSIGKey(key TSIGKey) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.keys[key.Name]; ok {
+		return ErrDuplicate
+	}
+	m.keys[key.Name] = key
+	return nil
+}
+
+// GetTSIGKey looks up a TSIG key by name
+func (m *Memory) GetTSIGKey(name string) (TSIGKey, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key, ok := m.keys[name]
+	if !ok {
+		return TSIGKey{}, ErrNotFound
+	}
+	return key, nil
+}
+
+// ListTSIGKeys returns all TSIG keys sorted by name
+func (m *Memory) ListTSIGKeys() ([]TSIGKey, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	keys := []TSIGKey{}
+	for _, key := range m.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys, nil
+}
+
+// UpdateTSIGKey replaces a stored TSIG key, used to rotate, revoke and encrypt keys
+func (m *Memory) UpdateTSIGKey(key TSIGKey) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.keys[key.Name]; !ok {
+		return ErrNotFound
+	}
+	m.keys[key.Name] = key
+	return nil
+}
+
+// UsableBy reports whether a key may sign messages of a zone
+func (k TSIGKey) UsableBy(zone Zone) bool {
+	if k.User != "" {
+		return util.Includes(zone.Users, k.User)
+	}
+	return k.Zone == zone.Zone
+}
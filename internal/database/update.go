@@ -0,0 +1,82 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// RecordsUpdate computes the new records of a zone from its current records, which it must not modify
+type RecordsUpdate func(zone Zone) ([]string, error)
+
+// equalRecords reports whether two record lists are the same
+func equalRecords(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// UpdateZoneRecords atomically replaces the records of a zone with the result of update
+func (d Mongo) UpdateZoneRecords(zone string, update RecordsUpdate) (uint32, error) {
+	for i := 0; i < zoneSerialRetries; i++ {
+		current, err := d.GetZoneByName(zone)
+		if err != nil {
+			return 0, err
+		}
+
+		records, err := update(current)
+		if err != nil {
+			return 0, err
+		}
+		if equalRecords(records, current.Records) {
+			return current.Serial, nil // nothing changed
+		}
+
+		// Only apply the update to the records it was computed from
+		serial := current.Scheme().Next(current.Serial, time.Now())
+		result, err := d.Db.Collection("zones").UpdateOne(
+			context.Background(),
+			bson.M{"zone": zone, "serial": current.Serial},
+			bson.M{"$set": bson.M{"records": records, "serial": serial}},
+		)
+		if err != nil {
+			return 0, mongoErr(err)
+		}
+		if result.MatchedCount > 0 {
+			return serial, nil
+		}
+	}
+	return 0, ErrConflict
+}
+
+// UpdateZoneRecords atomically replaces the records of a zone with the result of update
+func (m *Memory) UpdateZoneRecords(zone string, update RecordsUpdate) (uint32, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	id, ok := m.zoneByName(zone)
+	if !ok {
+		return 0, ErrNotFound
+	}
+
+	current := copyZone(m.zones[id])
+	records, err := update(copyZone(current))
+	if err != nil {
+		return 0, err
+	}
+	if equalRecords(records, current.Records) {
+		return current.Serial, nil // nothing changed
+	}
+
+	current.Records = append([]string{}, records...)
+	current.Serial = current.Scheme().Next(current.Serial, time.Now())
+	m.zones[id] = current
+	return current.Serial, nil
+}
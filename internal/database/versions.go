@@ -0,0 +1,125 @@
+package database
+
+import (
+	"context"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ZoneVersion stores an immutable snapshot of the records of a zone at a serial
+type ZoneVersion struct {
+	Zone    string   `json:"zone" bson:"zone"`
+	Serial  uint32   `json:"serial" bson:"serial"`
+	Records []string `json:"records,omitempty" bson:"records"`
+	Created int64    `json:"created" bson:"created"`
+	Author  string   `json:"author,omitempty" bson:"author"` // user ID, empty for changes made by the controller
+	Change  string   `json:"change" bson:"change"`           // description of the change that produced this version
+}
+
+// NewZoneVersion snapshots the current state of a zone
+func NewZoneVersion(zone Zone, author string, change string, created int64) ZoneVersion {
+	return ZoneVersion{
+		Zone:    zone.Zone,
+		Serial:  zone.Serial,
+		Records: append([]string{}, zone.Records...),
+		Created: created,
+		Author:  author,
+		Change:  change,
+	}
+}
+
+// AddZoneVersion stores a zone version, returning ErrDuplicate if the zone already has a version at that serial
+func (d Mongo) AddZoneVersion(version ZoneVersion) error {
+	_, err := d.Db.Collection("zone_versions").InsertOne(context.Background(), version)
+	return mongoErr(err)
+}
+
+// ListZoneVersions returns all versions of a zone without their records, newest first
+func (d Mongo) ListZoneVersions(zone string) ([]ZoneVersion, error) {
+	cursor, err := d.Db.Collection("zone_versions").Find(
+		context.Background(),
+		bson.M{"zone": zone},
+		options.Find().SetSort(bson.D{{Key: "created", Value: -1}}).SetProjection(bson.M{"records": 0}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []ZoneVersion
+	if err := cursor.All(context.Background(), &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// GetZoneVersion looks up the version of a zone at a serial
+func (d Mongo) GetZoneVersion(zone string, serial uint32) (ZoneVersion, error) {
+	var version ZoneVersion
+	if err := d.findOne("zone_versions", bson.M{"zone": zone, "serial": serial}, &version); err != nil {
+		return ZoneVersion{}, err
+	}
+	return version, nil
+}
+
+// SetZoneRecords replaces all records of a zone and returns the new zone serial
+func (d Mongo) SetZoneRecords(zone string, records []string) (uint32, error) {
+	return d.changeZone(zone, func(current *Zone) bson.M {
+		return bson.M{"records": records}
+	})
+}
+
+// AddZoneVersion stores a zone version, returning ErrDuplicate if the zone already has a version at that serial
+func (m *Memory) AddZoneVersion(version ZoneVersion) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, v := range m.versions {
+		if v.Zone == version.Zone && v.Serial == version.Serial {
+			return ErrDuplicate
+		}
+	}
+
+	version.Records = append([]string{}, version.Records...)
+	m.versions = append(m.versions, version)
+	return nil
+}
+
+// ListZoneVersions returns all versions of a zone without their records, newest first
+func (m *Memory) ListZoneVersions(zone string) ([]ZoneVersion, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var versions []ZoneVersion
+	for _, version := range m.versions {
+		if version.Zone == zone {
+			version.Records = nil
+			versions = append(versions, version)
+		}
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Created > versions[j].Created })
+	return versions, nil
+}
+
+// GetZoneVersion looks up the version of a zone at a serial
+func (m *Memory) GetZoneVersion(zone string, serial uint32) (ZoneVersion, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, version := range m.versions {
+		if version.Zone == zone && version.Serial == serial {
+			version.Records = append([]string{}, version.Records...)
+			return version, nil
+		}
+	}
+	return ZoneVersion{}, ErrNotFound
+}
+
+// SetZoneRecords replaces all records of a zone and returns the new zone serial
+func (m *Memory) SetZoneRecords(zone string, records []string) (uint32, error) {
+	return m.changeZone(zone, func(z *Zone) {
+		z.Records = append([]string{}, records...)
+	})
+}
@@ -0,0 +1,265 @@
+// Package dnstap encodes and decodes dnstap messages (https://dnstap.info) and carries them over Frame Streams
+package dnstap
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ContentType is the Frame Streams content type of dnstap
+const ContentType = "protobuf:dnstap.Dnstap"
+
+// MessageType is the dnstap Message.Type
+type MessageType int
+
+// Message types of authoritative servers
+const (
+	AuthQuery    MessageType = 1
+	AuthResponse MessageType = 2
+)
+
+// SocketProtocol is the dnstap SocketProtocol
+type SocketProtocol int
+
+// Socket protocols
+const (
+	UDP SocketProtocol = 1
+	TCP SocketProtocol = 2
+	DOT SocketProtocol = 3
+	DOH SocketProtocol = 4
+)
+
+// String gets the name of a socket protocol
+func (p SocketProtocol) String() string {
+	switch p {
+	case UDP:
+		return "udp"
+	case TCP:
+		return "tcp"
+	case DOT:
+		return "dot"
+	case DOH:
+		return "doh"
+	}
+	return "unknown"
+}
+
+// dnstap.proto field numbers
+const (
+	fieldIdentity = 1
+	fieldVersion  = 2
+	fieldMessage  = 14
+	fieldType     = 15
+
+	fieldMessageType      = 1
+	fieldSocketFamily     = 2
+	fieldSocketProtocol   = 3
+	fieldQueryAddress     = 4
+	fieldResponseAddress  = 5
+	fieldQueryPort        = 6
+	fieldResponsePort     = 7
+	fieldQueryTimeSec     = 8
+	fieldQueryTimeNsec    = 9
+	fieldQueryMessage     = 10
+	fieldQueryZone        = 11
+	fieldResponseTimeSec  = 12
+	fieldResponseTimeNsec = 13
+	fieldResponseMessage  = 14
+
+	typeMessage = 1 // Dnstap.Type MESSAGE
+	familyINET  = 1
+	familyINET6 = 2
+)
+
+// Message stores a single dnstap message
+type Message struct {
+	Identity        string // node ID of the server
+	Version         string // software version of the server
+	Type            MessageType
+	Protocol        SocketProtocol
+	QueryAddress    net.IP // client address
+	QueryPort       uint16
+	ResponseAddress net.IP // server address
+	ResponsePort    uint16
+	QueryTime       time.Time
+	QueryMessage    []byte // wire format
+	QueryZone       []byte // wire format name of the zone the query was answered from
+	ResponseTime    time.Time
+	ResponseMessage []byte // wire format
+}
+
+// appendBytes appends a length delimited field if it isn't empty
+func appendBytes(b []byte, field protowire.Number, value []byte) []byte {
+	if len(value) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendBytes(b, value)
+}
+
+// appendVarint appends a varint field
+func appendVarint(b []byte, field protowire.Number, value uint64) []byte {
+	b = protowire.AppendTag(b, field, protowire.VarintType)
+	return protowire.AppendVarint(b, value)
+}
+
+// appendTime appends the seconds and nanoseconds fields of a time if it is set
+func appendTime(b []byte, secField protowire.Number, nsecField protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	b = appendVarint(b, secField, uint64(t.Unix()))
+	b = protowire.AppendTag(b, nsecField, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, uint32(t.Nanosecond()))
+}
+
+// address gets the bytes of an IP address and its dnstap socket family
+func address(ip net.IP) ([]byte, uint64) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, familyINET
+	}
+	return ip.To16(), familyINET6
+}
+
+// Marshal encodes a message as a dnstap.Dnstap protobuf
+func (m Message) Marshal() []byte {
+	var message []byte
+	message = appendVarint(message, fieldMessageType, uint64(m.Type))
+	if m.QueryAddress != nil {
+		queryAddress, family := address(m.QueryAddress)
+		message = appendVarint(message, fieldSocketFamily, family)
+		message = appendBytes(message, fieldQueryAddress, queryAddress)
+	}
+	if m.Protocol != 0 {
+		message = appendVarint(message, fieldSocketProtocol, uint64(m.Protocol))
+	}
+	if m.ResponseAddress != nil {
+		responseAddress, _ := address(m.ResponseAddress)
+		message = appendBytes(message, fieldResponseAddress, responseAddress)
+	}
+	message = appendVarint(message, fieldQueryPort, uint64(m.QueryPort))
+	message = appendVarint(message, fieldResponsePort, uint64(m.ResponsePort))
+	message = appendTime(message, fieldQueryTimeSec, fieldQueryTimeNsec, m.QueryTime)
+	message = appendBytes(message, fieldQueryMessage, m.QueryMessage)
+	message = appendBytes(message, fieldQueryZone, m.QueryZone)
+	message = appendTime(message, fieldResponseTimeSec, fieldResponseTimeNsec, m.ResponseTime)
+	message = appendBytes(message, fieldResponseMessage, m.ResponseMessage)
+
+	var b []byte
+	b = appendBytes(b, fieldIdentity, []byte(m.Identity))
+	b = appendBytes(b, fieldVersion, []byte(m.Version))
+	b = protowire.AppendTag(b, fieldMessage, protowire.BytesType)
+	b = protowire.AppendBytes(b, message)
+	return appendVarint(b, fieldType, typeMessage)
+}
+
+// fields calls fn for every field of a protobuf message
+func fields(b []byte, fn func(field protowire.Number, value uint64, data []byte)) error {
+	for len(b) > 0 {
+		field, wireType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch wireType {
+		case protowire.VarintType:
+			value, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(field, value, nil)
+			b = b[n:]
+		case protowire.Fixed32Type:
+			value, n := protowire.ConsumeFixed32(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(field, uint64(value), nil)
+			b = b[n:]
+		case protowire.BytesType:
+			data, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(field, 0, data)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(field, wireType, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+// Unmarshal decodes a dnstap.Dnstap protobuf. Fields this package doesn't use are skipped.
+func Unmarshal(b []byte) (Message, error) {
+	var m Message
+	var message []byte
+	var frameType uint64
+	if err := fields(b, func(field protowire.Number, value uint64, data []byte) {
+		switch field {
+		case fieldIdentity:
+			m.Identity = string(data)
+		case fieldVersion:
+			m.Version = string(data)
+		case fieldMessage:
+			message = data
+		case fieldType:
+			frameType = value
+		}
+	}); err != nil {
+		return Message{}, err
+	}
+	if frameType != typeMessage || message == nil {
+		return Message{}, errors.New("dnstap frame isn't a message")
+	}
+
+	var querySec, queryNsec, responseSec, responseNsec uint64
+	if err := fields(message, func(field protowire.Number, value uint64, data []byte) {
+		switch field {
+		case fieldMessageType:
+			m.Type = MessageType(value)
+		case fieldSocketProtocol:
+			m.Protocol = SocketProtocol(value)
+		case fieldQueryAddress:
+			m.QueryAddress = net.IP(append([]byte(nil), data...))
+		case fieldResponseAddress:
+			m.ResponseAddress = net.IP(append([]byte(nil), data...))
+		case fieldQueryPort:
+			m.QueryPort = uint16(value)
+		case fieldResponsePort:
+			m.ResponsePort = uint16(value)
+		case fieldQueryTimeSec:
+			querySec = value
+		case fieldQueryTimeNsec:
+			queryNsec = value
+		case fieldQueryMessage:
+			m.QueryMessage = append([]byte(nil), data...)
+		case fieldQueryZone:
+			m.QueryZone = append([]byte(nil), data...)
+		case fieldResponseTimeSec:
+			responseSec = value
+		case fieldResponseTimeNsec:
+			responseNsec = value
+		case fieldResponseMessage:
+			m.ResponseMessage = append([]byte(nil), data...)
+		}
+	}); err != nil {
+		return Message{}, err
+	}
+
+	if querySec != 0 {
+		m.QueryTime = time.Unix(int64(querySec), int64(queryNsec))
+	}
+	if responseSec != 0 {
+		m.ResponseTime = time.Unix(int64(responseSec), int64(responseNsec))
+	}
+	return m, nil
+}
@@ -0,0 +1,255 @@
+package dnstap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Frame Streams control frame types
+const (
+	controlAccept = 1
+	controlStart  = 2
+	controlStop   = 3
+	controlReady  = 4
+	controlFinish = 5
+
+	controlFieldContentType = 1
+
+	maxControlFrame = 512
+	maxDataFrame    = 1 << 20
+)
+
+// ErrStopped is returned by Reader.Read after the writer stopped the stream
+var ErrStopped = errors.New("frame stream stopped")
+
+// control is a decoded Frame Streams control frame
+type control struct {
+	Type         uint32
+	ContentTypes []string
+}
+
+// appendUint32 appends a big endian uint32
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// writeControl writes a control frame with a set of content types
+func writeControl(w io.Writer, frameType uint32, contentTypes ...string) error {
+	length := 4
+	for _, contentType := range contentTypes {
+		length += 8 + len(contentType)
+	}
+
+	b := make([]byte, 0, 8+length)
+	b = appendUint32(b, 0) // escape
+	b = appendUint32(b, uint32(length))
+	b = appendUint32(b, frameType)
+	for _, contentType := range contentTypes {
+		b = appendUint32(b, controlFieldContentType)
+		b = appendUint32(b, uint32(len(contentType)))
+		b = append(b, contentType...)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readControlBody reads the body of a control frame after its escape
+func readControlBody(r io.Reader) (control, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return control{}, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length < 4 || length > maxControlFrame {
+		return control{}, fmt.Errorf("invalid control frame length %d", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return control{}, err
+	}
+
+	frame := control{Type: binary.BigEndian.Uint32(body)}
+	body = body[4:]
+	for len(body) > 0 {
+		if len(body) < 8 {
+			return control{}, errors.New("truncated control frame field")
+		}
+		field := binary.BigEndian.Uint32(body)
+		fieldLength := binary.BigEndian.Uint32(body[4:])
+		body = body[8:]
+		if uint32(len(body)) < fieldLength {
+			return control{}, errors.New("truncated control frame field")
+		}
+		if field == controlFieldContentType {
+			frame.ContentTypes = append(frame.ContentTypes, string(body[:fieldLength]))
+		}
+		body = body[fieldLength:]
+	}
+	return frame, nil
+}
+
+// readControl reads a control frame of an expected type
+func readControl(r io.Reader, frameType uint32) (control, error) {
+	var escape [4]byte
+	if _, err := io.ReadFull(r, escape[:]); err != nil {
+		return control{}, err
+	}
+	if binary.BigEndian.Uint32(escape[:]) != 0 {
+		return control{}, errors.New("expected control frame, got data frame")
+	}
+	frame, err := readControlBody(r)
+	if err != nil {
+		return control{}, err
+	}
+	if frame.Type != frameType {
+		return control{}, fmt.Errorf("expected control frame %d, got %d", frameType, frame.Type)
+	}
+	return frame, nil
+}
+
+// hasContentType reports whether a control frame carries a content type, or none at all
+func (c control) hasContentType(contentType string) bool {
+	if len(c.ContentTypes) == 0 {
+		return true
+	}
+	for _, t := range c.ContentTypes {
+		if t == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// Writer writes dnstap frames to a Frame Streams stream
+type Writer struct {
+	w             *bufio.Writer
+	rw            io.ReadWriter // set on bidirectional streams
+	bidirectional bool
+}
+
+// NewWriter starts a Frame Streams stream of dnstap frames
+func NewWriter(rw io.ReadWriter, bidirectional bool) (*Writer, error) {
+	if bidirectional {
+		if err := writeControl(rw, controlReady, ContentType); err != nil {
+			return nil, err
+		}
+		accept, err := readControl(rw, controlAccept)
+		if err != nil {
+			return nil, err
+		}
+		if !accept.hasContentType(ContentType) {
+			return nil, errors.New("reader doesn't accept " + ContentType)
+		}
+	}
+
+	w := bufio.NewWriter(rw)
+	if err := writeControl(w, controlStart, ContentType); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, rw: rw, bidirectional: bidirectional}, nil
+}
+
+// Write buffers a data frame. Frames are only written when the buffer fills up or on Flush.
+func (w *Writer) Write(frame []byte) error {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(frame)))
+	if _, err := w.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(frame)
+	return err
+}
+
+// Flush writes all buffered frames
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// Close stops the stream and waits for bidirectional readers to finish. It doesn't close the underlying connection.
+func (w *Writer) Close() error {
+	if err := writeControl(w.w, controlStop); err != nil {
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	if w.bidirectional {
+		if _, err := readControl(w.rw, controlFinish); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reader reads dnstap frames from a Frame Streams stream
+type Reader struct {
+	r             *bufio.Reader
+	w             io.Writer // set on bidirectional streams
+	bidirectional bool
+}
+
+// NewReader accepts a Frame Streams stream of dnstap frames
+func NewReader(rw io.ReadWriter, bidirectional bool) (*Reader, error) {
+	r := bufio.NewReader(rw)
+	if bidirectional {
+		ready, err := readControl(r, controlReady)
+		if err != nil {
+			return nil, err
+		}
+		if !ready.hasContentType(ContentType) {
+			return nil, errors.New("writer doesn't offer " + ContentType)
+		}
+		if err := writeControl(rw, controlAccept, ContentType); err != nil {
+			return nil, err
+		}
+	}
+
+	start, err := readControl(r, controlStart)
+	if err != nil {
+		return nil, err
+	}
+	if !start.hasContentType(ContentType) {
+		return nil, fmt.Errorf("unexpected content type %v", start.ContentTypes)
+	}
+	return &Reader{r: r, w: rw, bidirectional: bidirectional}, nil
+}
+
+// Read reads the next data frame, or returns ErrStopped once the writer stopped the stream
+func (r *Reader) Read() ([]byte, error) {
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r.r, header[:]); err != nil {
+			return nil, err
+		}
+		length := binary.BigEndian.Uint32(header[:])
+		if length > 0 {
+			if length > maxDataFrame {
+				return nil, fmt.Errorf("data frame of %d bytes is too large", length)
+			}
+			frame := make([]byte, length)
+			if _, err := io.ReadFull(r.r, frame); err != nil {
+				return nil, err
+			}
+			return frame, nil
+		}
+
+		frame, err := readControlBody(r.r)
+		if err != nil {
+			return nil, err
+		}
+		if frame.Type == controlStop {
+			if r.bidirectional {
+				if err := writeControl(r.w, controlFinish); err != nil {
+					return nil, err
+				}
+			}
+			return nil, ErrStopped
+		}
+		// Ignore other control frames
+	}
+}
@@ -0,0 +1,169 @@
+package dnstap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	minBackoff = 1 * time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// Stats stores the counters of a Logger
+type Stats struct {
+	Sink      string `json:"sink"`
+	Connected bool   `json:"connected"`
+	Sent      uint64 `json:"sent"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+// Logger sends dnstap messages to a sink without blocking, dropping them when its queue is full
+type Logger struct {
+	Identity string // node ID written to every message
+	Version  string // software version written to every message
+
+	sink      string
+	network   string // unix, tcp or file
+	addr      string
+	queue     chan []byte
+	connected uint32
+	sent      uint64
+	dropped   uint64
+}
+
+// NewLogger constructs a new Logger for a unix:, tcp: or file: sink
+func NewLogger(sink string, size int) (*Logger, error) {
+	parts := strings.SplitN(sink, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, errors.New("dnstap sink must be unix:/path, tcp:host:port or file:/path")
+	}
+	switch parts[0] {
+	case "unix", "file":
+	case "tcp":
+		if _, _, err := net.SplitHostPort(parts[1]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unknown dnstap sink type " + parts[0])
+	}
+	if size < 1 {
+		return nil, errors.New("dnstap queue size must be positive")
+	}
+
+	return &Logger{
+		sink:    sink,
+		network: parts[0],
+		addr:    parts[1],
+		queue:   make(chan []byte, size),
+	}, nil
+}
+
+// Log queues a message, dropping it if the queue is full
+func (l *Logger) Log(m Message) {
+	m.Identity = l.Identity
+	m.Version = l.Version
+	select {
+	case l.queue <- m.Marshal():
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+// Stats gets the counters of the logger
+func (l *Logger) Stats() Stats {
+	return Stats{
+		Sink:      l.sink,
+		Connected: atomic.LoadUint32(&l.connected) == 1,
+		Sent:      atomic.LoadUint64(&l.sent),
+		Dropped:   atomic.LoadUint64(&l.dropped),
+	}
+}
+
+// open opens the sink and starts a stream on it
+func (l *Logger) open() (io.ReadWriteCloser, *Writer, error) {
+	var conn io.ReadWriteCloser
+	var err error
+	if l.network == "file" {
+		conn, err = os.Create(l.addr)
+	} else {
+		conn, err = net.DialTimeout(l.network, l.addr, 5*time.Second)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if c, ok := conn.(net.Conn); ok {
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+		defer c.SetDeadline(time.Time{})
+	}
+	w, err := NewWriter(conn, l.network != "file")
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, w, nil
+}
+
+// Run sends queued messages to the sink until ctx is cancelled, reconnecting with backoff when the sink fails
+func (l *Logger) Run(ctx context.Context) {
+	backoff := minBackoff
+	for {
+		conn, w, err := l.open()
+		if err == nil {
+			log.Printf("Sending dnstap messages to %s\n", l.sink)
+			atomic.StoreUint32(&l.connected, 1)
+			err = l.send(ctx, w)
+			atomic.StoreUint32(&l.connected, 0)
+			if err == nil {
+				// Stopped by ctx, finish the stream
+				if c, ok := conn.(net.Conn); ok {
+					_ = c.SetDeadline(time.Now().Add(time.Second))
+				}
+				_ = w.Close()
+				conn.Close()
+				return
+			}
+			conn.Close()
+			backoff = minBackoff
+		}
+		log.Printf("dnstap sink %s: %v\n", l.sink, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// send writes queued messages until ctx is cancelled or a write fails
+func (l *Logger) send(ctx context.Context, w *Writer) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case frame := <-l.queue:
+			if err := w.Write(frame); err != nil {
+				atomic.AddUint64(&l.dropped, 1)
+				return err
+			}
+			if len(l.queue) == 0 {
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+			atomic.AddUint64(&l.sent, 1)
+		}
+	}
+}
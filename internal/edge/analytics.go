@@ -0,0 +1,99 @@
+package edge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/natesales/cdn-tree/internal/analytics"
+)
+
+// maxReportCounts is the largest number of counts sent in one report, matching the limit of the controller
+const maxReportCounts = 5000
+
+// Reporter periodically sends the query counters to the controller
+type Reporter struct {
+	Controller string             // controller API base URL
+	NodeID     string             // ID of this node
+	Token      string             // credential issued by the controller when the node was provisioned
+	Counter    *analytics.Counter // counters of the local nameserver
+	Interval   time.Duration      // time between reports
+
+	client *http.Client
+}
+
+// NewReporter constructs a new Reporter
+func NewReporter(controller string, nodeID string, counter *analytics.Counter) *Reporter {
+	return &Reporter{
+		Controller: controller,
+		NodeID:     nodeID,
+		Counter:    counter,
+		Interval:   time.Minute,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// report sends counts to the controller
+func (r *Reporter) report(ctx context.Context, counts []analytics.Count) error {
+	body, err := json.Marshal(map[string]interface{}{"counts": counts})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", r.Controller+"/nodes/"+r.NodeID+"/analytics", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", r.Token)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("controller returned %d for query counts", resp.StatusCode)
+	}
+	return nil
+}
+
+// Flush reports all counted queries. Counts that couldn't be reported are kept for the next report.
+func (r *Reporter) Flush(ctx context.Context) error {
+	counts := r.Counter.Flush()
+	for len(counts) > 0 {
+		batch := counts
+		if len(batch) > maxReportCounts {
+			batch = batch[:maxReportCounts]
+		}
+		if err := r.report(ctx, batch); err != nil {
+			r.Counter.Restore(counts)
+			return err
+		}
+		counts = counts[len(batch):]
+	}
+	return nil
+}
+
+// Run starts the report loop and blocks until ctx is cancelled
+func (r *Reporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := r.Flush(ctx); err != nil {
+			log.Printf("reporting query counts: %v\n", err)
+		}
+	}
+}
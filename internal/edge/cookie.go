@@ -0,0 +1,197 @@
+package edge
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/bits"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNS cookie limits (RFC 7873 and RFC 9018)
+const (
+	clientCookieLen    = 8
+	serverCookieLen    = 16 // version, reserved, timestamp and hash
+	minServerCookieLen = 8
+	maxServerCookieLen = 32
+	cookieVersion      = 1
+	cookieMaxAge       = time.Hour       // server cookies older than this are invalid
+	cookieMaxSkew      = 5 * time.Minute // server cookies newer than this are invalid
+	cookieRefreshAge   = 30 * time.Minute
+	cookieSecretLen    = 16
+)
+
+// ErrMalformedCookie is returned for queries with a cookie option of an invalid length, which are answered with FORMERR
+var ErrMalformedCookie = errors.New("malformed DNS cookie")
+
+// CookieStats stores the DNS cookie counters since the cookies were constructed
+type CookieStats struct {
+	Queries   uint64 `json:"queries"`   // queries with a cookie
+	Valid     uint64 `json:"valid"`     // queries with a valid server cookie
+	Malformed uint64 `json:"malformed"` // queries answered with FORMERR for a malformed cookie
+	BadCookie uint64 `json:"badcookie"` // rate limited queries answered with BADCOOKIE
+}
+
+// cookie stores the DNS cookie of a query
+type cookie struct {
+	client []byte
+	server []byte
+	valid  bool      // the server cookie was made by this server, or another with the same secret, for this client
+	issued time.Time // timestamp of a valid server cookie
+}
+
+// Cookies makes and checks DNS server cookies (RFC 7873) in the format of RFC 9018
+type Cookies struct {
+	secret [cookieSecretLen]byte
+
+	lock  sync.Mutex
+	stats CookieStats
+}
+
+// NewCookies constructs a new Cookies with a hex encoded 16 byte secret, or a random secret if it is empty
+func NewCookies(secret string) (*Cookies, error) {
+	c := &Cookies{}
+	if secret == "" {
+		if _, err := rand.Read(c.secret[:]); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	key, err := hex.DecodeString(secret)
+	if err != nil || len(key) != cookieSecretLen {
+		return nil, errors.New("cookie secret has to be 16 hex encoded bytes")
+	}
+	copy(c.secret[:], key)
+	return c, nil
+}
+
+// parse gets the cookie of a query, and whether it has one (RFC 7873 section 5.2.2)
+func (c *Cookies) parse(r *dns.Msg, ip net.IP, now time.Time) (cookie, bool, error) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return cookie{}, false, nil
+	}
+	for _, option := range opt.Option {
+		option, ok := option.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+
+		c.count(func(stats *CookieStats) { stats.Queries++ })
+		data, err := hex.DecodeString(option.Cookie)
+		if err != nil || len(data) < clientCookieLen {
+			return cookie{}, true, ErrMalformedCookie
+		}
+		if server := len(data) - clientCookieLen; server != 0 && (server < minServerCookieLen || server > maxServerCookieLen) {
+			return cookie{}, true, ErrMalformedCookie
+		}
+
+		ck := cookie{client: data[:clientCookieLen], server: data[clientCookieLen:]}
+		if len(ck.server) == serverCookieLen && ck.server[0] == cookieVersion {
+			issued := time.Unix(int64(binary.BigEndian.Uint32(ck.server[4:8])), 0)
+			age := now.Sub(issued)
+			if age <= cookieMaxAge && age >= -cookieMaxSkew && subtle.ConstantTimeCompare(ck.server, c.serverCookie(ck.client, ip, issued)) == 1 {
+				ck.valid = true
+				ck.issued = issued
+				c.count(func(stats *CookieStats) { stats.Valid++ })
+			}
+		}
+		return ck, true, nil
+	}
+	return cookie{}, false, nil
+}
+
+// serverCookie makes the server cookie of a client cookie and address issued at a time (RFC 9018 section 4)
+func (c *Cookies) serverCookie(client []byte, ip net.IP, issued time.Time) []byte {
+	server := make([]byte, serverCookieLen)
+	server[0] = cookieVersion
+	binary.BigEndian.PutUint32(server[4:8], uint32(issued.Unix()))
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	input := make([]byte, 0, len(client)+8+len(ip))
+	input = append(input, client...)
+	input = append(input, server[:8]...)
+	input = append(input, ip...)
+	binary.LittleEndian.PutUint64(server[8:], siphash(c.secret, input))
+	return server
+}
+
+// option builds the cookie option of a response, renewing the server cookie if needed
+func (c *Cookies) option(ck cookie, ip net.IP, now time.Time) *dns.EDNS0_COOKIE {
+	server := ck.server
+	if !ck.valid || now.Sub(ck.issued) > cookieRefreshAge {
+		server = c.serverCookie(ck.client, ip, now)
+	}
+	return &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(ck.client) + hex.EncodeToString(server)}
+}
+
+// count updates the cookie counters
+func (c *Cookies) count(update func(stats *CookieStats)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	update(&c.stats)
+}
+
+// Stats gets the DNS cookie counters
+func (c *Cookies) Stats() CookieStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
+
+// siphash computes the SipHash-2-4 of data under a 128 bit key, the hash function of RFC 9018 server cookies
+func siphash(key [16]byte, data []byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+	compress := func(m uint64) {
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+
+	length := len(data)
+	for ; len(data) >= 8; data = data[8:] {
+		compress(binary.LittleEndian.Uint64(data))
+	}
+	var last [8]byte
+	copy(last[:], data)
+	last[7] = byte(length)
+	compress(binary.LittleEndian.Uint64(last[:]))
+
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		round()
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -0,0 +1,112 @@
+package edge
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TestSiphash checks the SipHash-2-4 implementation against the reference vectors, with key 00..0f and messages 00..n-1
+func TestSiphash(t *testing.T) {
+	var key [16]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	message := make([]byte, 64)
+	for i := range message {
+		message[i] = byte(i)
+	}
+
+	tests := []struct {
+		length int
+		want   string // little endian, as in the reference vectors
+	}{
+		{0, "310e0edd47db6f72"},
+		{1, "fd67dc93c539f874"},
+		{2, "5a4fa9d909806c0d"},
+		{3, "2d7efbd796666785"},
+		{7, "37d1018bf50002ab"},
+		{8, "6224939a79f5f593"},
+		{15, "e545be4961ca29a1"},
+	}
+	for _, test := range tests {
+		want, err := hex.DecodeString(test.want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 8)
+		hash := siphash(key, message[:test.length])
+		for i := range got {
+			got[i] = byte(hash >> (8 * i))
+		}
+		if hex.EncodeToString(got) != test.want {
+			t.Errorf("siphash of %d bytes = %x, want %x", test.length, got, want)
+		}
+	}
+}
+
+// TestServerCookie checks server cookies against the examples of RFC 9018 appendix A
+func TestServerCookie(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		client string
+		ip     string
+		issued int64
+		want   string
+	}{
+		{"IPv4", "e5e973e5a6b2a43f48e7dc849e37bfcf", "2464c4abcf10c957", "198.51.100.100", 1559731985, "010000005cf79f111f8130c3eee29480"},
+		{"IPv4 renewed", "e5e973e5a6b2a43f48e7dc849e37bfcf", "2464c4abcf10c957", "198.51.100.100", 1559734385, "010000005cf7a871d4a564a1442aca77"},
+		{"IPv6", "dd3bdf9344b678b185a6f5cb60fca715", "22681ab97d52c298", "2001:db8:220:1:59de:d0f4:8769:82b8", 1559741817, "010000005cf7c57926556bd0934c72f8"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cookies, err := NewCookies(test.secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := hex.DecodeString(test.client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := cookies.serverCookie(client, net.ParseIP(test.ip), time.Unix(test.issued, 0))
+			if hex.EncodeToString(got) != test.want {
+				t.Errorf("server cookie = %x, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+// TestCookieRenewal checks that a valid server cookie is accepted and replaced once it is older than the refresh age, as in RFC 9018 appendix A.2
+func TestCookieRenewal(t *testing.T) {
+	cookies, err := NewCookies("e5e973e5a6b2a43f48e7dc849e37bfcf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("198.51.100.100")
+	now := time.Unix(1559734385, 0)
+
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	r.SetEdns0(dns.DefaultMsgSize, false)
+	r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "2464c4abcf10c957010000005cf79f111f8130c3eee29480"})
+
+	ck, ok, err := cookies.parse(r, ip, now)
+	if err != nil || !ok {
+		t.Fatalf("parse = %v, %v, want a cookie", ok, err)
+	}
+	if !ck.valid {
+		t.Fatal("server cookie isn't valid")
+	}
+	if got := cookies.option(ck, ip, now).Cookie; got != "2464c4abcf10c957010000005cf7a871d4a564a1442aca77" {
+		t.Errorf("renewed cookie = %s, want 2464c4abcf10c957010000005cf7a871d4a564a1442aca77", got)
+	}
+
+	// The same cookie from another address isn't valid
+	if ck, _, _ := cookies.parse(r, net.ParseIP("198.51.100.101"), now); ck.valid {
+		t.Error("server cookie is valid for another client address")
+	}
+}
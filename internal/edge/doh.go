@@ -0,0 +1,189 @@
+package edge
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// DNS over HTTPS (RFC 8484)
+const (
+	DoHPath        = "/dns-query"
+	dohContentType = "application/dns-message"
+)
+
+// DoH serves DNS over HTTPS queries with the same handler as the other transports
+type DoH struct {
+	Server *Server
+}
+
+// NewDoH constructs a new DoH
+func NewDoH(server *Server) *DoH {
+	return &DoH{Server: server}
+}
+
+// dohWriter adapts a HTTP request to a dns.ResponseWriter, including TSIG
+type dohWriter struct {
+	local      net.Addr
+	remote     net.Addr
+	secrets    map[string]string
+	tsigStatus error
+	requestMAC string
+	response   *dns.Msg
+	data       []byte
+}
+
+// LocalAddr implements dns.ResponseWriter
+func (w *dohWriter) LocalAddr() net.Addr {
+	return w.local
+}
+
+// RemoteAddr implements dns.ResponseWriter
+func (w *dohWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+// WriteMsg implements dns.ResponseWriter, signing responses that carry a TSIG record
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	var data []byte
+	var err error
+	if t := m.IsTsig(); t != nil {
+		secret, ok := w.secrets[t.Hdr.Name]
+		if !ok {
+			return dns.ErrSecret
+		}
+		data, _, err = dns.TsigGenerate(m, secret, w.requestMAC, false)
+	} else {
+		data, err = m.Pack()
+	}
+	if err != nil {
+		return err
+	}
+
+	w.response = m
+	w.data = data
+	return nil
+}
+
+// Write implements dns.ResponseWriter
+func (w *dohWriter) Write(data []byte) (int, error) {
+	w.data = append([]byte(nil), data...)
+	return len(data), nil
+}
+
+// Close implements dns.ResponseWriter
+func (w *dohWriter) Close() error {
+	return nil
+}
+
+// TsigStatus implements dns.ResponseWriter
+func (w *dohWriter) TsigStatus() error {
+	return w.tsigStatus
+}
+
+// TsigTimersOnly implements dns.ResponseWriter
+func (w *dohWriter) TsigTimersOnly(bool) {}
+
+// Hijack implements dns.ResponseWriter
+func (w *dohWriter) Hijack() {}
+
+// readQuery reads the wire format query of a GET or POST request
+func readQuery(w http.ResponseWriter, r *http.Request) ([]byte, int, error) {
+	switch r.Method {
+	case http.MethodGet:
+		query, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(query) == 0 {
+			return nil, http.StatusBadRequest, errors.New("invalid dns parameter")
+		}
+		return query, 0, nil
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			return nil, http.StatusUnsupportedMediaType, errors.New("content type has to be " + dohContentType)
+		}
+		query, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize+1))
+		if err != nil || len(query) > dns.MaxMsgSize {
+			return nil, http.StatusRequestEntityTooLarge, errors.New("query is too large")
+		}
+		return query, 0, nil
+	}
+	return nil, http.StatusMethodNotAllowed, errors.New("method has to be GET or POST")
+}
+
+// cacheTTL gets the lowest TTL of the records of a response, which HTTP caches may keep it for (RFC 8484 section 5.1)
+func cacheTTL(m *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if t := rr.Header().Rrtype; t == dns.TypeOPT || t == dns.TypeTSIG {
+				continue
+			}
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// ServeHTTP answers a single DNS over HTTPS query
+func (d *DoH) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query, status, err := readQuery(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(query); err != nil {
+		http.Error(w, "invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	writer := &dohWriter{secrets: d.Server.Store.TSIGSecrets()}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		writer.local = local
+	}
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.remote = remote
+
+	if t := m.IsTsig(); t != nil {
+		writer.requestMAC = t.MAC
+		if secret, ok := writer.secrets[t.Hdr.Name]; ok {
+			writer.tsigStatus = dns.TsigVerify(query, secret, "", false)
+		} else {
+			writer.tsigStatus = dns.ErrSecret
+		}
+	}
+
+	d.Server.ServeDNS(writer, m)
+	if writer.data == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	// Signed responses and answers that depend on the client must not be served to other clients by shared caches
+	w.Header().Set("Content-Type", dohContentType)
+	if m.IsTsig() != nil {
+		w.Header().Set("Cache-Control", "no-store")
+	} else if writer.response != nil {
+		if ttl, ok := cacheTTL(writer.response); ok {
+			cacheControl := "max-age=" + strconv.FormatUint(uint64(ttl), 10)
+			if d.Server.tailored(m) {
+				cacheControl = "private, " + cacheControl
+			}
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+	}
+	w.Write(writer.data)
+}
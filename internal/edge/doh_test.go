@@ -0,0 +1,95 @@
+package edge
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/natesales/cdn-tree/internal/geo"
+)
+
+// TestDoHCacheControl checks that only answers that are the same for every client may be kept by shared HTTP caches
+func TestDoHCacheControl(t *testing.T) {
+	directory, err := ioutil.TempDir("", "edge-doh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	store, err := NewStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(Zone{
+		Zone:   "example.com.",
+		Serial: 1,
+		Records: []string{
+			"example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300",
+			"example.com. 300 IN A 192.0.2.1",
+		},
+		GeoRecords: []geo.RecordSet{{
+			Name:    "geo.example.com.",
+			Type:    "A",
+			TTL:     60,
+			Regions: map[string][]string{"us": {"192.0.2.10"}},
+			Default: []string{"192.0.2.20"},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	store.SetRegions([]geo.Region{{Name: "us", Healthy: true}}, "us")
+	store.SetTSIGKeys([]TSIGKey{{Name: "transfer.", Algorithm: dns.HmacSHA256, Secret: "c2VjcmV0c2VjcmV0c2VjcmV0", Zones: []string{"example.com."}}})
+	doh := NewDoH(NewServer(store, nil, nil))
+
+	tests := []struct {
+		name  string
+		qname string
+		sign  bool
+		want  string
+	}{
+		{"plain", "example.com.", false, "max-age=300"},
+		{"geo", "geo.example.com.", false, "private, max-age=60"},
+		{"signed", "example.com.", true, "no-store"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetQuestion(test.qname, dns.TypeA)
+			var query []byte
+			if test.sign {
+				m.SetTsig("transfer.", dns.HmacSHA256, 300, time.Now().Unix())
+				query, _, err = dns.TsigGenerate(m, "c2VjcmV0c2VjcmV0c2VjcmV0", "", false)
+			} else {
+				query, err = m.Pack()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, DoHPath, bytes.NewReader(query))
+			r.Header.Set("Content-Type", dohContentType)
+			w := httptest.NewRecorder()
+			doh.ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+			}
+			response := new(dns.Msg)
+			if err := response.Unpack(w.Body.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			if response.Rcode != dns.RcodeSuccess || len(response.Answer) == 0 {
+				t.Fatalf("rcode = %s with %d answers, want an answer", dns.RcodeToString[response.Rcode], len(response.Answer))
+			}
+			if got := w.Header().Get("Cache-Control"); got != test.want {
+				t.Errorf("Cache-Control = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
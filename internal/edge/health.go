@@ -0,0 +1,129 @@
+package edge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/natesales/cdn-tree/internal/health"
+)
+
+// checkConcurrency is the largest number of checks run at once
+const checkConcurrency = 32
+
+// Checker runs the health checks of all local zones and reports the results to the controller
+type Checker struct {
+	Controller string        // controller API base URL
+	NodeID     string        // ID of this node
+	Token      string        // credential issued by the controller when the node was provisioned
+	Store      *Store        // local zone store
+	Tick       time.Duration // time between looking for checks that are due
+
+	client *http.Client
+	last   map[string]time.Time // last run by target key
+}
+
+// NewChecker constructs a new Checker
+func NewChecker(controller string, nodeID string, store *Store) *Checker {
+	return &Checker{
+		Controller: controller,
+		NodeID:     nodeID,
+		Store:      store,
+		Tick:       5 * time.Second,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		last:       map[string]time.Time{},
+	}
+}
+
+// due gets the targets whose interval has passed since they were last checked
+func (c *Checker) due(now time.Time) []health.Target {
+	var due []health.Target
+	current := map[string]bool{}
+	for _, target := range c.Store.Targets() {
+		current[target.Key] = true
+		if now.Sub(c.last[target.Key]) >= time.Duration(target.Check.Normalize().Interval)*time.Second {
+			c.last[target.Key] = now
+			due = append(due, target)
+		}
+	}
+
+	// Forget targets that are no longer checked
+	for key := range c.last {
+		if !current[key] {
+			delete(c.last, key)
+		}
+	}
+	return due
+}
+
+// Check runs the checks of a list of targets concurrently
+func Check(ctx context.Context, targets []health.Target) []health.Result {
+	results := make([]health.Result, len(targets))
+	semaphore := make(chan struct{}, checkConcurrency)
+
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		i, target := i, target // capture for the goroutine
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			results[i] = health.Probe(ctx, target)
+			<-semaphore
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// report sends check results to the controller
+func (c *Checker) report(ctx context.Context, results []health.Result) error {
+	body, err := json.Marshal(map[string]interface{}{"results": results})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.Controller+"/nodes/"+c.NodeID+"/health", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", c.Token)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("controller returned %d for health results", resp.StatusCode)
+	}
+	return nil
+}
+
+// Run starts the check loop and blocks until ctx is cancelled
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.Tick)
+	defer ticker.Stop()
+
+	for {
+		if targets := c.due(time.Now()); len(targets) > 0 {
+			if err := c.report(ctx, Check(ctx, targets)); err != nil {
+				log.Printf("reporting %d health check results: %v\n", len(targets), err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package edge
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RRLCategory is the kind of response a rate limit applies to
+type RRLCategory int
+
+// Response categories with separate limits
+const (
+	RRLResponses RRLCategory = iota // answers, NODATA and referrals
+	RRLNXDomains                    // NXDOMAIN
+	RRLErrors                       // REFUSED, SERVFAIL, FORMERR and other errors
+)
+
+// RRLAction is what to do with a response after checking its rate limit
+type RRLAction int
+
+// Rate limit actions
+const (
+	RRLAllow RRLAction = iota // send the response
+	RRLDrop                   // send nothing
+	RRLSlip                   // send a truncated response, so legitimate clients retry over TCP
+)
+
+// RRLConfig stores the limits of response rate limiting. A rate of 0 disables the limit of its category.
+type RRLConfig struct {
+	ResponsesPerSecond float64
+	NXDomainsPerSecond float64
+	ErrorsPerSecond    float64
+	Slip               int // every Nth limited response is truncated instead of dropped, 0 drops all
+	IPv4PrefixLength   int // clients are grouped by prefix, so spoofing addresses within a network doesn't get around the limits
+	IPv6PrefixLength   int
+	Exempt             []*net.IPNet // clients that are never limited
+	MaxPrefixes        int          // largest number of tracked prefixes, responses to new prefixes aren't limited once it is reached
+}
+
+// RRLCounters stores the number of responses of a category by action
+type RRLCounters struct {
+	Allowed uint64 `json:"allowed"`
+	Dropped uint64 `json:"dropped"`
+	Slipped uint64 `json:"slipped"`
+}
+
+// RRLStats stores the response rate limiting counters since the limiter was constructed
+type RRLStats struct {
+	Prefixes  int         `json:"prefixes"` // currently tracked prefixes
+	Responses RRLCounters `json:"responses"`
+	NXDomains RRLCounters `json:"nxdomains"`
+	Errors    RRLCounters `json:"errors"`
+	Exempt    uint64      `json:"exempt"`   // responses to exempt clients
+	Bypassed  uint64      `json:"bypassed"` // responses to queries with a valid server cookie or TSIG signature
+	Overflow  uint64      `json:"overflow"` // responses that weren't limited because too many prefixes were tracked
+}
+
+// rrlKey identifies the token bucket of a prefix and category
+type rrlKey struct {
+	prefix   [net.IPv6len]byte
+	category RRLCategory
+}
+
+// rrlBucket is a token bucket that holds up to one second of responses
+type rrlBucket struct {
+	tokens  float64
+	last    time.Time
+	limited uint64 // responses limited by this bucket, to pick the ones that slip
+}
+
+// RRL limits the rate of UDP responses per client prefix, so the edges can't be used to amplify reflection attacks
+type RRL struct {
+	config RRLConfig
+
+	lock      sync.Mutex
+	buckets   map[rrlKey]*rrlBucket
+	lastSweep time.Time
+	stats     RRLStats
+}
+
+// NewRRL constructs a new RRL
+func NewRRL(config RRLConfig) (*RRL, error) {
+	if config.ResponsesPerSecond < 0 || config.NXDomainsPerSecond < 0 || config.ErrorsPerSecond < 0 {
+		return nil, errors.New("rate limits can't be negative")
+	}
+	if config.Slip < 0 {
+		return nil, errors.New("slip can't be negative")
+	}
+	if config.IPv4PrefixLength < 1 || config.IPv4PrefixLength > 8*net.IPv4len {
+		return nil, errors.New("IPv4 prefix length has to be between 1 and 32")
+	}
+	if config.IPv6PrefixLength < 1 || config.IPv6PrefixLength > 8*net.IPv6len {
+		return nil, errors.New("IPv6 prefix length has to be between 1 and 128")
+	}
+	if config.MaxPrefixes < 1 {
+		return nil, errors.New("max prefixes has to be positive")
+	}
+	return &RRL{config: config, buckets: map[rrlKey]*rrlBucket{}}, nil
+}
+
+// ParseNetworks parses a comma separated list of CIDR networks, plain addresses are taken as a single host
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// rrlCategory gets the rate limit category of a response
+func rrlCategory(response *dns.Msg) RRLCategory {
+	switch response.Rcode {
+	case dns.RcodeSuccess:
+		return RRLResponses
+	case dns.RcodeNameError:
+		return RRLNXDomains
+	}
+	return RRLErrors
+}
+
+// rate gets the responses per second of a category
+func (l *RRL) rate(category RRLCategory) float64 {
+	switch category {
+	case RRLResponses:
+		return l.config.ResponsesPerSecond
+	case RRLNXDomains:
+		return l.config.NXDomainsPerSecond
+	}
+	return l.config.ErrorsPerSecond
+}
+
+// counters gets the counters of a category
+func (l *RRL) counters(category RRLCategory) *RRLCounters {
+	switch category {
+	case RRLResponses:
+		return &l.stats.Responses
+	case RRLNXDomains:
+		return &l.stats.NXDomains
+	}
+	return &l.stats.Errors
+}
+
+// exempt reports whether a client is never limited
+func (l *RRL) exempt(ip net.IP) bool {
+	for _, network := range l.config.Exempt {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// key gets the bucket key of a client prefix and category
+func (l *RRL) key(ip net.IP, category RRLCategory) rrlKey {
+	k := rrlKey{category: category}
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(k.prefix[:], ip4.Mask(net.CIDRMask(l.config.IPv4PrefixLength, 8*net.IPv4len)))
+	} else {
+		copy(k.prefix[:], ip.Mask(net.CIDRMask(l.config.IPv6PrefixLength, 8*net.IPv6len)))
+	}
+	return k
+}
+
+// sweep removes the buckets that have been refilled, at most once a second
+func (l *RRL) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Second {
+		return
+	}
+	l.lastSweep = now
+	for k, b := range l.buckets {
+		rate := l.rate(k.category)
+		if rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*rate >= rate {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// Check counts a response to a client and decides whether to send it
+func (l *RRL) Check(ip net.IP, category RRLCategory, now time.Time) RRLAction {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	counters := l.counters(category)
+	rate := l.rate(category)
+	if rate <= 0 || ip == nil {
+		counters.Allowed++
+		return RRLAllow
+	}
+	if l.exempt(ip) {
+		l.stats.Exempt++
+		counters.Allowed++
+		return RRLAllow
+	}
+
+	k := l.key(ip, category)
+	b, ok := l.buckets[k]
+	if !ok {
+		if len(l.buckets) >= l.config.MaxPrefixes {
+			l.sweep(now)
+		}
+		if len(l.buckets) >= l.config.MaxPrefixes {
+			l.stats.Overflow++
+			counters.Allowed++
+			return RRLAllow
+		}
+		b = &rrlBucket{tokens: rate, last: now}
+		l.buckets[k] = b
+	}
+
+	// Refill the bucket for the time since the last response, up to one second of responses
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * rate
+		if b.tokens > rate {
+			b.tokens = rate
+		}
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		counters.Allowed++
+		return RRLAllow
+	}
+
+	b.limited++
+	if l.config.Slip > 0 && b.limited%uint64(l.config.Slip) == 0 {
+		counters.Slipped++
+		return RRLSlip
+	}
+	counters.Dropped++
+	return RRLDrop
+}
+
+// Bypass counts a response that skipped the limits because the query had a valid server cookie or TSIG signature
+func (l *RRL) Bypass() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.stats.Bypassed++
+}
+
+// Stats gets the response rate limiting counters
+func (l *RRL) Stats() RRLStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	stats := l.stats
+	stats.Prefixes = len(l.buckets)
+	return stats
+}
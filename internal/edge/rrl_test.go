@@ -0,0 +1,195 @@
+package edge
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// udpWriter records the responses to a client that queries over UDP
+type udpWriter struct {
+	remote    *net.UDPAddr
+	responses []*dns.Msg
+}
+
+func (w *udpWriter) LocalAddr() net.Addr         { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *udpWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *udpWriter) WriteMsg(m *dns.Msg) error   { w.responses = append(w.responses, m); return nil }
+func (w *udpWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *udpWriter) Close() error                { return nil }
+func (w *udpWriter) TsigStatus() error           { return nil }
+func (w *udpWriter) TsigTimersOnly(bool)         {}
+func (w *udpWriter) Hijack()                     {}
+
+// TestRRLPrefix checks that clients are limited by prefix and that the buckets refill
+func TestRRLPrefix(t *testing.T) {
+	rrl, err := NewRRL(RRLConfig{ResponsesPerSecond: 2, NXDomainsPerSecond: 1, IPv4PrefixLength: 24, IPv6PrefixLength: 56, MaxPrefixes: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+
+	tests := []struct {
+		name     string
+		ip       string
+		category RRLCategory
+		elapsed  time.Duration
+		want     RRLAction
+	}{
+		{"first response", "192.0.2.1", RRLResponses, 0, RRLAllow},
+		{"second response", "192.0.2.1", RRLResponses, 0, RRLAllow},
+		{"over the limit", "192.0.2.1", RRLResponses, 0, RRLDrop},
+		{"same prefix", "192.0.2.200", RRLResponses, 0, RRLDrop},
+		{"other prefix", "198.51.100.1", RRLResponses, 0, RRLAllow},
+		{"other category", "192.0.2.1", RRLNXDomains, 0, RRLAllow},
+		{"IPv6 prefix", "2001:db8::1", RRLResponses, 0, RRLAllow},
+		{"same IPv6 prefix", "2001:db8:0:ff::1", RRLResponses, 0, RRLAllow},
+		{"same IPv6 prefix over the limit", "2001:db8:0:ff::2", RRLResponses, 0, RRLDrop},
+		{"refilled", "192.0.2.1", RRLResponses, time.Second, RRLAllow},
+	}
+	for _, test := range tests {
+		now = now.Add(test.elapsed)
+		if got := rrl.Check(net.ParseIP(test.ip), test.category, now); got != test.want {
+			t.Errorf("%s: action = %d, want %d", test.name, got, test.want)
+		}
+	}
+
+	stats := rrl.Stats()
+	if stats.Responses.Dropped != 3 {
+		t.Errorf("dropped = %d, want 3", stats.Responses.Dropped)
+	}
+}
+
+// TestRRLSlip checks that every Nth limited response is truncated instead of dropped
+func TestRRLSlip(t *testing.T) {
+	rrl, err := NewRRL(RRLConfig{ResponsesPerSecond: 1, Slip: 2, IPv4PrefixLength: 24, IPv6PrefixLength: 56, MaxPrefixes: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	ip := net.ParseIP("192.0.2.1")
+
+	want := []RRLAction{RRLAllow, RRLDrop, RRLSlip, RRLDrop, RRLSlip, RRLDrop}
+	for i, action := range want {
+		if got := rrl.Check(ip, RRLResponses, now); got != action {
+			t.Errorf("response %d: action = %d, want %d", i, got, action)
+		}
+	}
+	if stats := rrl.Stats(); stats.Responses.Slipped != 2 || stats.Responses.Dropped != 3 {
+		t.Errorf("slipped = %d, dropped = %d, want 2 and 3", stats.Responses.Slipped, stats.Responses.Dropped)
+	}
+}
+
+// TestRRLExempt checks that exempt networks are never limited
+func TestRRLExempt(t *testing.T) {
+	exempt, err := ParseNetworks("192.0.2.0/24, 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrl, err := NewRRL(RRLConfig{ResponsesPerSecond: 1, IPv4PrefixLength: 24, IPv6PrefixLength: 56, Exempt: exempt, MaxPrefixes: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+
+	for _, ip := range []string{"192.0.2.1", "2001:db8::1"} {
+		for i := 0; i < 10; i++ {
+			if got := rrl.Check(net.ParseIP(ip), RRLResponses, now); got != RRLAllow {
+				t.Fatalf("%s response %d: action = %d, want allow", ip, i, got)
+			}
+		}
+	}
+	if got := rrl.Check(net.ParseIP("2001:db8::2"), RRLResponses, now); got != RRLAllow {
+		t.Errorf("first response to a host next to an exempt one: action = %d, want allow", got)
+	}
+	if got := rrl.Check(net.ParseIP("2001:db8::2"), RRLResponses, now); got != RRLDrop {
+		t.Errorf("host next to an exempt one over the limit: action = %d, want drop", got)
+	}
+
+	stats := rrl.Stats()
+	if stats.Exempt != 20 {
+		t.Errorf("exempt = %d, want 20", stats.Exempt)
+	}
+	if stats.Prefixes != 1 {
+		t.Errorf("prefixes = %d, want 1", stats.Prefixes)
+	}
+}
+
+// TestRRLCookieBypass checks that queries with a valid server cookie skip the rate limits and others are limited
+func TestRRLCookieBypass(t *testing.T) {
+	directory, err := ioutil.TempDir("", "edge-rrl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	store, err := NewStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(Zone{
+		Zone:   "example.com.",
+		Serial: 1,
+		Records: []string{
+			"example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300",
+			"example.com. 300 IN A 192.0.2.1",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer(store, nil, nil)
+	server.RRL, err = NewRRL(RRLConfig{ResponsesPerSecond: 1, IPv4PrefixLength: 24, IPv6PrefixLength: 56, MaxPrefixes: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Cookies, err = NewCookies("e5e973e5a6b2a43f48e7dc849e37bfcf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("198.51.100.100")
+	client := []byte{0x24, 0x64, 0xc4, 0xab, 0xcf, 0x10, 0xc9, 0x57}
+	query := func(cookie string) *udpWriter {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		r.SetEdns0(dns.DefaultMsgSize, false)
+		if cookie != "" {
+			r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+		}
+		w := &udpWriter{remote: &net.UDPAddr{IP: ip, Port: 5353}}
+		server.ServeDNS(w, r)
+		return w
+	}
+
+	// The first query uses up the bucket, the next without a valid cookie is dropped
+	if w := query(""); len(w.responses) != 1 || len(w.responses[0].Answer) != 1 {
+		t.Fatalf("first query: responses = %v, want an answer", w.responses)
+	}
+	if w := query(""); len(w.responses) != 0 {
+		t.Fatalf("query over the limit: responses = %v, want none", w.responses)
+	}
+	if w := query(hex.EncodeToString(client)); len(w.responses) != 0 {
+		t.Fatalf("query with only a client cookie over the limit: responses = %v, want none", w.responses)
+	}
+
+	valid := hex.EncodeToString(client) + hex.EncodeToString(server.Cookies.serverCookie(client, ip, time.Now()))
+	for i := 0; i < 5; i++ {
+		w := query(valid)
+		if len(w.responses) != 1 || len(w.responses[0].Answer) != 1 {
+			t.Fatalf("query %d with a valid cookie: responses = %v, want an answer", i, w.responses)
+		}
+	}
+
+	if stats := server.RRL.Stats(); stats.Bypassed != 5 {
+		t.Errorf("bypassed = %d, want 5", stats.Bypassed)
+	}
+	if stats := server.Cookies.Stats(); stats.Valid != 5 {
+		t.Errorf("valid cookies = %d, want 5", stats.Valid)
+	}
+}
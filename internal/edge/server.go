@@ -0,0 +1,579 @@
+package edge
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/natesales/cdn-tree/internal/alias"
+	"github.com/natesales/cdn-tree/internal/analytics"
+	"github.com/natesales/cdn-tree/internal/balance"
+	"github.com/natesales/cdn-tree/internal/dnstap"
+	"github.com/natesales/cdn-tree/internal/geo"
+)
+
+// typeNXNAME marks names that don't exist in compact denial of existence (RFC 9824)
+const typeNXNAME uint16 = 128
+
+// Server is an authoritative DNS server that answers from the local zone store
+type Server struct {
+	Store   *Store
+	GeoIP   *geo.Database      // optional, without it clients are located at the region of this node
+	Aliases *alias.Resolver    // optional, without it ALIAS records can't be answered
+	Tap     *dnstap.Logger     // optional, without it no queries are logged
+	Counter *analytics.Counter // optional, without it no queries are counted
+	RRL     *RRL               // optional, without it UDP responses aren't rate limited
+	Cookies *Cookies           // optional, without it DNS cookies are ignored
+}
+
+// NewServer constructs a new Server
+func NewServer(store *Store, geoIP *geo.Database, aliases *alias.Resolver) *Server {
+	return &Server{Store: store, GeoIP: geoIP, Aliases: aliases}
+}
+
+// remoteIP gets the IP address of a client
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// addrPort gets the IP address and port of a UDP or TCP address
+func addrPort(addr net.Addr) (net.IP, uint16) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, uint16(a.Port)
+	case *net.TCPAddr:
+		return a.IP, uint16(a.Port)
+	}
+	return nil, 0
+}
+
+// transport gets the transport a query was received over
+func transport(w dns.ResponseWriter) dnstap.SocketProtocol {
+	if _, ok := w.(*dohWriter); ok {
+		return dnstap.DOH
+	}
+	if stater, ok := w.(dns.ConnectionStater); ok && stater.ConnectionState() != nil {
+		return dnstap.DOT
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		return dnstap.UDP
+	}
+	return dnstap.TCP
+}
+
+// ServeDNS answers a single query, checking its TSIG signature and applying rate limits
+func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	start := time.Now()
+	client := remoteIP(w.RemoteAddr())
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	signature := r.IsTsig()
+	if signature != nil && w.TsigStatus() != nil {
+		// Unknown key, bad signature or time, the response can't be signed (RFC 8945 section 5.2)
+		response := new(dns.Msg)
+		response.SetRcode(r, dns.RcodeNotAuth)
+		if udp {
+			if response = s.limit(r, response, client, false, false, start); response == nil {
+				return
+			}
+		}
+		s.write(w, response)
+		return
+	}
+
+	var ck cookie
+	var hasCookie bool
+	var cookieErr error
+	if s.Cookies != nil {
+		ck, hasCookie, cookieErr = s.Cookies.parse(r, client, start)
+	}
+
+	var response *dns.Msg
+	if cookieErr != nil {
+		s.Cookies.count(func(stats *CookieStats) { stats.Malformed++ })
+		response = new(dns.Msg)
+		response.SetRcode(r, dns.RcodeFormatError)
+	} else if signature != nil && len(r.Question) == 1 && !s.keyAllowed(signature.Hdr.Name, r.Question[0].Name) {
+		response = new(dns.Msg)
+		response.SetRcode(r, dns.RcodeRefused)
+	} else {
+		response = s.Answer(r, client)
+	}
+
+	// Return the client cookie with a server cookie, which lets the client skip the rate limits on later queries
+	if hasCookie && cookieErr == nil {
+		opt := response.IsEdns0()
+		if opt == nil {
+			response.SetEdns0(dns.DefaultMsgSize, r.IsEdns0().Do())
+			opt = response.IsEdns0()
+		}
+		opt.Option = append(opt.Option, s.Cookies.option(ck, client, start))
+	}
+
+	// Rate limit UDP responses and truncate them to the size the client accepts, leaving room for the TSIG record
+	if udp {
+		if response = s.limit(r, response, client, hasCookie && cookieErr == nil, signature != nil || ck.valid, start); response == nil {
+			return
+		}
+
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		if signature != nil {
+			size -= dns.Len(signature)
+		}
+		response.Truncate(size)
+	}
+
+	// The MAC is computed by the dns.Server when the response is written
+	if signature != nil {
+		response.SetTsig(signature.Hdr.Name, signature.Algorithm, signature.Fudge, time.Now().Unix())
+	}
+	s.write(w, response)
+
+	if len(r.Question) != 1 || (s.Counter == nil && s.Tap == nil) {
+		return
+	}
+	if zone, _, _, ok := s.Store.Find(r.Question[0].Name); ok {
+		if s.Counter != nil {
+			s.Counter.Add(start, zone.Zone, dns.Type(r.Question[0].Qtype).String(), dns.RcodeToString[response.Rcode])
+		}
+		s.logQuery(w, r, response, zone.Zone, start)
+	}
+}
+
+// limit applies response rate limiting to a UDP response, returning nil if nothing is sent
+func (s *Server) limit(r *dns.Msg, response *dns.Msg, client net.IP, hasCookie bool, bypass bool, now time.Time) *dns.Msg {
+	if s.RRL == nil {
+		return response
+	}
+	if bypass {
+		s.RRL.Bypass()
+		return response
+	}
+
+	switch s.RRL.Check(client, rrlCategory(response), now) {
+	case RRLDrop:
+		return nil
+	case RRLSlip:
+		slipped := new(dns.Msg)
+		slipped.SetReply(r)
+		if opt := response.IsEdns0(); opt != nil {
+			slipped.Extra = []dns.RR{opt}
+		}
+		if hasCookie && slipped.IsEdns0() != nil {
+			s.Cookies.count(func(stats *CookieStats) { stats.BadCookie++ })
+			slipped.Rcode = dns.RcodeBadCookie
+		} else {
+			slipped.Truncated = true
+		}
+		return slipped
+	}
+	return response
+}
+
+// logQuery sends a sampled query of a zone that opted in to query logging to the dnstap logger
+func (s *Server) logQuery(w dns.ResponseWriter, r *dns.Msg, response *dns.Msg, zone string, start time.Time) {
+	if s.Tap == nil {
+		return
+	}
+	rate := s.Store.QueryLogRate(zone)
+	if rate <= 0 || rand.Float64() >= rate {
+		return
+	}
+
+	query, err := r.Pack()
+	if err != nil {
+		return
+	}
+	answer, err := response.Pack()
+	if err != nil {
+		return
+	}
+	zoneName := make([]byte, 256)
+	n, err := dns.PackDomainName(dns.Fqdn(zone), zoneName, 0, nil, false)
+	if err != nil {
+		return
+	}
+
+	message := dnstap.Message{
+		Type:            dnstap.AuthResponse,
+		Protocol:        transport(w),
+		QueryTime:       start,
+		QueryMessage:    query,
+		QueryZone:       zoneName[:n],
+		ResponseTime:    time.Now(),
+		ResponseMessage: answer,
+	}
+	message.QueryAddress, message.QueryPort = addrPort(w.RemoteAddr())
+	message.ResponseAddress, message.ResponsePort = addrPort(w.LocalAddr())
+	s.Tap.Log(message)
+}
+
+// tailored reports whether the answer to a query depends on the client
+func (s *Server) tailored(r *dns.Msg) bool {
+	if len(r.Question) != 1 {
+		return false
+	}
+	q := r.Question[0]
+	zone, _, _, ok := s.Store.Find(q.Name)
+	if !ok {
+		return false
+	}
+
+	qname := strings.ToLower(q.Name)
+	for _, set := range zone.GeoRecords {
+		if set.Matches(qname, q.Qtype) {
+			return true
+		}
+	}
+	for _, set := range zone.Balanced {
+		if set.Matches(qname, q.Qtype) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyAllowed reports whether a TSIG key may query a name, which it may if it is scoped to the closest enclosing zone
+func (s *Server) keyAllowed(key string, name string) bool {
+	zone, _, _, ok := s.Store.Find(name)
+	return ok && s.Store.TSIGAllowed(key, zone.Zone)
+}
+
+// write sends a response to a client
+func (s *Server) write(w dns.ResponseWriter, response *dns.Msg) {
+	if err := w.WriteMsg(response); err != nil {
+		log.Printf("writing response to %s: %v\n", w.RemoteAddr(), err)
+	}
+}
+
+// locate finds the location of a client address in the GeoIP database
+func (s *Server) locate(ip net.IP) (geo.Location, bool) {
+	if s.GeoIP == nil || ip == nil {
+		return geo.Location{}, false
+	}
+	location, _, ok := s.GeoIP.Lookup(ip)
+	return location, ok
+}
+
+// clientSubnet gets the EDNS Client Subnet option of a query (RFC 7871)
+func clientSubnet(r *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// querySeed derives the random seed of a query, so every query is shuffled independently
+func querySeed(r *dns.Msg, client net.IP) uint64 {
+	var buf [10]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint16(buf[8:], r.Id)
+
+	h := fnv.New64a()
+	h.Write(buf[:])
+	h.Write(client)
+	h.Write([]byte(r.Question[0].Name))
+	return h.Sum64()
+}
+
+// Answer builds the response to a query, locating the client by its EDNS Client Subnet or address
+func (s *Server) Answer(r *dns.Msg, client net.IP) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	if r.Opcode != dns.OpcodeQuery {
+		m.Rcode = dns.RcodeNotImplemented
+		return m
+	}
+	if len(r.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		return m
+	}
+
+	subnet := clientSubnet(r)
+	do := false
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+		m.SetEdns0(dns.DefaultMsgSize, do)
+	}
+
+	q := r.Question[0]
+	qname := strings.ToLower(q.Name)
+	zone, records, signer, ok := s.Store.Find(qname)
+	if !ok || (q.Qclass != dns.ClassINET && q.Qclass != dns.ClassANY) {
+		m.Rcode = dns.RcodeRefused
+		return m
+	}
+	apex := strings.ToLower(zone.Zone)
+
+	// Only sign for clients that ask for DNSSEC records
+	if !do {
+		signer = nil
+	}
+
+	// Refer queries below a delegation to the child nameservers
+	for offset, end := 0, false; !end; offset, end = dns.NextLabel(qname, offset) {
+		name := qname[offset:]
+		if name == apex {
+			break
+		}
+		if ns := filter(records[name], dns.TypeNS); len(ns) > 0 {
+			m.Ns = ns
+			m.Extra = append(m.Extra, glue(records, ns)...)
+
+			// Prove that the delegation has no DS records, the child zone is unsigned
+			if signer != nil {
+				m.Ns = append(m.Ns, signer.Deny(name, types(zone, records, name), ns[0].Header().Ttl)...)
+			}
+			return m
+		}
+	}
+
+	m.Authoritative = true
+
+	// Geo and load-balanced record sets take precedence over static records of the same name and type
+	geoAnswered, balanceAnswered := false, false
+	for _, set := range zone.GeoRecords {
+		if !set.Matches(qname, q.Qtype) {
+			continue
+		}
+
+		if subnet != nil && subnet.SourceNetmask > 0 {
+			client = subnet.Address
+		}
+		location, known := s.locate(client)
+		regions, local := s.Store.Regions()
+
+		answers, err := set.Records(set.Select(location, known, regions, local))
+		if err != nil {
+			log.Printf("geo record set %s %s: %v\n", set.Name, set.Type, err)
+			continue
+		}
+		m.Answer = append(m.Answer, answers...)
+		geoAnswered = true
+	}
+
+	var rng *rand.Rand
+	for _, set := range zone.Balanced {
+		if !set.Matches(qname, q.Qtype) {
+			continue
+		}
+		if rng == nil {
+			rng = balance.NewRand(querySeed(r, client))
+		}
+
+		answers, err := set.Records(set.Select(rng))
+		if err != nil {
+			log.Printf("load-balanced record set %s %s: %v\n", set.Name, set.Type, err)
+			continue
+		}
+		m.Answer = append(m.Answer, answers...)
+		balanceAnswered = true
+	}
+
+	if !geoAnswered && !balanceAnswered && q.Qtype != alias.TypeALIAS {
+		static := records[qname]
+		aliases := filter(static, alias.TypeALIAS)
+		if q.Qtype == dns.TypeANY {
+			m.Answer = append(m.Answer, withoutAliases(static)...)
+		} else if answers := filter(static, q.Qtype); len(answers) > 0 {
+			m.Answer = append(m.Answer, answers...)
+		} else if len(aliases) > 0 && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+			answers, err := s.flatten(aliases[0], q.Qtype)
+			if err != nil {
+				log.Printf("resolving ALIAS %s: %v\n", qname, err)
+				m.Rcode = dns.RcodeServerFailure
+				return m
+			}
+			m.Answer = append(m.Answer, answers...)
+		} else {
+			m.Answer = append(m.Answer, filter(static, dns.TypeCNAME)...)
+		}
+	}
+
+	// The scope tells the resolver which clients it may reuse the answer for
+	if subnet != nil && m.IsEdns0() != nil {
+		scope := uint8(0)
+		if geoAnswered {
+			scope = subnet.SourceNetmask
+		}
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        subnet.Family,
+			SourceNetmask: subnet.SourceNetmask,
+			SourceScope:   scope,
+			Address:       subnet.Address,
+		})
+	}
+
+	if len(m.Answer) == 0 {
+		found := exists(zone, records, qname)
+		m.Ns = negative(records[apex])
+
+		if signer != nil && len(m.Ns) > 0 {
+			// Compact denial answers nonexistent names with NOERROR and an NSEC record of the NXNAME type
+			denied := []uint16{typeNXNAME}
+			if found {
+				// An ALIAS owner has no A or AAAA records when its target has none, so qtype is left out of the bitmap
+				denied = without(types(zone, records, qname), q.Qtype)
+			}
+			m.Ns = append(signer.Sign(m.Ns), signer.Deny(qname, denied, m.Ns[0].Header().Ttl)...)
+		} else if !found {
+			m.Rcode = dns.RcodeNameError
+		}
+	} else if signer != nil {
+		m.Answer = signer.Sign(m.Answer)
+	}
+
+	return m
+}
+
+// flatten resolves an ALIAS record into address records of qtype owned by the ALIAS name
+func (s *Server) flatten(rr dns.RR, qtype uint16) ([]dns.RR, error) {
+	if s.Aliases == nil {
+		return nil, errors.New("no ALIAS resolver configured")
+	}
+	target, ok := alias.Target(rr)
+	if !ok {
+		return nil, errors.New("invalid ALIAS record")
+	}
+
+	addresses, ttl, err := s.Aliases.Resolve(target, qtype)
+	if err != nil {
+		return nil, err
+	}
+	if rr.Header().Ttl < ttl {
+		ttl = rr.Header().Ttl
+	}
+
+	var answers []dns.RR
+	hdr := dns.RR_Header{Name: rr.Header().Name, Rrtype: qtype, Class: dns.ClassINET, Ttl: ttl}
+	for _, address := range addresses {
+		if qtype == dns.TypeA {
+			answers = append(answers, &dns.A{Hdr: hdr, A: address})
+		} else {
+			answers = append(answers, &dns.AAAA{Hdr: hdr, AAAA: address})
+		}
+	}
+	return answers, nil
+}
+
+// withoutAliases leaves the ALIAS records out of a list of records, they are never sent to clients
+func withoutAliases(records []dns.RR) []dns.RR {
+	var filtered []dns.RR
+	for _, rr := range records {
+		if rr.Header().Rrtype != alias.TypeALIAS {
+			filtered = append(filtered, rr)
+		}
+	}
+	return filtered
+}
+
+// types gets the record types a name has in a zone as seen by clients, with ALIAS records answering A and AAAA queries
+func types(zone Zone, records index, name string) []uint16 {
+	var found []uint16
+	for _, rr := range records[name] {
+		if rr.Header().Rrtype == alias.TypeALIAS {
+			found = append(found, dns.TypeA, dns.TypeAAAA)
+		} else {
+			found = append(found, rr.Header().Rrtype)
+		}
+	}
+	for _, set := range zone.GeoRecords {
+		if strings.EqualFold(dns.Fqdn(set.Name), name) {
+			found = append(found, dns.StringToType[strings.ToUpper(set.Type)])
+		}
+	}
+	for _, set := range zone.Balanced {
+		if strings.EqualFold(dns.Fqdn(set.Name), name) {
+			found = append(found, dns.StringToType[strings.ToUpper(set.Type)])
+		}
+	}
+	return found
+}
+
+// without removes a type from a list of types
+func without(types []uint16, rrtype uint16) []uint16 {
+	var filtered []uint16
+	for _, t := range types {
+		if t != rrtype {
+			filtered = append(filtered, t)
+		}
+	}
+	return filtered
+}
+
+// filter gets the records of a type
+func filter(records []dns.RR, rrtype uint16) []dns.RR {
+	var filtered []dns.RR
+	for _, rr := range records {
+		if rr.Header().Rrtype == rrtype {
+			filtered = append(filtered, rr)
+		}
+	}
+	return filtered
+}
+
+// glue gets the address records of nameservers that are inside the zone
+func glue(records index, nameservers []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range nameservers {
+		target := strings.ToLower(rr.(*dns.NS).Ns)
+		extra = append(extra, filter(records[target], dns.TypeA)...)
+		extra = append(extra, filter(records[target], dns.TypeAAAA)...)
+	}
+	return extra
+}
+
+// exists reports whether a name has records, geo or load-balanced record sets, or names below it in a zone
+func exists(zone Zone, records index, name string) bool {
+	for _, set := range zone.GeoRecords {
+		if dns.IsSubDomain(name, strings.ToLower(dns.Fqdn(set.Name))) {
+			return true
+		}
+	}
+	for _, set := range zone.Balanced {
+		if dns.IsSubDomain(name, strings.ToLower(dns.Fqdn(set.Name))) {
+			return true
+		}
+	}
+	for owner := range records {
+		if dns.IsSubDomain(name, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// negative builds the authority section of a negative answer (RFC 2308 section 3)
+func negative(apex []dns.RR) []dns.RR {
+	for _, rr := range filter(apex, dns.TypeSOA) {
+		soa := dns.Copy(rr).(*dns.SOA)
+		if soa.Minttl < soa.Hdr.Ttl {
+			soa.Hdr.Ttl = soa.Minttl
+		}
+		return []dns.RR{soa}
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package edge
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/natesales/cdn-tree/internal/alias"
+	"github.com/natesales/cdn-tree/internal/geo"
+)
+
+// TestGeoClientSubnet checks that geo answers locate the client by its EDNS Client Subnet when given, and otherwise by the resolver address
+func TestGeoClientSubnet(t *testing.T) {
+	directory, err := ioutil.TempDir("", "edge-geo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	store, err := NewStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(Zone{
+		Zone:   "example.com.",
+		Serial: 1,
+		Records: []string{
+			"example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300",
+		},
+		GeoRecords: []geo.RecordSet{{
+			Name: "www.example.com.",
+			Type: "A",
+			TTL:  60,
+			Regions: map[string][]string{
+				"us-west":    {"192.0.2.1"},
+				"eu-central": {"192.0.2.2"},
+			},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	store.SetRegions([]geo.Region{
+		{Name: "us-west", Location: geo.Location{Latitude: 37.77, Longitude: -122.42}, Healthy: true},
+		{Name: "eu-central", Location: geo.Location{Latitude: 50.11, Longitude: 8.68}, Healthy: true},
+	}, "us-west")
+
+	// The resolver is in Frankfurt and its clients in San Francisco
+	geoIP, err := geo.Read(strings.NewReader(`network,latitude,longitude
+203.0.113.0/24,50.11,8.68
+198.51.100.0/24,37.77,-122.42
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(store, geoIP, nil)
+	resolver := net.ParseIP("203.0.113.53")
+
+	tests := []struct {
+		name   string
+		subnet *dns.EDNS0_SUBNET
+		want   string
+		scope  uint8
+	}{
+		{"resolver address", nil, "192.0.2.2", 0},
+		{"client subnet", &dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 24, Address: net.ParseIP("198.51.100.0").To4()}, "192.0.2.1", 24},
+		{"client subnet without a prefix", &dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 0, Address: net.IPv4zero.To4()}, "192.0.2.2", 0},
+		{"unknown client subnet", &dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0").To4()}, "192.0.2.1", 24},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.com.", dns.TypeA)
+			if test.subnet != nil {
+				m.SetEdns0(dns.DefaultMsgSize, false)
+				test.subnet.Code = dns.EDNS0SUBNET
+				m.IsEdns0().Option = append(m.IsEdns0().Option, test.subnet)
+			}
+
+			response := server.Answer(m, resolver)
+			if len(response.Answer) != 1 {
+				t.Fatalf("answer = %v, want one A record", response.Answer)
+			}
+			if a, ok := response.Answer[0].(*dns.A); !ok || a.A.String() != test.want {
+				t.Errorf("answer = %v, want %s", response.Answer[0], test.want)
+			}
+
+			if test.subnet != nil {
+				subnet := clientSubnet(response)
+				if subnet == nil {
+					t.Fatal("response has no client subnet option")
+				}
+				if subnet.SourceScope != test.scope {
+					t.Errorf("scope = %d, want %d", subnet.SourceScope, test.scope)
+				}
+			}
+		})
+	}
+}
+
+// TestAliasFlattening checks that ALIAS records are answered with the addresses of their target from a local upstream resolver
+func TestAliasFlattening(t *testing.T) {
+	upstream := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		switch q.Name {
+		case "lb.example.net.":
+			if q.Qtype == dns.TypeA {
+				m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30}, A: net.ParseIP("198.51.100.1")})
+			} else if q.Qtype == dns.TypeAAAA {
+				m.Answer = append(m.Answer, &dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 3600}, AAAA: net.ParseIP("2001:db8::1")})
+			}
+		case "missing.example.net.":
+			m.Rcode = dns.RcodeNameError
+		default:
+			m.Rcode = dns.RcodeServerFailure
+		}
+		w.WriteMsg(m)
+	})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	resolver := &dns.Server{PacketConn: conn, Handler: upstream, NotifyStartedFunc: func() { close(started) }}
+	go resolver.ActivateAndServe()
+	<-started
+	defer resolver.Shutdown()
+
+	directory, err := ioutil.TempDir("", "edge-alias")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	store, err := NewStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(Zone{
+		Zone:   "example.com.",
+		Serial: 1,
+		Records: []string{
+			"example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300",
+			"example.com. 300 IN ALIAS lb.example.net.",
+			"broken.example.com. 300 IN ALIAS broken.example.net.",
+			"missing.example.com. 300 IN ALIAS missing.example.net.",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(store, nil, alias.NewResolver(conn.LocalAddr().String()))
+
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		rcode  int
+		answer string
+	}{
+		{"A, upstream TTL", "example.com.", dns.TypeA, dns.RcodeSuccess, "example.com.\t30\tIN\tA\t198.51.100.1"},
+		{"AAAA, clamped to the ALIAS TTL", "example.com.", dns.TypeAAAA, dns.RcodeSuccess, "example.com.\t300\tIN\tAAAA\t2001:db8::1"},
+		{"ALIAS records aren't answered", "example.com.", alias.TypeALIAS, dns.RcodeSuccess, ""},
+		{"SERVFAIL", "broken.example.com.", dns.TypeA, dns.RcodeServerFailure, ""},
+		{"NXDOMAIN target", "missing.example.com.", dns.TypeA, dns.RcodeSuccess, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetQuestion(test.qname, test.qtype)
+			response := server.Answer(m, net.ParseIP("192.0.2.53"))
+
+			if response.Rcode != test.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[response.Rcode], dns.RcodeToString[test.rcode])
+			}
+			if test.answer == "" {
+				if len(response.Answer) != 0 {
+					t.Errorf("answer = %v, want none", response.Answer)
+				}
+				return
+			}
+			if len(response.Answer) != 1 || response.Answer[0].String() != test.answer {
+				t.Errorf("answer = %v, want %s", response.Answer, test.answer)
+			}
+		})
+	}
+}
+
+// TestSignedAliasNoData checks that the NSEC record of a signed NODATA answer for an ALIAS owner doesn't list the denied type
+func TestSignedAliasNoData(t *testing.T) {
+	upstream := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		if q.Name == "v4.example.net." && q.Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30}, A: net.ParseIP("198.51.100.1")})
+		}
+		w.WriteMsg(m)
+	})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	resolver := &dns.Server{PacketConn: conn, Handler: upstream, NotifyStartedFunc: func() { close(started) }}
+	go resolver.ActivateAndServe()
+	<-started
+	defer resolver.Shutdown()
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	private, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := json.Marshal(map[string]string{
+		"base":    "Kexample.com.+013+" + strconv.Itoa(int(key.KeyTag())),
+		"key":     key.String(),
+		"private": key.PrivateKeyString(private),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	directory, err := ioutil.TempDir("", "edge-alias-nodata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	store, err := NewStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(Zone{
+		Zone:   "example.com.",
+		Serial: 1,
+		Records: []string{
+			"example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300",
+			"www.example.com. 300 IN ALIAS v4.example.net.",
+		},
+		DNSSEC: exported,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(store, nil, alias.NewResolver(conn.LocalAddr().String()))
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeAAAA)
+	m.SetEdns0(dns.DefaultMsgSize, true)
+	response := server.Answer(m, net.ParseIP("192.0.2.53"))
+
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 0 {
+		t.Fatalf("rcode = %s, answer = %v, want NODATA", dns.RcodeToString[response.Rcode], response.Answer)
+	}
+	var nsec *dns.NSEC
+	signed := false
+	for _, rr := range response.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsec = rr
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeNSEC {
+				signed = true
+			}
+		}
+	}
+	if nsec == nil || !signed {
+		t.Fatalf("authority = %v, want a signed NSEC record", response.Ns)
+	}
+	if nsec.Hdr.Name != "www.example.com." {
+		t.Errorf("NSEC owner = %s, want www.example.com.", nsec.Hdr.Name)
+	}
+	hasA := false
+	for _, rrtype := range nsec.TypeBitMap {
+		if rrtype == dns.TypeAAAA {
+			t.Errorf("NSEC bitmap %v lists the denied AAAA type", nsec.TypeBitMap)
+		}
+		if rrtype == dns.TypeA {
+			hasA = true
+		}
+	}
+	if !hasA {
+		t.Errorf("NSEC bitmap %v doesn't list the A type answered by the ALIAS record", nsec.TypeBitMap)
+	}
+}
@@ -0,0 +1,138 @@
+package edge
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Signature validity, backdated to allow for clock skew between the nodes and validators
+const (
+	signatureBackdate = time.Hour
+	signatureValidity = 7 * 24 * time.Hour
+)
+
+// Signer signs answers online with the DNSSEC key of a zone
+type Signer struct {
+	key     *dns.DNSKEY
+	private crypto.Signer
+}
+
+// NewSigner parses the DNSSEC key of a zone as exported by the controller. Zones without a key have no signer.
+func NewSigner(raw json.RawMessage) (*Signer, error) {
+	var exported struct {
+		Base    string `json:"base"`
+		Key     string `json:"key"`
+		Private string `json:"private"`
+	}
+	if len(raw) > 0 && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &exported); err != nil {
+			return nil, err
+		}
+	}
+	if exported.Key == "" || exported.Private == "" {
+		return nil, nil // no key, nil error
+	}
+
+	rr, err := dns.NewRR(exported.Key)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, errors.New("DNSSEC key isn't a DNSKEY record")
+	}
+
+	private, err := key.ReadPrivateKey(strings.NewReader(exported.Private), exported.Base+".private")
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported DNSSEC private key")
+	}
+
+	return &Signer{key: key, private: signer}, nil
+}
+
+// DNSKEY gets the public key record of the zone
+func (s *Signer) DNSKEY() dns.RR {
+	return dns.Copy(s.key)
+}
+
+// signature signs a single RRset
+func (s *Signer) signature(rrset []dns.RR, now time.Time) (*dns.RRSIG, error) {
+	inception := now.Add(-signatureBackdate).Truncate(time.Hour)
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  s.key.Algorithm,
+		KeyTag:     s.key.KeyTag(),
+		SignerName: s.key.Hdr.Name,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(inception.Add(signatureValidity).Unix()),
+	}
+	if err := sig.Sign(s.private, rrset); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// Sign returns a section with a signature appended for every RRset in it
+func (s *Signer) Sign(section []dns.RR) []dns.RR {
+	type setKey struct {
+		name   string
+		rrtype uint16
+	}
+
+	var order []setKey
+	sets := map[setKey][]dns.RR{}
+	for _, rr := range section {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := setKey{strings.ToLower(h.Name), h.Rrtype}
+		if _, ok := sets[key]; !ok {
+			order = append(order, key)
+		}
+		sets[key] = append(sets[key], rr)
+	}
+
+	now := time.Now()
+	signed := append([]dns.RR(nil), section...)
+	for _, key := range order {
+		sig, err := s.signature(sets[key], now)
+		if err != nil {
+			log.Printf("signing %s %s: %v\n", key.name, dns.TypeToString[key.rrtype], err)
+			continue
+		}
+		signed = append(signed, sig)
+	}
+	return signed
+}
+
+// Deny builds a signed NSEC record that proves name has none but the given types (RFC 9824)
+func (s *Signer) Deny(name string, types []uint16, ttl uint32) []dns.RR {
+	bitmap := map[uint16]bool{dns.TypeRRSIG: true, dns.TypeNSEC: true}
+	for _, t := range types {
+		bitmap[t] = true
+	}
+	var sorted []uint16
+	for t := range bitmap {
+		sorted = append(sorted, t)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	nsec := &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: "\\000." + name,
+		TypeBitMap: sorted,
+	}
+	return s.Sign([]dns.RR{nsec})
+}
@@ -0,0 +1,411 @@
+// Package edge provides functions and types for edge node (ECA) operations
+package edge
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+
+	"github.com/natesales/cdn-tree/internal/balance"
+	"github.com/natesales/cdn-tree/internal/geo"
+	"github.com/natesales/cdn-tree/internal/health"
+)
+
+// Zone stores a zone as served to edge nodes by the controller
+type Zone struct {
+	Zone       string              `json:"zone"`
+	Serial     uint32              `json:"serial"`
+	Records    []string            `json:"records"`
+	GeoRecords []geo.RecordSet     `json:"geo_records,omitempty"`
+	Balanced   []balance.RecordSet `json:"balanced_records,omitempty"`
+	Checks     []health.Target     `json:"checks,omitempty"`
+	DNSSEC     json.RawMessage     `json:"dnssec"`
+}
+
+// index stores the parsed records of a zone by lowercase owner name
+type index map[string][]dns.RR
+
+// parse builds the record index of a zone
+func parse(zone Zone) (index, error) {
+	records := index{}
+	for _, record := range zone.Records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return nil, err
+		}
+		if rr == nil {
+			continue
+		}
+		name := strings.ToLower(rr.Header().Name)
+		records[name] = append(records[name], rr)
+	}
+	return records, nil
+}
+
+// indexed stores the name of a zone in the store, its parsed records and its signer
+type indexed struct {
+	zone    string
+	records index
+	signer  *Signer // nil for zones without a DNSSEC key
+}
+
+// load parses the records and DNSSEC key of a zone. The DNSKEY record is added to the apex of signed zones.
+func load(zone Zone) (indexed, error) {
+	records, err := parse(zone)
+	if err != nil {
+		return indexed{}, err
+	}
+
+	signer, err := NewSigner(zone.DNSSEC)
+	if err != nil {
+		return indexed{}, err
+	}
+	if signer != nil {
+		apex := strings.ToLower(dns.Fqdn(zone.Zone))
+		records[apex] = append(records[apex], signer.DNSKEY())
+	}
+
+	return indexed{zone: zone.Zone, records: records, signer: signer}, nil
+}
+
+// Store is a local on-disk zone store
+type Store struct {
+	directory string
+	lock      sync.RWMutex
+	zones     map[string]Zone
+	indexes   map[string]indexed // by lowercase zone name
+
+	regions []geo.Region // edge regions as last reported by the controller
+	region  string       // region of this node
+
+	keys    map[string]TSIGKey // by lowercase key name
+	secrets map[string]string  // TSIG secrets by key name, replaced and never modified
+
+	queryLog map[string]float64 // query log sample rates of opted in zones, by lowercase zone name
+
+	certificates       map[string]*tls.Certificate // TLS certificates by lowercase hostname without the trailing dot
+	defaultCertificate *tls.Certificate            // served to clients that don't send a known server name
+}
+
+// TSIGKey stores a TSIG key clients can sign queries with, as shipped by the controller
+type TSIGKey struct {
+	Name      string   `json:"name"`
+	Algorithm string   `json:"algorithm"`
+	Secret    string   `json:"secret"`
+	Zones     []string `json:"zones"` // zones the key may query
+}
+
+// Certificate stores the TLS certificate of a nameserver hostname, as shipped by the controller
+type Certificate struct {
+	Domain      string `json:"domain"`
+	Certificate []byte `json:"certificate"` // PEM, leaf first
+	PrivateKey  []byte `json:"key"`         // PEM
+}
+
+// NewStore constructs a new Store and loads all existing zone files from directory
+func NewStore(directory string) (*Store, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		directory: directory,
+		zones:     map[string]Zone{},
+		indexes:   map[string]indexed{},
+		keys:      map[string]TSIGKey{},
+		secrets:   map[string]string{},
+		queryLog:  map[string]float64{},
+	}
+
+	files, err := filepath.Glob(filepath.Join(directory, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		// Unreadable zones are left in place until the controller sends a replacement, so local data is never lost
+		zone, err := decodeZone(data)
+		var i indexed
+		if err == nil {
+			i, err = load(zone)
+		}
+		if err != nil {
+			log.Printf("skipping zone file %s: %v\n", file, err)
+			continue
+		}
+
+		s.zones[zone.Zone] = zone
+		s.indexes[strings.ToLower(zone.Zone)] = i
+	}
+
+	return s, nil
+}
+
+// decodeZone decodes a local zone file, resetting serials that don't fit 32 bits
+func decodeZone(data []byte) (Zone, error) {
+	var zone Zone
+	err := json.Unmarshal(data, &zone)
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field == "serial" {
+		var legacy struct {
+			Serial uint64 `json:"serial"`
+		}
+		if json.Unmarshal(data, &legacy) != nil {
+			return Zone{}, err
+		}
+		zone.Serial = 0
+		if legacy.Serial <= math.MaxUint32 {
+			zone.Serial = uint32(legacy.Serial)
+		}
+		return zone, nil
+	}
+	return zone, err
+}
+
+// zoneFile gets the path of the local zone file for a zone
+func (s *Store) zoneFile(zone string) string {
+	return filepath.Join(s.directory, strings.TrimSuffix(dns.Fqdn(zone), ".")+".json")
+}
+
+// Manifest gets a map of zone:serial pairs of all locally installed zones
+func (s *Store) Manifest() map[string]uint32 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	manifest := map[string]uint32{}
+	for name, zone := range s.zones {
+		manifest[name] = zone.Serial
+	}
+
+	return manifest
+}
+
+// Get gets a single zone by name
+func (s *Store) Get(zone string) (Zone, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	z, ok := s.zones[dns.Fqdn(zone)]
+	return z, ok
+}
+
+// Put atomically writes a zone to disk and replaces the in-memory copy
+func (s *Store) Put(zone Zone) error {
+	zone.Zone = dns.Fqdn(zone.Zone)
+
+	i, err := load(zone)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(zone)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Write to a temporary file first so a crash never leaves a partial zone file behind
+	tmpFile, err := ioutil.TempFile(s.directory, ".zone-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpFile.Name(), s.zoneFile(zone.Zone)); err != nil {
+		return err
+	}
+
+	s.zones[zone.Zone] = zone
+	s.indexes[strings.ToLower(zone.Zone)] = i
+	return nil
+}
+
+// Remove deletes a zone from disk and memory
+func (s *Store) Remove(zone string) error {
+	zone = dns.Fqdn(zone)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := os.Remove(s.zoneFile(zone)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	delete(s.zones, zone)
+	delete(s.indexes, strings.ToLower(zone))
+	return nil
+}
+
+// Find gets the closest enclosing zone of a name, its parsed records and its signer
+func (s *Store) Find(name string) (Zone, index, *Signer, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	name = strings.ToLower(dns.Fqdn(name))
+	for offset, end := 0, false; !end; offset, end = dns.NextLabel(name, offset) {
+		if i, ok := s.indexes[name[offset:]]; ok {
+			return s.zones[i.zone], i.records, i.signer, true
+		}
+	}
+	return Zone{}, nil, nil, false
+}
+
+// Targets gets the health check targets of all zones
+func (s *Store) Targets() []health.Target {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	seen := map[string]bool{}
+	var targets []health.Target
+	for _, zone := range s.zones {
+		for _, target := range zone.Checks {
+			if !seen[target.Key] {
+				seen[target.Key] = true
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets
+}
+
+// SetRegions replaces the edge regions and the region of this node
+func (s *Store) SetRegions(regions []geo.Region, region string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.regions = regions
+	s.region = region
+}
+
+// Regions gets the edge regions and the region of this node
+func (s *Store) Regions() ([]geo.Region, string) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.regions, s.region
+}
+
+// SetTSIGKeys replaces the TSIG keys clients can sign queries with. Keys are only kept in memory.
+func (s *Store) SetTSIGKeys(keys []TSIGKey) {
+	byName := map[string]TSIGKey{}
+	secrets := map[string]string{}
+	for _, key := range keys {
+		name := strings.ToLower(dns.Fqdn(key.Name))
+		byName[name] = key
+		secrets[name] = key.Secret
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.keys = byName
+	s.secrets = secrets
+}
+
+// TSIGSecrets gets the secrets of all TSIG keys by key name. The map must not be modified.
+func (s *Store) TSIGSecrets() map[string]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.secrets
+}
+
+// TSIGAllowed reports whether a TSIG key may query a zone
+func (s *Store) TSIGAllowed(key string, zone string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	k, ok := s.keys[strings.ToLower(key)]
+	if !ok {
+		return false
+	}
+	for _, z := range k.Zones {
+		if strings.EqualFold(z, zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetQueryLog replaces the query log sample rates of the zones that opted in to query logging
+func (s *Store) SetQueryLog(rates map[string]float64) {
+	byZone := map[string]float64{}
+	for zone, rate := range rates {
+		byZone[strings.ToLower(dns.Fqdn(zone))] = rate
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.queryLog = byZone
+}
+
+// QueryLogRate gets the fraction of queries of a zone that are logged, 0 if the zone didn't opt in
+func (s *Store) QueryLogRate(zone string) float64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.queryLog[strings.ToLower(dns.Fqdn(zone))]
+}
+
+// SetCertificates replaces the TLS certificates of DNS over TLS and HTTPS, the first being the default
+func (s *Store) SetCertificates(certificates []Certificate) {
+	byName := map[string]*tls.Certificate{}
+	var first *tls.Certificate
+	for _, c := range certificates {
+		certificate, err := tls.X509KeyPair(c.Certificate, c.PrivateKey)
+		if err != nil {
+			log.Printf("discarding certificate of %s: %v\n", c.Domain, err)
+			continue
+		}
+		byName[strings.TrimSuffix(strings.ToLower(c.Domain), ".")] = &certificate
+		if first == nil {
+			first = &certificate
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.certificates = byName
+	s.defaultCertificate = first
+}
+
+// GetCertificate picks the TLS certificate of a handshake by server name, for use as tls.Config.GetCertificate
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if certificate, ok := s.certificates[strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")]; ok {
+		return certificate, nil
+	}
+	if s.defaultCertificate == nil {
+		return nil, errors.New("no TLS certificate synced from the controller")
+	}
+	return s.defaultCertificate, nil
+}
@@ -0,0 +1,51 @@
+package edge
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestNewStoreLegacyZones checks that zone files written before serials were 32 bits are loaded, and unreadable files are kept
+func TestNewStoreLegacyZones(t *testing.T) {
+	directory, err := ioutil.TempDir("", "edge-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	files := map[string]string{
+		"fits.example.json":     `{"zone": "fits.example.", "serial": 2021010100, "records": ["fits.example. 300 IN A 192.0.2.1"]}`,
+		"overflow.example.json": `{"zone": "overflow.example.", "serial": 202101010000, "records": ["overflow.example. 300 IN A 192.0.2.2"]}`,
+		"broken.example.json":   `{"zone": `,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(directory, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store, err := NewStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := store.Manifest()
+	if serial, ok := manifest["fits.example."]; !ok || serial != 2021010100 {
+		t.Errorf("fits.example. serial = %d, %v, want 2021010100", serial, ok)
+	}
+	if serial, ok := manifest["overflow.example."]; !ok || serial != 0 {
+		t.Errorf("overflow.example. serial = %d, %v, want 0 so the next sync replaces it", serial, ok)
+	}
+	if _, ok := manifest["broken.example."]; ok {
+		t.Error("broken.example. was loaded")
+	}
+	if _, _, _, ok := store.Find("www.overflow.example."); !ok {
+		t.Error("records of overflow.example. aren't served")
+	}
+
+	if _, err := os.Stat(filepath.Join(directory, "broken.example.json")); err != nil {
+		t.Errorf("unreadable zone file was removed: %v", err)
+	}
+}
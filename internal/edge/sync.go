@@ -0,0 +1,249 @@
+package edge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/natesales/cdn-tree/internal/geo"
+	"github.com/natesales/cdn-tree/internal/soa"
+)
+
+// apiResponse stores the response envelope returned by the controller API
+type apiResponse struct {
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// manifestEntry stores a single zone:serial pair of the controller manifest
+type manifestEntry struct {
+	Zone   string `json:"zone"`
+	Serial uint32 `json:"serial"`
+}
+
+// SyncStatus stores the state of the reconciliation loop
+type SyncStatus struct {
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	LagSeconds  float64   `json:"lag_seconds"` // seconds since the local store last matched the controller
+	Failures    int       `json:"consecutive_failures"`
+	Stale       []string  `json:"stale_zones"` // zones that are missing or out of date locally
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Syncer reconciles the local zone store with the controller manifest
+type Syncer struct {
+	Controller string        // controller API base URL
+	NodeID     string        // ID of this node
+	Token      string        // credential issued by the controller when the node was provisioned
+	Store      *Store        // local zone store
+	Interval   time.Duration // time between reconciliation passes
+	MinBackoff time.Duration // initial retry delay after a failed pass
+	MaxBackoff time.Duration // upper bound of the retry delay
+
+	client  *http.Client
+	trigger chan struct{}
+	lock    sync.Mutex
+	status  SyncStatus
+}
+
+// NewSyncer constructs a new Syncer with default timings
+func NewSyncer(controller string, nodeID string, store *Store) *Syncer {
+	return &Syncer{
+		Controller: controller,
+		NodeID:     nodeID,
+		Store:      store,
+		Interval:   30 * time.Second,
+		MinBackoff: 2 * time.Second,
+		MaxBackoff: 5 * time.Minute,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		trigger:    make(chan struct{}, 1),
+	}
+}
+
+// get sends a HTTP GET request to the controller and decodes the response data into out
+func (s *Syncer) get(ctx context.Context, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.Controller+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", s.Token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var body apiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("decoding %s: %v", path, err)
+	}
+
+	if resp.StatusCode != http.StatusOK || !body.Success {
+		return fmt.Errorf("controller returned %d for %s: %s", resp.StatusCode, path, body.Message)
+	}
+
+	return json.Unmarshal(body.Data, out)
+}
+
+// Sync runs a single reconciliation pass
+func (s *Syncer) Sync(ctx context.Context) error {
+	var manifest struct {
+		Zones        []manifestEntry    `json:"zones"`
+		Regions      []geo.Region       `json:"regions"`
+		Region       string             `json:"region"` // region of this node
+		TSIG         []TSIGKey          `json:"tsig"`
+		QueryLog     map[string]float64 `json:"querylog"` // sample rates by zone
+		Certificates []Certificate      `json:"certificates"`
+	}
+	if err := s.get(ctx, "/nodes/"+s.NodeID+"/manifest", &manifest); err != nil {
+		return err
+	}
+	s.Store.SetRegions(manifest.Regions, manifest.Region)
+	s.Store.SetTSIGKeys(manifest.TSIG)
+	s.Store.SetQueryLog(manifest.QueryLog)
+	s.Store.SetCertificates(manifest.Certificates)
+
+	local := s.Store.Manifest()
+	remote := map[string]uint32{}
+
+	// Fetch missing or out of date zones
+	var stale []string
+	var syncErr error
+	for _, entry := range manifest.Zones {
+		remote[entry.Zone] = entry.Serial
+		if serial, ok := local[entry.Zone]; ok && serial == entry.Serial {
+			continue // zone is up to date
+		}
+
+		var zone Zone
+		if err := s.get(ctx, "/nodes/"+s.NodeID+"/zones/"+url.PathEscape(entry.Zone), &zone); err != nil {
+			stale = append(stale, entry.Zone)
+			syncErr = err
+			continue
+		}
+
+		if err := s.Store.Put(zone); err != nil {
+			stale = append(stale, entry.Zone)
+			syncErr = err
+			continue
+		}
+
+		log.Printf("synced zone %s serial %d\n", zone.Zone, zone.Serial)
+	}
+
+	// Prune zones that have been deleted on the controller. An empty manifest never prunes, so an outage can't wipe local data
+	if len(manifest.Zones) > 0 {
+		for zone := range local {
+			if _, ok := remote[zone]; !ok {
+				if err := s.Store.Remove(zone); err != nil {
+					syncErr = err
+					continue
+				}
+				log.Printf("removed zone %s\n", zone)
+			}
+		}
+	}
+
+	s.lock.Lock()
+	s.status.Stale = stale
+	s.lock.Unlock()
+
+	return syncErr
+}
+
+// backoff gets the jittered retry delay for a number of consecutive failures
+func (s *Syncer) backoff(failures int) time.Duration {
+	delay := s.MinBackoff
+	for i := 1; i < failures && delay < s.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > s.MaxBackoff {
+		delay = s.MaxBackoff
+	}
+
+	// Equal jitter: wait between half and all of the computed delay
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Run starts the reconciliation loop and blocks until ctx is cancelled
+func (s *Syncer) Run(ctx context.Context) {
+	for {
+		err := s.Sync(ctx)
+
+		s.lock.Lock()
+		s.status.LastAttempt = time.Now()
+		if err == nil {
+			s.status.LastSuccess = s.status.LastAttempt
+			s.status.Failures = 0
+			s.status.LastError = ""
+		} else {
+			s.status.Failures++
+			s.status.LastError = err.Error()
+		}
+		failures := s.status.Failures
+		s.lock.Unlock()
+
+		delay := s.Interval
+		if err != nil {
+			log.Printf("sync failed (attempt %d): %v\n", failures, err)
+			delay = s.backoff(failures)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.trigger:
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Trigger requests an immediate reconciliation pass
+func (s *Syncer) Trigger() {
+	select {
+	case s.trigger <- struct{}{}:
+	default: // a pass is already pending
+	}
+}
+
+// WaitFor triggers a reconciliation pass and waits until the store holds a zone serial or a newer one
+func (s *Syncer) WaitFor(ctx context.Context, zone string, serial uint32) error {
+	s.Trigger()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if local, ok := s.Store.Get(zone); ok && !soa.Less(local.Serial, serial) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Status gets the current reconciliation state
+func (s *Syncer) Status() SyncStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	status := s.status
+	if !status.LastSuccess.IsZero() {
+		status.LagSeconds = time.Since(status.LastSuccess).Seconds()
+	}
+
+	return status
+}
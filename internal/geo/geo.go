@@ -0,0 +1,160 @@
+// Package geo provides GeoIP lookups and the selection of geo-aware record set answers by client location
+package geo
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Location is a point on the globe in degrees
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// earthRadius is the mean radius of the earth in kilometers
+const earthRadius = 6371.0
+
+// Distance computes the great circle distance between two locations in kilometers
+func Distance(a Location, b Location) float64 {
+	radians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+
+	dLat := radians(b.Latitude - a.Latitude)
+	dLon := radians(b.Longitude - a.Longitude)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(radians(a.Latitude))*math.Cos(radians(b.Latitude))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// network stores a single GeoIP network as an inclusive address range
+type network struct {
+	first    net.IP // 16 byte form
+	last     net.IP // 16 byte form
+	bits     int    // prefix length of the network as written in the database
+	location Location
+}
+
+// Database is an in-memory GeoIP database of non-overlapping networks
+type Database struct {
+	networks []network // sorted by first address
+}
+
+// column finds a column by name in a CSV header
+func column(header []string, name string) int {
+	for i, c := range header {
+		if strings.TrimSpace(strings.ToLower(c)) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Read parses a GeoIP database in CSV format, with or without a header
+func Read(r io.Reader) (*Database, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+
+	networkColumn, latitudeColumn, longitudeColumn := 0, 1, 2
+	db := &Database{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if line == 1 && column(record, "network") != -1 {
+			networkColumn, latitudeColumn, longitudeColumn = column(record, "network"), column(record, "latitude"), column(record, "longitude")
+			if latitudeColumn == -1 || longitudeColumn == -1 {
+				return nil, errors.New("header must have network, latitude and longitude columns")
+			}
+			continue
+		}
+
+		if len(record) <= networkColumn || len(record) <= latitudeColumn || len(record) <= longitudeColumn {
+			return nil, fmt.Errorf("line %d: missing columns", line)
+		}
+		if record[latitudeColumn] == "" || record[longitudeColumn] == "" {
+			continue // networks without a location are of no use
+		}
+
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(record[networkColumn]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		latitude, err := strconv.ParseFloat(strings.TrimSpace(record[latitudeColumn]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		longitude, err := strconv.ParseFloat(strings.TrimSpace(record[longitudeColumn]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		first := ipNet.IP.To16()
+		last := make(net.IP, len(first))
+		mask := ipNet.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range first {
+			last[i] = first[i] | ^mask[i]
+		}
+		bits, _ := ipNet.Mask.Size()
+
+		db.networks = append(db.networks, network{
+			first:    first,
+			last:     last,
+			bits:     bits,
+			location: Location{Latitude: latitude, Longitude: longitude},
+		})
+	}
+
+	sort.Slice(db.networks, func(i, j int) bool {
+		return bytes.Compare(db.networks[i].first, db.networks[j].first) < 0
+	})
+	return db, nil
+}
+
+// Open reads a GeoIP database file
+func Open(file string) (*Database, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Read(f)
+}
+
+// Len gets the number of networks in the database
+func (d *Database) Len() int {
+	return len(d.networks)
+}
+
+// Lookup finds the location of an address and the prefix length of the network it was found in
+func (d *Database) Lookup(ip net.IP) (Location, int, bool) {
+	ip = ip.To16()
+	if d == nil || ip == nil {
+		return Location{}, 0, false
+	}
+
+	// Find the last network that starts at or before the address
+	i := sort.Search(len(d.networks), func(i int) bool {
+		return bytes.Compare(d.networks[i].first, ip) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip, d.networks[i].last) > 0 {
+		return Location{}, 0, false
+	}
+	return d.networks[i].location, d.networks[i].bits, true
+}
@@ -0,0 +1,135 @@
+package geo
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Edge regions of the tests
+var (
+	usWest    = Location{Latitude: 37.77, Longitude: -122.42} // San Francisco
+	usCentral = Location{Latitude: 41.88, Longitude: -87.63}  // Chicago
+	euWest    = Location{Latitude: 53.35, Longitude: -6.26}   // Dublin
+	euCentral = Location{Latitude: 50.11, Longitude: 8.68}    // Frankfurt
+)
+
+// testRegions gets the test regions, all healthy except the given ones
+func testRegions(down ...string) []Region {
+	regions := []Region{
+		{Name: "us-west", Location: usWest, Healthy: true},
+		{Name: "us-central", Location: usCentral, Healthy: true},
+		{Name: "eu-west", Location: euWest, Healthy: true},
+		{Name: "eu-central", Location: euCentral, Healthy: true},
+	}
+	for i := range regions {
+		for _, name := range down {
+			if regions[i].Name == name {
+				regions[i].Healthy = false
+			}
+		}
+	}
+	return regions
+}
+
+// TestSelect checks which region answers clients in different countries and continents, and the fallbacks when regions are down
+func TestSelect(t *testing.T) {
+	perRegion := RecordSet{
+		Name: "www.example.com.",
+		Type: "A",
+		Regions: map[string][]string{
+			"us-west":    {"192.0.2.1"},
+			"us-central": {"192.0.2.2"},
+			"eu-west":    {"192.0.2.3"},
+			"eu-central": {"192.0.2.4"},
+		},
+	}
+	perContinent := RecordSet{
+		Name: "www.example.com.",
+		Type: "A",
+		Regions: map[string][]string{
+			"us-central": {"198.51.100.1"},
+			"eu-central": {"198.51.100.2"},
+		},
+		Default: []string{"203.0.113.1"},
+	}
+
+	tests := []struct {
+		name    string
+		set     RecordSet
+		client  Location
+		known   bool
+		regions []Region
+		local   string
+		want    []string
+	}{
+		// Countries
+		{"Germany", perRegion, Location{Latitude: 52.52, Longitude: 13.40}, true, testRegions(), "us-west", []string{"192.0.2.4"}},
+		{"United Kingdom", perRegion, Location{Latitude: 51.51, Longitude: -0.13}, true, testRegions(), "us-west", []string{"192.0.2.3"}},
+		{"Portugal", perRegion, Location{Latitude: 38.72, Longitude: -9.14}, true, testRegions(), "us-west", []string{"192.0.2.3"}},
+		{"United States east", perRegion, Location{Latitude: 40.71, Longitude: -74.0}, true, testRegions(), "us-west", []string{"192.0.2.2"}},
+		{"Japan", perRegion, Location{Latitude: 35.68, Longitude: 139.69}, true, testRegions(), "eu-west", []string{"192.0.2.1"}},
+
+		// Continents, with values in fewer regions than there are
+		{"North America", perContinent, Location{Latitude: 37.77, Longitude: -122.42}, true, testRegions(), "eu-west", []string{"198.51.100.1"}},
+		{"South America", perContinent, Location{Latitude: -23.55, Longitude: -46.63}, true, testRegions(), "eu-west", []string{"198.51.100.1"}},
+		{"Europe", perContinent, Location{Latitude: 48.86, Longitude: 2.35}, true, testRegions(), "us-west", []string{"198.51.100.2"}},
+		{"Africa", perContinent, Location{Latitude: -1.29, Longitude: 36.82}, true, testRegions(), "us-west", []string{"198.51.100.2"}},
+		{"Asia", perContinent, Location{Latitude: 19.08, Longitude: 72.88}, true, testRegions(), "us-west", []string{"198.51.100.2"}},
+
+		// Fallbacks
+		{"nearest region down", perRegion, Location{Latitude: 52.52, Longitude: 13.40}, true, testRegions("eu-central"), "us-west", []string{"192.0.2.3"}},
+		{"all regions with values down, default", perContinent, Location{Latitude: 48.86, Longitude: 2.35}, true, testRegions("us-central", "eu-central"), "us-west", []string{"203.0.113.1"}},
+		{"all regions down, no default", perRegion, Location{Latitude: 52.52, Longitude: 13.40}, true, testRegions("us-west", "us-central", "eu-west", "eu-central"), "us-west", []string{"192.0.2.4"}},
+		{"unknown location, local region", perRegion, Location{}, false, testRegions(), "eu-west", []string{"192.0.2.3"}},
+		{"no regions known", perRegion, Location{Latitude: 52.52, Longitude: 13.40}, true, nil, "", []string{"192.0.2.4"}},
+		{"no regions known, default", perContinent, Location{Latitude: 52.52, Longitude: 13.40}, true, nil, "", []string{"203.0.113.1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.set.Select(test.client, test.known, test.regions, test.local)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Select = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestLookup checks that addresses are located by the network that contains them
+func TestLookup(t *testing.T) {
+	db, err := Read(strings.NewReader(`network,geoname_id,latitude,longitude
+192.0.2.0/24,1,50.11,8.68
+198.51.100.0/25,2,37.77,-122.42
+2001:db8::/32,3,53.35,-6.26
+203.0.113.0/24,4,,
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Len() != 3 {
+		t.Errorf("%d networks, want 3 without the one without a location", db.Len())
+	}
+
+	tests := []struct {
+		ip    string
+		want  Location
+		bits  int
+		found bool
+	}{
+		{"192.0.2.1", euCentral, 24, true},
+		{"192.0.2.255", euCentral, 24, true},
+		{"198.51.100.127", usWest, 25, true},
+		{"198.51.100.128", Location{}, 0, false},
+		{"2001:db8::1", euWest, 32, true},
+		{"2001:db9::1", Location{}, 0, false},
+		{"203.0.113.1", Location{}, 0, false},
+		{"::ffff:192.0.2.10", euCentral, 24, true},
+	}
+	for _, test := range tests {
+		location, bits, found := db.Lookup(net.ParseIP(test.ip))
+		if found != test.found || location != test.want || bits != test.bits {
+			t.Errorf("Lookup(%s) = %v, %d, %v, want %v, %d, %v", test.ip, location, bits, found, test.want, test.bits, test.found)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package geo
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/natesales/cdn-tree/internal/health"
+)
+
+// Region stores the location and health of an edge region
+type Region struct {
+	Name     string   `json:"name"`
+	Location Location `json:"location"` // center of the region's nodes
+	Healthy  bool     `json:"healthy"`
+}
+
+// RecordSet is a geo-aware record set whose answer is picked by the location of the querying client
+type RecordSet struct {
+	Name    string              `json:"name" bson:"name"`
+	Type    string              `json:"type" bson:"type"`
+	TTL     uint32              `json:"ttl" bson:"ttl"`
+	Regions map[string][]string `json:"regions" bson:"regions"`                     // region name to RDATA values
+	Default []string            `json:"default,omitempty" bson:"default,omitempty"` // answered when no region with values is healthy
+	Check   *health.Check       `json:"check,omitempty" bson:"check,omitempty"`     // optional, values that are down are left out of the answers
+}
+
+// rrType parses the record type of a set
+func (s RecordSet) rrType() (uint16, bool) {
+	t, ok := dns.StringToType[strings.ToUpper(s.Type)]
+	return t, ok
+}
+
+// Matches reports whether a set answers a query for qname and qtype. CNAME sets answer queries of every type.
+func (s RecordSet) Matches(qname string, qtype uint16) bool {
+	t, ok := s.rrType()
+	if !ok || !strings.EqualFold(dns.Fqdn(s.Name), qname) {
+		return false
+	}
+	return t == qtype || t == dns.TypeCNAME || qtype == dns.TypeANY
+}
+
+// Records builds the RRs of a list of values of the set
+func (s RecordSet) Records(values []string) ([]dns.RR, error) {
+	var records []dns.RR
+	for _, value := range values {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(s.Name), s.TTL, strings.ToUpper(s.Type), value))
+		if err != nil {
+			return nil, err
+		}
+		if rr == nil {
+			return nil, errors.New("empty value")
+		}
+		records = append(records, rr)
+	}
+	return records, nil
+}
+
+// Validate checks that a set has a known type and that all values parse
+func (s RecordSet) Validate() error {
+	t, ok := s.rrType()
+	if !ok {
+		return errors.New("unknown record type " + s.Type)
+	}
+	if t == dns.TypeSOA || t == dns.TypeNS {
+		return errors.New(s.Type + " records are managed by the platform")
+	}
+	if _, ok := dns.IsDomainName(s.Name); !ok {
+		return errors.New("invalid name " + s.Name)
+	}
+	if len(s.Regions) == 0 {
+		return errors.New("at least one region is required")
+	}
+
+	for region, values := range s.Regions {
+		if len(values) == 0 {
+			return errors.New("region " + region + " has no values")
+		}
+		if _, err := s.Records(values); err != nil {
+			return fmt.Errorf("region %s: %v", region, err)
+		}
+	}
+	if _, err := s.Records(s.Default); err != nil {
+		return fmt.Errorf("default: %v", err)
+	}
+	if s.Check != nil {
+		if t != dns.TypeA && t != dns.TypeAAAA && t != dns.TypeCNAME {
+			return errors.New("only A, AAAA and CNAME record sets can be health checked")
+		}
+		return s.Check.Normalize().Validate()
+	}
+	return nil
+}
+
+// Targets gets the health check targets of a set, which are all region values if it has a check
+func (s RecordSet) Targets() []health.Target {
+	if s.Check == nil {
+		return nil
+	}
+
+	var targets []health.Target
+	for _, values := range s.Regions {
+		for _, value := range values {
+			targets = append(targets, health.NewTarget(*s.Check, value))
+		}
+	}
+	return targets
+}
+
+// WithoutUnhealthy returns a copy of a set without the values and regions that are down
+func (s RecordSet) WithoutUnhealthy(states map[string]bool) RecordSet {
+	if s.Check == nil {
+		return s
+	}
+
+	regions := map[string][]string{}
+	for region, values := range s.Regions {
+		if healthy := health.Healthy(*s.Check, values, states); len(healthy) > 0 {
+			regions[region] = healthy
+		}
+	}
+
+	// Keep answering with every value when all are down and there are no defaults
+	if len(regions) == 0 && len(s.Default) == 0 {
+		return s
+	}
+	s.Regions = regions
+	return s
+}
+
+// Select picks the values of the healthy region nearest to client
+func (s RecordSet) Select(client Location, known bool, regions []Region, local string) []string {
+	if !known {
+		for _, region := range regions {
+			if region.Name == local {
+				client, known = region.Location, true
+			}
+		}
+	}
+
+	// Keep the result deterministic when distances are equal
+	sorted := append([]Region(nil), regions...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	nearest := func(healthy bool) ([]string, bool) {
+		var best []string
+		bestDistance := -1.0
+		for _, region := range sorted {
+			values, ok := s.Regions[region.Name]
+			if !ok || (healthy && !region.Healthy) {
+				continue
+			}
+
+			distance := 0.0
+			if known {
+				distance = Distance(client, region.Location)
+			}
+			if bestDistance < 0 || distance < bestDistance {
+				best, bestDistance = values, distance
+			}
+		}
+		return best, best != nil
+	}
+
+	if values, ok := nearest(true); ok {
+		return values
+	}
+	if len(s.Default) > 0 {
+		return s.Default
+	}
+	if values, ok := nearest(false); ok {
+		return values
+	}
+
+	// No regions are known, for example before the first sync
+	var names []string
+	for name := range s.Regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		return s.Regions[names[0]]
+	}
+	return nil
+}
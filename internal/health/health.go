@@ -0,0 +1,206 @@
+// Package health provides endpoint health checks and health checked record sets
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Check types
+const (
+	TypeHTTP  = "http"
+	TypeHTTPS = "https"
+	TypeTCP   = "tcp" // TCP connect
+)
+
+// Check defaults and limits in seconds
+const (
+	DefaultInterval = 30
+	DefaultTimeout  = 5
+	MinInterval     = 10
+)
+
+// Check stores a health check definition
+type Check struct {
+	Type     string `json:"type" bson:"type"`
+	Port     uint16 `json:"port" bson:"port"`
+	Path     string `json:"path,omitempty" bson:"path,omitempty"`         // HTTP(S) request path
+	Host     string `json:"host,omitempty" bson:"host,omitempty"`         // HTTP(S) Host header and TLS server name, the certificate isn't verified without it
+	Status   int    `json:"status,omitempty" bson:"status,omitempty"`     // expected HTTP status, 0 accepts any 2xx or 3xx status
+	Interval uint32 `json:"interval,omitempty" bson:"interval,omitempty"` // seconds between checks
+	Timeout  uint32 `json:"timeout,omitempty" bson:"timeout,omitempty"`   // seconds
+}
+
+// Normalize returns a check with defaults filled in
+func (c Check) Normalize() Check {
+	c.Type = strings.ToLower(c.Type)
+	if c.Interval == 0 {
+		c.Interval = DefaultInterval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultTimeout
+	}
+	if c.Type != TypeTCP && c.Path == "" {
+		c.Path = "/"
+	}
+	return c
+}
+
+// Validate checks that a normalized check is usable
+func (c Check) Validate() error {
+	switch c.Type {
+	case TypeHTTP, TypeHTTPS:
+		if !strings.HasPrefix(c.Path, "/") {
+			return errors.New("path must start with /")
+		}
+		if c.Status != 0 && (c.Status < 100 || c.Status > 599) {
+			return errors.New("invalid status " + strconv.Itoa(c.Status))
+		}
+	case TypeTCP:
+	default:
+		return errors.New("unknown check type " + c.Type)
+	}
+
+	if c.Port == 0 {
+		return errors.New("port is required")
+	}
+	if c.Interval < MinInterval {
+		return fmt.Errorf("interval must be at least %d seconds", MinInterval)
+	}
+	if c.Timeout >= c.Interval {
+		return errors.New("timeout must be shorter than the interval")
+	}
+	return nil
+}
+
+// Target is a check of a single address
+type Target struct {
+	Key     string `json:"key" bson:"key"`
+	Check   Check  `json:"check" bson:"check"`
+	Address string `json:"address" bson:"address"`
+}
+
+// NewTarget builds the target of a check and an address
+func NewTarget(check Check, address string) Target {
+	check = check.Normalize()
+	key := fmt.Sprintf("%s://%s%s", check.Type, net.JoinHostPort(address, strconv.Itoa(int(check.Port))), check.Path)
+	if check.Host != "" || check.Status != 0 {
+		key += fmt.Sprintf("#%s,%d", check.Host, check.Status)
+	}
+	key += fmt.Sprintf("@%d/%d", check.Interval, check.Timeout)
+	return Target{Key: key, Check: check, Address: address}
+}
+
+// Result stores the outcome of a single check run by a node
+type Result struct {
+	Key     string `json:"key" bson:"key"`
+	Healthy bool   `json:"healthy" bson:"healthy"`
+	Error   string `json:"error,omitempty" bson:"error,omitempty"`
+	Checked int64  `json:"checked" bson:"checked"` // unix nanoseconds
+}
+
+// Probe runs a single check against the address of a target
+func Probe(ctx context.Context, target Target) Result {
+	check := target.Check.Normalize()
+	result := Result{Key: target.Key, Checked: time.Now().UnixNano()}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(check.Timeout)*time.Second)
+	defer cancel()
+
+	var err error
+	switch check.Type {
+	case TypeTCP:
+		err = probeTCP(ctx, check, target.Address)
+	case TypeHTTP, TypeHTTPS:
+		err = probeHTTP(ctx, check, target.Address)
+	default:
+		err = errors.New("unknown check type " + check.Type)
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Healthy = true
+	}
+	return result
+}
+
+// probeTCP opens and closes a TCP connection
+func probeTCP(ctx context.Context, check Check, address string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(address, strconv.Itoa(int(check.Port))))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeHTTP sends a HTTP GET request without following redirects and checks the response status
+func probeHTTP(ctx context.Context, check Check, address string) error {
+	url := check.Type + "://" + net.JoinHostPort(address, strconv.Itoa(int(check.Port))) + check.Path
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if check.Host != "" {
+		req.Host = check.Host
+	}
+	req.Header.Set("User-Agent", "packetframe-healthcheck")
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{ServerName: check.Host, InsecureSkipVerify: check.Host == ""},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if check.Status != 0 && resp.StatusCode != check.Status {
+		return fmt.Errorf("status %d, expected %d", resp.StatusCode, check.Status)
+	}
+	if check.Status == 0 && (resp.StatusCode < 200 || resp.StatusCode > 399) {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Evaluate decides the health of a target from the latest result of every node
+func Evaluate(results map[string]Result, current bool, quorum int, staleness time.Duration, now time.Time) bool {
+	up, down := 0, 0
+	for _, result := range results {
+		if now.Sub(time.Unix(0, result.Checked)) > staleness {
+			continue
+		}
+		if result.Healthy {
+			up++
+		} else {
+			down++
+		}
+	}
+
+	if quorum < 1 {
+		quorum = 1
+	}
+	if current && down >= quorum && down > up {
+		return false
+	}
+	if !current && up >= quorum && up > down {
+		return true
+	}
+	return current
+}
@@ -0,0 +1,215 @@
+package health
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testEndpoint splits the address of a test server into the address and port of a check
+func testEndpoint(t *testing.T, hostport string) (string, uint16) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, uint16(n)
+}
+
+// TestProbeTCP checks that a TCP check passes while a port is listening and fails once it is closed
+func TestProbeTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	address, port := testEndpoint(t, listener.Addr().String())
+	target := NewTarget(Check{Type: TypeTCP, Port: port, Timeout: 1}, address)
+
+	if result := Probe(context.Background(), target); !result.Healthy || result.Key != target.Key {
+		t.Errorf("listening port: %+v, want healthy", result)
+	}
+
+	listener.Close()
+	if result := Probe(context.Background(), target); result.Healthy || result.Error == "" {
+		t.Errorf("closed port: %+v, want down with an error", result)
+	}
+}
+
+// TestProbeHTTP checks the status, Host header and TLS handling of HTTP checks
+func TestProbeHTTP(t *testing.T) {
+	var status int32 = http.StatusOK
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path != "/health" && r.URL.Path != "/vhost":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case r.URL.Path == "/vhost" && r.Host != "www.example.com":
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			return
+		}
+		if s := atomic.LoadInt32(&status); s == http.StatusFound {
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		} else {
+			w.WriteHeader(int(s))
+		}
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewUnstartedServer(handler)
+	secure.Config.ErrorLog = log.New(ioutil.Discard, "", 0) // the failed handshakes are expected
+	secure.StartTLS()
+	defer secure.Close()
+
+	tests := []struct {
+		name    string
+		check   Check
+		status  int32
+		healthy bool
+	}{
+		{"ok", Check{Type: TypeHTTP, Path: "/health"}, http.StatusOK, true},
+		{"redirect", Check{Type: TypeHTTP, Path: "/health"}, http.StatusFound, true},
+		{"server error", Check{Type: TypeHTTP, Path: "/health"}, http.StatusServiceUnavailable, false},
+		{"client error", Check{Type: TypeHTTP, Path: "/health"}, http.StatusForbidden, false},
+		{"expected status", Check{Type: TypeHTTP, Path: "/health", Status: http.StatusServiceUnavailable}, http.StatusServiceUnavailable, true},
+		{"unexpected status", Check{Type: TypeHTTP, Path: "/health", Status: http.StatusNoContent}, http.StatusOK, false},
+		{"wrong path", Check{Type: TypeHTTP, Path: "/"}, http.StatusOK, false},
+		{"host", Check{Type: TypeHTTP, Path: "/vhost", Host: "www.example.com"}, http.StatusOK, true},
+		{"wrong host", Check{Type: TypeHTTP, Path: "/vhost", Host: "www.example.net"}, http.StatusOK, false},
+		{"HTTPS without a host", Check{Type: TypeHTTPS, Path: "/health"}, http.StatusOK, true},
+		{"HTTPS untrusted certificate", Check{Type: TypeHTTPS, Path: "/vhost", Host: "www.example.com"}, http.StatusOK, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			atomic.StoreInt32(&status, test.status)
+			server := plain
+			if test.check.Type == TypeHTTPS {
+				server = secure
+			}
+			address, port := testEndpoint(t, server.Listener.Addr().String())
+			test.check.Port = port
+			test.check.Timeout = 1
+
+			result := Probe(context.Background(), NewTarget(test.check, address))
+			if result.Healthy != test.healthy {
+				t.Errorf("healthy = %v (%s), want %v", result.Healthy, result.Error, test.healthy)
+			}
+		})
+	}
+}
+
+// TestEvaluate checks that a target only changes state when a quorum of nodes, and more nodes than disagree, report it
+func TestEvaluate(t *testing.T) {
+	now := time.Now()
+	fresh := now.Add(-10 * time.Second).UnixNano()
+	stale := now.Add(-10 * time.Minute).UnixNano()
+
+	results := func(up int, down int, old int) map[string]Result {
+		results := map[string]Result{}
+		node := 0
+		add := func(healthy bool, checked int64) {
+			node++
+			results["node"+strconv.Itoa(node)] = Result{Healthy: healthy, Checked: checked}
+		}
+		for i := 0; i < up; i++ {
+			add(true, fresh)
+		}
+		for i := 0; i < down; i++ {
+			add(false, fresh)
+		}
+		for i := 0; i < old; i++ {
+			add(false, stale)
+		}
+		return results
+	}
+
+	tests := []struct {
+		name    string
+		results map[string]Result
+		current bool
+		quorum  int
+		want    bool
+	}{
+		{"up, no reports", results(0, 0, 0), true, 2, true},
+		{"down, no reports", results(0, 0, 0), false, 2, false},
+		{"up, one failure below quorum", results(3, 1, 0), true, 2, true},
+		{"up, failures at quorum but outnumbered", results(3, 2, 0), true, 2, true},
+		{"up, failures at quorum and majority", results(1, 2, 0), true, 2, false},
+		{"up, tie", results(2, 2, 0), true, 2, true},
+		{"up, stale failures", results(1, 0, 5), true, 2, true},
+		{"down, one success below quorum", results(1, 0, 0), false, 2, false},
+		{"down, successes at quorum and majority", results(2, 1, 0), false, 2, true},
+		{"down, tie", results(2, 2, 0), false, 2, false},
+		{"quorum below one", results(0, 1, 0), true, 0, false},
+	}
+	for _, test := range tests {
+		if got := Evaluate(test.results, test.current, test.quorum, time.Minute, now); got != test.want {
+			t.Errorf("%s: Evaluate = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// TestProbeTransitions checks that the state of an endpoint probed by several nodes follows it down and back up
+func TestProbeTransitions(t *testing.T) {
+	var status int32 = http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	address, port := testEndpoint(t, server.Listener.Addr().String())
+	target := NewTarget(Check{Type: TypeHTTP, Port: port, Timeout: 1}, address)
+	results := map[string]Result{}
+	healthy := true
+
+	// probe runs the check from a number of nodes and evaluates the results with a quorum of 2
+	probe := func(nodes ...string) bool {
+		for _, node := range nodes {
+			results[node] = Probe(context.Background(), target)
+		}
+		healthy = Evaluate(results, healthy, 2, time.Minute, time.Now())
+		return healthy
+	}
+
+	if !probe("a", "b", "c") {
+		t.Fatal("endpoint is down while it responds")
+	}
+
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	if !probe("a") {
+		t.Error("endpoint went down after a single failed check")
+	}
+	if probe("b") {
+		t.Error("endpoint is still up after a quorum of failed checks")
+	}
+	if probe("c") {
+		t.Error("endpoint came back up while all nodes report it down")
+	}
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	if probe("a") {
+		t.Error("endpoint came back up after a single passed check")
+	}
+	if !probe("b") {
+		t.Error("endpoint is still down after a quorum of passed checks")
+	}
+}
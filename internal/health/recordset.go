@@ -0,0 +1,92 @@
+package health
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RecordSet is a record set that only answers with the values whose health check passes
+type RecordSet struct {
+	Name     string   `json:"name" bson:"name"`
+	Type     string   `json:"type" bson:"type"`
+	TTL      uint32   `json:"ttl" bson:"ttl"`
+	Values   []string `json:"values" bson:"values"`                         // addresses or hostnames that are checked
+	Failover []string `json:"failover,omitempty" bson:"failover,omitempty"` // answered when all values are down
+	Check    Check    `json:"check" bson:"check"`
+}
+
+// Healthy filters values down to the ones whose target is healthy. Targets without a state yet are healthy.
+func Healthy(check Check, values []string, states map[string]bool) []string {
+	var healthy []string
+	for _, value := range values {
+		if up, ok := states[NewTarget(check, value).Key]; !ok || up {
+			healthy = append(healthy, value)
+		}
+	}
+	return healthy
+}
+
+// Targets gets the targets checked for a set
+func (s RecordSet) Targets() []Target {
+	var targets []Target
+	for _, value := range s.Values {
+		targets = append(targets, NewTarget(s.Check, value))
+	}
+	return targets
+}
+
+// Answer picks the values a set answers with, falling back when all values are down
+func (s RecordSet) Answer(states map[string]bool) []string {
+	if healthy := Healthy(s.Check, s.Values, states); len(healthy) > 0 {
+		return healthy
+	}
+	if len(s.Failover) > 0 {
+		return s.Failover
+	}
+	return s.Values
+}
+
+// Records builds the RR strings of a list of values of the set
+func (s RecordSet) Records(values []string) ([]string, error) {
+	var records []string
+	for _, value := range values {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(s.Name), s.TTL, strings.ToUpper(s.Type), value))
+		if err != nil {
+			return nil, err
+		}
+		if rr == nil {
+			return nil, errors.New("empty value")
+		}
+		records = append(records, rr.String())
+	}
+	return records, nil
+}
+
+// Validate checks that a set has a checkable type, that all values parse and that its check is usable
+func (s RecordSet) Validate() error {
+	switch strings.ToUpper(s.Type) {
+	case "A", "AAAA", "CNAME":
+	default:
+		return errors.New("health checked record sets must be of type A, AAAA or CNAME")
+	}
+	if _, ok := dns.IsDomainName(s.Name); !ok {
+		return errors.New("invalid name " + s.Name)
+	}
+	if len(s.Values) == 0 {
+		return errors.New("at least one value is required")
+	}
+	if strings.ToUpper(s.Type) == "CNAME" && (len(s.Values) > 1 || len(s.Failover) > 1) {
+		return errors.New("CNAME record sets can only have a single value and failover value")
+	}
+
+	if _, err := s.Records(s.Values); err != nil {
+		return err
+	}
+	if _, err := s.Records(s.Failover); err != nil {
+		return fmt.Errorf("failover: %v", err)
+	}
+	return s.Check.Normalize().Validate()
+}
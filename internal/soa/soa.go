@@ -0,0 +1,186 @@
+// Package soa provides zone serial arithmetic (RFC 1982) and SOA record generation
+package soa
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Scheme is a zone serial numbering scheme
+type Scheme string
+
+const (
+	SchemeDate    Scheme = "date"    // YYYYMMDDnn
+	SchemeUnix    Scheme = "unix"    // unix seconds
+	SchemeCounter Scheme = "counter" // incremented on every change
+)
+
+// DefaultScheme is the platform serial scheme, used for new zones that don't select one
+var DefaultScheme = SchemeDate
+
+// ParseScheme validates a serial scheme name. An empty name selects DefaultScheme.
+func ParseScheme(name string) (Scheme, error) {
+	switch Scheme(name) {
+	case "":
+		return DefaultScheme, nil
+	case SchemeDate, SchemeUnix, SchemeCounter:
+		return Scheme(name), nil
+	}
+	return "", errors.New("unknown serial scheme " + name)
+}
+
+// maxIncrement is the largest value that can be added to a serial (RFC 1982 section 3.1)
+const maxIncrement = math.MaxInt32
+
+// Less reports whether serial a precedes serial b (RFC 1982 section 3.2)
+func Less(a uint32, b uint32) bool {
+	const half = 1 << 31
+	return a < b && b-a < half || a > b && a-b > half
+}
+
+// Add adds n to a serial with wraparound, n is capped at 2^31-1 (RFC 1982 section 3.1)
+func Add(serial uint32, n uint32) uint32 {
+	if n > maxIncrement {
+		n = maxIncrement
+	}
+	return serial + n
+}
+
+// candidate returns the serial the scheme would pick at a time
+func (s Scheme) candidate(current uint32, now time.Time) uint32 {
+	switch s {
+	case SchemeUnix:
+		return uint32(now.Unix())
+	case SchemeCounter:
+		return Add(current, 1)
+	default:
+		year, month, day := now.UTC().Date()
+		return uint32(year*1000000 + int(month)*10000 + day*100) // wraps after the year 4294, which Next handles like any other wrap
+	}
+}
+
+// Next computes the serial following current, incrementing current if the scheme wouldn't move it forward
+func (s Scheme) Next(current uint32, now time.Time) uint32 {
+	next := s.candidate(current, now)
+	if !Less(current, next) {
+		return Add(current, 1)
+	}
+	return next
+}
+
+// Initial computes the serial of a new zone
+func (s Scheme) Initial(now time.Time) uint32 {
+	if s == SchemeCounter {
+		return 1
+	}
+	return s.candidate(0, now)
+}
+
+// Settings stores the SOA fields of a zone. Zero values are taken from the platform defaults.
+type Settings struct {
+	PrimaryNS string `json:"primary_ns,omitempty" bson:"primaryns,omitempty"`
+	Mbox      string `json:"mbox,omitempty" bson:"mbox,omitempty"` // admin mailbox in email or domain name format
+	Refresh   uint32 `json:"refresh,omitempty" bson:"refresh,omitempty"`
+	Retry     uint32 `json:"retry,omitempty" bson:"retry,omitempty"`
+	Expire    uint32 `json:"expire,omitempty" bson:"expire,omitempty"`
+	MinTTL    uint32 `json:"minttl,omitempty" bson:"minttl,omitempty"` // negative caching TTL (RFC 2308)
+	TTL       uint32 `json:"ttl,omitempty" bson:"ttl,omitempty"`       // TTL of the SOA record itself
+}
+
+// Defaults are the platform SOA settings used where a zone has no override
+var Defaults = Settings{
+	PrimaryNS: "ns1.packetframe.com.",
+	Mbox:      "hostmaster.packetframe.com.",
+	Refresh:   7200,
+	Retry:     3600,
+	Expire:    1209600,
+	MinTTL:    300,
+	TTL:       3600,
+}
+
+// Merge returns s with all zero fields taken from defaults
+func (s Settings) Merge(defaults Settings) Settings {
+	if s.PrimaryNS == "" {
+		s.PrimaryNS = defaults.PrimaryNS
+	}
+	if s.Mbox == "" {
+		s.Mbox = defaults.Mbox
+	}
+	if s.Refresh == 0 {
+		s.Refresh = defaults.Refresh
+	}
+	if s.Retry == 0 {
+		s.Retry = defaults.Retry
+	}
+	if s.Expire == 0 {
+		s.Expire = defaults.Expire
+	}
+	if s.MinTTL == 0 {
+		s.MinTTL = defaults.MinTTL
+	}
+	if s.TTL == 0 {
+		s.TTL = defaults.TTL
+	}
+	return s
+}
+
+// mbox converts an admin email address into its domain name form (RFC 1035 section 8)
+func mbox(address string) string {
+	for i, c := range address {
+		if c == '@' {
+			local := address[:i]
+			escaped := ""
+			for _, l := range local {
+				if l == '.' {
+					escaped += "\\"
+				}
+				escaped += string(l)
+			}
+			return dns.Fqdn(escaped + "." + address[i+1:])
+		}
+	}
+	return dns.Fqdn(address)
+}
+
+// Validate checks that the set fields of the settings are usable
+func (s Settings) Validate() error {
+	if s.PrimaryNS != "" {
+		if _, ok := dns.IsDomainName(s.PrimaryNS); !ok {
+			return errors.New("invalid primary nameserver " + s.PrimaryNS)
+		}
+	}
+	if s.Mbox != "" {
+		if _, ok := dns.IsDomainName(mbox(s.Mbox)); !ok {
+			return errors.New("invalid admin mailbox " + s.Mbox)
+		}
+	}
+	if s.Retry != 0 && s.Refresh != 0 && s.Retry >= s.Refresh {
+		return errors.New("retry must be shorter than refresh")
+	}
+	if s.Expire != 0 && s.Refresh != 0 && s.Expire <= s.Refresh {
+		return errors.New("expire must be longer than refresh")
+	}
+	return nil
+}
+
+// Record builds the SOA record of a zone. The settings must already be merged with the defaults.
+func (s Settings) Record(zone string, serial uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(zone),
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    s.TTL,
+		},
+		Ns:      dns.Fqdn(s.PrimaryNS),
+		Mbox:    mbox(s.Mbox),
+		Serial:  serial,
+		Refresh: s.Refresh,
+		Retry:   s.Retry,
+		Expire:  s.Expire,
+		Minttl:  s.MinTTL,
+	}
+}
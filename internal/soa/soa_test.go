@@ -0,0 +1,105 @@
+package soa
+
+import (
+	"testing"
+	"time"
+)
+
+// TestLess checks sequence space comparison around the 2^31 boundary and wraparound
+func TestLess(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		want bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		{0, 1<<31 - 1, true},
+		{1<<31 - 1, 0, false},
+		{0, 1 << 31, false}, // exactly 2^31 apart is undefined
+		{1 << 31, 0, false},
+		{1, 1<<31 + 1, false},
+		{0xffffffff, 0, true}, // wraparound
+		{0xffffffff, 1<<31 - 2, true},
+		{0xffffffff, 1<<31 - 1, false},
+		{0, 0xffffffff, false},
+	}
+	for _, test := range tests {
+		if got := Less(test.a, test.b); got != test.want {
+			t.Errorf("Less(%d, %d) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+// TestAdd checks that additions wrap around and are capped at 2^31-1
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		serial, n, want uint32
+	}{
+		{1, 1, 2},
+		{0xffffffff, 1, 0},
+		{0xfffffffe, 5, 3},
+		{0, 1<<31 - 1, 1<<31 - 1},
+		{0, 1 << 31, 1<<31 - 1},
+		{10, 0xffffffff, 10 + 1<<31 - 1},
+	}
+	for _, test := range tests {
+		got := Add(test.serial, test.n)
+		if got != test.want {
+			t.Errorf("Add(%d, %d) = %d, want %d", test.serial, test.n, got, test.want)
+		}
+		if test.n != 0 && !Less(test.serial, got) {
+			t.Errorf("Add(%d, %d) = %d doesn't follow the serial", test.serial, test.n, got)
+		}
+	}
+}
+
+// TestNext checks the serial following a change for each scheme
+func TestNext(t *testing.T) {
+	now := time.Date(2021, 3, 14, 15, 9, 26, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		scheme  Scheme
+		current uint32
+		want    uint32
+	}{
+		{"date, new day", SchemeDate, 2021031302, 2021031400},
+		{"date, second change of the day", SchemeDate, 2021031400, 2021031401},
+		{"date, 100th change of the day", SchemeDate, 2021031499, 2021031500},
+		{"date, ahead of the date", SchemeDate, 2021031807, 2021031808},
+		{"counter", SchemeCounter, 41, 42},
+		{"counter wraps around", SchemeCounter, 0xffffffff, 0},
+		{"unix", SchemeUnix, 1600000000, uint32(now.Unix())},
+		{"counter to date", SchemeDate, 42, 2021031400},
+		{"counter far ahead to date", SchemeDate, 3000000000, 3000000001},
+		{"date to counter", SchemeCounter, 2021031400, 2021031401},
+		{"date to unix moves backwards", SchemeUnix, 2021031400, 2021031401},
+		{"date wraps past 2^32", SchemeDate, 0xfffffff0, 2021031400},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.scheme.Next(test.current, now)
+			if got != test.want {
+				t.Errorf("Next(%d) = %d, want %d", test.current, got, test.want)
+			}
+			if !Less(test.current, got) {
+				t.Errorf("Next(%d) = %d doesn't follow the serial", test.current, got)
+			}
+		})
+	}
+}
+
+// TestInitial checks the serials of new zones
+func TestInitial(t *testing.T) {
+	now := time.Date(2021, 3, 14, 15, 9, 26, 0, time.UTC)
+	if got := SchemeDate.Initial(now); got != 2021031400 {
+		t.Errorf("date: %d, want 2021031400", got)
+	}
+	if got := SchemeCounter.Initial(now); got != 1 {
+		t.Errorf("counter: %d, want 1", got)
+	}
+	if got := SchemeUnix.Initial(now); got != uint32(now.Unix()) {
+		t.Errorf("unix: %d, want %d", got, now.Unix())
+	}
+}
@@ -0,0 +1,120 @@
+// Package tsig provides DNS listeners whose TSIG secrets can be replaced while they serve
+package tsig
+
+import (
+	"crypto/tls"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Listener serves a handler over UDP, TCP and optionally TLS (RFC 7858) with replaceable TSIG secrets
+type Listener struct {
+	Addr    string // address:port
+	Handler dns.Handler
+	Accept  dns.MsgAcceptFunc // decides which messages are handled, dns.DefaultMsgAcceptFunc if nil
+
+	TLSAddr   string      // address:port of DNS over TLS, disabled if empty
+	TLSConfig *tls.Config // certificates of DNS over TLS
+
+	lock    sync.Mutex
+	servers []*dns.Server
+	secrets map[string]string
+	failed  []string // networks that didn't start with the current secrets
+}
+
+// NewListener constructs a new Listener. It doesn't listen before the first Update.
+func NewListener(addr string, handler dns.Handler) *Listener {
+	return &Listener{Addr: addr, Handler: handler}
+}
+
+// Update starts serving with a set of TSIG secrets by key name, which must not be modified afterwards
+func (l *Listener) Update(secrets map[string]string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.servers != nil && reflect.DeepEqual(secrets, l.secrets) {
+		if len(l.failed) == 0 {
+			return nil
+		}
+		servers, failed, err := l.start(l.failed, secrets)
+		l.servers = append(l.servers, servers...)
+		l.failed = failed
+		return err
+	}
+
+	// dns.Server reads its TSIG secrets without locking, so new servers are started before the old ones stop
+	networks := []string{"udp", "tcp"}
+	if l.TLSAddr != "" {
+		networks = append(networks, "tcp-tls")
+	}
+	servers, failed, err := l.start(networks, secrets)
+	if len(servers) == 0 {
+		return err // keep the running servers
+	}
+
+	for _, server := range l.servers {
+		_ = server.Shutdown()
+	}
+	l.servers = servers
+	l.secrets = secrets
+	l.failed = failed
+	return err
+}
+
+// start starts a server for each network and returns the networks that failed
+func (l *Listener) start(networks []string, secrets map[string]string) ([]*dns.Server, []string, error) {
+	var servers []*dns.Server
+	var failed []string
+	var errs []string
+	for _, network := range networks {
+		addr := l.Addr
+		if network == "tcp-tls" {
+			addr = l.TLSAddr
+		}
+
+		started := make(chan error, 1)
+		server := &dns.Server{
+			Addr:              addr,
+			Net:               network,
+			Handler:           l.Handler,
+			MsgAcceptFunc:     l.Accept,
+			TsigSecret:        secrets,
+			TLSConfig:         l.TLSConfig,
+			ReusePort:         true,
+			NotifyStartedFunc: func() { started <- nil },
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				started <- err
+			}
+		}()
+		if err := <-started; err != nil {
+			failed = append(failed, network)
+			errs = append(errs, network+": "+err.Error())
+			continue
+		}
+		servers = append(servers, server)
+	}
+
+	if len(errs) > 0 {
+		return servers, failed, errors.New(strings.Join(errs, "; "))
+	}
+	return servers, nil, nil
+}
+
+// Shutdown stops serving
+func (l *Listener) Shutdown() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, server := range l.servers {
+		_ = server.Shutdown()
+	}
+	l.servers = nil
+	l.secrets = nil
+	l.failed = nil
+}
@@ -0,0 +1,63 @@
+package tsig
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TestUpdateRetriesFailedNetworks checks that a network that failed to start is started by a later update with the same secrets
+func TestUpdateRetriesFailedNetworks(t *testing.T) {
+	// Hold the DNS over TLS port without SO_REUSEPORT, so the listener can't bind it
+	blocker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsAddr := blocker.Addr().String()
+
+	listener := NewListener("127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+	}))
+	listener.TLSAddr = tlsAddr
+	listener.TLSConfig = &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return nil, errors.New("no certificate")
+	}}
+	defer listener.Shutdown()
+
+	secrets := map[string]string{"key.": "c2VjcmV0"}
+	if err := listener.Update(secrets); err == nil {
+		t.Fatal("update with the DNS over TLS port taken succeeded")
+	}
+	if len(listener.servers) != 2 || len(listener.failed) != 1 || listener.failed[0] != "tcp-tls" {
+		t.Fatalf("servers = %d, failed = %v, want UDP and TCP serving and DNS over TLS failed", len(listener.servers), listener.failed)
+	}
+
+	// The same secrets again retry DNS over TLS once the port is free
+	blocker.Close()
+	if err := listener.Update(secrets); err != nil {
+		t.Fatalf("retrying DNS over TLS: %v", err)
+	}
+	if len(listener.servers) != 3 || len(listener.failed) != 0 {
+		t.Fatalf("servers = %d, failed = %v, want all networks serving", len(listener.servers), listener.failed)
+	}
+	conn, err := net.DialTimeout("tcp", tlsAddr, time.Second)
+	if err != nil {
+		t.Fatalf("DNS over TLS isn't listening: %v", err)
+	}
+	conn.Close()
+
+	// Nothing is restarted while the secrets stay the same and all networks serve
+	servers := listener.servers
+	if err := listener.Update(secrets); err != nil {
+		t.Fatal(err)
+	}
+	if &listener.servers[0] != &servers[0] {
+		t.Error("servers were restarted without a change")
+	}
+}
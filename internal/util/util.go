@@ -1,6 +1,12 @@
 // Package util includes general utility functions that aren't specific to a certain subsystem
 package util
 
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
 // Includes checks for array inclusion by means of linear search
 func Includes(array []string, element string) bool {
 	for _, item := range array {
@@ -10,3 +16,34 @@ func Includes(array []string, element string) bool {
 	}
 	return false
 }
+
+// Duration is a time.Duration that is read from JSON as a duration string such as "10s"
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string or a number of nanoseconds
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case float64:
+		*d = Duration(v)
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return errors.New("invalid duration")
+	}
+
+	return nil
+}
+
+// MarshalJSON formats a duration as a duration string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
@@ -0,0 +1,196 @@
+// Package worker provides a runtime that consumes the message queue with typed job handlers
+package worker
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// minHeartbeat is the shortest time between extensions of a message's visibility timeout
+const minHeartbeat = 10 * time.Millisecond
+
+// Handler processes a single queue message. Returning an error releases the message for retry.
+type Handler func(ctx context.Context, message database.QueueMessage) error
+
+// Runtime claims queue messages and dispatches them to the handler registered for their job type
+type Runtime struct {
+	DB           database.Store
+	Concurrency  int           // number of messages processed in parallel
+	PollInterval time.Duration // time to wait when the queue is empty
+	JobTimeout   time.Duration // longest time a handler may run, its message is kept claimed until then
+
+	handlers map[database.JobType]Handler
+}
+
+// New constructs a new Runtime
+func New(db database.Store, concurrency int) *Runtime {
+	return &Runtime{
+		DB:           db,
+		Concurrency:  concurrency,
+		PollInterval: time.Second,
+		JobTimeout:   10 * time.Minute,
+		handlers:     map[database.JobType]Handler{},
+	}
+}
+
+// Register sets the handler of a job type
+func (r *Runtime) Register(jobType database.JobType, handler Handler) {
+	r.handlers[jobType] = handler
+}
+
+// types gets all job types with a registered handler
+func (r *Runtime) types() []database.JobType {
+	var types []database.JobType
+	for jobType := range r.handlers {
+		types = append(types, jobType)
+	}
+	return types
+}
+
+// execute runs a handler and converts a panic into an error
+func (r *Runtime) execute(ctx context.Context, handler Handler, message database.QueueMessage) (status string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Errorf("job %s (%s) panicked: %v\n%s", message.ID.Hex(), message.Type, p, debug.Stack())
+			status, err = "panicked", fmt.Errorf("panic: %v", p)
+		}
+	}()
+
+	if err := handler(ctx, message); err != nil {
+		return "failed", err
+	}
+	return "succeeded", nil
+}
+
+// heartbeatInterval gets the time between extensions of a visibility timeout
+func heartbeatInterval(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		timeout = database.DefaultQueueOptions.VisibilityTimeout
+	}
+	if interval := timeout / 3; interval > minHeartbeat {
+		return interval
+	}
+	return minHeartbeat
+}
+
+// heartbeat extends the visibility timeout of a message until stop is closed
+func (r *Runtime) heartbeat(message database.QueueMessage, cancel context.CancelFunc, stop <-chan struct{}, held chan<- database.QueueMessage) {
+	ticker := time.NewTicker(heartbeatInterval(r.DB.QueueOptions().VisibilityTimeout))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			held <- message
+			return
+		case <-ticker.C:
+			extended, err := r.DB.QueueExtend(message)
+			if err == database.ErrQueueLockLost {
+				log.Warnf("job %s (%s): lock lost, cancelling", message.ID.Hex(), message.Type)
+				cancel()
+				<-stop
+				held <- message
+				return
+			} else if err != nil {
+				log.Warnf("job %s (%s): extending lock: %v", message.ID.Hex(), message.Type, err)
+			} else {
+				message = extended
+			}
+		}
+	}
+}
+
+// process runs a single claimed message and records the outcome
+func (r *Runtime) process(message database.QueueMessage) {
+	started := time.Now()
+
+	// Keep the message claimed while the handler runs, up to the job timeout
+	ctx, cancel := context.WithTimeout(context.Background(), r.JobTimeout)
+	stop := make(chan struct{})
+	held := make(chan database.QueueMessage)
+	go r.heartbeat(message, cancel, stop, held)
+
+	status, err := r.execute(ctx, r.handlers[message.Type], message)
+	close(stop)
+	message = <-held
+	cancel()
+
+	history := database.QueueHistory{
+		Message:  message.ID,
+		Type:     message.Type,
+		Key:      message.Key,
+		Attempt:  message.Attempts,
+		Status:   status,
+		Started:  started.UnixNano(),
+		Finished: time.Now().UnixNano(),
+	}
+
+	if err != nil {
+		history.Error = err.Error()
+		log.Warnf("job %s (%s) attempt %d failed: %v", message.ID.Hex(), message.Type, message.Attempts, err)
+		err = r.DB.QueueFail(message, err)
+	} else {
+		err = r.DB.QueueConfirm(message)
+	}
+	if err != nil {
+		log.Warnf("job %s (%s): %v", message.ID.Hex(), message.Type, err)
+	}
+
+	if err := r.DB.AddQueueHistory(history); err != nil {
+		log.Warnf("job history: %v", err)
+	}
+}
+
+// loop claims and processes messages until ctx is cancelled
+func (r *Runtime) loop(ctx context.Context, types []database.JobType) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		message, err := r.DB.NextQueueMessage(types...)
+		if err != nil {
+			if err != database.ErrNotFound {
+				log.Warnf("queue: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(r.PollInterval):
+			}
+			continue
+		}
+
+		r.process(message)
+	}
+}
+
+// Run starts the workers and blocks until ctx is cancelled. In-flight jobs are allowed to finish before Run returns.
+func (r *Runtime) Run(ctx context.Context) {
+	types := r.types()
+	if len(types) == 0 {
+		return // NextQueueMessage would claim messages of every type
+	}
+	log.Debugf("starting %d workers for %v", r.Concurrency, types)
+
+	var wg sync.WaitGroup
+	for i := 0; i < r.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.loop(ctx, types)
+		}()
+	}
+
+	wg.Wait()
+	log.Debugln("workers stopped")
+}
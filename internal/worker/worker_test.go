@@ -0,0 +1,124 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/natesales/cdn-tree/internal/database"
+)
+
+// TestHeartbeat checks that a job running longer than the visibility timeout keeps its message, and is cancelled at the job timeout
+func TestHeartbeat(t *testing.T) {
+	db := database.NewMemory()
+	db.Queue.VisibilityTimeout = 60 * time.Millisecond
+
+	message, err := database.NewQueueMessage("slow", struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddQueueMessage(message); err != nil {
+		t.Fatal(err)
+	}
+
+	r := New(db, 1)
+	r.JobTimeout = time.Second
+	r.Register("slow", func(ctx context.Context, message database.QueueMessage) error {
+		// Nobody else may claim the message while it runs
+		for i := 0; i < 5; i++ {
+			time.Sleep(db.Queue.VisibilityTimeout)
+			if _, err := db.NextQueueMessage(); err != database.ErrNotFound {
+				t.Errorf("message was claimed by another worker while running: %v", err)
+			}
+		}
+		return ctx.Err()
+	})
+
+	claimed, err := db.NextQueueMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.process(claimed)
+
+	queue, err := db.ListQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 0 {
+		t.Errorf("queue has %d messages, want the message confirmed", len(queue))
+	}
+	history, err := db.ListQueueHistory("slow", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Status != "succeeded" {
+		t.Errorf("history = %+v, want one succeeded delivery", history)
+	}
+
+	// A handler that outlives the job timeout has its context cancelled
+	r.JobTimeout = 50 * time.Millisecond
+	r.Register("slow", func(ctx context.Context, message database.QueueMessage) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+			t.Error("handler wasn't cancelled at the job timeout")
+			return nil // nil error
+		}
+	})
+	if err := db.AddQueueMessage(message); err != nil {
+		t.Fatal(err)
+	}
+	claimed, err = db.NextQueueMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.process(claimed)
+
+	queue, err = db.ListQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 1 || queue[0].LastError != context.DeadlineExceeded.Error() {
+		t.Errorf("queue = %+v, want the message released for retry", queue)
+	}
+}
+
+// TestHeartbeatInterval checks that visibility timeouts that are zero, negative or too short for a ticker get a usable heartbeat
+func TestHeartbeatInterval(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{30 * time.Second, 10 * time.Second},
+		{0, database.DefaultQueueOptions.VisibilityTimeout / 3},
+		{-time.Second, database.DefaultQueueOptions.VisibilityTimeout / 3},
+		{2, minHeartbeat},
+		{20 * time.Millisecond, minHeartbeat},
+	}
+	for _, test := range tests {
+		if got := heartbeatInterval(test.timeout); got != test.want {
+			t.Errorf("heartbeatInterval(%s) = %s, want %s", test.timeout, got, test.want)
+		}
+	}
+
+	// A message processed with a zero visibility timeout doesn't panic the runtime
+	db := database.NewMemory()
+	db.Queue.VisibilityTimeout = 0
+	message, err := database.NewQueueMessage("quick", struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddQueueMessage(message); err != nil {
+		t.Fatal(err)
+	}
+	r := New(db, 1)
+	r.Register("quick", func(ctx context.Context, message database.QueueMessage) error {
+		return nil
+	})
+	claimed, err := db.NextQueueMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.process(claimed)
+}